@@ -13,6 +13,9 @@ func OverridingFlags() {
 	flag.String("packets.source", "", "Interface to read packets from")
 	flag.String("packets.bpf", "", "BPF to filter packets")
 	flag.Int("packets.maxcount", 0, "Max packets to parse (0 => all)")
+	flag.String("features.out", "", "CSV file to export flow features to (features command)")
+	flag.String("query.db", "", "Flow store to query, default processors.flowstore.path (query command)")
+	flag.Int("query.limit", 20, "Max rows of a report (query command)")
 }
 
 func SetupConfig() {
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint"
+	"github.com/sharat910/edrint/processor"
+	"github.com/spf13/viper"
+)
+
+// ExportFeatures writes the ml classifier features of every flow in
+// packets.source to features.out, labelled by the header and SNI
+// classifiers, for training models offline
+func ExportFeatures() {
+	SetupConfig()
+	edrint.SetupLogging(viper.GetString("log.level"))
+	outPath := viper.GetString("features.out")
+	if outPath == "" {
+		log.Fatal().Msg("features.out not set")
+	}
+
+	manager := edrint.New()
+	manager.RegisterProc(processor.NewFlowProcessor(2))
+	hc := processor.NewHeaderClassifer(GetHeaderClassificationRules())
+	prefixRules, err := GetPrefixRules()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load prefix rules")
+	}
+	hc.AddRules(prefixRules)
+	manager.RegisterProc(hc)
+	if sniRules := viper.GetStringMapString("sniclassifier.classes"); len(sniRules) > 0 {
+		manager.RegisterProc(processor.NewSNIParser())
+		manager.RegisterProc(processor.NewSNIClassifier(sniRules))
+	}
+	// no telemetry is attached but the flow processor needs a publisher
+	manager.RegisterProc(processor.NewTelemetryManager())
+	manager.RegisterProc(processor.NewFeatureExporter(outPath,
+		viper.GetInt("features.packets"),
+		viper.GetStringSlice("features.label_sources"),
+		viper.GetBool("features.keep_unlabelled")))
+
+	if err := manager.InitProcessors(); err != nil {
+		log.Fatal().Err(err).Msg("init error")
+	}
+	err = manager.Run(edrint.ParserConfig{
+		CapMode:    edrint.PCAPFILE,
+		CapSource:  viper.GetString("packets.source"),
+		DirMode:    edrint.CLIENT_IP,
+		DirMatches: viper.GetStringSlice("packets.direction.client_ips"),
+		BPF:        viper.GetString("packets.bpf"),
+		MaxPackets: viper.GetInt("packets.maxcount"),
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("some error occurred")
+	}
+}
@@ -27,6 +27,7 @@ func (A AFLCT) Pubs() []events.Topic {
 func (A *AFLCT) EventHandler(topic events.Topic, event interface{}) {
 	switch topic {
 	case events.TELEMETRY_FLOWLET:
+		event, _ = telemetry.Unsampled(event)
 		flSummary := event.(telemetry.FlowletExport)
 		A.flowlets = append(A.flowlets, flSummary.Flowlets...)
 	}
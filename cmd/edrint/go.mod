@@ -3,10 +3,13 @@ module edrint
 go 1.16
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/lib/pq v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/rs/zerolog v1.22.0
 	github.com/sharat910/edrint v0.0.0-20210121105758-1d249d6511ee
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
 )
 
-replace github.com/sharat910/edrint => ../../
\ No newline at end of file
+replace github.com/sharat910/edrint => ../../
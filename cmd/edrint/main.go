@@ -2,13 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"os"
 	"path/filepath"
-	"time"
-
-	"github.com/sharat910/edrint/telemetry"
 
 	"github.com/sharat910/edrint/events"
 
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog/log"
 	"github.com/sharat910/edrint"
 	"github.com/sharat910/edrint/processor"
@@ -16,16 +17,143 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "features" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		ExportFeatures()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		Query()
+		return
+	}
 	SetupConfig()
 	edrint.SetupLogging(viper.GetString("log.level"))
 	manager := edrint.New()
-	manager.RegisterProc(processor.NewFlowProcessor(2))
+	collector := viper.GetString("packets.capture_mode") == "collector"
+	if collector {
+		manager.RegisterProc(processor.NewFlowRecordProcessor(2))
+	} else {
+		fp := processor.NewFlowProcessor(2)
+		fp.ReplayPackets = viper.GetInt("processors.flow.replay_packets")
+		if n := viper.GetInt("processors.flow.replay_window"); n > 0 {
+			fp.ReplayWindow = n
+		}
+		manager.RegisterProc(fp)
+	}
 	rules := GetHeaderClassificationRules()
-	manager.RegisterProc(processor.NewHeaderClassifer(rules))
-	//manager.RegisterProc(processor.NewSNIParser())
-	//manager.RegisterProc(processor.NewSNIClassifier(viper.GetStringMapString("sniclassifier.classes")))
+	hc := processor.NewHeaderClassifer(rules)
+	hc.FirstMatch = viper.GetBool("processors.header_classifier.first_match")
+	hc.DefaultClass = viper.GetString("processors.header_classifier.default_class")
+	prefixRules, err := GetPrefixRules()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load prefix rules")
+	}
+	hc.AddRules(prefixRules)
+	geo, err := GetGeoDB()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to open geo db")
+	}
+	dumpTopics := []events.Topic{
+		events.TELEMETRY_FLOWLET,
+		"aflct",
+	}
+	if collector {
+		dumpTopics = append(dumpTopics, events.FLOW_EXPIRED, events.TELEMETRY_UNAVAILABLE)
+	}
+	if geo != nil {
+		defer geo.Close()
+		hc.SetGeoDB(geo)
+		manager.RegisterProc(processor.NewGeoEnricher(geo))
+		dumpTopics = append(dumpTopics, events.ENRICHED_FLOW_EXPIRED)
+	}
+	manager.RegisterProc(hc)
+	if viper.GetBool("processors.payload_classifier.enabled") {
+		signatures, err := GetPayloadSignatures()
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load payload signatures")
+		}
+		manager.RegisterProc(processor.NewPayloadClassifier(signatures,
+			viper.GetInt("processors.payload_classifier.max_bytes")))
+	}
+	if viper.GetBool("processors.parsers.dtls") {
+		manager.RegisterProc(processor.NewDTLSParser())
+		dumpTopics = append(dumpTopics, events.PROTOCOL_DTLS)
+	}
+	if viper.GetBool("processors.parsers.tls_server") {
+		manager.RegisterProc(processor.NewTLSServerParser())
+		dumpTopics = append(dumpTopics, events.PROTOCOL_TLS_SERVER)
+	}
+	if modelPath := viper.GetString("processors.ml_classifier.model"); modelPath != "" {
+		model, err := processor.LoadTreeModel(modelPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to load ml model")
+		}
+		manager.RegisterProc(processor.NewMLClassifier(model,
+			viper.GetFloat64("processors.ml_classifier.min_confidence")))
+	}
+	var sni *processor.SNIClassifier
+	if viper.GetBool("sniclassifier.enabled") {
+		rules, err := GetNameRules("sniclassifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to read sni rules")
+		}
+		sni = processor.NewSNIClassifier(nil)
+		sni.SetRules(rules)
+		sni.FirstMatch = viper.GetBool("sniclassifier.first_match")
+		manager.RegisterProc(processor.NewSNIParser())
+		manager.RegisterProc(sni)
+	}
+	var dns *processor.DNSClassifier
+	if viper.GetBool("dnsclassifier.enabled") {
+		rules, err := GetNameRules("dnsclassifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to read dns rules")
+		}
+		dns = processor.NewDNSClassifier(nil, viper.GetInt("dnsclassifier.max_entries"))
+		dns.SetRules(rules)
+		dns.FirstMatch = viper.GetBool("dnsclassifier.first_match")
+		manager.RegisterProc(processor.NewDNSParser())
+		manager.RegisterProc(dns)
+	}
+	// after every classifier, as some classify on flow expiry
+	if viper.GetBool("processors.final_classifier.enabled") {
+		manager.RegisterProc(processor.NewFinalClassifier(
+			viper.GetStringSlice("processors.final_classifier.precedence"),
+			viper.GetString("processors.final_classifier.default_class")))
+		dumpTopics = append(dumpTopics, events.CLASSIFICATION_FINAL)
+	}
+	if viper.GetBool("processors.aggregate.enabled") {
+		var ac processor.AggregateConfig
+		if err := viper.UnmarshalKey("processors.aggregate", &ac); err != nil {
+			log.Fatal().Err(err).Msg("unable to read aggregate config")
+		}
+		ag := processor.NewAggregator(ac)
+		if geo != nil {
+			ag.SetGeoDB(geo)
+		}
+		manager.RegisterProc(ag)
+		dumpTopics = append(dumpTopics, events.AGGREGATE_TIMESERIES)
+	}
+	if viper.GetBool("processors.host_profile.enabled") {
+		var hpc processor.HostProfileConfig
+		if err := viper.UnmarshalKey("processors.host_profile", &hpc); err != nil {
+			log.Fatal().Err(err).Msg("unable to read host profile config")
+		}
+		manager.RegisterProc(processor.NewHostProfiler(hpc))
+		dumpTopics = append(dumpTopics, events.HOST_PROFILE)
+	}
 	teleManager := processor.NewTelemetryManager()
-	teleManager.AddTFToClass("all_https", telemetry.NewFlowletTracker(50*time.Millisecond))
+	classes, err := GetTelemetryClasses()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read telemetry classes")
+	}
+	teleManager.SetClasses(classes)
+	teleManager.Reclassify = viper.GetBool("processors.telemetry_manager.reclassify")
+	teleManager.Sampling, teleManager.ClassSampling, err = GetTelemetrySampling()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to read telemetry sampling")
+	}
 
 	manager.RegisterProc(teleManager)
 	manager.RegisterProc(&AFLCT{})
@@ -34,24 +162,132 @@ func main() {
 	//dumpPath := fmt.Sprintf("./files/dumps/%s.json.log", filepath.Base(packetPath))
 	dumpPath := fmt.Sprintf("%s/telemetry/%s.json.log",
 		filepath.Dir(filepath.Dir(packetPath)), filepath.Base(packetPath))
-	manager.RegisterProc(processor.NewDumper(dumpPath,
-		[]events.Topic{
-			events.TELEMETRY_FLOWLET,
-			"aflct",
-		}, false))
+	if collector {
+		dumpPath = "./files/telemetry/collector.json.log"
+	}
+	var rotate processor.RotateConfig
+	if err := viper.UnmarshalKey("processors.dump.rotate", &rotate); err != nil {
+		log.Fatal().Err(err).Msg("unable to read dump rotation")
+	}
+	dumper := processor.NewRotatingDumper(dumpPath, dumpTopics, false, rotate)
+	anon, err := GetAnonymizer()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to set up anonymization")
+	}
+	if anon != nil {
+		dumper.SetAnonymizer(anon)
+	}
+	manager.RegisterProc(dumper)
+	if format := viper.GetString("processors.tables.format"); format != "" {
+		var topics []events.Topic
+		for _, t := range viper.GetStringSlice("processors.tables.topics") {
+			topics = append(topics, events.Topic(t))
+		}
+		tw := processor.NewTableWriter(format, viper.GetString("processors.tables.dir"), topics)
+		if n := viper.GetInt("processors.tables.flush_rows"); n > 0 {
+			tw.FlushRows = n
+		}
+		if c := viper.GetString("processors.tables.compression"); c != "" {
+			tw.Compression = c
+		}
+		if anon != nil {
+			tw.SetAnonymizer(anon)
+		}
+		manager.RegisterProc(tw)
+	}
+
+	if viper.GetString("processors.ipfix.collector") != "" {
+		var ipfix processor.IPFIXConfig
+		if err := viper.UnmarshalKey("processors.ipfix", &ipfix); err != nil {
+			log.Fatal().Err(err).Msg("unable to read ipfix config")
+		}
+		manager.RegisterProc(processor.NewIPFIXExporter(ipfix))
+	}
+
+	if addr := viper.GetString("processors.stream.listen"); addr != "" {
+		var topics []events.Topic
+		for _, t := range viper.GetStringSlice("processors.stream.topics") {
+			topics = append(topics, events.Topic(t))
+		}
+		ss := processor.NewStreamServer(addr, topics)
+		if n := viper.GetInt("processors.stream.buffer"); n > 0 {
+			ss.Buffer = n
+		}
+		if anon != nil {
+			ss.SetAnonymizer(anon)
+		}
+		manager.RegisterProc(ss)
+	}
 
-	err := manager.InitProcessors()
+	if len(viper.GetStringSlice("processors.kafka.brokers")) > 0 {
+		var kafka processor.KafkaConfig
+		if err := viper.UnmarshalKey("processors.kafka", &kafka); err != nil {
+			log.Fatal().Err(err).Msg("unable to read kafka config")
+		}
+		ko := processor.NewKafkaOutput(kafka)
+		if anon != nil {
+			ko.SetAnonymizer(anon)
+		}
+		manager.RegisterProc(ko)
+	}
+
+	if path := viper.GetString("processors.flowstore.path"); path != "" {
+		var topics []events.Topic
+		for _, t := range viper.GetStringSlice("processors.flowstore.topics") {
+			topics = append(topics, events.Topic(t))
+		}
+		fs := processor.NewFlowStore(path, topics, viper.GetBool("processors.flowstore.sni"))
+		if n := viper.GetInt("processors.flowstore.commit_flows"); n > 0 {
+			fs.CommitFlows = n
+		}
+		manager.RegisterProc(fs)
+	}
+
+	if viper.GetString("processors.timeseries.format") != "" {
+		var tsc processor.TimeSeriesConfig
+		if err := viper.UnmarshalKey("processors.timeseries", &tsc); err != nil {
+			log.Fatal().Err(err).Msg("unable to read timeseries config")
+		}
+		manager.RegisterProc(processor.NewTimeSeriesOutput(tsc))
+	}
+
+	if addr := viper.GetString("metrics.listen"); addr != "" {
+		var gauges []processor.GaugeConfig
+		if err := viper.UnmarshalKey("metrics.gauges", &gauges); err != nil {
+			log.Fatal().Err(err).Msg("unable to read metrics gauges")
+		}
+		manager.RegisterProc(processor.NewClassMetrics(gauges))
+		if err := manager.EnableMetrics(addr); err != nil {
+			log.Fatal().Err(err).Msg("unable to start metrics server")
+		}
+	}
+
+	err = manager.InitProcessors()
 	if err != nil {
 		log.Fatal().Err(err).Msg("init error")
 	}
-	err = manager.Run(edrint.ParserConfig{
+
+	// read before reloads start, viper is not safe for concurrent use
+	parserConfig := edrint.ParserConfig{
 		CapMode:    edrint.PCAPFILE,
 		CapSource:  viper.GetString("packets.source"),
 		DirMode:    edrint.CLIENT_IP,
 		DirMatches: viper.GetStringSlice("packets.direction.client_ips"),
 		BPF:        viper.GetString("packets.bpf"),
 		MaxPackets: viper.GetInt("packets.maxcount"),
-	})
+		ClientMACs: viper.GetBool("processors.host_profile.enabled") &&
+			viper.GetString("processors.host_profile.key") == "mac",
+	}
+	if collector {
+		parserConfig.CapMode = edrint.FLOWCOLLECTOR
+		parserConfig.CapSource = viper.GetString("packets.collector.listen")
+	}
+	reloader := &Reloader{hc: hc, sni: sni, dns: dns, tm: teleManager}
+	manager.ReloadOnSignal(reloader.Prepare)
+	if viper.GetBool("reload.watch_config") {
+		reloader.WatchConfig(&manager)
+	}
+	err = manager.Run(parserConfig)
 	if err != nil {
 		log.Fatal().Err(err).Msg("some error occurred")
 	}
@@ -65,3 +301,88 @@ func GetHeaderClassificationRules() map[string]map[string]string {
 	}
 	return rules
 }
+
+func GetPrefixRules() ([]processor.Rule, error) {
+	var files []processor.PrefixFile
+	err := viper.UnmarshalKey("processors.header_classifier.prefix_files", &files)
+	if err != nil {
+		return nil, err
+	}
+	var rules []processor.Rule
+	for _, pf := range files {
+		r, err := processor.LoadPrefixRules(pf)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("path", pf.Path).Int("rules", len(r)).Msg("prefix rules loaded")
+		rules = append(rules, r...)
+	}
+	return rules, nil
+}
+
+// GetNameRules reads the sorted SNI or DNS name rules under key
+func GetNameRules(key string) ([]processor.NameRule, error) {
+	priorities := make(map[string]int)
+	if err := viper.UnmarshalKey(key+".priorities", &priorities); err != nil {
+		return nil, err
+	}
+	return processor.CompileNameRules(viper.GetStringMapString(key+".classes"), priorities)
+}
+
+// GetPayloadSignatures returns the default signatures followed by those
+// of the signatures file, with the configured app protocol -> class
+// mapping applied to signatures without a class
+func GetPayloadSignatures() ([]processor.Signature, error) {
+	signatures := processor.DefaultSignatures()
+	if path := viper.GetString("processors.payload_classifier.signatures_file"); path != "" {
+		loaded, err := processor.LoadSignatures(path)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, loaded...)
+	}
+	classes := viper.GetStringMapString("processors.payload_classifier.classes")
+	for i := range signatures {
+		if signatures[i].Class == "" {
+			signatures[i].Class = classes[signatures[i].AppProtocol]
+		}
+	}
+	return signatures, nil
+}
+
+// GetGeoDB opens the configured MMDB files, nil if none are configured
+func GetGeoDB() (*processor.GeoDB, error) {
+	asnPath := viper.GetString("processors.geo.asn_db")
+	countryPath := viper.GetString("processors.geo.country_db")
+	if asnPath == "" && countryPath == "" {
+		return nil, nil
+	}
+	return processor.OpenGeoDB(asnPath, countryPath)
+}
+
+// GetAnonymizer builds the dump anonymizer, nil if no key file is configured
+func GetAnonymizer() (*processor.Anonymizer, error) {
+	keyFile := viper.GetString("processors.dump.anonymize.key_file")
+	if keyFile == "" {
+		return nil, nil
+	}
+	key, err := processor.LoadAnonymizerKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var passThrough []net.IPNet
+	for _, s := range viper.GetStringSlice("processors.dump.anonymize.pass_through") {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		passThrough = append(passThrough, *subnet)
+	}
+	anon, err := processor.NewAnonymizer(key, passThrough)
+	if err != nil {
+		return nil, err
+	}
+	anon.RedactPorts = viper.GetBool("processors.dump.anonymize.redact_ports")
+	anon.RedactNames = viper.GetBool("processors.dump.anonymize.redact_names")
+	return anon, nil
+}
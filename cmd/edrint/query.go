@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/processor"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Query prints a canned report of the flow store written by
+// processors.flowstore, e.g. edrint query top_talkers --query.limit 10
+func Query() {
+	// logs stay on stderr, the report goes to stdout
+	SetupConfig()
+	path := viper.GetString("query.db")
+	if path == "" {
+		path = viper.GetString("processors.flowstore.path")
+	}
+	if pflag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: edrint query [--query.db flows.db] [--query.limit n] <report>")
+		for _, r := range processor.FlowReports {
+			fmt.Fprintf(os.Stderr, "  %-14s %s\n", r.Name, r.Description)
+		}
+		os.Exit(2)
+	}
+	if _, err := os.Stat(path); err != nil {
+		log.Fatal().Err(err).Msg("no flow store")
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("unable to open flow store")
+	}
+	defer db.Close()
+	if err := processor.RunFlowReport(db, pflag.Arg(0), viper.GetInt("query.limit"), os.Stdout); err != nil {
+		log.Fatal().Err(err).Str("report", pflag.Arg(0)).Msg("query failed")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint"
+	"github.com/sharat910/edrint/processor"
+	"github.com/spf13/viper"
+)
+
+// Reloader rebuilds classifier rules and telemetry mappings from the
+// config on SIGHUP or when the config file changes. viper is not safe
+// for concurrent use, so after startup the config is only read by
+// Prepare, under mu.
+type Reloader struct {
+	mu  sync.Mutex
+	hc  *processor.HeaderClassifier
+	sni *processor.SNIClassifier
+	dns *processor.DNSClassifier
+	tm  *processor.TelemetryManager
+}
+
+func (rl *Reloader) Prepare(trigger string) (edrint.Reload, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if err := viper.ReadInConfig(); err != nil {
+		return edrint.Reload{}, err
+	}
+
+	rules, err := processor.ParseRules(GetHeaderClassificationRules())
+	if err != nil {
+		return edrint.Reload{}, err
+	}
+	prefixRules, err := GetPrefixRules()
+	if err != nil {
+		return edrint.Reload{}, err
+	}
+	rules = append(rules, prefixRules...)
+	firstMatch := viper.GetBool("processors.header_classifier.first_match")
+	defaultClass := viper.GetString("processors.header_classifier.default_class")
+
+	sniRules, err := GetNameRules("sniclassifier")
+	if err != nil {
+		return edrint.Reload{}, err
+	}
+	sniFirstMatch := viper.GetBool("sniclassifier.first_match")
+	dnsRules, err := GetNameRules("dnsclassifier")
+	if err != nil {
+		return edrint.Reload{}, err
+	}
+	dnsFirstMatch := viper.GetBool("dnsclassifier.first_match")
+
+	classes, err := GetTelemetryClasses()
+	if err != nil {
+		return edrint.Reload{}, err
+	}
+	sampling, classSampling, err := GetTelemetrySampling()
+	if err != nil {
+		return edrint.Reload{}, err
+	}
+
+	return edrint.Reload{
+		Trigger:  trigger,
+		Checksum: configChecksum(),
+		Apply: func() {
+			if rl.hc != nil {
+				rl.hc.SetRules(rules)
+				rl.hc.FirstMatch = firstMatch
+				rl.hc.DefaultClass = defaultClass
+			}
+			if rl.sni != nil {
+				rl.sni.SetRules(sniRules)
+				rl.sni.FirstMatch = sniFirstMatch
+			}
+			if rl.dns != nil {
+				rl.dns.SetRules(dnsRules)
+				rl.dns.FirstMatch = dnsFirstMatch
+			}
+			if rl.tm != nil {
+				rl.tm.SetClasses(classes)
+				rl.tm.Sampling = sampling
+				rl.tm.ClassSampling = classSampling
+			}
+		},
+	}, nil
+}
+
+// WatchConfig reloads whenever the config file is written. The file's
+// directory is watched as editors often replace the file.
+func (rl *Reloader) WatchConfig(m *edrint.Manager) {
+	path, err := filepath.Abs(viper.ConfigFileUsed())
+	if err != nil {
+		log.Error().Err(err).Msg("unable to watch config")
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("unable to watch config")
+		return
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		log.Error().Err(err).Msg("unable to watch config")
+		watcher.Close()
+		return
+	}
+	go func() {
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) != path || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				log.Info().Str("file", e.Name).Msg("config file changed: reloading config")
+				r, err := rl.Prepare("file")
+				if err != nil {
+					log.Error().Err(err).Msg("config reload failed: keeping current config")
+					continue
+				}
+				m.RequestReload(r)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Msg("config watcher error")
+			}
+		}
+	}()
+}
+
+func configChecksum() string {
+	b, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sharat910/edrint/processor"
+	"github.com/spf13/viper"
+)
+
+// reloadTestConfig returns a config with the given header rule,
+// prefix files, telemetry and class sampling sections
+func reloadTestConfig(rule, prefixFiles, telemetry, classSampling string) string {
+	return fmt.Sprintf(`
+processors:
+  header_classifier:
+    first_match: true
+    prefix_files: %s
+    classes:
+      web:
+        %s
+        protocol: '6'
+telemetry:
+  classes:
+    web: %s
+  sampling:
+    flow: 4
+  class_sampling: %s
+`, prefixFiles, rule, telemetry, classSampling)
+}
+
+func ruleClasses(rules []processor.Rule) []string {
+	var classes []string
+	for _, r := range rules {
+		classes = append(classes, r.Class)
+	}
+	return classes
+}
+
+func TestReloaderPrepare(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetConfigFile(path)
+	writeConfig(reloadTestConfig("server_port: '443'", "[]", "[flowlet_tracker]", "{}"))
+
+	hc := processor.NewHeaderClassifer(nil)
+	tm := processor.NewTelemetryManager()
+	rl := &Reloader{hc: hc, tm: tm}
+	r, err := rl.Prepare("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hc.Rules) != 0 || len(tm.Classes) != 0 {
+		t.Fatal("config applied before Apply")
+	}
+	r.Apply()
+	if r.Trigger != "test" || r.Checksum == "" {
+		t.Errorf("reload %q %q, want the trigger and the config checksum", r.Trigger, r.Checksum)
+	}
+	if got := ruleClasses(hc.Rules); !reflect.DeepEqual(got, []string{"web"}) || !hc.FirstMatch {
+		t.Errorf("header rules %v, first match %v", got, hc.FirstMatch)
+	}
+	if len(tm.Classes["web"]) != 1 || tm.Sampling.Flow != 4 {
+		t.Errorf("telemetry classes %v, sampling %+v", tm.Classes, tm.Sampling)
+	}
+
+	prefixes := filepath.Join(dir, "prefixes.csv")
+	if err := ioutil.WriteFile(prefixes, []byte("1.2.3.0/24,cdn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	badTemplate := fmt.Sprintf("[{path: '%s', format: csv, template: {server_port: https}}]", prefixes)
+	bad := map[string]string{
+		"yaml":            "processors: [",
+		"rule":            reloadTestConfig("server_ip: '1.2.3.4'", "[]", "[flowlet_tracker]", "{}"),
+		"prefix template": reloadTestConfig("server_port: '443'", badTemplate, "[flowlet_tracker]", "{}"),
+		"telemetry":       reloadTestConfig("server_port: '443'", "[]", "[no_such_telemetry]", "{}"),
+		"sampling":        reloadTestConfig("server_port: '443'", "[]", "[flowlet_tracker]", "{web: 4}"),
+	}
+	for name, config := range bad {
+		writeConfig(config)
+		if _, err := rl.Prepare("test"); err == nil {
+			t.Errorf("%s: invalid config accepted", name)
+		}
+	}
+	if got := ruleClasses(hc.Rules); !reflect.DeepEqual(got, []string{"web"}) || len(tm.Classes["web"]) != 1 {
+		t.Errorf("header rules %v, telemetry classes %v after rejected reloads", got, tm.Classes)
+	}
+
+	writeConfig(reloadTestConfig("server_port: '443'", "[]", "[flowlet_tracker, tcp_rtt]", "{web: {flow: 2}}"))
+	r2, err := rl.Prepare("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2.Apply()
+	if r2.Checksum == r.Checksum {
+		t.Error("changed config has the same checksum")
+	}
+	if len(tm.Classes["web"]) != 2 || tm.ClassSampling["web"].Flow != 2 {
+		t.Errorf("telemetry classes %v, class sampling %v after reload", tm.Classes, tm.ClassSampling)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sharat910/edrint/telemetry"
+	"github.com/spf13/viper"
+)
+
+// NewTeleGen builds a telemetry generator by name with its
+// parameters read from telemetry.<name> in the config
+func NewTeleGen(name string) (telemetry.TeleGen, error) {
+	key := func(param string) string {
+		return fmt.Sprintf("telemetry.%s.%s", name, param)
+	}
+	switch name {
+	case "flowlet_tracker":
+		gap := viper.GetDuration(key("gap"))
+		if gap == 0 {
+			gap = 50 * time.Millisecond
+		}
+		return telemetry.NewFlowletTracker(gap), nil
+	case "flowpulse":
+		return telemetry.NewFlowPulse(viper.GetInt(key("interval_ms"))), nil
+	case "flowprint":
+		return telemetry.NewFlowPrint(viper.GetInt(key("interval_ms"))), nil
+	case "flow_summary":
+		return telemetry.NewFlowSummary(), nil
+	case "tcp_rtt":
+		return telemetry.NewTCPRTT(), nil
+	case "tcp_retransmit_simple":
+		return telemetry.NewTCPRetransmit(viper.GetInt(key("interval_ms"))), nil
+	case "tcp_handshake":
+		return telemetry.NewTCPHandshake(), nil
+	case "tcp_window":
+		return telemetry.NewTCPWindow(viper.GetInt(key("interval_ms"))), nil
+	case "tcp_loss":
+		return telemetry.NewTCPLoss(viper.GetInt(key("interval_ms"))), nil
+	case "gap_chunk_detector":
+		return telemetry.NewGapChunkDetector(viper.GetDuration(key("gap"))), nil
+	case "http_chunk_detector":
+		return telemetry.NewHTTPChunkDetector(viper.GetInt(key("req_threshold"))), nil
+	case "http_req_isolator":
+		return telemetry.NewHTTPReqIsolator(viper.GetInt(key("req_threshold"))), nil
+	case "frame_detector":
+		return telemetry.NewFrameDetector(), nil
+	}
+	return nil, fmt.Errorf("unknown telemetry: %s", name)
+}
+
+// GetTelemetryClasses reads the class -> telemetry names mapping
+func GetTelemetryClasses() (map[string][]telemetry.TeleGen, error) {
+	classes := make(map[string][]telemetry.TeleGen)
+	for class, names := range viper.GetStringMapStringSlice("telemetry.classes") {
+		for _, name := range names {
+			tfgen, err := NewTeleGen(name)
+			if err != nil {
+				return nil, fmt.Errorf("class %s: %w", class, err)
+			}
+			classes[class] = append(classes[class], tfgen)
+		}
+	}
+	return classes, nil
+}
+
+// GetTelemetrySampling reads the default and per class sample rates
+func GetTelemetrySampling() (telemetry.SampleRates, map[string]telemetry.SampleRates, error) {
+	var sampling telemetry.SampleRates
+	if err := viper.UnmarshalKey("telemetry.sampling", &sampling); err != nil {
+		return sampling, nil, err
+	}
+	classSampling := make(map[string]telemetry.SampleRates)
+	if err := viper.UnmarshalKey("telemetry.class_sampling", &classSampling); err != nil {
+		return sampling, nil, err
+	}
+	return sampling, classSampling, nil
+}
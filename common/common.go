@@ -24,6 +24,8 @@ type Packet struct {
 	Payload    []byte
 	IsOutbound bool
 	TCPLayer   layers.TCP
+	// ClientMAC is set if the parser records MACs
+	ClientMAC string
 }
 
 func (p Packet) GetKey() FiveTuple {
@@ -1,6 +1,9 @@
 package events
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type Topic string
 type PubFunc func(topic Topic, event interface{})
@@ -8,6 +11,7 @@ type PubFunc func(topic Topic, event interface{})
 type EventBus struct {
 	topics map[Topic][]EventHandler
 	lock   sync.RWMutex
+	counts sync.Map // Topic -> *uint64
 }
 
 func New() *EventBus {
@@ -19,6 +23,12 @@ func New() *EventBus {
 type EventHandler func(topic Topic, event interface{})
 
 func (eb *EventBus) Publish(topic Topic, event interface{}) {
+	count, ok := eb.counts.Load(topic)
+	if !ok {
+		count, _ = eb.counts.LoadOrStore(topic, new(uint64))
+	}
+	atomic.AddUint64(count.(*uint64), 1)
+
 	eb.lock.RLock()
 	defer eb.lock.RUnlock()
 	for _, handler := range eb.topics[topic] {
@@ -41,3 +51,14 @@ func (eb *EventBus) GetSubscriptions() map[Topic]int {
 	}
 	return m
 }
+
+// GetPublishCounts returns the number of events published per topic.
+// It is safe to call while events are being published.
+func (eb *EventBus) GetPublishCounts() map[Topic]uint64 {
+	m := make(map[Topic]uint64)
+	eb.counts.Range(func(topic, count interface{}) bool {
+		m[topic.(Topic)] = atomic.LoadUint64(count.(*uint64))
+		return true
+	})
+	return m
+}
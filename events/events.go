@@ -1,24 +1,42 @@
 package events
 
 const (
-	PACKET         = Topic("packet")
-	CLASSIFICATION = Topic("classification")
+	PACKET               = Topic("packet")
+	CLASSIFICATION       = Topic("classification")
+	CLASSIFICATION_FINAL = Topic("classification.final")
+
+	CONFIG_RELOADED = Topic("config.reloaded")
 
 	FLOW_CREATED          = Topic("flow.created")
 	FLOW_EXPIRED          = Topic("flow.expired")
+	FLOW_RECORD           = Topic("flow.record")
 	FLOW_ATTACH_TELEMETRY = Topic("flow.attach_telemetry")
+	FLOW_DETACH_TELEMETRY = Topic("flow.detach_telemetry")
+
+	ENRICHED_FLOW_CREATED   = Topic("enriched.flow.created")
+	ENRICHED_FLOW_EXPIRED   = Topic("enriched.flow.expired")
+	ENRICHED_CLASSIFICATION = Topic("enriched.classification")
 
-	PROTOCOL_SNI = Topic("protocol.sni")
-	PROTOCOL_DNS = Topic("protocol.dns")
+	PROTOCOL_SNI        = Topic("protocol.sni")
+	PROTOCOL_DNS        = Topic("protocol.dns")
+	PROTOCOL_DTLS       = Topic("protocol.dtls")
+	PROTOCOL_TLS_SERVER = Topic("protocol.tls_server")
 
 	TELEMETRY_FLOWSUMMARY    = Topic("telemetry.flowsummary")
 	TELEMETRY_FLOWPRINT      = Topic("telemetry.flowprint")
 	TELEMETRY_FLOWPULSE      = Topic("telemetry.flowpulse")
 	TELEMETRY_TCP_RTT        = Topic("telemetry.tcp.rtt")
 	TELEMETRY_TCP_RETRANSMIT = Topic("telemetry.tcp.retransmit")
+	TELEMETRY_TCP_HANDSHAKE  = Topic("telemetry.tcp.handshake")
+	TELEMETRY_TCP_WINDOW     = Topic("telemetry.tcp.window")
+	TELEMETRY_TCP_LOSS       = Topic("telemetry.tcp.loss")
 	TELEMETRY_GAP_CHUNK      = Topic("telemetry.gap_chunk")
 	TELEMETRY_FRAME          = Topic("telemetry.frame")
 	TELEMETRY_HTTP_CHUNK     = Topic("telemetry.http_chunk")
 	TELEMETRY_HTTP_REQ       = Topic("telemetry.http_req")
 	TELEMETRY_FLOWLET        = Topic("telemetry.flowlet")
+	TELEMETRY_UNAVAILABLE    = Topic("telemetry.unavailable")
+
+	AGGREGATE_TIMESERIES = Topic("aggregate.timeseries")
+	HOST_PROFILE         = Topic("host.profile")
 )
@@ -0,0 +1,91 @@
+package edrint
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/processor"
+)
+
+// FlowCollector is the input mode for flow exports: it listens on UDP
+// address c.CapSource for NetFlow v5, v9 and IPFIX messages and publishes
+// their records as FLOW_RECORD events, to be turned into flows by a
+// processor.FlowRecordProcessor. Record direction is inferred from the
+// client IPs. It runs until SIGINT or SIGTERM, or c.MaxPackets records.
+func FlowCollector(c ParserConfig, pf events.PubFunc) error {
+	if c.DirMode != CLIENT_IP {
+		return errors.New("flow collector needs client ip direction inference")
+	}
+	clientSubnets, err := GetClientSubnets(c)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", c.CapSource)
+	if err != nil {
+		return err
+	}
+	var closed int32
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		if _, ok := <-sigs; ok {
+			log.Info().Msg("stopping flow collector")
+			atomic.StoreInt32(&closed, 1)
+			conn.Close()
+		}
+	}()
+	defer conn.Close()
+
+	decoder := processor.NewNetFlowDecoder()
+	buf := make([]byte, 65536)
+	nRecords, upRecords := 0, 0
+	log.Info().Str("listen", conn.LocalAddr().String()).Msg("flow collector started")
+	for c.MaxPackets == 0 || nRecords < c.MaxPackets {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&closed) == 1 {
+				break
+			}
+			return err
+		}
+		exporter := addr.(*net.UDPAddr).IP.String()
+		records, err := decoder.Decode(exporter, buf[:n], time.Now())
+		if c.Stats != nil {
+			atomic.AddUint64(&c.Stats.Packets, 1)
+			atomic.AddUint64(&c.Stats.Bytes, uint64(n))
+			if err != nil {
+				atomic.AddUint64(&c.Stats.DecodeFailures, 1)
+			}
+		}
+		if err != nil {
+			log.Debug().Err(err).Str("exporter", exporter).Msg("unable to decode flow export")
+		}
+		for _, r := range records {
+			if ip := net.ParseIP(r.Header.SrcIP); ip != nil {
+				for _, s := range clientSubnets {
+					if s.Contains(ip) {
+						r.IsOutbound = true
+						upRecords++
+						break
+					}
+				}
+			}
+			pf(events.FLOW_RECORD, r)
+			nRecords++
+		}
+	}
+	log.Info().Uint64("messages", decoder.NMessages).Int("records", nRecords).
+		Uint64("unknown_template", decoder.NUnknownTemplate).Msg("flow collection completed")
+	if upRecords == 0 {
+		log.Warn().Msg("No upload record! Maybe check config.")
+	}
+	return nil
+}
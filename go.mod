@@ -4,7 +4,12 @@ go 1.14
 
 require (
 	github.com/google/gopacket v1.1.18
+	github.com/klauspost/compress v1.10.5
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/montanaflynn/stats v0.6.6
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/rs/zerolog v1.20.0
-	golang.org/x/sys v0.0.0-20190624142023-c5567b49c5d0 // indirect
+	github.com/xitongsys/parquet-go v1.5.4
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -13,6 +13,11 @@ type Manager struct {
 	eb         *events.EventBus
 	processors []processor.Processor
 	pMap       map[string]struct{}
+
+	reloads       chan Reload
+	reloadVersion int
+
+	metrics *metricsServer
 }
 
 func New() Manager {
@@ -20,6 +25,7 @@ func New() Manager {
 		eb:         events.New(),
 		processors: nil,
 		pMap:       make(map[string]struct{}),
+		reloads:    make(chan Reload, 1),
 	}
 }
 
@@ -48,7 +54,11 @@ func (m *Manager) InitProcessors() error {
 		// Subscribe to topics by passing proc's event handlers
 		for _, topic := range proc.Subs() {
 			log.Info().Str("proc", proc.Name()).Str("topic", string(topic)).Msg("subscription")
-			m.eb.Subscribe(topic, proc.EventHandler)
+			handler := proc.EventHandler
+			if m.metrics != nil {
+				handler = m.metrics.timed(proc.Name(), handler)
+			}
+			m.eb.Subscribe(topic, handler)
 		}
 
 		// Pass events to procs that publish
@@ -57,12 +67,22 @@ func (m *Manager) InitProcessors() error {
 		}
 
 	}
+	if m.metrics != nil {
+		m.metrics.serve(m.processors)
+	}
 	return nil
 }
 
 func (m *Manager) Run(c ParserConfig) error {
-	// Start processing packets
-	if err := PacketParser(c, m.eb.Publish); err != nil {
+	if m.metrics != nil && c.Stats == nil {
+		c.Stats = &m.metrics.parser
+	}
+	// Start processing packets, or flow records
+	input := PacketParser
+	if c.CapMode == FLOWCOLLECTOR {
+		input = FlowCollector
+	}
+	if err := input(c, m.publish); err != nil {
 		return err
 	}
 
@@ -76,6 +96,8 @@ func (m *Manager) Run(c ParserConfig) error {
 func (m *Manager) SanityCheck() error {
 	pubs := make(map[events.Topic]struct{})
 	pubs[events.PACKET] = struct{}{}
+	pubs[events.FLOW_RECORD] = struct{}{}
+	pubs[events.CONFIG_RELOADED] = struct{}{}
 	for _, proc := range m.processors {
 		for _, pub := range proc.Pubs() {
 			pubs[pub] = struct{}{}
@@ -0,0 +1,136 @@
+package edrint
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/processor"
+)
+
+// ParserStats are PacketParser's counters, updated atomically
+type ParserStats struct {
+	Packets        uint64
+	Bytes          uint64
+	DecodeFailures uint64
+}
+
+type metricsServer struct {
+	ln         net.Listener
+	parser     ParserStats
+	eb         *events.EventBus
+	procs      []string
+	handlers   map[string]*handlerStats
+	collectors []processor.MetricsCollector
+
+	// child handler time of each running handler, handlers nest as
+	// publishing runs the subscribers' handlers
+	children []time.Duration
+}
+
+type handlerStats struct {
+	nanos uint64
+	calls uint64
+}
+
+// EnableMetrics serves Prometheus metrics at http://addr/metrics once
+// the processors are initialized. It must be called before InitProcessors.
+func (m *Manager) EnableMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.metrics = &metricsServer{
+		ln:       ln,
+		eb:       m.eb,
+		handlers: make(map[string]*handlerStats),
+	}
+	return nil
+}
+
+// timed wraps a processor's handler to count its calls and the time
+// spent in it, excluding the time spent in handlers of events it publishes.
+// The children stack is not locked: it assumes every Publish, and so
+// every handler, runs on the packet goroutine. Processors running
+// goroutines of their own (ipfix, timeseries, kafka) must not publish
+// from them.
+func (ms *metricsServer) timed(proc string, eh events.EventHandler) events.EventHandler {
+	hs, exists := ms.handlers[proc]
+	if !exists {
+		hs = &handlerStats{}
+		ms.handlers[proc] = hs
+		ms.procs = append(ms.procs, proc)
+	}
+	return func(topic events.Topic, event interface{}) {
+		ms.children = append(ms.children, 0)
+		start := time.Now()
+		eh(topic, event)
+		elapsed := time.Since(start)
+		n := len(ms.children) - 1
+		self := elapsed - ms.children[n]
+		ms.children = ms.children[:n]
+		if n > 0 {
+			ms.children[n-1] += elapsed
+		}
+		atomic.AddUint64(&hs.nanos, uint64(self))
+		atomic.AddUint64(&hs.calls, 1)
+	}
+}
+
+func (ms *metricsServer) serve(procs []processor.Processor) {
+	for _, proc := range procs {
+		if c, ok := proc.(processor.MetricsCollector); ok {
+			ms.collectors = append(ms.collectors, c)
+		}
+	}
+	sort.Strings(ms.procs)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ms)
+	log.Info().Str("addr", ms.ln.Addr().String()).Msg("metrics server started")
+	go func() {
+		if err := http.Serve(ms.ln, mux); err != nil {
+			log.Error().Err(err).Msg("metrics server stopped")
+		}
+	}()
+}
+
+func (ms *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := processor.NewMetricsWriter(w)
+
+	mw.Counter("edrint_packets_total", "Packets read", float64(atomic.LoadUint64(&ms.parser.Packets)))
+	mw.Counter("edrint_bytes_total", "Bytes of packets read", float64(atomic.LoadUint64(&ms.parser.Bytes)))
+	mw.Counter("edrint_decode_failures_total", "Packets that failed to decode",
+		float64(atomic.LoadUint64(&ms.parser.DecodeFailures)))
+
+	counts := ms.eb.GetPublishCounts()
+	topics := make([]string, 0, len(counts))
+	for topic := range counts {
+		topics = append(topics, string(topic))
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		mw.Counter("edrint_events_published_total", "Events published per topic",
+			float64(counts[events.Topic(topic)]), "topic", topic)
+	}
+
+	for _, proc := range ms.procs {
+		mw.Counter("edrint_handler_seconds_total", "Time spent in a processor's event handler",
+			float64(atomic.LoadUint64(&ms.handlers[proc].nanos))/1e9, "proc", proc)
+	}
+	for _, proc := range ms.procs {
+		mw.Counter("edrint_handler_calls_total", "Events handled per processor",
+			float64(atomic.LoadUint64(&ms.handlers[proc].calls)), "proc", proc)
+	}
+
+	for _, c := range ms.collectors {
+		c.Collect(mw)
+	}
+	if err := mw.Err(); err != nil {
+		log.Debug().Err(err).Msg("unable to write metrics")
+	}
+}
@@ -0,0 +1,63 @@
+package edrint
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/events"
+)
+
+func TestHandlerSelfTime(t *testing.T) {
+	eb := events.New()
+	ms := &metricsServer{eb: eb, handlers: make(map[string]*handlerStats)}
+	// outer publishes to inner, inner to leaf while timed
+	eb.Subscribe("outer", ms.timed("outer", func(topic events.Topic, event interface{}) {
+		time.Sleep(10 * time.Millisecond)
+		eb.Publish("inner", event)
+	}))
+	eb.Subscribe("inner", ms.timed("inner", func(topic events.Topic, event interface{}) {
+		eb.Publish("leaf", event)
+		time.Sleep(30 * time.Millisecond)
+	}))
+	eb.Subscribe("leaf", ms.timed("leaf", func(topic events.Topic, event interface{}) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	eb.Publish("outer", nil)
+	eb.Publish("leaf", nil)
+
+	self := func(proc string) time.Duration { return time.Duration(ms.handlers[proc].nanos) }
+	if d := self("outer"); d < 10*time.Millisecond || d >= 30*time.Millisecond {
+		t.Errorf("outer self time %v, want 10ms, not its children's 60ms", d)
+	}
+	if d := self("inner"); d < 30*time.Millisecond || d >= 50*time.Millisecond {
+		t.Errorf("inner self time %v, want 30ms, not leaf's 20ms", d)
+	}
+	if d := self("leaf"); d < 40*time.Millisecond {
+		t.Errorf("leaf self time %v, want 2 x 20ms", d)
+	}
+	for proc, want := range map[string]uint64{"outer": 1, "inner": 1, "leaf": 2} {
+		if got := ms.handlers[proc].calls; got != want {
+			t.Errorf("%s calls = %d, want %d", proc, got, want)
+		}
+	}
+	if len(ms.children) != 0 {
+		t.Errorf("children stack %v left behind", ms.children)
+	}
+
+	ms.parser.Packets = 3
+	rec := httptest.NewRecorder()
+	ms.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"edrint_packets_total 3",
+		`edrint_events_published_total{topic="leaf"} 2`,
+		`edrint_events_published_total{topic="outer"} 1`,
+		`edrint_handler_calls_total{proc="leaf"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no %q in\n%s", line, body)
+		}
+	}
+}
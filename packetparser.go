@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/sharat910/edrint/common"
@@ -21,6 +22,9 @@ const (
 	UNDEFINEDCM CaptureMode = iota
 	PCAPFILE
 	INTERFACE
+	// FLOWCOLLECTOR takes NetFlow/IPFIX exports instead of packets, see
+	// FlowCollector
+	FLOWCOLLECTOR
 )
 
 type DirectionMode int
@@ -38,6 +42,10 @@ type ParserConfig struct {
 	DirMatches []string
 	BPF        string
 	MaxPackets int
+	// Stats, if set, is updated while parsing
+	Stats *ParserStats
+	// ClientMACs sets Packet.ClientMAC
+	ClientMACs bool
 }
 
 func PacketParser(c ParserConfig, pf events.PubFunc) error {
@@ -69,6 +77,7 @@ func PacketParser(c ParserConfig, pf events.PubFunc) error {
 		&tcpLayer,
 		&udpLayer,
 	)
+	parser.IgnoreUnsupported = true
 
 	// Uni IPs
 	var clientSubnets []*net.IPNet
@@ -109,10 +118,19 @@ func PacketParser(c ParserConfig, pf events.PubFunc) error {
 		}
 		lastPacketTS = p.Timestamp
 		var foundLayerTypes []gopacket.LayerType
-		_ = parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+		var srcMAC, dstMAC net.HardwareAddr
+		err := parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+		if c.Stats != nil {
+			atomic.AddUint64(&c.Stats.Packets, 1)
+			atomic.AddUint64(&c.Stats.Bytes, uint64(p.TotalLen))
+			if err != nil {
+				atomic.AddUint64(&c.Stats.DecodeFailures, 1)
+			}
+		}
 		for _, layerType := range foundLayerTypes {
 			switch layerType {
 			case layers.LayerTypeEthernet:
+				srcMAC, dstMAC = ethLayer.SrcMAC, ethLayer.DstMAC
 				if c.DirMode == CLIENT_MAC {
 					for _, clientMac := range c.DirMatches {
 						if ethLayer.SrcMAC.String() == clientMac {
@@ -135,6 +153,9 @@ func PacketParser(c ParserConfig, pf events.PubFunc) error {
 						}
 					}
 				}
+				if c.ClientMACs {
+					p.ClientMAC = clientMAC(srcMAC, dstMAC, p.IsOutbound)
+				}
 			case layers.LayerTypeIPv6:
 				p.Header.SrcIP = ip6Layer.SrcIP.String()
 				p.Header.DstIP = ip6Layer.DstIP.String()
@@ -147,6 +168,9 @@ func PacketParser(c ParserConfig, pf events.PubFunc) error {
 						}
 					}
 				}
+				if c.ClientMACs {
+					p.ClientMAC = clientMAC(srcMAC, dstMAC, p.IsOutbound)
+				}
 			case layers.LayerTypeICMPv4:
 				pf(events.PACKET, p)
 			case layers.LayerTypeUDP:
@@ -178,6 +202,17 @@ func PacketParser(c ParserConfig, pf events.PubFunc) error {
 	return nil
 }
 
+// clientMAC is the MAC of the client side of a frame, "" without one
+func clientMAC(src, dst net.HardwareAddr, outbound bool) string {
+	if src == nil {
+		return ""
+	}
+	if outbound {
+		return src.String()
+	}
+	return dst.String()
+}
+
 func SanityCheck(c ParserConfig) error {
 	if c.CapMode == UNDEFINEDCM {
 		return errors.New("capture mode undefined")
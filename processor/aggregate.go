@@ -0,0 +1,437 @@
+package processor
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type AggregateConfig struct {
+	// Bucket is the width of a time bucket
+	Bucket time.Duration `mapstructure:"bucket"`
+	// Grace keeps buckets open after they end. RTT and retransmit
+	// telemetry is published as its flow expires: samples of buckets
+	// closed by then are counted as late.
+	Grace time.Duration `mapstructure:"grace"`
+	// By are the breakdowns, each publishing a series per group:
+	//	total                    all traffic
+	//	class                    the flow's class
+	//	client_ip, server_ip
+	//	client_subnet            client /SubnetV4 or /SubnetV6
+	//	server_asn               needs a geo db
+	//	<topic>:<Field>          the field of the flow's latest event of topic
+	By       []string `mapstructure:"by"`
+	SubnetV4 int      `mapstructure:"subnet_v4"`
+	SubnetV6 int      `mapstructure:"subnet_v6"`
+	// RTT and Retransmits summarise tcp.rtt and tcp.retransmit telemetry
+	RTT         bool `mapstructure:"rtt"`
+	Retransmits bool `mapstructure:"retransmits"`
+}
+
+// AggregateEvent is a bucket of a group of flows
+type AggregateEvent struct {
+	Start       time.Time
+	BucketMS    int
+	Dimension   string
+	Group       string
+	UpBytes     uint64
+	DownBytes   uint64
+	UpPackets   uint64
+	DownPackets uint64
+	// ActiveFlows had packets in the bucket, NewFlows were created in it
+	ActiveFlows int
+	NewFlows    int
+	RTTSamples  int     `json:",omitempty"`
+	RTTMeanMS   float64 `json:",omitempty"`
+	RTTP50MS    float64 `json:",omitempty"`
+	RTTP95MS    float64 `json:",omitempty"`
+	RTTMaxMS    float64 `json:",omitempty"`
+	// RetransmitsUp and RetransmitsDown are counted per telemetry interval
+	RetransmitsUp   uint64 `json:",omitempty"`
+	RetransmitsDown uint64 `json:",omitempty"`
+}
+
+// Aggregator keeps time bucketed counters of all flows, broken down by
+// groups of flows, like an I/O graph. Buckets are timed by packets and
+// published as aggregate.timeseries once the packet clock passes their
+// end plus the grace period, then at teardown. Flows are grouped when
+// a bucket closes so a class found after the first packets counts for
+// the whole bucket.
+type Aggregator struct {
+	BasePublisher
+	config AggregateConfig
+	dims   []aggDimension
+	geo    *GeoDB
+
+	flows   map[common.FiveTuple]*aggFlow
+	buckets map[int64]*aggBucket
+	clock   time.Time
+
+	nLate    int
+	nBuckets int
+}
+
+type aggDimension struct {
+	name  string
+	topic events.Topic
+	field string
+}
+
+// aggFlow is what groups a flow
+type aggFlow struct {
+	header   common.FiveTuple
+	class    string
+	fallback bool
+	asn      string
+	fields   []string
+}
+
+type aggBucket struct {
+	start time.Time
+	flows map[*aggFlow]*aggCounters
+}
+
+type aggCounters struct {
+	upBytes, downBytes, upPackets, downPackets uint64
+	active, new                                bool
+	rtts                                       []float64
+	retransUp, retransDown                     uint64
+}
+
+func NewAggregator(config AggregateConfig) *Aggregator {
+	if config.Bucket <= 0 {
+		config.Bucket = 10 * time.Second
+	}
+	if len(config.By) == 0 {
+		config.By = []string{"total"}
+	}
+	if config.SubnetV4 == 0 {
+		config.SubnetV4 = 24
+	}
+	if config.SubnetV6 == 0 {
+		config.SubnetV6 = 64
+	}
+	a := &Aggregator{
+		config:  config,
+		flows:   make(map[common.FiveTuple]*aggFlow),
+		buckets: make(map[int64]*aggBucket),
+	}
+	for _, by := range config.By {
+		d := aggDimension{name: by}
+		switch by {
+		case "total", "class", "client_ip", "server_ip", "client_subnet", "server_asn":
+		default:
+			i := strings.LastIndex(by, ":")
+			if i <= 0 || i == len(by)-1 {
+				log.Fatal().Str("by", by).Msg("aggregate: unknown breakdown, want a name or <topic>:<Field>")
+			}
+			d.topic, d.field = events.Topic(by[:i]), by[i+1:]
+		}
+		a.dims = append(a.dims, d)
+	}
+	return a
+}
+
+// SetGeoDB enables the server_asn breakdown
+func (a *Aggregator) SetGeoDB(g *GeoDB) {
+	a.geo = g
+}
+
+func (a *Aggregator) Init() {
+	log.Debug().Str("proc", a.Name()).Dur("bucket", a.config.Bucket).Dur("grace", a.config.Grace).
+		Strs("by", a.config.By).Msg("init")
+	for _, d := range a.dims {
+		if d.name == "server_asn" && a.geo == nil {
+			log.Warn().Str("proc", a.Name()).Msg("no geo db: server_asn is unknown")
+		}
+	}
+}
+
+func (a *Aggregator) Name() string {
+	return "aggregator"
+}
+
+func (a *Aggregator) Subs() []events.Topic {
+	subs := []events.Topic{events.PACKET, events.FLOW_CREATED, events.FLOW_EXPIRED, events.CLASSIFICATION}
+	if a.config.RTT {
+		subs = append(subs, events.TELEMETRY_TCP_RTT)
+	}
+	if a.config.Retransmits {
+		subs = append(subs, events.TELEMETRY_TCP_RETRANSMIT)
+	}
+	seen := make(map[events.Topic]bool)
+	for _, t := range subs {
+		seen[t] = true
+	}
+	for _, d := range a.dims {
+		if d.topic != "" && !seen[d.topic] {
+			seen[d.topic] = true
+			subs = append(subs, d.topic)
+		}
+	}
+	return subs
+}
+
+func (a *Aggregator) Pubs() []events.Topic {
+	return []events.Topic{events.AGGREGATE_TIMESERIES}
+}
+
+func (a *Aggregator) flow(header common.FiveTuple) *aggFlow {
+	f, exists := a.flows[header]
+	if !exists {
+		f = &aggFlow{header: header, fields: make([]string, len(a.dims))}
+		a.flows[header] = f
+	}
+	return f
+}
+
+// counters returns the counters of a flow in the bucket of t, nil if
+// the bucket is closed
+func (a *Aggregator) counters(f *aggFlow, t time.Time) *aggCounters {
+	start := t.Truncate(a.config.Bucket)
+	if !a.clock.IsZero() && !start.Add(a.config.Bucket+a.config.Grace).After(a.clock) {
+		a.nLate++
+		return nil
+	}
+	b, exists := a.buckets[start.UnixNano()]
+	if !exists {
+		b = &aggBucket{start: start, flows: make(map[*aggFlow]*aggCounters)}
+		a.buckets[start.UnixNano()] = b
+	}
+	c, exists := b.flows[f]
+	if !exists {
+		c = &aggCounters{}
+		b.flows[f] = c
+	}
+	return c
+}
+
+func (a *Aggregator) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		p := event.(common.Packet)
+		if p.Timestamp.After(a.clock) {
+			a.clock = p.Timestamp
+			a.closeBuckets(false)
+		}
+		c := a.counters(a.flow(p.GetKey()), p.Timestamp)
+		if c == nil {
+			return
+		}
+		c.active = true
+		if p.IsOutbound {
+			c.upBytes += uint64(p.TotalLen)
+			c.upPackets++
+		} else {
+			c.downBytes += uint64(p.TotalLen)
+			c.downPackets++
+		}
+		return
+	case events.FLOW_CREATED:
+		fc := event.(FlowCreatedEvent)
+		if c := a.counters(a.flow(fc.Header), fc.CreatedTS); c != nil {
+			c.new = true
+		}
+	case events.FLOW_EXPIRED:
+		// open buckets keep the flow, only its lookup goes
+		delete(a.flows, event.(FlowExpiredEvent).Header)
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Class != "" && !clf.AtExpiry {
+			f := a.flow(clf.Header)
+			if f.class == "" || (f.fallback && !clf.Fallback) {
+				f.class, f.fallback = clf.Class, clf.Fallback
+			}
+		}
+	}
+	// a topic may be both telemetry and a breakdown, events of expired
+	// flows (e.g. enriched.flow.expired) are ignored
+	v, header, ok := eventFlow(event)
+	if !ok {
+		return
+	}
+	f, exists := a.flows[header]
+	if !exists {
+		return
+	}
+	switch topic {
+	case events.TELEMETRY_TCP_RTT:
+		if a.config.RTT {
+			a.addRTT(f, v)
+		}
+	case events.TELEMETRY_TCP_RETRANSMIT:
+		if a.config.Retransmits {
+			a.addRetransmits(f, v)
+		}
+	}
+	for i, d := range a.dims {
+		if d.topic != topic {
+			continue
+		}
+		if fv := v.FieldByName(d.field); fv.IsValid() && fv.CanInterface() {
+			f.fields[i] = fmt.Sprint(fv.Interface())
+		}
+	}
+}
+
+func (a *Aggregator) addRTT(f *aggFlow, v reflect.Value) {
+	first, _ := fieldTime(v, "FirstPacketTS")
+	rel, rtts := numericField(v, "RelTimestampMS"), numericField(v, "RTTMS")
+	for i := 0; i < len(rel) && i < len(rtts); i++ {
+		if c := a.counters(f, first.Add(time.Duration(rel[i])*time.Millisecond)); c != nil {
+			c.rtts = append(c.rtts, rtts[i])
+		}
+	}
+}
+
+func (a *Aggregator) addRetransmits(f *aggFlow, v reflect.Value) {
+	first, _ := fieldTime(v, "FirstPacketTS")
+	interval := numericField(v, "IntervalMS")
+	if len(interval) != 1 {
+		return
+	}
+	up, down := numericField(v, "RetransmitsUp"), numericField(v, "RetransmitsDown")
+	for i := 0; i < len(up) || i < len(down); i++ {
+		var u, d uint64
+		if i < len(up) {
+			u = uint64(up[i])
+		}
+		if i < len(down) {
+			d = uint64(down[i])
+		}
+		if u+d == 0 {
+			continue
+		}
+		t := first.Add(time.Duration(float64(i)*interval[0]) * time.Millisecond)
+		if c := a.counters(f, t); c != nil {
+			c.retransUp += u
+			c.retransDown += d
+		}
+	}
+}
+
+// closeBuckets publishes the buckets past the grace period, or all
+func (a *Aggregator) closeBuckets(all bool) {
+	var closing []*aggBucket
+	for key, b := range a.buckets {
+		if all || !b.start.Add(a.config.Bucket+a.config.Grace).After(a.clock) {
+			closing = append(closing, b)
+			delete(a.buckets, key)
+		}
+	}
+	sort.Slice(closing, func(i, j int) bool { return closing[i].start.Before(closing[j].start) })
+	for _, b := range closing {
+		a.publish(b)
+	}
+}
+
+// group returns the group of a flow in a breakdown
+func (a *Aggregator) group(i int, f *aggFlow) string {
+	switch a.dims[i].name {
+	case "total":
+		return "all"
+	case "class":
+		if f.class == "" {
+			return "unclassified"
+		}
+		return f.class
+	case "client_ip":
+		return f.header.DstIP
+	case "server_ip":
+		return f.header.SrcIP
+	case "client_subnet":
+		ip := net.ParseIP(f.header.DstIP)
+		if ip == nil {
+			return f.header.DstIP
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(a.config.SubnetV4, 32)), Mask: net.CIDRMask(a.config.SubnetV4, 32)}).String()
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(a.config.SubnetV6, 128)), Mask: net.CIDRMask(a.config.SubnetV6, 128)}).String()
+	case "server_asn":
+		if f.asn == "" {
+			f.asn = "unknown"
+			if a.geo != nil {
+				if asn := a.geo.Lookup(net.ParseIP(f.header.SrcIP)).ServerASN; asn != 0 {
+					f.asn = fmt.Sprintf("AS%d", asn)
+				}
+			}
+		}
+		return f.asn
+	}
+	if f.fields[i] == "" {
+		return "unknown"
+	}
+	return f.fields[i]
+}
+
+func (a *Aggregator) publish(b *aggBucket) {
+	a.nBuckets++
+	type groupKey struct {
+		dim   int
+		group string
+	}
+	groups := make(map[groupKey]*AggregateEvent)
+	rtts := make(map[groupKey][]float64)
+	for f, c := range b.flows {
+		for i := range a.dims {
+			k := groupKey{i, a.group(i, f)}
+			ae, exists := groups[k]
+			if !exists {
+				ae = &AggregateEvent{
+					Start:     b.start,
+					BucketMS:  int(a.config.Bucket / time.Millisecond),
+					Dimension: a.dims[i].name,
+					Group:     k.group,
+				}
+				groups[k] = ae
+			}
+			ae.UpBytes += c.upBytes
+			ae.DownBytes += c.downBytes
+			ae.UpPackets += c.upPackets
+			ae.DownPackets += c.downPackets
+			if c.active {
+				ae.ActiveFlows++
+			}
+			if c.new {
+				ae.NewFlows++
+			}
+			ae.RetransmitsUp += c.retransUp
+			ae.RetransmitsDown += c.retransDown
+			rtts[k] = append(rtts[k], c.rtts...)
+		}
+	}
+	keys := make([]groupKey, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].dim != keys[j].dim {
+			return keys[i].dim < keys[j].dim
+		}
+		return keys[i].group < keys[j].group
+	})
+	for _, k := range keys {
+		ae := groups[k]
+		if samples := rtts[k]; len(samples) > 0 {
+			ae.RTTSamples = len(samples)
+			ae.RTTMeanMS = sumValues(samples) / float64(len(samples))
+			ae.RTTP50MS = percentile(samples, 50)
+			ae.RTTP95MS = percentile(samples, 95)
+			ae.RTTMaxMS = samples[len(samples)-1]
+		}
+		a.Publish(events.AGGREGATE_TIMESERIES, *ae)
+	}
+}
+
+func (a *Aggregator) Teardown() {
+	a.closeBuckets(true)
+	log.Info().Str("proc", a.Name()).Int("buckets", a.nBuckets).Int("late", a.nLate).Msg("teardown")
+}
@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator(AggregateConfig{
+		Bucket: time.Second,
+		By:     []string{"total", "class", "client_subnet", "enriched.flow.created:ServerCountry"},
+		RTT:    true,
+	})
+	var got []AggregateEvent
+	a.SetPubFunc(func(topic events.Topic, event interface{}) {
+		got = append(got, event.(AggregateEvent))
+	})
+	a.Init()
+
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	flowA := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	flowB := common.FiveTuple{SrcIP: "5.6.7.8", DstIP: "10.0.1.1", SrcPort: 443, DstPort: 50001, Protocol: 6}
+	packet := func(ms int, key common.FiveTuple, outbound bool, size uint) {
+		p := common.Packet{Timestamp: at(ms), Header: key, TotalLen: size}
+		if outbound {
+			p.IsOutbound = true
+			p.Header = common.FiveTuple{SrcIP: key.DstIP, DstIP: key.SrcIP, SrcPort: key.DstPort, DstPort: key.SrcPort, Protocol: key.Protocol}
+		}
+		a.EventHandler(events.PACKET, p)
+	}
+
+	a.EventHandler(events.FLOW_CREATED, FlowCreatedEvent{CreatedTS: at(100), Header: flowA})
+	a.EventHandler(events.ENRICHED_FLOW_CREATED, EnrichedFlowCreatedEvent{
+		FlowCreatedEvent{CreatedTS: at(100), Header: flowA}, GeoInfo{ServerCountry: "US"}})
+	packet(100, flowA, true, 100)
+	packet(200, flowA, false, 1500)
+	// classified after its first packets, grouped by class at close
+	a.EventHandler(events.CLASSIFICATION, EventClassification{Header: flowA, Class: "netflix"})
+	if len(got) != 0 {
+		t.Fatalf("%d events before the bucket closed", len(got))
+	}
+
+	a.EventHandler(events.FLOW_CREATED, FlowCreatedEvent{CreatedTS: at(1500), Header: flowB})
+	packet(1500, flowB, false, 1000)
+	want := []AggregateEvent{
+		{Dimension: "total", Group: "all", UpBytes: 100, DownBytes: 1500, UpPackets: 1, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+		{Dimension: "class", Group: "netflix", UpBytes: 100, DownBytes: 1500, UpPackets: 1, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+		{Dimension: "client_subnet", Group: "10.0.0.0/24", UpBytes: 100, DownBytes: 1500, UpPackets: 1, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+		{Dimension: "enriched.flow.created:ServerCountry", Group: "US", UpBytes: 100, DownBytes: 1500, UpPackets: 1, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+	}
+	checkAggregates(t, got, want, t0)
+
+	// rtt samples of the closed bucket are late
+	a.EventHandler(events.TELEMETRY_TCP_RTT, struct {
+		FirstPacketTS  time.Time
+		Header         common.FiveTuple
+		RelTimestampMS []uint
+		RTTMS          []uint
+	}{at(100), flowA, []uint{50, 1450, 1460}, []uint{20, 30, 50}})
+	a.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: flowA})
+	if len(a.flows) != 1 {
+		t.Errorf("%d flows kept, want 1", len(a.flows))
+	}
+	got = got[:0]
+	a.Teardown()
+	rtt := AggregateEvent{RTTSamples: 2, RTTMeanMS: 40, RTTP50MS: 30, RTTP95MS: 50, RTTMaxMS: 50}
+	want = []AggregateEvent{
+		{Dimension: "total", Group: "all", DownBytes: 1000, DownPackets: 1, ActiveFlows: 1, NewFlows: 1,
+			RTTSamples: 2, RTTMeanMS: 40, RTTP50MS: 30, RTTP95MS: 50, RTTMaxMS: 50},
+		{Dimension: "class", Group: "netflix",
+			RTTSamples: rtt.RTTSamples, RTTMeanMS: rtt.RTTMeanMS, RTTP50MS: rtt.RTTP50MS, RTTP95MS: rtt.RTTP95MS, RTTMaxMS: rtt.RTTMaxMS},
+		{Dimension: "class", Group: "unclassified", DownBytes: 1000, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+		{Dimension: "client_subnet", Group: "10.0.0.0/24",
+			RTTSamples: rtt.RTTSamples, RTTMeanMS: rtt.RTTMeanMS, RTTP50MS: rtt.RTTP50MS, RTTP95MS: rtt.RTTP95MS, RTTMaxMS: rtt.RTTMaxMS},
+		{Dimension: "client_subnet", Group: "10.0.1.0/24", DownBytes: 1000, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+		{Dimension: "enriched.flow.created:ServerCountry", Group: "US",
+			RTTSamples: rtt.RTTSamples, RTTMeanMS: rtt.RTTMeanMS, RTTP50MS: rtt.RTTP50MS, RTTP95MS: rtt.RTTP95MS, RTTMaxMS: rtt.RTTMaxMS},
+		{Dimension: "enriched.flow.created:ServerCountry", Group: "unknown", DownBytes: 1000, DownPackets: 1, ActiveFlows: 1, NewFlows: 1},
+	}
+	checkAggregates(t, got, want, t0.Add(time.Second))
+	if a.nLate != 1 {
+		t.Errorf("%d late samples, want 1", a.nLate)
+	}
+}
+
+func checkAggregates(t *testing.T, got, want []AggregateEvent, start time.Time) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		want[i].Start, want[i].BucketMS = start, 1000
+		if !got[i].Start.Equal(start) {
+			t.Errorf("event %d: start %v, want %v", i, got[i].Start, start)
+		}
+		got[i].Start = start
+		if got[i] != want[i] {
+			t.Errorf("event %d:\n%+v\nwant\n%+v", i, got[i], want[i])
+		}
+	}
+}
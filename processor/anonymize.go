@@ -0,0 +1,230 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// CryptoPAn is the prefix-preserving IP anonymization scheme of Xu et al.
+// Two addresses sharing a k bit prefix map to addresses sharing a k bit
+// prefix and the mapping depends only on the key. IPv6 addresses are
+// anonymized the same way over 128 bits.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [16]byte
+}
+
+// NewCryptoPAn takes a 32 byte key: an AES-128 key followed by the secret
+// the padding is derived from
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("crypto-pan key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	cp := &CryptoPAn{block: block}
+	block.Encrypt(cp.pad[:], key[16:])
+	return cp, nil
+}
+
+func (cp *CryptoPAn) Anonymize(ip net.IP) net.IP {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+		if addr == nil {
+			return ip
+		}
+	}
+	nbits := len(addr) * 8
+
+	var in, out [16]byte
+	anon := make(net.IP, len(addr))
+	for pos := 0; pos < nbits; pos++ {
+		// first pos bits of the address, the rest from the pad
+		in = cp.pad
+		full := pos / 8
+		copy(in[:full], addr[:full])
+		if rem := pos % 8; rem > 0 {
+			mask := byte(0xff << uint(8-rem))
+			in[full] = addr[full]&mask | cp.pad[full]&^mask
+		}
+		cp.block.Encrypt(out[:], in[:])
+		anon[pos/8] |= (out[0] >> 7) << uint(7-pos%8)
+	}
+	for i := range anon {
+		anon[i] ^= addr[i]
+	}
+	return anon
+}
+
+// LoadAnonymizerKey reads a 32 byte key stored raw or hex encoded
+func LoadAnonymizerKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: key must be 32 raw bytes or 64 hex characters", path)
+	}
+	return key, nil
+}
+
+// Anonymizer rewrites events for export: every IP (in a FiveTuple or any
+// other field) outside the pass-through subnets is anonymized with
+// Crypto-PAn and, optionally, ports and host names are redacted. Events
+// are converted to their generic JSON form so any event type works.
+type Anonymizer struct {
+	cp          *CryptoPAn
+	passThrough []net.IPNet
+	RedactPorts bool
+	RedactNames bool
+	// NameFields are the fields holding host names
+	NameFields map[string]struct{}
+	cache      map[string]string
+}
+
+func NewAnonymizer(key []byte, passThrough []net.IPNet) (*Anonymizer, error) {
+	cp, err := NewCryptoPAn(key)
+	if err != nil {
+		return nil, err
+	}
+	a := &Anonymizer{
+		cp:          cp,
+		passThrough: passThrough,
+		NameFields:  make(map[string]struct{}),
+		cache:       make(map[string]string),
+	}
+	for _, field := range []string{"SNI", "Name", "CName", "Subject", "SAN", "Services"} {
+		a.NameFields[field] = struct{}{}
+	}
+	return a, nil
+}
+
+// AnonymizeIP returns the anonymized form of an IP string, or s unchanged
+// if it is not an IP or is passed through
+func (a *Anonymizer) AnonymizeIP(s string) string {
+	if anon, exists := a.cache[s]; exists {
+		return anon
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	anon := s
+	if !a.passed(ip) {
+		anon = a.cp.Anonymize(ip).String()
+	}
+	if len(a.cache) > 1<<20 {
+		a.cache = make(map[string]string)
+	}
+	a.cache[s] = anon
+	return anon
+}
+
+func (a *Anonymizer) passed(ip net.IP) bool {
+	for _, subnet := range a.passThrough {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AnonymizeColumn anonymizes a table column value (see Column.Value)
+// the way Anonymize does the field it comes from
+func (a *Anonymizer) AnonymizeColumn(c Column, v interface{}) interface{} {
+	switch val := v.(type) {
+	case string:
+		if c.Kind != ColJSON {
+			return a.walk(c.field, val)
+		}
+		var generic interface{}
+		dec := json.NewDecoder(strings.NewReader(val))
+		dec.UseNumber()
+		if err := dec.Decode(&generic); err != nil {
+			return val
+		}
+		b, err := json.Marshal(a.walk(c.field, generic))
+		if err != nil {
+			return val
+		}
+		return string(b)
+	case []string:
+		for i := range val {
+			val[i] = a.walk(c.field, val[i]).(string)
+		}
+	case int64:
+		if a.RedactPorts && strings.HasSuffix(c.field, "Port") {
+			return int64(0)
+		}
+	}
+	return v
+}
+
+// Anonymize returns the generic JSON form of event with addresses
+// anonymized and ports and names redacted as configured
+func (a *Anonymizer) Anonymize(event interface{}) (interface{}, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return a.walk("", generic), nil
+}
+
+func (a *Anonymizer) walk(field string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		// keys may be addresses too, e.g. of per server counters
+		anon := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			anon[a.anonymizeAddr(k)] = a.walk(k, child)
+		}
+		return anon
+	case []interface{}:
+		for i, child := range val {
+			val[i] = a.walk(field, child)
+		}
+		return val
+	case string:
+		if _, isName := a.NameFields[field]; isName && a.RedactNames && val != "" {
+			return "redacted"
+		}
+		return a.anonymizeAddr(val)
+	case json.Number:
+		if a.RedactPorts && strings.HasSuffix(field, "Port") {
+			return 0
+		}
+		return val
+	}
+	return v
+}
+
+// anonymizeAddr anonymizes s if it is an IP or a subnet, keeping the mask
+func (a *Anonymizer) anonymizeAddr(s string) string {
+	if i := strings.IndexByte(s, '/'); i > 0 {
+		if _, subnet, err := net.ParseCIDR(s); err == nil {
+			ip := net.ParseIP(a.AnonymizeIP(s[:i]))
+			return (&net.IPNet{IP: ip.Mask(subnet.Mask), Mask: subnet.Mask}).String()
+		}
+	}
+	return a.AnonymizeIP(s)
+}
@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"net"
+	"testing"
+)
+
+// key of the Crypto-PAn reference implementation's sample
+var cryptoPAnTestKey = []byte{
+	21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+}
+
+func TestCryptoPAnReferenceVectors(t *testing.T) {
+	cp, err := NewCryptoPAn(cryptoPAnTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip, want string
+	}{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"141.233.145.108", "141.129.237.235"},
+		{"152.163.225.39", "151.140.114.167"},
+		{"156.29.3.236", "147.225.12.42"},
+		{"165.247.96.84", "162.9.99.234"},
+		{"166.107.77.190", "160.132.178.185"},
+		{"192.102.249.13", "252.138.62.131"},
+	}
+	for _, tt := range tests {
+		if got := cp.Anonymize(net.ParseIP(tt.ip)).String(); got != tt.want {
+			t.Errorf("Anonymize(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCryptoPAnPrefixPreserving(t *testing.T) {
+	cp, err := NewCryptoPAn(cryptoPAnTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := cp.Anonymize(net.ParseIP("2001:db8:1:2::1"))
+	b := cp.Anonymize(net.ParseIP("2001:db8:1:3::1"))
+	if len(a) != net.IPv6len {
+		t.Fatalf("anonymized %v is not IPv6", a)
+	}
+	// the addresses share 63 bits
+	for i := 0; i < 63; i++ {
+		if a[i/8]>>uint(7-i%8)&1 != b[i/8]>>uint(7-i%8)&1 {
+			t.Fatalf("%v and %v differ at bit %d", a, b, i)
+		}
+	}
+	if a[7]&1 == b[7]&1 {
+		t.Errorf("%v and %v share bit 63", a, b)
+	}
+}
+
+func TestAnonymizerWalk(t *testing.T) {
+	_, local, _ := net.ParseCIDR("10.0.0.0/8")
+	anon, err := NewAnonymizer(cryptoPAnTestKey, []net.IPNet{*local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anon.RedactPorts = true
+	anon.RedactNames = true
+
+	event := struct {
+		Header  map[string]interface{}
+		Servers map[string]int
+		Subnet  string
+		SNI     string
+		Other   string
+	}{
+		Header:  map[string]interface{}{"SrcIP": "128.11.68.132", "DstIP": "10.1.2.3", "SrcPort": 443},
+		Servers: map[string]int{"129.118.74.4": 3, "10.1.2.3": 1},
+		Subnet:  "128.11.68.0/24",
+		SNI:     "example.com",
+		Other:   "not an ip",
+	}
+	got, err := anon.Anonymize(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := got.(map[string]interface{})
+	header := m["Header"].(map[string]interface{})
+	if header["SrcIP"] != "135.242.180.132" || header["DstIP"] != "10.1.2.3" || header["SrcPort"] != 0 {
+		t.Errorf("header = %v", header)
+	}
+	servers := m["Servers"].(map[string]interface{})
+	if _, leaked := servers["129.118.74.4"]; leaked || len(servers) != 2 {
+		t.Errorf("servers = %v", servers)
+	}
+	if _, ok := servers["134.136.186.123"]; !ok {
+		t.Errorf("servers = %v, want anonymized key", servers)
+	}
+	if m["Subnet"] != "135.242.180.0/24" {
+		t.Errorf("subnet = %v", m["Subnet"])
+	}
+	if m["SNI"] != "redacted" || m["Other"] != "not an ip" {
+		t.Errorf("SNI = %v, Other = %v", m["SNI"], m["Other"])
+	}
+}
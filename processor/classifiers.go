@@ -5,6 +5,7 @@ import (
 	"math"
 	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,32 +15,65 @@ import (
 )
 
 type Rule struct {
+	Class           string
+	Priority        int
 	ClientSubnet    net.IPNet
 	ServerSubnet    net.IPNet
 	ClientPortRange [2]uint16
 	ServerPortRange [2]uint16
 	Protocol        uint8
 	ProtocolMatch   bool
+
+	// Matched against a GeoDB by RuleMatcher, not by Match/MatchIPs
+	ServerASNs      []uint
+	ServerCountries []string
+
+	// Negations -- a field prefixed with '!' matches everything but the value
+	ClientSubnetNegate  bool
+	ServerSubnetNegate  bool
+	ClientPortNegate    bool
+	ServerPortNegate    bool
+	ProtocolNegate      bool
+	ServerASNNegate     bool
+	ServerCountryNegate bool
 }
 
+// GetStarRule returns a rule matching every flow. Its subnets are unset,
+// which unlike 0.0.0.0/0 or ::/0 match IPv4 and IPv6 addresses.
 func GetStarRule() Rule {
-	_, zeroSubnet, _ := net.ParseCIDR("0.0.0.0/0")
 	return Rule{
-		ClientSubnet:    *zeroSubnet,
-		ServerSubnet:    *zeroSubnet,
 		ClientPortRange: [2]uint16{0, math.MaxUint16},
 		ServerPortRange: [2]uint16{0, math.MaxUint16},
 	}
 }
 
 func BuildRule(config map[string]string) Rule {
+	r, err := ParseRule(config)
+	if err != nil {
+		log.Fatal().Err(err).Str("rule", fmt.Sprint(config)).Msg("unable to parse rule")
+	}
+	return r
+}
+
+// ParseRule is BuildRule returning an error instead of exiting
+func ParseRule(config map[string]string) (Rule, error) {
 	r := GetStarRule()
 
+	priority, exists := config["priority"]
+	if exists {
+		p, err := strconv.Atoi(priority)
+		if err != nil {
+			return r, fmt.Errorf("priority: %w", err)
+		}
+		r.Priority = p
+	}
+
 	protocol, exists := config["protocol"]
 	if exists && protocol != "*" {
+		protocol, r.ProtocolNegate = parseNegation(protocol)
 		protoInt, err := strconv.Atoi(protocol)
 		if err != nil {
-			log.Fatal().Err(err).Str("protocol", protocol).Msg("unable to parse rule")
+			return r, fmt.Errorf("protocol: %w", err)
 		}
 		r.Protocol = uint8(protoInt)
 		r.ProtocolMatch = true
@@ -47,112 +81,238 @@ func BuildRule(config map[string]string) Rule {
 
 	clientIP, exists := config["client_ip"]
 	if exists && clientIP != "*" {
-		fmt.Println(net.ParseCIDR(clientIP))
+		clientIP, r.ClientSubnetNegate = parseNegation(clientIP)
 		_, subnet, err := net.ParseCIDR(clientIP)
 		if err != nil {
-			log.Fatal().Err(err).Str("client_ip_cidr", clientIP).Msg("unable to parse CIDR")
+			return r, fmt.Errorf("client_ip: %w", err)
 		}
 		r.ClientSubnet = *subnet
 	}
 
 	serverIP, exists := config["server_ip"]
 	if exists && serverIP != "*" {
-		_, subnet, _ := net.ParseCIDR(serverIP)
+		serverIP, r.ServerSubnetNegate = parseNegation(serverIP)
+		_, subnet, err := net.ParseCIDR(serverIP)
+		if err != nil {
+			return r, fmt.Errorf("server_ip: %w", err)
+		}
 		r.ServerSubnet = *subnet
 	}
 
-	clientPort, exists := config["client_port"]
-	if exists && clientPort != "*" {
-		clientPort = strings.Replace(clientPort, " ", "", -1)
-		ports := strings.Split(clientPort, "-")
-		var portInts []int
-		for _, port := range ports {
-			portInt, err := strconv.Atoi(port)
+	serverASN, exists := config["server_asn"]
+	if exists && serverASN != "*" {
+		serverASN, r.ServerASNNegate = parseNegation(serverASN)
+		for _, asn := range strings.Split(serverASN, ",") {
+			asnInt, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(asn), "AS"), 10, 32)
 			if err != nil {
-				log.Fatal().Err(err).Str("client_port", clientPort).Msg("unable to parse rule")
+				return r, fmt.Errorf("server_asn: %w", err)
 			}
-			portInts = append(portInts, portInt)
+			r.ServerASNs = append(r.ServerASNs, uint(asnInt))
 		}
-		if len(portInts) == 1 {
-			r.ClientPortRange[0] = uint16(portInts[0])
-			r.ClientPortRange[1] = uint16(portInts[0])
-		} else if len(portInts) == 2 {
-			r.ClientPortRange[0] = uint16(portInts[0])
-			r.ClientPortRange[1] = uint16(portInts[1])
-		} else {
-			log.Fatal().Ints("parsed_integer_ports", portInts).
-				Str("client_port", clientPort).
-				Msg("unable to parse rule")
+	}
+
+	serverCountry, exists := config["server_country"]
+	if exists && serverCountry != "*" {
+		serverCountry, r.ServerCountryNegate = parseNegation(serverCountry)
+		for _, country := range strings.Split(serverCountry, ",") {
+			r.ServerCountries = append(r.ServerCountries, strings.ToUpper(strings.TrimSpace(country)))
+		}
+	}
+
+	var err error
+	clientPort, exists := config["client_port"]
+	if exists && clientPort != "*" {
+		clientPort, r.ClientPortNegate = parseNegation(clientPort)
+		if r.ClientPortRange, err = parsePortRange(clientPort); err != nil {
+			return r, fmt.Errorf("client_port: %w", err)
 		}
 	}
 
 	serverPort, exists := config["server_port"]
 	if exists && serverPort != "*" {
-		serverPort = strings.Replace(serverPort, " ", "", -1)
-		ports := strings.Split(serverPort, "-")
-		var portInts []int
-		for _, port := range ports {
-			portInt, err := strconv.Atoi(port)
-			if err != nil {
-				log.Fatal().Err(err).Str("server_port", serverPort).Msg("unable to parse rule")
-			}
-			portInts = append(portInts, portInt)
+		serverPort, r.ServerPortNegate = parseNegation(serverPort)
+		if r.ServerPortRange, err = parsePortRange(serverPort); err != nil {
+			return r, fmt.Errorf("server_port: %w", err)
 		}
-		if len(portInts) == 1 {
-			r.ServerPortRange[0] = uint16(portInts[0])
-			r.ServerPortRange[1] = uint16(portInts[0])
-		} else if len(portInts) == 2 {
-			r.ServerPortRange[0] = uint16(portInts[0])
-			r.ServerPortRange[1] = uint16(portInts[1])
-		} else {
-			log.Fatal().Ints("parsed_integer_ports", portInts).
-				Str("server_port", serverPort).
-				Msg("unable to parse rule")
+	}
+	return r, nil
+}
+
+// ParseRules parses a class -> rule config into sorted rules
+func ParseRules(ruleConfig map[string]map[string]string) ([]Rule, error) {
+	var rules []Rule
+	for class, rule := range ruleConfig {
+		r, err := ParseRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %w", class, err)
 		}
+		r.Class = class
+		rules = append(rules, r)
 	}
-	return r
+	SortRules(rules)
+	return rules, nil
+}
+
+func parseNegation(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "!") {
+		return strings.TrimSpace(value[1:]), true
+	}
+	return value, false
+}
+
+func parsePortRange(value string) ([2]uint16, error) {
+	value = strings.Replace(value, " ", "", -1)
+	ports := strings.Split(value, "-")
+	var portInts []uint16
+	for _, port := range ports {
+		portInt, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return [2]uint16{}, err
+		}
+		portInts = append(portInts, uint16(portInt))
+	}
+	if len(portInts) == 1 {
+		return [2]uint16{portInts[0], portInts[0]}, nil
+	} else if len(portInts) == 2 {
+		return [2]uint16{portInts[0], portInts[1]}, nil
+	}
+	return [2]uint16{}, fmt.Errorf("invalid port range: %s", value)
 }
 
 func (r Rule) Match(header common.FiveTuple) bool {
-	if r.ProtocolMatch && header.Protocol != r.Protocol {
+	return r.MatchIPs(header, net.ParseIP(header.SrcIP), net.ParseIP(header.DstIP))
+}
+
+// MatchIPs is Match with the header's server and client IPs already parsed
+func (r Rule) MatchIPs(header common.FiveTuple, serverIP, clientIP net.IP) bool {
+	if r.ProtocolMatch && (header.Protocol == r.Protocol) == r.ProtocolNegate {
 		return false
 	}
 
-	if !(header.SrcPort >= r.ServerPortRange[0] && header.SrcPort <= r.ServerPortRange[1]) {
+	if (header.SrcPort >= r.ServerPortRange[0] && header.SrcPort <= r.ServerPortRange[1]) == r.ServerPortNegate {
 		return false
 	}
 
-	if !(header.DstPort >= r.ClientPortRange[0] && header.DstPort <= r.ClientPortRange[1]) {
+	if (header.DstPort >= r.ClientPortRange[0] && header.DstPort <= r.ClientPortRange[1]) == r.ClientPortNegate {
 		return false
 	}
 
-	serverIP := net.ParseIP(header.SrcIP)
-	clientIP := net.ParseIP(header.DstIP)
+	if subnetContains(r.ServerSubnet, serverIP) == r.ServerSubnetNegate {
+		return false
+	}
 
-	if !(r.ServerSubnet.Contains(serverIP) && r.ClientSubnet.Contains(clientIP)) {
+	if subnetContains(r.ClientSubnet, clientIP) == r.ClientSubnetNegate {
 		return false
 	}
 	return true
 }
 
+// subnetContains is n.Contains(ip) with an unset subnet containing any IP
+func subnetContains(n net.IPNet, ip net.IP) bool {
+	if n.IP == nil {
+		return true
+	}
+	return n.Contains(ip)
+}
+
+// NeedsGeo reports whether the rule matches on server ASN or country
+func (r Rule) NeedsGeo() bool {
+	return len(r.ServerASNs) > 0 || len(r.ServerCountries) > 0
+}
+
+// MatchGeo checks the rule's server ASNs and countries against g
+func (r Rule) MatchGeo(g GeoInfo) bool {
+	if len(r.ServerASNs) > 0 {
+		found := false
+		for _, asn := range r.ServerASNs {
+			if asn == g.ServerASN {
+				found = true
+				break
+			}
+		}
+		if found == r.ServerASNNegate {
+			return false
+		}
+	}
+	if len(r.ServerCountries) > 0 {
+		found := false
+		for _, country := range r.ServerCountries {
+			if country == g.ServerCountry {
+				found = true
+				break
+			}
+		}
+		if found == r.ServerCountryNegate {
+			return false
+		}
+	}
+	return true
+}
+
+// HeaderClassifier matches flow headers against rules in order of
+// increasing priority (ties broken by class name). With FirstMatch only
+// the first matching rule publishes a class and flows matching no rule
+// are published with DefaultClass if set.
 type HeaderClassifier struct {
 	BasePublisher
-	ruleConfig map[string]map[string]string
-	Rules      map[string]Rule
+	Rules        []Rule
+	FirstMatch   bool
+	DefaultClass string
+	matcher      *RuleMatcher
+	geo          *GeoDB
 }
 
 func NewHeaderClassifer(ruleConfig map[string]map[string]string) *HeaderClassifier {
-	hc := &HeaderClassifier{
-		Rules: make(map[string]Rule),
-	}
-	for class, rule := range ruleConfig {
-		hc.Rules[class] = BuildRule(rule)
+	rules, err := ParseRules(ruleConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to parse rules")
 	}
+	hc := &HeaderClassifier{}
+	hc.SetRules(rules)
 	return hc
 }
 
+// AddRules adds rules (e.g. loaded from prefix files) and re-indexes them
+func (hc *HeaderClassifier) AddRules(rules []Rule) {
+	hc.SetRules(append(hc.Rules, rules...))
+}
+
+// SetRules replaces all rules. Flows that are already classified
+// are not affected.
+func (hc *HeaderClassifier) SetRules(rules []Rule) {
+	SortRules(rules)
+	hc.Rules = rules
+	hc.matcher = NewRuleMatcher(hc.Rules)
+	hc.matcher.Geo = hc.geo
+}
+
+// SetGeoDB enables server_asn and server_country rules
+func (hc *HeaderClassifier) SetGeoDB(g *GeoDB) {
+	hc.geo = g
+	hc.matcher.Geo = g
+}
+
+func SortRules(rules []Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].Class < rules[j].Class
+	})
+}
+
 func (hc *HeaderClassifier) Init() {
-	log.Debug().Str("proc", hc.Name()).Str("rules", fmt.Sprint(hc.Rules)).Msg("init")
+	if len(hc.Rules) <= 100 {
+		log.Debug().Str("proc", hc.Name()).Str("rules", fmt.Sprint(hc.Rules)).Msg("rules")
+	}
+	for _, r := range hc.Rules {
+		if r.NeedsGeo() && hc.geo == nil {
+			log.Warn().Str("proc", hc.Name()).Str("class", r.Class).Msg("rule needs geo db: will never match")
+		}
+	}
+	log.Debug().Str("proc", hc.Name()).Int("rule_count", len(hc.Rules)).
+		Bool("first_match", hc.FirstMatch).Str("default_class", hc.DefaultClass).Msg("init")
 }
 
 func (hc *HeaderClassifier) Name() string {
@@ -169,39 +329,93 @@ func (hc *HeaderClassifier) Pubs() []events.Topic {
 
 func (hc *HeaderClassifier) EventHandler(topic events.Topic, event interface{}) {
 	fc := event.(FlowCreatedEvent)
-	for class, rule := range hc.Rules {
-		if rule.Match(fc.Header) {
-			log.Debug().Str("header", fmt.Sprint(fc.Header)).Str("class", class).Msg("classification")
-			hc.Publish(events.CLASSIFICATION, EventClassification{
-				Header: fc.Header,
-				Class:  class,
-			})
-		}
+	matched := false
+	hc.matcher.Match(fc.Header, func(rule Rule) bool {
+		matched = true
+		log.Debug().Str("header", fmt.Sprint(fc.Header)).Str("class", rule.Class).Msg("classification")
+		hc.Publish(events.CLASSIFICATION, EventClassification{
+			Header: fc.Header,
+			Class:  rule.Class,
+			Source: hc.Name(),
+		})
+		return !hc.FirstMatch
+	})
+
+	if !matched && hc.DefaultClass != "" {
+		hc.Publish(events.CLASSIFICATION, EventClassification{
+			Header:   fc.Header,
+			Class:    hc.DefaultClass,
+			Source:   hc.Name(),
+			Fallback: true,
+		})
 	}
 }
 
+// EventClassification associates a class to a flow. Source is
+// the name of the classifier, Fallback marks default classes
+// assigned to flows that matched no rule and Confidence is set
+// by classifiers that estimate one. AppProtocol is set by payload
+// classification; events with no Class only label the protocol.
+// AtExpiry marks classifications made as the flow expired, which
+// no longer has telemetry to attach.
 type EventClassification struct {
-	Header common.FiveTuple
-	Class  string
+	Header      common.FiveTuple
+	Class       string
+	Source      string
+	Fallback    bool    `json:",omitempty"`
+	Confidence  float64 `json:",omitempty"`
+	AppProtocol string  `json:",omitempty"`
+	AtExpiry    bool    `json:",omitempty"`
 }
 
-type SNIClassifier struct {
-	BasePublisher
-	rules map[string]*regexp.Regexp
+// NameRule classifies flows whose SNI or DNS name matches Pattern
+type NameRule struct {
+	Class    string
+	Priority int
+	Pattern  *regexp.Regexp
 }
 
-func NewSNIClassifier(rules map[string]string) Processor {
-	compiledRules := make(map[string]*regexp.Regexp)
+// CompileNameRules compiles class -> regexp rules into rules sorted by
+// increasing priority (default 0, ties broken by class name)
+func CompileNameRules(rules map[string]string, priorities map[string]int) ([]NameRule, error) {
+	var compiled []NameRule
 	for class, reg := range rules {
 		re, err := regexp.Compile(reg)
 		if err != nil {
-			log.Fatal().Str("regexp", reg).Err(err).Msg("regexp not compiling")
+			return nil, fmt.Errorf("class %s: %w", class, err)
 		}
-		compiledRules[class] = re
+		compiled = append(compiled, NameRule{Class: class, Priority: priorities[class], Pattern: re})
+	}
+	sort.Slice(compiled, func(i, j int) bool {
+		if compiled[i].Priority != compiled[j].Priority {
+			return compiled[i].Priority < compiled[j].Priority
+		}
+		return compiled[i].Class < compiled[j].Class
+	})
+	return compiled, nil
+}
+
+// SNIClassifier matches SNIs against rules in order. With FirstMatch
+// only the first matching rule publishes a class.
+type SNIClassifier struct {
+	BasePublisher
+	rules      []NameRule
+	FirstMatch bool
+}
+
+func NewSNIClassifier(rules map[string]string) *SNIClassifier {
+	compiledRules, err := CompileNameRules(rules, nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("regexp not compiling")
 	}
 	return &SNIClassifier{rules: compiledRules}
 }
 
+// SetRules replaces the rules, which must be sorted
+func (S *SNIClassifier) SetRules(rules []NameRule) {
+	S.rules = rules
+}
+
 func (S *SNIClassifier) Name() string {
 	return "sni_classifier"
 }
@@ -216,9 +430,99 @@ func (S *SNIClassifier) Pubs() []events.Topic {
 
 func (S *SNIClassifier) EventHandler(topic events.Topic, event interface{}) {
 	sni := event.(SNIRecord)
-	for class, re := range S.rules {
-		if re.MatchString(sni.SNI) {
-			S.Publish(events.CLASSIFICATION, EventClassification{Header: sni.Header, Class: class})
+	for _, rule := range S.rules {
+		if rule.Pattern.MatchString(sni.SNI) {
+			S.Publish(events.CLASSIFICATION, EventClassification{Header: sni.Header, Class: rule.Class, Source: S.Name()})
+			if S.FirstMatch {
+				return
+			}
+		}
+	}
+}
+
+// DNSClassifier classifies flows by the names their server IP was
+// resolved from in previously seen DNS answers (following CNAMEs).
+// Rules are matched in order; with FirstMatch only the first matching
+// rule publishes a class.
+type DNSClassifier struct {
+	BasePublisher
+	rules      []NameRule
+	FirstMatch bool
+	ipNames    map[string][]string
+	cnames     map[string]string
+	maxEntries int
+}
+
+func NewDNSClassifier(rules map[string]string, maxEntries int) *DNSClassifier {
+	if maxEntries == 0 {
+		maxEntries = 100000
+	}
+	compiledRules, err := CompileNameRules(rules, nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("regexp not compiling")
+	}
+	return &DNSClassifier{
+		rules:      compiledRules,
+		ipNames:    make(map[string][]string),
+		cnames:     make(map[string]string),
+		maxEntries: maxEntries,
+	}
+}
+
+// SetRules replaces the rules, which must be sorted
+func (dc *DNSClassifier) SetRules(rules []NameRule) {
+	dc.rules = rules
+}
+
+func (dc *DNSClassifier) Name() string {
+	return "dns_classifier"
+}
+
+func (dc *DNSClassifier) Subs() []events.Topic {
+	return []events.Topic{events.PROTOCOL_DNS, events.FLOW_CREATED}
+}
+
+func (dc *DNSClassifier) Pubs() []events.Topic {
+	return []events.Topic{events.CLASSIFICATION}
+}
+
+func (dc *DNSClassifier) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PROTOCOL_DNS:
+		dr := event.(DNSRecord)
+		if len(dc.ipNames) >= dc.maxEntries || len(dc.cnames) >= dc.maxEntries {
+			log.Debug().Str("proc", dc.Name()).Int("entries", len(dc.ipNames)).Msg("resetting dns cache")
+			dc.ipNames = make(map[string][]string)
+			dc.cnames = make(map[string]string)
+		}
+		if dr.DNSType == "CNAME" {
+			dc.cnames[dr.CName] = dr.Name
+			return
+		}
+		if dr.ServerIP == "" {
+			return
+		}
+		var names []string
+		for name, hops := dr.Name, 0; name != "" && hops < 16; name, hops = dc.cnames[name], hops+1 {
+			names = append(names, name)
+		}
+		dc.ipNames[dr.ServerIP] = names
+	case events.FLOW_CREATED:
+		fc := event.(FlowCreatedEvent)
+		names, exists := dc.ipNames[fc.Header.SrcIP]
+		if !exists {
+			return
+		}
+		for _, rule := range dc.rules {
+			for _, name := range names {
+				if rule.Pattern.MatchString(name) {
+					dc.Publish(events.CLASSIFICATION, EventClassification{Header: fc.Header, Class: rule.Class, Source: dc.Name()})
+					if dc.FirstMatch {
+						return
+					}
+					break
+				}
+			}
 		}
 	}
 }
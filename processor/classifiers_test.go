@@ -0,0 +1,77 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func collectClasses(p interface{ SetPubFunc(events.PubFunc) }) *[]string {
+	var classes []string
+	p.SetPubFunc(func(topic events.Topic, event interface{}) {
+		classes = append(classes, event.(EventClassification).Class)
+	})
+	return &classes
+}
+
+func TestSNIClassifierOrder(t *testing.T) {
+	rules, err := CompileNameRules(map[string]string{
+		"video":   `\.nflxvideo\.net$`,
+		"netflix": `netflix|nflx`,
+		"cdn":     `^occ-`,
+	}, map[string]int{"video": -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := SNIRecord{SNI: "occ-0-1.1.nflxvideo.net", Header: common.FiveTuple{SrcIP: "1.2.3.4"}}
+
+	sc := NewSNIClassifier(nil)
+	sc.SetRules(rules)
+	got := collectClasses(sc)
+	sc.EventHandler(events.PROTOCOL_SNI, record)
+	if want := []string{"video", "cdn", "netflix"}; !reflect.DeepEqual(*got, want) {
+		t.Errorf("all matches = %v, want %v", *got, want)
+	}
+
+	sc.FirstMatch = true
+	*got = nil
+	sc.EventHandler(events.PROTOCOL_SNI, record)
+	if want := []string{"video"}; !reflect.DeepEqual(*got, want) {
+		t.Errorf("first match = %v, want %v", *got, want)
+	}
+}
+
+func TestDNSClassifierOrder(t *testing.T) {
+	dc := NewDNSClassifier(map[string]string{
+		"b_cdn":   `akamai`,
+		"a_video": `video\.example\.com$`,
+	}, 0)
+	dc.FirstMatch = true
+	got := collectClasses(dc)
+	dc.EventHandler(events.PROTOCOL_DNS, DNSRecord{DNSType: "CNAME", Name: "video.example.com", CName: "e1.akamai.net"})
+	dc.EventHandler(events.PROTOCOL_DNS, DNSRecord{DNSType: "A", Name: "e1.akamai.net", ServerIP: "5.6.7.8"})
+	dc.EventHandler(events.FLOW_CREATED, FlowCreatedEvent{Header: common.FiveTuple{SrcIP: "5.6.7.8"}})
+	dc.EventHandler(events.FLOW_CREATED, FlowCreatedEvent{Header: common.FiveTuple{SrcIP: "9.9.9.9"}})
+	if want := []string{"a_video"}; !reflect.DeepEqual(*got, want) {
+		t.Errorf("classes = %v, want %v", *got, want)
+	}
+}
+
+func TestFinalClassifierBest(t *testing.T) {
+	fc := NewFinalClassifier([]string{"header_classifier", "sni_classifier"}, "")
+	trail := []ClassificationStep{
+		{Source: "header_classifier", Class: "other", Fallback: true},
+		{Source: "payload_classifier", AppProtocol: "tls"},
+		{Source: "dns_classifier", Class: "dns_class"},
+		{Source: "sni_classifier", Class: "netflix"},
+	}
+	best, ok := fc.Best(trail)
+	if !ok || best.Class != "netflix" {
+		t.Errorf("Best = %+v, %v, want netflix", best, ok)
+	}
+	if _, ok := fc.Best(trail[1:2]); ok {
+		t.Error("step without class picked")
+	}
+}
@@ -0,0 +1,265 @@
+package processor
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// GaugeConfig defines a per class gauge aggregating the last Window
+// values of a numeric (or numeric list) field of a topic's events, e.g.
+// the median of telemetry.tcp.rtt's rttms. Field is a column name as in
+// EventColumns. Agg is mean, median, min, max, sum, count or pN for the
+// Nth percentile.
+type GaugeConfig struct {
+	Name   string `mapstructure:"name"`
+	Help   string `mapstructure:"help"`
+	Topic  string `mapstructure:"topic"`
+	Field  string `mapstructure:"field"`
+	Agg    string `mapstructure:"agg"`
+	Window int    `mapstructure:"window"`
+}
+
+// ClassMetrics exposes the number of classifications per class and
+// the configured per class gauges. Events are attributed to the classes
+// of the flow in their Header field.
+type ClassMetrics struct {
+	BaseSubscriber
+	gauges  []GaugeConfig
+	flows   map[common.FiveTuple][]string
+	columns map[columnKey]*Column
+
+	mu      sync.Mutex
+	counts  map[[2]string]uint64
+	windows []map[string]*window
+}
+
+type columnKey struct {
+	gauge int
+	typ   reflect.Type
+}
+
+type window struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func (w *window) add(v float64) {
+	w.values[w.next] = v
+	w.next++
+	if w.next == len(w.values) {
+		w.next, w.full = 0, true
+	}
+}
+
+func (w *window) snapshot() []float64 {
+	if w.full {
+		return append([]float64(nil), w.values...)
+	}
+	return append([]float64(nil), w.values[:w.next]...)
+}
+
+func NewClassMetrics(gauges []GaugeConfig) *ClassMetrics {
+	cm := &ClassMetrics{
+		gauges:  gauges,
+		flows:   make(map[common.FiveTuple][]string),
+		columns: make(map[columnKey]*Column),
+		counts:  make(map[[2]string]uint64),
+		windows: make([]map[string]*window, len(gauges)),
+	}
+	for i := range cm.gauges {
+		g := &cm.gauges[i]
+		if g.Name == "" || g.Topic == "" || g.Field == "" {
+			log.Fatal().Interface("gauge", g).Msg("gauge needs a name, topic and field")
+		}
+		if _, ok := aggregate(g.Agg, []float64{0}); !ok {
+			log.Fatal().Str("gauge", g.Name).Str("agg", g.Agg).Msg("unknown aggregation")
+		}
+		if g.Window == 0 {
+			g.Window = 1000
+		}
+		if g.Help == "" {
+			g.Help = g.Agg + " of " + g.Topic + " " + g.Field + " per class"
+		}
+		cm.windows[i] = make(map[string]*window)
+	}
+	return cm
+}
+
+func (cm *ClassMetrics) Name() string {
+	return "class_metrics"
+}
+
+func (cm *ClassMetrics) Subs() []events.Topic {
+	subs := []events.Topic{events.CLASSIFICATION, events.FLOW_EXPIRED}
+	seen := map[events.Topic]bool{events.CLASSIFICATION: true, events.FLOW_EXPIRED: true}
+	for _, g := range cm.gauges {
+		// the handler serves all gauges of a topic
+		if topic := events.Topic(g.Topic); !seen[topic] {
+			seen[topic] = true
+			subs = append(subs, topic)
+		}
+	}
+	return subs
+}
+
+func (cm *ClassMetrics) EventHandler(topic events.Topic, event interface{}) {
+	if topic == events.CLASSIFICATION && event.(EventClassification).Class != "" {
+		clf := event.(EventClassification)
+		cm.flows[clf.Header] = append(cm.flows[clf.Header], clf.Class)
+		cm.mu.Lock()
+		cm.counts[[2]string{clf.Class, clf.Source}]++
+		cm.mu.Unlock()
+	}
+	for i, g := range cm.gauges {
+		if events.Topic(g.Topic) == topic {
+			cm.observe(i, event)
+		}
+	}
+	if topic == events.FLOW_EXPIRED {
+		delete(cm.flows, event.(FlowExpiredEvent).Header)
+	}
+}
+
+func (cm *ClassMetrics) observe(gauge int, event interface{}) {
+	v, header, ok := eventFlow(event)
+	if !ok {
+		return
+	}
+
+	key := columnKey{gauge, v.Type()}
+	col, exists := cm.columns[key]
+	if !exists {
+		for _, c := range EventColumns(v.Type()) {
+			if c.Name == cm.gauges[gauge].Field && (c.Kind == ColInt || c.Kind == ColFloat) {
+				c := c
+				col = &c
+			}
+		}
+		if col == nil {
+			log.Warn().Str("gauge", cm.gauges[gauge].Name).Str("type", v.Type().String()).
+				Msg("gauge field not found or not numeric")
+		}
+		cm.columns[key] = col
+	}
+	if col == nil {
+		return
+	}
+
+	var values []float64
+	switch val := col.Value(v).(type) {
+	case int64:
+		values = []float64{float64(val)}
+	case float64:
+		values = []float64{val}
+	case []int64:
+		for _, x := range val {
+			values = append(values, float64(x))
+		}
+	case []float64:
+		values = val
+	}
+
+	classes := cm.flows[header]
+	if len(classes) == 0 {
+		classes = []string{"unclassified"}
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, class := range classes {
+		w, exists := cm.windows[gauge][class]
+		if !exists {
+			w = &window{values: make([]float64, cm.gauges[gauge].Window)}
+			cm.windows[gauge][class] = w
+		}
+		for _, x := range values {
+			w.add(x)
+		}
+	}
+}
+
+func (cm *ClassMetrics) Collect(mw *MetricsWriter) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	keys := make([][2]string, 0, len(cm.counts))
+	for k := range cm.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	for _, k := range keys {
+		mw.Counter("edrint_classifications_total", "Flow classifications per class and classifier",
+			float64(cm.counts[k]), "class", k[0], "source", k[1])
+	}
+
+	for i, g := range cm.gauges {
+		classes := make([]string, 0, len(cm.windows[i]))
+		for class := range cm.windows[i] {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			value, ok := aggregate(g.Agg, cm.windows[i][class].snapshot())
+			if ok {
+				mw.Gauge(g.Name, g.Help, value, "class", class)
+			}
+		}
+	}
+}
+
+// aggregate reports false for unknown aggregations or no values
+func aggregate(agg string, values []float64) (float64, bool) {
+	if len(values) == 0 {
+		return 0, false
+	}
+	switch agg {
+	case "count":
+		return float64(len(values)), true
+	case "sum", "mean":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		if agg == "mean" {
+			return sum / float64(len(values)), true
+		}
+		return sum, true
+	case "min", "max":
+		m := values[0]
+		for _, v := range values {
+			if (agg == "min" && v < m) || (agg == "max" && v > m) {
+				m = v
+			}
+		}
+		return m, true
+	case "median":
+		return percentile(values, 50), true
+	}
+	if strings.HasPrefix(agg, "p") {
+		p, err := strconv.ParseFloat(agg[1:], 64)
+		if err == nil && p >= 0 && p <= 100 {
+			return percentile(values, p), true
+		}
+	}
+	return 0, false
+}
+
+// percentile of values by nearest rank, values are sorted in place
+func percentile(values []float64, p float64) float64 {
+	sort.Float64s(values)
+	rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
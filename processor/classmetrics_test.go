@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+func TestAggregate(t *testing.T) {
+	values := []float64{4, 1, 3, 2, 10}
+	tests := []struct {
+		agg  string
+		want float64
+		ok   bool
+	}{
+		{"count", 5, true},
+		{"sum", 20, true},
+		{"mean", 4, true},
+		{"min", 1, true},
+		{"max", 10, true},
+		{"median", 3, true},
+		{"p0", 1, true},
+		{"p20", 1, true},
+		{"p21", 2, true},
+		{"p90", 10, true},
+		{"p100", 10, true},
+		{"p99.9", 10, true},
+		{"p101", 0, false},
+		{"p-1", 0, false},
+		{"pNaN", 0, false},
+		{"p", 0, false},
+		{"avg", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		// percentiles sort in place
+		v := append([]float64(nil), values...)
+		got, ok := aggregate(tt.agg, v)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("aggregate(%q) = %v, %v, want %v, %v", tt.agg, got, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := aggregate("count", nil); ok {
+		t.Error("aggregate of no values succeeded")
+	}
+	if got := percentile([]float64{7}, 0); got != 7 {
+		t.Errorf("p0 of one value = %v, want 7", got)
+	}
+}
+
+type testRTTEvent struct {
+	Header common.FiveTuple
+	RTTMS  []float64
+	Label  string
+}
+
+func TestClassMetrics(t *testing.T) {
+	video := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	other := common.FiveTuple{SrcIP: "5.6.7.8", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50001, Protocol: 6}
+	cm := NewClassMetrics([]GaugeConfig{
+		{Name: "edrint_rtt_ms", Topic: "telemetry.test", Field: "rttms", Agg: "max", Window: 3},
+		{Name: "edrint_rtt_count", Topic: "telemetry.test", Field: "rttms", Agg: "count", Window: 100},
+		// not numeric
+		{Name: "edrint_label", Topic: "telemetry.test", Field: "label", Agg: "max"},
+	})
+	if subs := cm.Subs(); len(subs) != 3 || subs[2] != "telemetry.test" {
+		t.Errorf("subs = %v, want classification, flow.expired and telemetry.test", subs)
+	}
+	cm.EventHandler(events.CLASSIFICATION, EventClassification{Header: video, Class: "netflix", Source: "sni_classifier"})
+	cm.EventHandler(events.CLASSIFICATION, EventClassification{Header: video, Class: "all_https", Source: "header_classifier"})
+	cm.EventHandler(events.CLASSIFICATION, EventClassification{Header: other, Class: "all_https", Source: "header_classifier"})
+	// no class, not counted
+	cm.EventHandler(events.CLASSIFICATION, EventClassification{Header: other, Source: "dns_classifier"})
+
+	// the window of 3 keeps 30, 5 and 20
+	cm.EventHandler("telemetry.test", testRTTEvent{Header: video, RTTMS: []float64{100, 30}})
+	cm.EventHandler("telemetry.test", telemetry.SampledEvent{
+		Event: &testRTTEvent{Header: video, RTTMS: []float64{5, 20}}, SampleRates: telemetry.SampleRates{Flow: 4, Packet: 1}})
+	cm.EventHandler("telemetry.test", testRTTEvent{Header: other, RTTMS: []float64{50}})
+	// flows are forgotten at expiry, their later events are unclassified
+	cm.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: other})
+	cm.EventHandler("telemetry.test", testRTTEvent{Header: other, RTTMS: []float64{7}})
+	// events without a flow are ignored
+	cm.EventHandler("telemetry.test", struct{ RTTMS []float64 }{[]float64{1000}})
+
+	var b bytes.Buffer
+	cm.Collect(NewMetricsWriter(&b))
+	want := []string{
+		`edrint_classifications_total{class="all_https",source="header_classifier"} 2`,
+		`edrint_classifications_total{class="netflix",source="sni_classifier"} 1`,
+		`edrint_rtt_ms{class="all_https"} 50`,
+		`edrint_rtt_ms{class="netflix"} 30`,
+		`edrint_rtt_ms{class="unclassified"} 7`,
+		`edrint_rtt_count{class="all_https"} 5`,
+		`edrint_rtt_count{class="netflix"} 4`,
+		`edrint_rtt_count{class="unclassified"} 1`,
+	}
+	var got []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			got = append(got, line)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
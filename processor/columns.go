@@ -0,0 +1,284 @@
+package processor
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+type ColumnKind int
+
+const (
+	ColString ColumnKind = iota
+	ColInt
+	ColFloat
+	ColBool
+	ColTime
+	// ColJSON holds values without a column type (maps, slices of structs,
+	// interfaces, json.Marshalers) as JSON text
+	ColJSON
+)
+
+// Column is a column of an event table. Nested struct fields are
+// flattened into their own columns and slices of basic types are list
+// columns.
+type Column struct {
+	Name  string
+	Kind  ColumnKind
+	List  bool
+	index []int
+	// field is the Go name of the column's field
+	field string
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// EventColumns returns the columns of an event type. Columns are named
+// by the field's json tag or its snake_cased name, prefixed with the
+// names of enclosing structs (e.g. Header.SrcIP => header_src_ip).
+// Embedded structs are flattened without a prefix.
+func EventColumns(t reflect.Type) []Column {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType || t.Implements(marshalerType) {
+		return []Column{newColumn("value", t, nil)}
+	}
+	return structColumns(t, "", nil)
+}
+
+func structColumns(t reflect.Type, prefix string, index []int) []Column {
+	var columns []Column
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name, tagged := jsonName(f)
+		if name == "-" {
+			continue
+		}
+		fIndex := append(append([]int(nil), index...), i)
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		isStruct := ft.Kind() == reflect.Struct && ft != timeType && !ft.Implements(marshalerType)
+		switch {
+		case isStruct && f.Anonymous && !tagged:
+			columns = append(columns, structColumns(ft, prefix, fIndex)...)
+		case isStruct:
+			columns = append(columns, structColumns(ft, prefix+name+"_", fIndex)...)
+		case f.PkgPath == "":
+			c := newColumn(prefix+name, ft, fIndex)
+			c.field = f.Name
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+func jsonName(f reflect.StructField) (string, bool) {
+	if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+		return tag, true
+	}
+	return snakeCase(f.Name), false
+}
+
+// snakeCase converts a Go name: DownBytes => down_bytes, SrcIP => src_ip
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func newColumn(name string, t reflect.Type, index []int) Column {
+	c := Column{Name: name, Kind: ColJSON, index: index}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 && !t.Implements(marshalerType) {
+		if kind, ok := basicKind(t.Elem()); ok {
+			c.Kind, c.List = kind, true
+		}
+		return c
+	}
+	if kind, ok := basicKind(t); ok {
+		c.Kind = kind
+	}
+	return c
+}
+
+func basicKind(t reflect.Type) (ColumnKind, bool) {
+	if t == timeType {
+		return ColTime, true
+	}
+	if t.Implements(marshalerType) {
+		return ColJSON, false
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return ColString, true
+	case reflect.Bool:
+		return ColBool, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return ColInt, true
+	case reflect.Float32, reflect.Float64:
+		return ColFloat, true
+	}
+	return ColJSON, false
+}
+
+// Value returns the column of event v as a string, int64, float64, bool,
+// time.Time or a slice of one of those for list columns. Fields behind
+// nil pointers are zero.
+func (c Column) Value(v reflect.Value) interface{} {
+	for _, i := range c.index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v = reflect.Zero(v.Type().Elem())
+				break
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	if c.Kind == ColJSON {
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v = reflect.Zero(v.Type().Elem())
+			break
+		}
+		v = v.Elem()
+	}
+	if !c.List {
+		return basicValue(c.Kind, v)
+	}
+	switch c.Kind {
+	case ColString:
+		l := make([]string, v.Len())
+		for i := range l {
+			l[i] = v.Index(i).String()
+		}
+		return l
+	case ColInt:
+		l := make([]int64, v.Len())
+		for i := range l {
+			l[i] = basicValue(c.Kind, v.Index(i)).(int64)
+		}
+		return l
+	case ColFloat:
+		l := make([]float64, v.Len())
+		for i := range l {
+			l[i] = v.Index(i).Float()
+		}
+		return l
+	case ColBool:
+		l := make([]bool, v.Len())
+		for i := range l {
+			l[i] = v.Index(i).Bool()
+		}
+		return l
+	case ColTime:
+		l := make([]time.Time, v.Len())
+		for i := range l {
+			l[i] = v.Index(i).Interface().(time.Time)
+		}
+		return l
+	}
+	return nil
+}
+
+func basicValue(kind ColumnKind, v reflect.Value) interface{} {
+	switch kind {
+	case ColString:
+		return v.String()
+	case ColBool:
+		return v.Bool()
+	case ColFloat:
+		return v.Float()
+	case ColTime:
+		return v.Interface().(time.Time)
+	case ColInt:
+		switch v.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return int64(v.Uint())
+		}
+		return v.Int()
+	}
+	return nil
+}
+
+// eventFlow unwraps a (sampled) event to its struct value and returns
+// the flow of its Header field, ok is false for events without one
+func eventFlow(event interface{}) (reflect.Value, common.FiveTuple, bool) {
+	event, _ = telemetry.Unsampled(event)
+	v := reflect.ValueOf(event)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return v, common.FiveTuple{}, false
+	}
+	hv := v.FieldByName("Header")
+	if !hv.IsValid() || !hv.CanInterface() {
+		return v, common.FiveTuple{}, false
+	}
+	header, ok := hv.Interface().(common.FiveTuple)
+	return v, header, ok
+}
+
+// numericField returns the values of the numeric or numeric slice
+// field name of struct v, nil if there is no such field
+func numericField(v reflect.Value, name string) []float64 {
+	f := v.FieldByName(name)
+	if !f.IsValid() {
+		return nil
+	}
+	number := func(x reflect.Value) (float64, bool) {
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(x.Int()), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(x.Uint()), true
+		case reflect.Float32, reflect.Float64:
+			return x.Float(), true
+		}
+		return 0, false
+	}
+	if f.Kind() == reflect.Slice {
+		values := make([]float64, 0, f.Len())
+		for i := 0; i < f.Len(); i++ {
+			if x, ok := number(f.Index(i)); ok {
+				values = append(values, x)
+			}
+		}
+		return values
+	}
+	if x, ok := number(f); ok {
+		return []float64{x}
+	}
+	return nil
+}
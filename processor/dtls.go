@@ -0,0 +1,358 @@
+package processor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+const (
+	dtlsRecordHeaderLen    = 13
+	dtlsHandshakeHeaderLen = 12
+
+	dtlsContentHandshake = 22
+	dtlsHandshakeClient  = 1
+
+	tlsExtServerName        = 0
+	tlsExtUseSRTP           = 14
+	tlsExtSupportedVersions = 43
+)
+
+var dtlsVersions = map[uint16]string{
+	0xfeff: "DTLS1.0",
+	0xfefd: "DTLS1.2",
+	0xfefc: "DTLS1.3",
+}
+
+var srtpProfiles = map[uint16]string{
+	0x0001: "SRTP_AES128_CM_HMAC_SHA1_80",
+	0x0002: "SRTP_AES128_CM_HMAC_SHA1_32",
+	0x0005: "SRTP_NULL_HMAC_SHA1_80",
+	0x0006: "SRTP_NULL_HMAC_SHA1_32",
+	0x0007: "SRTP_AEAD_AES_128_GCM",
+	0x0008: "SRTP_AEAD_AES_256_GCM",
+}
+
+// DTLSRecord describes the ClientHello of a DTLS flow and
+// how long it took both sides to switch to encrypted records
+type DTLSRecord struct {
+	Timestamp         time.Time
+	Header            common.FiveTuple
+	Version           string
+	SNI               string
+	CipherSuites      []uint16
+	SRTPProfiles      []string
+	HandshakeComplete bool
+	HandshakeMS       float64
+}
+
+type dtlsHandshake struct {
+	record          DTLSRecord
+	clientOutbound  bool
+	clientEncrypted bool
+	serverEncrypted bool
+}
+
+type DTLSParser struct {
+	BasePublisher
+	flows map[common.FiveTuple]*dtlsHandshake
+}
+
+func NewDTLSParser() *DTLSParser {
+	return &DTLSParser{flows: make(map[common.FiveTuple]*dtlsHandshake)}
+}
+
+func (dp *DTLSParser) Name() string {
+	return "dtls"
+}
+
+func (dp *DTLSParser) Subs() []events.Topic {
+	return []events.Topic{events.PACKET, events.FLOW_EXPIRED}
+}
+
+func (dp *DTLSParser) Pubs() []events.Topic {
+	return []events.Topic{events.PROTOCOL_DTLS, events.PROTOCOL_SNI}
+}
+
+func (dp *DTLSParser) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		dp.OnPacket(event.(common.Packet))
+	case events.FLOW_EXPIRED:
+		fe := event.(FlowExpiredEvent)
+		if hs, exists := dp.flows[fe.Header]; exists {
+			dp.Publish(events.PROTOCOL_DTLS, hs.record)
+			delete(dp.flows, fe.Header)
+		}
+	}
+}
+
+func (dp *DTLSParser) OnPacket(p common.Packet) {
+	// Packet Filter
+	if p.Header.Protocol != 17 || len(p.Payload) < dtlsRecordHeaderLen {
+		return
+	}
+
+	records, ok := SplitDTLSRecords(p.Payload)
+	if !ok {
+		return
+	}
+
+	key := p.GetKey()
+	for _, r := range records {
+		hs, exists := dp.flows[key]
+		if r.Encrypted {
+			if !exists {
+				continue
+			}
+			if p.IsOutbound == hs.clientOutbound {
+				hs.clientEncrypted = true
+			} else {
+				hs.serverEncrypted = true
+			}
+			if hs.clientEncrypted && hs.serverEncrypted {
+				hs.record.HandshakeComplete = true
+				hs.record.HandshakeMS = msSince(hs.record.Timestamp, p.Timestamp)
+				dp.Publish(events.PROTOCOL_DTLS, hs.record)
+				delete(dp.flows, key)
+				return
+			}
+			continue
+		}
+
+		if r.ContentType != dtlsContentHandshake {
+			continue
+		}
+		ch, ok := ParseDTLSClientHello(r.Fragment)
+		if !ok {
+			continue
+		}
+
+		if !exists {
+			// First ClientHello -- the one following a HelloVerifyRequest
+			// carries a cookie but should keep the original start time
+			hs = &dtlsHandshake{clientOutbound: p.IsOutbound}
+			hs.record.Timestamp = p.Timestamp
+			hs.record.Header = key
+			dp.flows[key] = hs
+			if ch.SNI != "" {
+				dp.Publish(events.PROTOCOL_SNI, SNIRecord{
+					Timestamp: p.Timestamp,
+					SNI:       ch.SNI,
+					Header:    key,
+				})
+			}
+		}
+		hs.record.Version = ch.Version
+		hs.record.SNI = ch.SNI
+		hs.record.CipherSuites = ch.CipherSuites
+		hs.record.SRTPProfiles = ch.SRTPProfiles
+		log.Debug().Str("header", key.String()).Str("version", ch.Version).Str("sni", ch.SNI).Msg("dtls client hello")
+	}
+}
+
+func (dp *DTLSParser) Teardown() {
+	for key, hs := range dp.flows {
+		dp.Publish(events.PROTOCOL_DTLS, hs.record)
+		delete(dp.flows, key)
+	}
+}
+
+type DTLSPlainRecord struct {
+	ContentType uint8
+	Version     uint16
+	Epoch       uint16
+	Encrypted   bool
+	Fragment    []byte
+}
+
+// SplitDTLSRecords returns the records of a DTLS datagram. Records using
+// the DTLS 1.3 unified header are returned as encrypted with no fragment.
+func SplitDTLSRecords(payload []byte) ([]DTLSPlainRecord, bool) {
+	var records []DTLSPlainRecord
+	index := 0
+	for index < len(payload) {
+		first := payload[index]
+		if first&0xe0 == 0x20 {
+			// DTLS 1.3 unified header: 001CSLEE
+			// the rest of the datagram is ciphertext
+			records = append(records, DTLSPlainRecord{Epoch: uint16(first & 0x03), Encrypted: true})
+			return records, true
+		}
+		if index+dtlsRecordHeaderLen > len(payload) {
+			return records, len(records) > 0
+		}
+		if first < 20 || first > 25 || payload[index+1] != 0xfe {
+			return records, len(records) > 0
+		}
+		length := int(binary.BigEndian.Uint16(payload[index+11 : index+13]))
+		end := index + dtlsRecordHeaderLen + length
+		if end > len(payload) {
+			return records, len(records) > 0
+		}
+		r := DTLSPlainRecord{
+			ContentType: first,
+			Version:     binary.BigEndian.Uint16(payload[index+1 : index+3]),
+			Epoch:       binary.BigEndian.Uint16(payload[index+3 : index+5]),
+			Fragment:    payload[index+dtlsRecordHeaderLen : end],
+		}
+		r.Encrypted = r.Epoch > 0
+		records = append(records, r)
+		index = end
+	}
+	return records, len(records) > 0
+}
+
+type DTLSClientHello struct {
+	Version      string
+	SNI          string
+	CipherSuites []uint16
+	SRTPProfiles []string
+}
+
+// ParseDTLSClientHello parses an unfragmented ClientHello handshake message
+func ParseDTLSClientHello(fragment []byte) (DTLSClientHello, bool) {
+	var ch DTLSClientHello
+	if len(fragment) < dtlsHandshakeHeaderLen || fragment[0] != dtlsHandshakeClient {
+		return ch, false
+	}
+	length := bytesToInt24(fragment[1:4])
+	fragOffset := bytesToInt24(fragment[6:9])
+	fragLength := bytesToInt24(fragment[9:12])
+	if fragOffset != 0 || fragLength != length || len(fragment) < dtlsHandshakeHeaderLen+length {
+		log.Debug().Int("length", length).Int("frag_offset", fragOffset).Msg("fragmented dtls client hello")
+		return ch, false
+	}
+	body := fragment[dtlsHandshakeHeaderLen : dtlsHandshakeHeaderLen+length]
+
+	// <Version> <Random>
+	if len(body) < 35 {
+		return ch, false
+	}
+	ch.Version = dtlsVersionString(binary.BigEndian.Uint16(body[0:2]))
+	index := 34
+
+	// <Session ID> <Cookie>
+	for i := 0; i < 2; i++ {
+		if index >= len(body) {
+			return ch, false
+		}
+		index += 1 + int(body[index])
+	}
+
+	// <Cipher Suites>
+	if index+2 > len(body) {
+		return ch, false
+	}
+	cipherSuiteLength := bytesToInt16(body[index : index+2])
+	index += 2
+	if index+cipherSuiteLength > len(body) {
+		return ch, false
+	}
+	for i := index; i+1 < index+cipherSuiteLength; i += 2 {
+		ch.CipherSuites = append(ch.CipherSuites, binary.BigEndian.Uint16(body[i:i+2]))
+	}
+	index += cipherSuiteLength
+
+	// <Compression Methods>
+	if index >= len(body) {
+		return ch, false
+	}
+	index += 1 + int(body[index])
+
+	// Extensions are optional
+	if index+2 > len(body) {
+		return ch, true
+	}
+	index += 2
+	for index+4 <= len(body) {
+		extType := bytesToInt16(body[index : index+2])
+		extLength := bytesToInt16(body[index+2 : index+4])
+		index += 4
+		if index+extLength > len(body) {
+			break
+		}
+		ext := body[index : index+extLength]
+		switch extType {
+		case tlsExtServerName:
+			ch.SNI = parseServerNameExt(ext)
+		case tlsExtUseSRTP:
+			ch.SRTPProfiles = parseUseSRTPExt(ext)
+		case tlsExtSupportedVersions:
+			if v := parseSupportedVersionsExt(ext); v != "" {
+				ch.Version = v
+			}
+		}
+		index += extLength
+	}
+	return ch, true
+}
+
+func parseServerNameExt(ext []byte) string {
+	// <List Length> <Name Type> <Name Length> <Name>
+	if len(ext) < 5 || ext[2] != 0 {
+		return ""
+	}
+	nameLength := bytesToInt16(ext[3:5])
+	if 5+nameLength > len(ext) {
+		return ""
+	}
+	return string(ext[5 : 5+nameLength])
+}
+
+func parseUseSRTPExt(ext []byte) []string {
+	if len(ext) < 2 {
+		return nil
+	}
+	profilesLength := bytesToInt16(ext[0:2])
+	if 2+profilesLength > len(ext) {
+		return nil
+	}
+	var profiles []string
+	for i := 2; i+1 < 2+profilesLength; i += 2 {
+		id := binary.BigEndian.Uint16(ext[i : i+2])
+		name, known := srtpProfiles[id]
+		if !known {
+			name = fmt.Sprintf("0x%04x", id)
+		}
+		profiles = append(profiles, name)
+	}
+	return profiles
+}
+
+func parseSupportedVersionsExt(ext []byte) string {
+	if len(ext) < 1 {
+		return ""
+	}
+	listLength := int(ext[0])
+	if 1+listLength > len(ext) {
+		return ""
+	}
+	// DTLS version numbers decrease as versions increase
+	var best uint16
+	for i := 1; i+1 < 1+listLength; i += 2 {
+		v := binary.BigEndian.Uint16(ext[i : i+2])
+		if _, known := dtlsVersions[v]; known && (best == 0 || v < best) {
+			best = v
+		}
+	}
+	if best == 0 {
+		return ""
+	}
+	return dtlsVersions[best]
+}
+
+func dtlsVersionString(v uint16) string {
+	if name, known := dtlsVersions[v]; known {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func bytesToInt24(byteSlice []byte) int {
+	return int(byteSlice[0])<<16 + int(byteSlice[1])<<8 + int(byteSlice[2])
+}
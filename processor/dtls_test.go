@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func appendUint24(b []byte, v int) []byte {
+	return append(b, byte(v>>16), byte(v>>8), byte(v))
+}
+
+// dtlsClientHello builds a DTLS 1.2 datagram holding a ClientHello
+// with the given SNI and SRTP profiles
+func dtlsClientHello(sni string, profiles ...uint16) []byte {
+	body := []byte{0xfe, 0xfd}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0, 0)                // session id, cookie
+	body = appendUint16(body, 4)
+	body = append(body, 0xc0, 0x2b, 0xc0, 0x2f)
+	body = append(body, 1, 0) // null compression
+
+	var exts []byte
+	if sni != "" {
+		exts = appendUint16(exts, tlsExtServerName)
+		exts = appendUint16(exts, len(sni)+5)
+		exts = appendUint16(exts, len(sni)+3)
+		exts = append(exts, 0)
+		exts = appendUint16(exts, len(sni))
+		exts = append(exts, sni...)
+	}
+	if len(profiles) > 0 {
+		exts = appendUint16(exts, tlsExtUseSRTP)
+		exts = appendUint16(exts, 2*len(profiles)+3)
+		exts = appendUint16(exts, 2*len(profiles))
+		for _, p := range profiles {
+			exts = appendUint16(exts, int(p))
+		}
+		exts = append(exts, 0) // mki
+	}
+	body = appendUint16(body, len(exts))
+	body = append(body, exts...)
+
+	hs := []byte{dtlsHandshakeClient}
+	hs = appendUint24(hs, len(body))
+	hs = append(hs, 0, 0) // message seq
+	hs = appendUint24(hs, 0)
+	hs = appendUint24(hs, len(body))
+	hs = append(hs, body...)
+
+	return dtlsRecord(dtlsContentHandshake, 0, hs)
+}
+
+func dtlsRecord(contentType uint8, epoch uint16, fragment []byte) []byte {
+	r := []byte{contentType, 0xfe, 0xfd}
+	r = appendUint16(r, int(epoch))
+	r = append(r, make([]byte, 6)...) // sequence number
+	r = appendUint16(r, len(fragment))
+	return append(r, fragment...)
+}
+
+func TestParseDTLSClientHello(t *testing.T) {
+	records, ok := SplitDTLSRecords(dtlsClientHello("meet.example.com", 0x0001, 0x0007, 0x1234))
+	if !ok || len(records) != 1 {
+		t.Fatalf("SplitDTLSRecords = %+v, %v", records, ok)
+	}
+	ch, ok := ParseDTLSClientHello(records[0].Fragment)
+	if !ok {
+		t.Fatal("ClientHello not parsed")
+	}
+	want := DTLSClientHello{
+		Version:      "DTLS1.2",
+		SNI:          "meet.example.com",
+		CipherSuites: []uint16{0xc02b, 0xc02f},
+		SRTPProfiles: []string{"SRTP_AES128_CM_HMAC_SHA1_80", "SRTP_AEAD_AES_128_GCM", "0x1234"},
+	}
+	if !reflect.DeepEqual(ch, want) {
+		t.Errorf("ClientHello = %+v, want %+v", ch, want)
+	}
+
+	fragmented := append([]byte(nil), records[0].Fragment...)
+	binary.BigEndian.PutUint16(fragmented[10:12], 10) // fragment length
+	if _, ok := ParseDTLSClientHello(fragmented); ok {
+		t.Error("fragmented ClientHello parsed")
+	}
+	for n := 0; n < len(records[0].Fragment)-30; n++ {
+		ParseDTLSClientHello(records[0].Fragment[:n])
+	}
+}
+
+func TestSplitDTLSRecords(t *testing.T) {
+	datagram := append(dtlsRecord(dtlsContentHandshake, 0, []byte{1, 2}), dtlsRecord(23, 1, []byte{3})...)
+	records, ok := SplitDTLSRecords(datagram)
+	if !ok || len(records) != 2 || records[0].Encrypted || !records[1].Encrypted || records[1].Epoch != 1 {
+		t.Errorf("records = %+v, %v", records, ok)
+	}
+	records, ok = SplitDTLSRecords([]byte{0x2c, 1, 2, 3})
+	if !ok || len(records) != 1 || !records[0].Encrypted {
+		t.Errorf("unified header records = %+v, %v", records, ok)
+	}
+	if _, ok := SplitDTLSRecords([]byte("not a dtls datagram")); ok {
+		t.Error("non dtls payload split")
+	}
+}
+
+func TestDTLSParserHandshake(t *testing.T) {
+	dp := NewDTLSParser()
+	var got []interface{}
+	dp.SetPubFunc(func(topic events.Topic, event interface{}) {
+		got = append(got, event)
+	})
+	start := time.Unix(1600000000, 0)
+	client := common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "1.2.3.4", SrcPort: 50000, DstPort: 3478, Protocol: 17}
+	server := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 3478, DstPort: 50000, Protocol: 17}
+	packets := []common.Packet{
+		{Timestamp: start, Header: client, IsOutbound: true, Payload: dtlsClientHello("meet.example.com", 1)},
+		{Timestamp: start.Add(10 * time.Millisecond), Header: server, Payload: dtlsRecord(23, 1, []byte{0})},
+		{Timestamp: start.Add(25 * time.Millisecond), Header: client, IsOutbound: true, Payload: dtlsRecord(23, 1, []byte{0})},
+	}
+	for _, p := range packets {
+		dp.OnPacket(p)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want sni and dtls: %+v", len(got), got)
+	}
+	if sni := got[0].(SNIRecord); sni.SNI != "meet.example.com" || sni.Header != server {
+		t.Errorf("sni = %+v", sni)
+	}
+	record := got[1].(DTLSRecord)
+	if !record.HandshakeComplete || record.HandshakeMS != 25 || record.Header != server ||
+		!reflect.DeepEqual(record.SRTPProfiles, []string{"SRTP_AES128_CM_HMAC_SHA1_80"}) {
+		t.Errorf("record = %+v", record)
+	}
+	if len(dp.flows) != 0 {
+		t.Errorf("%d flows left", len(dp.flows))
+	}
+}
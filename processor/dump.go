@@ -1,32 +1,30 @@
 package processor
 
 import (
-	"bufio"
 	"encoding/json"
-	"os"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sharat910/edrint/events"
 )
 
+// Dumper writes events as newline delimited JSON. Events are buffered
+// by the writer while its file fails and written to a new file once it
+// can be opened (see RotatingWriter), without blocking the event path.
 type Dumper struct {
 	BaseSubscriber
-	console bool
-	file    *os.File
-	writer  *bufio.Writer
-	topics  []events.Topic
+	console  bool
+	writer   *RotatingWriter
+	topics   []events.Topic
+	anon     *Anonymizer
+	nDropped uint64
+	failing  bool
 }
 
 func (d *Dumper) Teardown() {
-	err := d.writer.Flush()
-	if err != nil {
-		log.Fatal().Err(err).Msg("unable to flush dump file")
-	}
-	err = d.file.Close()
-	if err != nil {
-		log.Fatal().Err(err).Msg("unable to close json dump file")
+	if err := d.writer.Close(); err != nil {
+		log.Error().Err(err).Msg("unable to finalize dump file")
 	}
-	log.Info().Msg("dumper: flushed files")
+	log.Info().Uint64("dropped", d.nDropped+d.writer.Lost()).Msg("dumper: flushed files")
 }
 
 type DumpItem struct {
@@ -36,15 +34,27 @@ type DumpItem struct {
 }
 
 func NewDumper(path string, topics []events.Topic, toConsole bool) *Dumper {
+	return NewRotatingDumper(path, topics, toConsole, RotateConfig{})
+}
+
+func NewRotatingDumper(path string, topics []events.Topic, toConsole bool, rc RotateConfig) *Dumper {
 	var d Dumper
 	//d.file = createFile(viper.GetString("processors.dump.path"))
-	d.file = createFile(path)
-	d.writer = bufio.NewWriter(d.file)
+	writer, err := NewRotatingWriter(path, rc)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot create dump file")
+	}
+	d.writer = writer
 	d.topics = topics
 	d.console = toConsole
 	return &d
 }
 
+// SetAnonymizer anonymizes every event before it is written
+func (d *Dumper) SetAnonymizer(a *Anonymizer) {
+	d.anon = a
+}
+
 func (d *Dumper) Name() string {
 	return "dump"
 }
@@ -59,6 +69,15 @@ func (d *Dumper) Subs() []events.Topic {
 }
 
 func (d *Dumper) EventHandler(topic events.Topic, event interface{}) {
+	if d.anon != nil {
+		var err error
+		event, err = d.anon.Anonymize(event)
+		if err != nil {
+			log.Error().Err(err).Str("topic", string(topic)).Msg("unable to anonymize event: dropping event")
+			d.nDropped++
+			return
+		}
+	}
 	if d.console {
 		log.Info().Interface("event", event).Msg(string(topic))
 	}
@@ -68,15 +87,19 @@ func (d *Dumper) EventHandler(topic events.Topic, event interface{}) {
 		Event: event,
 	})
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to marshal json")
-	}
-	_, err = d.writer.Write(b)
-	if err != nil {
-		log.Fatal().Err(err).Msg("unable to write json")
+		log.Error().Err(err).Str("topic", string(topic)).Msg("unable to marshal json: dropping event")
+		d.nDropped++
+		return
 	}
+	b = append(b, '\n')
 
-	_, err = d.writer.WriteRune('\n')
-	if err != nil {
-		log.Fatal().Err(err).Msg("unable to write newline")
+	// losses are counted by the writer
+	if _, err := d.writer.Write(b); err != nil {
+		if !d.failing {
+			log.Error().Err(err).Str("topic", string(topic)).Msg("unable to write json: dropping events")
+		}
+		d.failing = true
+		return
 	}
+	d.failing = false
 }
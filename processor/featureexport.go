@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type labelledFeatures struct {
+	features *FlowFeatures
+	label    string
+}
+
+// FeatureExporter writes the MLClassifier features of every flow to a
+// CSV file when it expires, labelled with the first non-fallback class
+// it got from one of labelSources (any source if empty). Unlabelled
+// flows are written with an empty label only if keepUnlabelled is set.
+type FeatureExporter struct {
+	BaseSubscriber
+	packets        int
+	labelSources   map[string]struct{}
+	keepUnlabelled bool
+	file           *os.File
+	writer         *csv.Writer
+	flows          map[common.FiveTuple]*labelledFeatures
+	nWritten       int
+}
+
+func NewFeatureExporter(path string, packets int, labelSources []string, keepUnlabelled bool) *FeatureExporter {
+	if packets == 0 {
+		log.Warn().Msg("feature_exporter unable to read packets. Setting default: 10")
+		packets = 10
+	}
+	fe := &FeatureExporter{
+		packets:        packets,
+		labelSources:   make(map[string]struct{}),
+		keepUnlabelled: keepUnlabelled,
+		file:           createFile(path),
+		flows:          make(map[common.FiveTuple]*labelledFeatures),
+	}
+	for _, source := range labelSources {
+		fe.labelSources[source] = struct{}{}
+	}
+	fe.writer = csv.NewWriter(fe.file)
+	return fe
+}
+
+func (fe *FeatureExporter) Init() {
+	header := append([]string{"flow", "label"}, FeatureNames(fe.packets)...)
+	if err := fe.writer.Write(header); err != nil {
+		log.Fatal().Err(err).Msg("unable to write feature header")
+	}
+	log.Debug().Str("proc", fe.Name()).Int("packets", fe.packets).
+		Bool("keep_unlabelled", fe.keepUnlabelled).Msg("init")
+}
+
+func (fe *FeatureExporter) Name() string {
+	return "feature_exporter"
+}
+
+func (fe *FeatureExporter) Subs() []events.Topic {
+	return []events.Topic{events.PACKET, events.CLASSIFICATION, events.FLOW_EXPIRED}
+}
+
+func (fe *FeatureExporter) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		p := event.(common.Packet)
+		fe.flow(p.GetKey()).features.Add(p)
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Fallback || clf.Class == "" {
+			return
+		}
+		if _, ok := fe.labelSources[clf.Source]; !ok && len(fe.labelSources) > 0 {
+			return
+		}
+		lf := fe.flow(clf.Header)
+		if lf.label == "" {
+			lf.label = clf.Class
+		}
+	case events.FLOW_EXPIRED:
+		key := event.(FlowExpiredEvent).Header
+		lf, exists := fe.flows[key]
+		if !exists {
+			return
+		}
+		delete(fe.flows, key)
+		if lf.label == "" && !fe.keepUnlabelled {
+			return
+		}
+		fe.write(key, lf)
+	}
+}
+
+func (fe *FeatureExporter) flow(key common.FiveTuple) *labelledFeatures {
+	lf, exists := fe.flows[key]
+	if !exists {
+		lf = &labelledFeatures{features: NewFlowFeatures(fe.packets)}
+		fe.flows[key] = lf
+	}
+	return lf
+}
+
+func (fe *FeatureExporter) write(key common.FiveTuple, lf *labelledFeatures) {
+	vector := lf.features.Vector(key)
+	record := make([]string, 0, len(vector)+2)
+	record = append(record, key.String(), lf.label)
+	for _, v := range vector {
+		record = append(record, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	if err := fe.writer.Write(record); err != nil {
+		log.Fatal().Err(err).Msg("unable to write features")
+	}
+	fe.nWritten++
+}
+
+func (fe *FeatureExporter) Teardown() {
+	fe.writer.Flush()
+	if err := fe.writer.Error(); err != nil {
+		log.Fatal().Err(err).Msg("unable to flush feature file")
+	}
+	if err := fe.file.Close(); err != nil {
+		log.Fatal().Err(err).Msg("unable to close feature file")
+	}
+	log.Info().Str("proc", fe.Name()).Int("flows", fe.nWritten).Msg("teardown")
+}
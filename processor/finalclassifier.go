@@ -0,0 +1,133 @@
+package processor
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type ClassificationStep struct {
+	Source      string
+	Class       string
+	Fallback    bool   `json:",omitempty"`
+	AppProtocol string `json:",omitempty"`
+}
+
+// EventFinalClassification is the single label of a flow along with
+// every classification it received (in arrival order). AppProtocol
+// is the first one detected.
+type EventFinalClassification struct {
+	Header      common.FiveTuple
+	Class       string
+	Source      string
+	AppProtocol string `json:",omitempty"`
+	Trail       []ClassificationStep
+}
+
+// FinalClassifier combines the classifications a flow received over its
+// lifetime into one label, published when the flow expires. Non-fallback
+// classifications win over fallback ones, then sources earlier in the
+// precedence list, then the earliest. Flows with no classification get
+// the default class.
+type FinalClassifier struct {
+	BasePublisher
+	precedence   map[string]int
+	defaultClass string
+	flows        map[common.FiveTuple][]ClassificationStep
+}
+
+func NewFinalClassifier(precedence []string, defaultClass string) *FinalClassifier {
+	if defaultClass == "" {
+		defaultClass = "unclassified"
+	}
+	fc := &FinalClassifier{
+		precedence:   make(map[string]int),
+		defaultClass: defaultClass,
+		flows:        make(map[common.FiveTuple][]ClassificationStep),
+	}
+	for i, source := range precedence {
+		fc.precedence[source] = i
+	}
+	return fc
+}
+
+func (fc *FinalClassifier) Init() {
+	log.Debug().Str("proc", fc.Name()).Interface("precedence", fc.precedence).
+		Str("default_class", fc.defaultClass).Msg("init")
+}
+
+func (fc *FinalClassifier) Name() string {
+	return "final_classifier"
+}
+
+func (fc *FinalClassifier) Subs() []events.Topic {
+	return []events.Topic{events.CLASSIFICATION, events.FLOW_EXPIRED}
+}
+
+func (fc *FinalClassifier) Pubs() []events.Topic {
+	return []events.Topic{events.CLASSIFICATION_FINAL}
+}
+
+func (fc *FinalClassifier) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		fc.flows[clf.Header] = append(fc.flows[clf.Header], ClassificationStep{
+			Source:      clf.Source,
+			Class:       clf.Class,
+			Fallback:    clf.Fallback,
+			AppProtocol: clf.AppProtocol,
+		})
+	case events.FLOW_EXPIRED:
+		fe := event.(FlowExpiredEvent)
+		trail := fc.flows[fe.Header]
+		delete(fc.flows, fe.Header)
+		final := EventFinalClassification{
+			Header: fe.Header,
+			Class:  fc.defaultClass,
+			Trail:  trail,
+		}
+		if best, ok := fc.Best(trail); ok {
+			final.Class = best.Class
+			final.Source = best.Source
+		}
+		for _, step := range trail {
+			if step.AppProtocol != "" {
+				final.AppProtocol = step.AppProtocol
+				break
+			}
+		}
+		fc.Publish(events.CLASSIFICATION_FINAL, final)
+	}
+}
+
+// Best picks the winning step of a trail, ignoring steps without a class
+func (fc *FinalClassifier) Best(trail []ClassificationStep) (ClassificationStep, bool) {
+	bestIdx := -1
+	for i, step := range trail {
+		if step.Class == "" {
+			continue
+		}
+		if bestIdx == -1 || fc.less(step, trail[bestIdx]) {
+			bestIdx = i
+		}
+	}
+	if bestIdx == -1 {
+		return ClassificationStep{}, false
+	}
+	return trail[bestIdx], true
+}
+
+func (fc *FinalClassifier) less(a, b ClassificationStep) bool {
+	if a.Fallback != b.Fallback {
+		return !a.Fallback
+	}
+	return fc.rank(a.Source) < fc.rank(b.Source)
+}
+
+func (fc *FinalClassifier) rank(source string) int {
+	if r, exists := fc.precedence[source]; exists {
+		return r
+	}
+	return len(fc.precedence)
+}
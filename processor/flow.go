@@ -2,6 +2,7 @@ package processor
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -17,9 +18,16 @@ type FlowProcessor struct {
 	oldest  *Entry
 	Timeout time.Duration
 
-	// Counters
-	nEntries uint
-	nExpired uint
+	// ReplayPackets is the number of packets kept per flow to be
+	// replayed to telemetry attached after the flow started
+	ReplayPackets int
+	// ReplayWindow is the number of flow packets after which the kept
+	// packets are freed, telemetry attached later gets no replay
+	ReplayWindow int
+
+	// Counters, atomic as they are read by Collect
+	nEntries uint64
+	nExpired uint64
 }
 
 func (f *FlowProcessor) Teardown() {
@@ -32,17 +40,26 @@ func (f *FlowProcessor) Teardown() {
 func NewFlowProcessor(timeoutMin int) *FlowProcessor {
 	log.Debug().Str("proc", "flow").Int("timeout_min", timeoutMin).Msg("config")
 	return &FlowProcessor{
-		m:       make(map[common.FiveTuple]*Entry, 1000),
-		Timeout: time.Duration(timeoutMin) * time.Minute,
+		m:            make(map[common.FiveTuple]*Entry, 1000),
+		Timeout:      time.Duration(timeoutMin) * time.Minute,
+		ReplayWindow: 64,
 	}
 }
 
+func (f *FlowProcessor) Collect(w *MetricsWriter) {
+	created := atomic.LoadUint64(&f.nEntries)
+	expired := atomic.LoadUint64(&f.nExpired)
+	w.Gauge("edrint_flows_active", "Flows in the flow table", float64(created-expired))
+	w.Counter("edrint_flows_created_total", "Flows created", float64(created))
+	w.Counter("edrint_flows_expired_total", "Flows expired", float64(expired))
+}
+
 func (f *FlowProcessor) Name() string {
 	return "flow"
 }
 
 func (f *FlowProcessor) Subs() []events.Topic {
-	return []events.Topic{events.PACKET, events.FLOW_ATTACH_TELEMETRY}
+	return []events.Topic{events.PACKET, events.FLOW_ATTACH_TELEMETRY, events.FLOW_DETACH_TELEMETRY}
 }
 
 func (f *FlowProcessor) Pubs() []events.Topic {
@@ -79,6 +96,24 @@ func (f *FlowProcessor) EventHandler(topic events.Topic, event interface{}) {
 				continue
 			}
 			entry.TFS[tf.Name()] = tf
+			tf.Init()
+			for _, p := range entry.early {
+				tf.OnFlowPacket(p)
+			}
+		}
+	case events.FLOW_DETACH_TELEMETRY:
+		dt := event.(EventDetachPerFlowTelemetry)
+		entry, exists := f.m[dt.Header]
+		if !exists {
+			return
+		}
+		for _, name := range dt.TelemetryNames {
+			tf, exists := entry.TFS[name]
+			if !exists {
+				continue
+			}
+			tf.Teardown()
+			delete(entry.TFS, name)
 		}
 	}
 }
@@ -114,9 +149,19 @@ type Entry struct {
 	UpPackets   uint
 
 	TFS map[string]telemetry.Telemetry
+
+	// First packets of the flow, replayed to telemetry attached late
+	// until the flow has seen replayUntil packets
+	early       []common.Packet
+	maxEarly    int
+	replayUntil uint
 }
 
 func (entry *Entry) UpdateOnPacket(p common.Packet) {
+	if entry.UpPackets+entry.DownPackets < uint(entry.maxEarly) {
+		entry.early = append(entry.early, p)
+	}
+
 	entry.UpdatedTS = p.Timestamp
 	if p.IsOutbound {
 		entry.UpPackets++
@@ -125,6 +170,9 @@ func (entry *Entry) UpdateOnPacket(p common.Packet) {
 		entry.DownPackets++
 		entry.DownBytes += p.TotalLen
 	}
+	if entry.early != nil && entry.UpPackets+entry.DownPackets >= entry.replayUntil {
+		entry.early = nil
+	}
 
 	for _, tf := range entry.TFS {
 		tf.OnFlowPacket(p)
@@ -141,12 +189,18 @@ func (f *FlowProcessor) Insert(p common.Packet) {
 		Prev:      prevPtr,
 		Next:      nil,
 		TFS:       make(map[string]telemetry.Telemetry),
+		maxEarly:  f.ReplayPackets,
+	}
+	if f.ReplayWindow > f.ReplayPackets {
+		entry.replayUntil = uint(f.ReplayWindow)
+	} else {
+		entry.replayUntil = uint(f.ReplayPackets)
 	}
 
 	// Insert into map
 	f.MakeEntrylatest(entry)
 	f.m[key] = entry
-	f.nEntries++
+	atomic.AddUint64(&f.nEntries, 1)
 
 	// Publish the event -- may have downstream deps and
 	// can add telemetry functions as a result
@@ -155,11 +209,6 @@ func (f *FlowProcessor) Insert(p common.Packet) {
 		Header:    key,
 	})
 
-	// Init telemetry functions
-	for _, tf := range entry.TFS {
-		tf.Init()
-	}
-
 	entry.UpdateOnPacket(p)
 
 	log.Debug().Time("start", p.Timestamp).Str("ft", key.String()).Msg("new flow")
@@ -220,7 +269,7 @@ func (f *FlowProcessor) expireEntries(now time.Time) {
 		entry := f.oldest
 		f.BeforeExpire(entry, now)
 		delete(f.m, entry.Header)
-		f.nExpired++
+		atomic.AddUint64(&f.nExpired, 1)
 		f.oldest = entry.Next
 		if entry.Next == nil {
 			f.latest = nil
@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+type countingTelemetry struct {
+	telemetry.BaseFlowTelemetry
+	packets int
+}
+
+func (ct *countingTelemetry) Name() string                 { return "counting" }
+func (ct *countingTelemetry) OnFlowPacket(p common.Packet) { ct.packets++ }
+func (ct *countingTelemetry) Pubs() []events.Topic         { return nil }
+func (ct *countingTelemetry) Init()                        {}
+func (ct *countingTelemetry) Teardown()                    {}
+
+func TestFlowProcessorReplayWindow(t *testing.T) {
+	fp := NewFlowProcessor(2)
+	fp.SetPubFunc(func(events.Topic, interface{}) {})
+	fp.ReplayPackets = 3
+	fp.ReplayWindow = 5
+
+	start := time.Unix(1600000000, 0)
+	packet := func(i int) common.Packet {
+		return common.Packet{
+			Header:    common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6},
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+			Payload:   []byte("data"),
+		}
+	}
+	attach := func() *countingTelemetry {
+		ct := &countingTelemetry{}
+		fp.EventHandler(events.FLOW_ATTACH_TELEMETRY, EventAttachPerFlowTelemetry{
+			Header:             packet(0).GetKey(),
+			TelemetryFunctions: []telemetry.Telemetry{ct},
+		})
+		return ct
+	}
+
+	for i := 0; i < 4; i++ {
+		fp.EventHandler(events.PACKET, packet(i))
+	}
+	if ct := attach(); ct.packets != 3 {
+		t.Errorf("attached within the window: replayed %d packets, want 3", ct.packets)
+	}
+	fp.EventHandler(events.PACKET, packet(4))
+	fp.EventHandler(events.PACKET, packet(5))
+	entry := fp.m[packet(0).GetKey()]
+	if entry.early != nil {
+		t.Errorf("%d packets kept after the window", len(entry.early))
+	}
+	fp.EventHandler(events.FLOW_DETACH_TELEMETRY, EventDetachPerFlowTelemetry{
+		Header: packet(0).GetKey(), TelemetryNames: []string{"counting"},
+	})
+	if ct := attach(); ct.packets != 0 {
+		t.Errorf("attached after the window: replayed %d packets, want 0", ct.packets)
+	}
+}
@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// FlowRecordProcessor stands in for the FlowProcessor when the input is
+// flow records (see NetFlowDecoder) rather than packets. The records of
+// both directions of a flow are merged into one flow, created on its
+// first record and expired once no record was seen for Timeout (in
+// export time), so classifiers, the dumper and aggregations see the
+// usual FLOW_CREATED and FLOW_EXPIRED events. Counts are scaled by the
+// sampling interval.
+//
+// Records carry no packets: telemetry attached to their flows is never
+// run and each attachment is answered with a TELEMETRY_UNAVAILABLE event.
+type FlowRecordProcessor struct {
+	BasePublisher
+	m       map[common.FiveTuple]*FlowExpiredEvent
+	Timeout time.Duration
+
+	now        time.Time
+	lastScan   time.Time
+	nEntries   uint64
+	nExpired   uint64
+	nRecords   uint64
+	nTelemetry uint64
+}
+
+// TelemetryUnavailableEvent reports telemetry that was not run for a
+// flow, e.g. as it needs packets and the flow comes from flow records
+type TelemetryUnavailableEvent struct {
+	Header    common.FiveTuple
+	Telemetry []string
+	Reason    string
+}
+
+func NewFlowRecordProcessor(timeoutMin int) *FlowRecordProcessor {
+	log.Debug().Str("proc", "flow_records").Int("timeout_min", timeoutMin).Msg("config")
+	return &FlowRecordProcessor{
+		m:       make(map[common.FiveTuple]*FlowExpiredEvent, 1000),
+		Timeout: time.Duration(timeoutMin) * time.Minute,
+	}
+}
+
+func (f *FlowRecordProcessor) Name() string {
+	return "flow_records"
+}
+
+func (f *FlowRecordProcessor) Subs() []events.Topic {
+	return []events.Topic{events.FLOW_RECORD, events.FLOW_ATTACH_TELEMETRY}
+}
+
+func (f *FlowRecordProcessor) Pubs() []events.Topic {
+	return []events.Topic{events.FLOW_CREATED, events.FLOW_EXPIRED, events.TELEMETRY_UNAVAILABLE}
+}
+
+func (f *FlowRecordProcessor) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.FLOW_RECORD:
+		f.onRecord(event.(FlowRecord))
+	case events.FLOW_ATTACH_TELEMETRY:
+		at := event.(EventAttachPerFlowTelemetry)
+		names := make([]string, len(at.TelemetryFunctions))
+		for i, tf := range at.TelemetryFunctions {
+			names[i] = tf.Name()
+		}
+		atomic.AddUint64(&f.nTelemetry, uint64(len(names)))
+		f.Publish(events.TELEMETRY_UNAVAILABLE, TelemetryUnavailableEvent{
+			Header:    at.Header,
+			Telemetry: names,
+			Reason:    "flow records carry no packets",
+		})
+	}
+}
+
+func (f *FlowRecordProcessor) onRecord(r FlowRecord) {
+	atomic.AddUint64(&f.nRecords, 1)
+	key := r.GetKey()
+	entry, exists := f.m[key]
+	if !exists {
+		entry = &FlowExpiredEvent{Header: key, FirstPacketTS: r.Start, LastPacketTS: r.End}
+		f.m[key] = entry
+		atomic.AddUint64(&f.nEntries, 1)
+		f.Publish(events.FLOW_CREATED, FlowCreatedEvent{CreatedTS: r.Start, Header: key})
+		log.Debug().Time("start", r.Start).Str("ft", key.String()).Str("exporter", r.Exporter).Msg("new flow")
+	}
+	if r.Start.Before(entry.FirstPacketTS) {
+		entry.FirstPacketTS = r.Start
+	}
+	if r.End.After(entry.LastPacketTS) {
+		entry.LastPacketTS = r.End
+	}
+	scale := uint(r.SamplingInterval)
+	if scale == 0 {
+		scale = 1
+	}
+	up, down := &entry.UpBytes, &entry.DownBytes
+	upPackets, downPackets := &entry.UpPackets, &entry.DownPackets
+	if !r.IsOutbound {
+		up, down, upPackets, downPackets = down, up, downPackets, upPackets
+	}
+	*up += uint(r.Bytes) * scale
+	*upPackets += uint(r.Packets) * scale
+	*down += uint(r.ReverseBytes) * scale
+	*downPackets += uint(r.ReversePackets) * scale
+
+	if r.End.After(f.now) {
+		f.now = r.End
+	}
+	// records are exported in bursts, scanning every so often is enough
+	if f.now.Sub(f.lastScan) >= f.Timeout/4 {
+		f.expire(f.now)
+		f.lastScan = f.now
+	}
+}
+
+func (f *FlowRecordProcessor) expire(now time.Time) {
+	for key, entry := range f.m {
+		if now.Sub(entry.LastPacketTS) < f.Timeout {
+			continue
+		}
+		entry.ExpiredTS = now
+		f.Publish(events.FLOW_EXPIRED, *entry)
+		delete(f.m, key)
+		atomic.AddUint64(&f.nExpired, 1)
+	}
+}
+
+func (f *FlowRecordProcessor) Teardown() {
+	f.expire(f.now.Add(f.Timeout))
+	log.Info().Str("proc", f.Name()).Uint64("records", atomic.LoadUint64(&f.nRecords)).
+		Uint64("flows", atomic.LoadUint64(&f.nEntries)).
+		Uint64("telemetry_unavailable", atomic.LoadUint64(&f.nTelemetry)).Msg("teardown")
+}
+
+func (f *FlowRecordProcessor) Collect(w *MetricsWriter) {
+	created := atomic.LoadUint64(&f.nEntries)
+	expired := atomic.LoadUint64(&f.nExpired)
+	w.Gauge("edrint_flows_active", "Flows in the flow table", float64(created-expired))
+	w.Counter("edrint_flows_created_total", "Flows created", float64(created))
+	w.Counter("edrint_flows_expired_total", "Flows expired", float64(expired))
+	w.Counter("edrint_flow_records_total", "Flow records received", float64(atomic.LoadUint64(&f.nRecords)))
+}
@@ -0,0 +1,183 @@
+package processor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// FlowReport is a canned report of a flow store (see FlowStore)
+type FlowReport struct {
+	Name        string
+	Description string
+	run         func(db *sql.DB, limit int) ([]string, [][]string, error)
+}
+
+// FlowReports are the reports of the query command
+var FlowReports = []FlowReport{
+	{"top_talkers", "clients by bytes sent and received", topTalkers},
+	{"class_volume", "flows and bytes per class", classVolume},
+	{"rtt_by_server", "RTT percentiles per server, needs telemetry.tcp.rtt", rttByServer},
+	{"retransmits", "flows with the most retransmits, needs telemetry.tcp.retransmit", mostRetransmits},
+}
+
+// RunFlowReport writes report name of the flow store db as a table of
+// at most limit rows
+func RunFlowReport(db *sql.DB, name string, limit int, w io.Writer) error {
+	for _, r := range FlowReports {
+		if r.Name != name {
+			continue
+		}
+		header, rows, err := r.run(db, limit)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		writeReportRow(tw, header)
+		for _, row := range rows {
+			writeReportRow(tw, row)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown report %q", name)
+}
+
+func writeReportRow(w io.Writer, row []string) {
+	for i, cell := range row {
+		if i > 0 {
+			io.WriteString(w, "\t")
+		}
+		io.WriteString(w, cell)
+	}
+	io.WriteString(w, "\n")
+}
+
+// queryRows returns the rows of a query as strings
+func queryRows(db *sql.DB, query string, args ...interface{}) ([][]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func topTalkers(db *sql.DB, limit int) ([]string, [][]string, error) {
+	rows, err := queryRows(db, `SELECT client_ip, COUNT(*), SUM(up_bytes), SUM(down_bytes), SUM(up_bytes + down_bytes) AS total
+		FROM flows GROUP BY client_ip ORDER BY total DESC LIMIT ?`, limit)
+	return []string{"CLIENT", "FLOWS", "UP_BYTES", "DOWN_BYTES", "TOTAL_BYTES"}, rows, err
+}
+
+func classVolume(db *sql.DB, limit int) ([]string, [][]string, error) {
+	rows, err := queryRows(db, `SELECT COALESCE(class, '-'), COUNT(*), SUM(up_bytes), SUM(down_bytes), SUM(up_bytes + down_bytes) AS total
+		FROM flows GROUP BY class ORDER BY total DESC LIMIT ?`, limit)
+	return []string{"CLASS", "FLOWS", "UP_BYTES", "DOWN_BYTES", "TOTAL_BYTES"}, rows, err
+}
+
+// jsonNumbers decodes a list column
+func jsonNumbers(s string) []float64 {
+	var values []float64
+	json.Unmarshal([]byte(s), &values)
+	return values
+}
+
+func rttByServer(db *sql.DB, limit int) ([]string, [][]string, error) {
+	header := []string{"SERVER", "FLOWS", "SAMPLES", "P50_MS", "P90_MS", "P99_MS"}
+	rows, err := queryRows(db, `SELECT f.server_ip, r.rttms FROM flows f JOIN telemetry_tcp_rtt r ON r.flow_id = f.id`)
+	if err != nil {
+		return header, nil, err
+	}
+	type server struct {
+		ip    string
+		flows int
+		rtts  []float64
+	}
+	servers := make(map[string]*server)
+	for _, row := range rows {
+		s, exists := servers[row[0]]
+		if !exists {
+			s = &server{ip: row[0]}
+			servers[row[0]] = s
+		}
+		s.flows++
+		s.rtts = append(s.rtts, jsonNumbers(row[1])...)
+	}
+	var sorted []*server
+	for _, s := range servers {
+		if len(s.rtts) > 0 {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].rtts) != len(sorted[j].rtts) {
+			return len(sorted[i].rtts) > len(sorted[j].rtts)
+		}
+		return sorted[i].ip < sorted[j].ip
+	})
+	var result [][]string
+	for i, s := range sorted {
+		if i == limit {
+			break
+		}
+		row := []string{s.ip, strconv.Itoa(s.flows), strconv.Itoa(len(s.rtts))}
+		for _, p := range []float64{50, 90, 99} {
+			row = append(row, strconv.FormatFloat(percentile(s.rtts, p), 'f', 1, 64))
+		}
+		result = append(result, row)
+	}
+	return header, result, nil
+}
+
+func mostRetransmits(db *sql.DB, limit int) ([]string, [][]string, error) {
+	header := []string{"FLOW", "CLIENT", "SERVER", "CLASS", "UP_RETRANSMITS", "DOWN_RETRANSMITS", "TOTAL"}
+	rows, err := queryRows(db, `SELECT f.id, f.client_ip || ':' || f.client_port, f.server_ip || ':' || f.server_port,
+		COALESCE(f.class, '-'), r.retransmits_up, r.retransmits_down
+		FROM flows f JOIN telemetry_tcp_retransmit r ON r.flow_id = f.id`)
+	if err != nil {
+		return header, nil, err
+	}
+	type flow struct {
+		row      []string
+		up, down float64
+	}
+	var flows []flow
+	for _, row := range rows {
+		f := flow{row: row[:4], up: sumValues(jsonNumbers(row[4])), down: sumValues(jsonNumbers(row[5]))}
+		if f.up+f.down > 0 {
+			flows = append(flows, f)
+		}
+	}
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].up+flows[i].down > flows[j].up+flows[j].down })
+	var result [][]string
+	for i, f := range flows {
+		if i == limit {
+			break
+		}
+		result = append(result, append(append([]string(nil), f.row...), strconv.Itoa(int(f.up)), strconv.Itoa(int(f.down)), strconv.Itoa(int(f.up+f.down))))
+	}
+	return header, result, nil
+}
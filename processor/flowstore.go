@@ -0,0 +1,317 @@
+package processor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+const flowStoreSchema = `
+CREATE TABLE IF NOT EXISTS flows (
+	id INTEGER PRIMARY KEY,
+	server_ip TEXT NOT NULL,
+	client_ip TEXT NOT NULL,
+	server_port INTEGER NOT NULL,
+	client_port INTEGER NOT NULL,
+	protocol INTEGER NOT NULL,
+	first_packet_ts TIMESTAMP,
+	last_packet_ts TIMESTAMP,
+	expired_ts TIMESTAMP,
+	up_bytes INTEGER NOT NULL,
+	down_bytes INTEGER NOT NULL,
+	up_packets INTEGER NOT NULL,
+	down_packets INTEGER NOT NULL,
+	class TEXT,
+	sni TEXT
+);
+CREATE INDEX IF NOT EXISTS flows_client_ip ON flows (client_ip);
+CREATE INDEX IF NOT EXISTS flows_server_ip ON flows (server_ip);
+CREATE INDEX IF NOT EXISTS flows_class ON flows (class);
+`
+
+// FlowStore stores expired flows, with their class and SNI, in the
+// flows table of a SQLite database. The events of every telemetry topic
+// go to a table named after the topic (telemetry.tcp.rtt =>
+// telemetry_tcp_rtt) with a flow_id referencing flows and the event
+// columns (see EventColumns) but the header, lists being JSON arrays.
+// Telemetry is kept until its flow expires so both are written together.
+//
+// Flows are committed every CommitFlows flows and at teardown. The
+// database is opened with the sqlite3 database/sql driver, which the
+// binary has to import.
+type FlowStore struct {
+	BaseSubscriber
+	path   string
+	topics []events.Topic
+	sni    bool
+	// CommitFlows is the number of flows written per transaction
+	CommitFlows int
+
+	db      *sql.DB
+	tx      *sql.Tx
+	insert  *sql.Stmt
+	pending int
+	flows   map[common.FiveTuple]*storedFlow
+	tables  map[events.Topic]*storeTable
+
+	nFlows   int
+	nRows    int
+	nDropped int
+}
+
+type storedFlow struct {
+	class    string
+	fallback bool
+	sni      string
+	events   []storedEvent
+}
+
+type storedEvent struct {
+	topic events.Topic
+	event interface{}
+}
+
+type storeTable struct {
+	name    string
+	typ     reflect.Type
+	columns []Column
+	insert  *sql.Stmt
+	dropped int
+}
+
+// NewFlowStore stores flows in the database at path with the events of
+// the telemetry topics. With sni, flows get the SNI of an SNI parser.
+func NewFlowStore(path string, topics []events.Topic, sni bool) *FlowStore {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("unable to open flow store")
+	}
+	// one connection: sqlite allows a single writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(flowStoreSchema); err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("unable to create flow store tables")
+	}
+	return &FlowStore{
+		path:        path,
+		topics:      topics,
+		sni:         sni,
+		CommitFlows: 1000,
+		db:          db,
+		flows:       make(map[common.FiveTuple]*storedFlow),
+		tables:      make(map[events.Topic]*storeTable),
+	}
+}
+
+func (fs *FlowStore) Init() {
+	log.Debug().Str("proc", fs.Name()).Str("path", fs.path).Int("topics", len(fs.topics)).
+		Int("commit_flows", fs.CommitFlows).Msg("init")
+}
+
+func (fs *FlowStore) Name() string {
+	return "flow_store"
+}
+
+func (fs *FlowStore) Subs() []events.Topic {
+	subs := append([]events.Topic{events.CLASSIFICATION, events.FLOW_EXPIRED}, fs.topics...)
+	if fs.sni {
+		subs = append(subs, events.PROTOCOL_SNI)
+	}
+	return subs
+}
+
+func (fs *FlowStore) flow(header common.FiveTuple) *storedFlow {
+	f, exists := fs.flows[header]
+	if !exists {
+		f = &storedFlow{}
+		fs.flows[header] = f
+	}
+	return f
+}
+
+func (fs *FlowStore) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Class == "" || clf.AtExpiry {
+			return
+		}
+		f := fs.flow(clf.Header)
+		if f.class == "" || (f.fallback && !clf.Fallback) {
+			f.class, f.fallback = clf.Class, clf.Fallback
+		}
+	case events.PROTOCOL_SNI:
+		sni := event.(SNIRecord)
+		fs.flow(sni.Header).sni = sni.SNI
+	case events.FLOW_EXPIRED:
+		fe := event.(FlowExpiredEvent)
+		f, exists := fs.flows[fe.Header]
+		if !exists {
+			f = &storedFlow{}
+		}
+		delete(fs.flows, fe.Header)
+		fs.store(fe, f)
+	default:
+		_, header, ok := eventFlow(event)
+		if !ok {
+			fs.nDropped++
+			return
+		}
+		f := fs.flow(header)
+		f.events = append(f.events, storedEvent{topic, event})
+	}
+}
+
+// store writes a flow and its telemetry
+func (fs *FlowStore) store(fe FlowExpiredEvent, f *storedFlow) {
+	if fs.tx == nil {
+		var err error
+		if fs.tx, err = fs.db.Begin(); err != nil {
+			log.Fatal().Err(err).Msg("unable to start flow store transaction")
+		}
+		fs.insert, err = fs.tx.Prepare(`INSERT INTO flows (server_ip, client_ip, server_port, client_port, protocol,
+			first_packet_ts, last_packet_ts, expired_ts, up_bytes, down_bytes, up_packets, down_packets, class, sni)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to prepare flow insert")
+		}
+	}
+	h := fe.Header
+	res, err := fs.insert.Exec(h.SrcIP, h.DstIP, h.SrcPort, h.DstPort, h.Protocol,
+		fe.FirstPacketTS.UTC(), fe.LastPacketTS.UTC(), fe.ExpiredTS.UTC(),
+		fe.UpBytes, fe.DownBytes, fe.UpPackets, fe.DownPackets, nullString(f.class), nullString(f.sni))
+	if err != nil {
+		log.Fatal().Err(err).Str("header", fmt.Sprint(h)).Msg("unable to store flow")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to get flow id")
+	}
+	fs.nFlows++
+	for _, se := range f.events {
+		fs.storeEvent(id, se.topic, se.event)
+	}
+	fs.pending++
+	if fs.pending >= fs.CommitFlows {
+		fs.commit()
+	}
+}
+
+func (fs *FlowStore) storeEvent(flowID int64, topic events.Topic, event interface{}) {
+	event, _ = telemetry.Unsampled(event)
+	t, exists := fs.tables[topic]
+	if !exists {
+		t = fs.newTable(topic, reflect.TypeOf(event))
+		fs.tables[topic] = t
+	}
+	if reflect.TypeOf(event) != t.typ {
+		if t.dropped == 0 {
+			log.Warn().Str("proc", fs.Name()).Str("topic", string(topic)).
+				Str("type", fmt.Sprintf("%T", event)).Msg("event type differs from table: dropping")
+		}
+		t.dropped++
+		fs.nDropped++
+		return
+	}
+	if t.insert == nil {
+		var err error
+		if t.insert, err = fs.tx.Prepare(t.insertSQL()); err != nil {
+			log.Fatal().Err(err).Str("table", t.name).Msg("unable to prepare insert, does the table have other columns?")
+		}
+	}
+	v := reflect.ValueOf(event)
+	values := []interface{}{flowID}
+	for _, c := range t.columns {
+		values = append(values, storeValue(c, c.Value(v)))
+	}
+	if _, err := t.insert.Exec(values...); err != nil {
+		log.Fatal().Err(err).Str("table", t.name).Msg("unable to store event")
+	}
+	fs.nRows++
+}
+
+// storeValue converts lists to JSON arrays and times to UTC
+func storeValue(c Column, value interface{}) interface{} {
+	if c.List {
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+	if t, ok := value.(time.Time); ok {
+		return t.UTC()
+	}
+	return value
+}
+
+// storeTableName is a topic as SQL identifier: telemetry.tcp.rtt => telemetry_tcp_rtt
+func storeTableName(topic events.Topic) string {
+	return strings.NewReplacer(".", "_", "/", "_", "-", "_").Replace(string(topic))
+}
+
+func (fs *FlowStore) newTable(topic events.Topic, typ reflect.Type) *storeTable {
+	t := &storeTable{name: storeTableName(topic), typ: typ}
+	defs := []string{"flow_id INTEGER NOT NULL REFERENCES flows (id)"}
+	for _, c := range EventColumns(typ) {
+		if strings.HasPrefix(c.Name, "header_") {
+			continue
+		}
+		t.columns = append(t.columns, c)
+		sqlType := "TEXT"
+		if !c.List {
+			switch c.Kind {
+			case ColInt, ColBool:
+				sqlType = "INTEGER"
+			case ColFloat:
+				sqlType = "REAL"
+			case ColTime:
+				sqlType = "TIMESTAMP"
+			}
+		}
+		defs = append(defs, fmt.Sprintf("%q %s", c.Name, sqlType))
+	}
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s); CREATE INDEX IF NOT EXISTS %s_flow_id ON %s (flow_id)",
+		t.name, strings.Join(defs, ", "), t.name, t.name)
+	if _, err := fs.tx.Exec(stmt); err != nil {
+		log.Fatal().Err(err).Str("table", t.name).Msg("unable to create table")
+	}
+	log.Info().Str("proc", fs.Name()).Str("table", t.name).Int("columns", len(t.columns)).Msg("table created")
+	return t
+}
+
+func (t *storeTable) insertSQL() string {
+	names := []string{"flow_id"}
+	for _, c := range t.columns {
+		names = append(names, fmt.Sprintf("%q", c.Name))
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)", t.name, strings.Join(names, ", "),
+		strings.Repeat(", ?", len(t.columns)))
+}
+
+func (fs *FlowStore) commit() {
+	if fs.tx == nil {
+		return
+	}
+	if err := fs.tx.Commit(); err != nil {
+		log.Fatal().Err(err).Msg("unable to commit flows")
+	}
+	// statements are bound to the transaction
+	fs.tx, fs.insert, fs.pending = nil, nil, 0
+	for _, t := range fs.tables {
+		t.insert = nil
+	}
+}
+
+func (fs *FlowStore) Teardown() {
+	fs.commit()
+	if err := fs.db.Close(); err != nil {
+		log.Error().Err(err).Str("path", fs.path).Msg("unable to close flow store")
+	}
+	log.Info().Str("proc", fs.Name()).Int("flows", fs.nFlows).Int("rows", fs.nRows).
+		Int("unexpired", len(fs.flows)).Int("dropped", fs.nDropped).Msg("teardown")
+}
@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type storeTestRTT struct {
+	FirstPacketTS  time.Time
+	Header         common.FiveTuple
+	RelTimestampMS []uint
+	RTTMS          []uint
+}
+
+type storeTestRetransmit struct {
+	Header          common.FiveTuple
+	RetransmitsUp   []int
+	RetransmitsDown []int
+}
+
+func newTestFlowStore(t *testing.T) (*FlowStore, string) {
+	path := filepath.Join(t.TempDir(), "flows.db")
+	fs := NewFlowStore(path, []events.Topic{events.TELEMETRY_TCP_RTT, events.TELEMETRY_TCP_RETRANSMIT}, true)
+	fs.CommitFlows = 2
+	fs.Init()
+	start := time.Unix(1600000000, 0)
+	flows := []struct {
+		header      common.FiveTuple
+		class       string
+		up, down    uint
+		rtts        []uint
+		retransmits []int
+	}{
+		{common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}, "netflix", 100, 5000, []uint{10, 20, 30}, []int{0, 2}},
+		{common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.2", SrcPort: 443, DstPort: 50001, Protocol: 6}, "netflix", 200, 3000, []uint{40}, []int{5}},
+		{common.FiveTuple{SrcIP: "5.6.7.8", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50002, Protocol: 6}, "zoom", 900, 900, []uint{100, 200}, nil},
+		{common.FiveTuple{SrcIP: "9.9.9.9", DstIP: "10.0.0.1", SrcPort: 53, DstPort: 50003, Protocol: 17}, "", 50, 50, nil, nil},
+	}
+	for i, f := range flows {
+		if f.class != "" {
+			fs.EventHandler(events.CLASSIFICATION, EventClassification{Header: f.header, Class: "default", Fallback: true})
+			fs.EventHandler(events.CLASSIFICATION, EventClassification{Header: f.header, Class: f.class})
+		}
+		if i == 0 {
+			fs.EventHandler(events.PROTOCOL_SNI, SNIRecord{Header: f.header, SNI: "nflxvideo.net"})
+		}
+		if f.rtts != nil {
+			fs.EventHandler(events.TELEMETRY_TCP_RTT, storeTestRTT{start, f.header, make([]uint, len(f.rtts)), f.rtts})
+		}
+		if f.retransmits != nil {
+			fs.EventHandler(events.TELEMETRY_TCP_RETRANSMIT, storeTestRetransmit{f.header, f.retransmits, []int{1}})
+		}
+		fs.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{
+			FirstPacketTS: start, LastPacketTS: start.Add(time.Second), ExpiredTS: start.Add(time.Minute),
+			Header: f.header, UpBytes: f.up, DownBytes: f.down, UpPackets: 1, DownPackets: 1,
+		})
+	}
+	fs.Teardown()
+	return fs, path
+}
+
+func TestFlowStore(t *testing.T) {
+	fs, path := newTestFlowStore(t)
+	if fs.nFlows != 4 || fs.nRows != 5 || len(fs.flows) != 0 {
+		t.Errorf("flows %d, rows %d, kept %d", fs.nFlows, fs.nRows, len(fs.flows))
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var class, sni, rtts string
+	err = db.QueryRow(`SELECT f.class, f.sni, r.rttms FROM flows f JOIN telemetry_tcp_rtt r ON r.flow_id = f.id
+		WHERE f.client_port = 50000`).Scan(&class, &sni, &rtts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class != "netflix" || sni != "nflxvideo.net" || rtts != "[10,20,30]" {
+		t.Errorf("class %q, sni %q, rtts %s", class, sni, rtts)
+	}
+	var unclassified int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM flows WHERE class IS NULL`).Scan(&unclassified); err != nil || unclassified != 1 {
+		t.Errorf("%d flows without class, err %v", unclassified, err)
+	}
+}
+
+func TestFlowReports(t *testing.T) {
+	_, path := newTestFlowStore(t)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tc := range []struct {
+		report string
+		limit  int
+		want   string
+	}{
+		{"top_talkers", 10, `
+CLIENT    FLOWS  UP_BYTES  DOWN_BYTES  TOTAL_BYTES
+10.0.0.1  3      1050      5950        7000
+10.0.0.2  1      200       3000        3200
+`},
+		{"class_volume", 2, `
+CLASS    FLOWS  UP_BYTES  DOWN_BYTES  TOTAL_BYTES
+netflix  2      300       8000        8300
+zoom     1      900       900         1800
+`},
+		{"rtt_by_server", 10, `
+SERVER   FLOWS  SAMPLES  P50_MS  P90_MS  P99_MS
+1.2.3.4  2      4        20.0    40.0    40.0
+5.6.7.8  1      2        100.0   200.0   200.0
+`},
+		{"retransmits", 1, `
+FLOW  CLIENT          SERVER       CLASS    UP_RETRANSMITS  DOWN_RETRANSMITS  TOTAL
+2     10.0.0.2:50001  1.2.3.4:443  netflix  5               1                 6
+`},
+	} {
+		var b bytes.Buffer
+		if err := RunFlowReport(db, tc.report, tc.limit, &b); err != nil {
+			t.Errorf("%s: %v", tc.report, err)
+			continue
+		}
+		if got := b.String(); got != strings.TrimPrefix(tc.want, "\n") {
+			t.Errorf("%s:\n%s\nwant\n%s", tc.report, got, tc.want)
+		}
+	}
+	if err := RunFlowReport(db, "nonsense", 10, &bytes.Buffer{}); err == nil {
+		t.Error("unknown report accepted")
+	}
+}
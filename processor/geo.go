@@ -0,0 +1,157 @@
+package processor
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type GeoInfo struct {
+	ServerASN     uint   `json:",omitempty"`
+	ServerOrg     string `json:",omitempty"`
+	ServerCountry string `json:",omitempty"`
+}
+
+// GeoDB looks up the ASN and country of IPs in local MMDB files
+// (e.g. GeoLite2-ASN and GeoLite2-City/Country). Either may be absent.
+type GeoDB struct {
+	asn     *maxminddb.Reader
+	country *maxminddb.Reader
+}
+
+type asnRecord struct {
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func OpenGeoDB(asnPath, countryPath string) (*GeoDB, error) {
+	var g GeoDB
+	var err error
+	if asnPath != "" {
+		if g.asn, err = maxminddb.Open(asnPath); err != nil {
+			return nil, err
+		}
+		log.Info().Str("path", asnPath).Str("type", g.asn.Metadata.DatabaseType).Msg("geo db opened")
+	}
+	if countryPath != "" {
+		if g.country, err = maxminddb.Open(countryPath); err != nil {
+			g.Close()
+			return nil, err
+		}
+		log.Info().Str("path", countryPath).Str("type", g.country.Metadata.DatabaseType).Msg("geo db opened")
+	}
+	return &g, nil
+}
+
+// Lookup returns whatever is known about ip. Missing entries are left empty.
+func (g *GeoDB) Lookup(ip net.IP) GeoInfo {
+	var info GeoInfo
+	if ip == nil {
+		return info
+	}
+	if g.asn != nil {
+		var rec asnRecord
+		if err := g.asn.Lookup(ip, &rec); err != nil {
+			log.Debug().Err(err).Str("ip", ip.String()).Msg("asn lookup failed")
+		}
+		info.ServerASN = rec.ASN
+		info.ServerOrg = rec.Org
+	}
+	if g.country != nil {
+		var rec countryRecord
+		if err := g.country.Lookup(ip, &rec); err != nil {
+			log.Debug().Err(err).Str("ip", ip.String()).Msg("country lookup failed")
+		}
+		info.ServerCountry = rec.Country.ISOCode
+	}
+	return info
+}
+
+func (g *GeoDB) Close() {
+	if g.asn != nil {
+		g.asn.Close()
+	}
+	if g.country != nil {
+		g.country.Close()
+	}
+}
+
+type EnrichedFlowCreatedEvent struct {
+	FlowCreatedEvent
+	GeoInfo
+}
+
+type EnrichedFlowExpiredEvent struct {
+	FlowExpiredEvent
+	GeoInfo
+}
+
+type EnrichedClassificationEvent struct {
+	EventClassification
+	GeoInfo
+}
+
+// GeoEnricher republishes flow and classification events annotated
+// with the server's ASN, organisation and country
+type GeoEnricher struct {
+	BasePublisher
+	db    *GeoDB
+	flows map[common.FiveTuple]GeoInfo
+}
+
+func NewGeoEnricher(db *GeoDB) *GeoEnricher {
+	return &GeoEnricher{
+		db:    db,
+		flows: make(map[common.FiveTuple]GeoInfo),
+	}
+}
+
+func (ge *GeoEnricher) Name() string {
+	return "geo_enricher"
+}
+
+func (ge *GeoEnricher) Subs() []events.Topic {
+	return []events.Topic{events.FLOW_CREATED, events.FLOW_EXPIRED, events.CLASSIFICATION}
+}
+
+func (ge *GeoEnricher) Pubs() []events.Topic {
+	return []events.Topic{
+		events.ENRICHED_FLOW_CREATED,
+		events.ENRICHED_FLOW_EXPIRED,
+		events.ENRICHED_CLASSIFICATION,
+	}
+}
+
+func (ge *GeoEnricher) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.FLOW_CREATED:
+		fc := event.(FlowCreatedEvent)
+		info := ge.db.Lookup(net.ParseIP(fc.Header.SrcIP))
+		ge.flows[fc.Header] = info
+		ge.Publish(events.ENRICHED_FLOW_CREATED, EnrichedFlowCreatedEvent{fc, info})
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		ge.Publish(events.ENRICHED_CLASSIFICATION, EnrichedClassificationEvent{clf, ge.lookup(clf.Header)})
+	case events.FLOW_EXPIRED:
+		fe := event.(FlowExpiredEvent)
+		info := ge.lookup(fe.Header)
+		delete(ge.flows, fe.Header)
+		ge.Publish(events.ENRICHED_FLOW_EXPIRED, EnrichedFlowExpiredEvent{fe, info})
+	}
+}
+
+func (ge *GeoEnricher) lookup(header common.FiveTuple) GeoInfo {
+	if info, exists := ge.flows[header]; exists {
+		return info
+	}
+	return ge.db.Lookup(net.ParseIP(header.SrcIP))
+}
@@ -0,0 +1,304 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+)
+
+// mmdbWriter writes minimal IPv4 MaxMind DB files (24 bit records, see
+// https://maxmind.github.io/MaxMind-DB/) holding maps of strings, maps
+// and unsigned integers, enough for ASN and country fixtures.
+type mmdbWriter struct {
+	root *mmdbNode
+	data bytes.Buffer
+}
+
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     [2]int // data offset + 1, 0 => none
+	index    int
+}
+
+func newMMDBWriter() *mmdbWriter {
+	return &mmdbWriter{root: &mmdbNode{}}
+}
+
+func (w *mmdbWriter) Insert(cidr string, record map[string]interface{}) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := subnet.Mask.Size()
+	ip := subnet.IP.To4()
+	offset := w.data.Len()
+	mmdbEncode(&w.data, record)
+
+	node := w.root
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+		if i == ones-1 {
+			node.data[bit] = offset + 1
+			break
+		}
+		if node.children[bit] == nil {
+			node.children[bit] = &mmdbNode{}
+		}
+		node = node.children[bit]
+	}
+}
+
+func (w *mmdbWriter) WriteFile(path, dbType string) error {
+	var nodes []*mmdbNode
+	var number func(n *mmdbNode)
+	number = func(n *mmdbNode) {
+		n.index = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				number(c)
+			}
+		}
+	}
+	number(w.root)
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for side := 0; side < 2; side++ {
+			record := len(nodes)
+			switch {
+			case n.children[side] != nil:
+				record = n.children[side].index
+			case n.data[side] != 0:
+				record = len(nodes) + 16 + n.data[side] - 1
+			}
+			out.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(w.data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbEncode(&out, map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               dbType,
+		"languages":                   []interface{}{},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1600000000),
+		"description":                 map[string]interface{}{},
+	})
+	return ioutil.WriteFile(path, out.Bytes(), 0644)
+}
+
+func mmdbEncode(b *bytes.Buffer, v interface{}) {
+	switch val := v.(type) {
+	case string:
+		mmdbControl(b, 2, len(val))
+		b.WriteString(val)
+	case uint16:
+		mmdbUint(b, 5, uint64(val))
+	case uint32:
+		mmdbUint(b, 6, uint64(val))
+	case uint64:
+		mmdbUint(b, 9, val)
+	case []interface{}:
+		mmdbControl(b, 11, len(val))
+		for _, e := range val {
+			mmdbEncode(b, e)
+		}
+	case map[string]interface{}:
+		mmdbControl(b, 7, len(val))
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbEncode(b, k)
+			mmdbEncode(b, val[k])
+		}
+	default:
+		panic("unsupported mmdb type")
+	}
+}
+
+func mmdbUint(b *bytes.Buffer, typ int, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	n := 8
+	for n > 0 && buf[8-n] == 0 {
+		n--
+	}
+	mmdbControl(b, typ, n)
+	b.Write(buf[8-n:])
+}
+
+func mmdbControl(b *bytes.Buffer, typ, size int) {
+	if size >= 285 {
+		panic("mmdb fixture sizes must be < 285")
+	}
+	sizeBits, extra := size, []byte(nil)
+	if size >= 29 {
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	}
+	if typ > 7 {
+		b.WriteByte(byte(sizeBits))
+		b.WriteByte(byte(typ - 7))
+	} else {
+		b.WriteByte(byte(typ<<5 | sizeBits))
+	}
+	b.Write(extra)
+}
+
+func writeGeoFixtures(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asn := newMMDBWriter()
+	asn.Insert("1.1.1.0/24", map[string]interface{}{
+		"autonomous_system_number":       uint32(13335),
+		"autonomous_system_organization": "CLOUDFLARENET",
+	})
+	asn.Insert("52.94.0.0/16", map[string]interface{}{
+		"autonomous_system_number":       uint32(16509),
+		"autonomous_system_organization": "AMAZON-02",
+	})
+	country := newMMDBWriter()
+	country.Insert("1.1.1.0/24", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "AU"},
+	})
+	country.Insert("52.94.128.0/17", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+	})
+
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	countryPath := filepath.Join(dir, "country.mmdb")
+	if err := asn.WriteFile(asnPath, "GeoLite2-ASN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := country.WriteFile(countryPath, "GeoLite2-Country"); err != nil {
+		t.Fatal(err)
+	}
+	return asnPath, countryPath, func() { os.RemoveAll(dir) }
+}
+
+func TestGeoDBLookup(t *testing.T) {
+	asnPath, countryPath, cleanup := writeGeoFixtures(t)
+	defer cleanup()
+	g, err := OpenGeoDB(asnPath, countryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	tests := []struct {
+		ip   string
+		want GeoInfo
+	}{
+		{"1.1.1.1", GeoInfo{ServerASN: 13335, ServerOrg: "CLOUDFLARENET", ServerCountry: "AU"}},
+		{"52.94.1.1", GeoInfo{ServerASN: 16509, ServerOrg: "AMAZON-02"}},
+		{"52.94.200.1", GeoInfo{ServerASN: 16509, ServerOrg: "AMAZON-02", ServerCountry: "US"}},
+		{"8.8.8.8", GeoInfo{}},
+		{"2001:db8::1", GeoInfo{}},
+	}
+	for _, tt := range tests {
+		if got := g.Lookup(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	if got := g.Lookup(nil); got != (GeoInfo{}) {
+		t.Errorf("Lookup(nil) = %+v", got)
+	}
+
+	asnOnly, err := OpenGeoDB(asnPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asnOnly.Close()
+	if got := asnOnly.Lookup(net.ParseIP("1.1.1.1")); got.ServerCountry != "" || got.ServerASN != 13335 {
+		t.Errorf("asn only Lookup = %+v", got)
+	}
+}
+
+func TestRuleMatchGeo(t *testing.T) {
+	tests := []struct {
+		config map[string]string
+		info   GeoInfo
+		want   bool
+	}{
+		{map[string]string{"server_asn": "13335"}, GeoInfo{ServerASN: 13335}, true},
+		{map[string]string{"server_asn": "AS16509, 14618"}, GeoInfo{ServerASN: 14618}, true},
+		{map[string]string{"server_asn": "16509,14618"}, GeoInfo{ServerASN: 13335}, false},
+		{map[string]string{"server_asn": "!16509"}, GeoInfo{ServerASN: 13335}, true},
+		{map[string]string{"server_asn": "!16509"}, GeoInfo{ServerASN: 16509}, false},
+		{map[string]string{"server_country": "au,nz"}, GeoInfo{ServerCountry: "AU"}, true},
+		{map[string]string{"server_country": "AU"}, GeoInfo{}, false},
+		{map[string]string{"server_country": "!AU"}, GeoInfo{ServerCountry: "US"}, true},
+		{map[string]string{"server_asn": "16509", "server_country": "US"}, GeoInfo{ServerASN: 16509, ServerCountry: "AU"}, false},
+		{map[string]string{"server_port": "443"}, GeoInfo{}, true},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.MatchGeo(tt.info); got != tt.want {
+			t.Errorf("%v MatchGeo(%+v) = %v, want %v", tt.config, tt.info, got, tt.want)
+		}
+	}
+}
+
+func TestRuleMatcherGeo(t *testing.T) {
+	asnPath, countryPath, cleanup := writeGeoFixtures(t)
+	defer cleanup()
+	g, err := OpenGeoDB(asnPath, countryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	rules, err := ParseRules(map[string]map[string]string{
+		"cloudflare": {"server_asn": "13335"},
+		"aws_us":     {"server_asn": "16509", "server_country": "US", "server_port": "443"},
+		"not_au":     {"server_country": "!AU", "priority": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := NewRuleMatcher(rules)
+	header := common.FiveTuple{SrcIP: "52.94.200.1", DstIP: "10.0.0.1", SrcPort: 443}
+	if got := matchAll(rm, header); len(got) != 0 {
+		t.Errorf("matched %v without a geo db", got)
+	}
+	rm.Geo = g
+	tests := []struct {
+		header common.FiveTuple
+		want   []string
+	}{
+		{header, []string{"aws_us", "not_au"}},
+		{common.FiveTuple{SrcIP: "52.94.200.1", DstIP: "10.0.0.1", SrcPort: 80}, []string{"not_au"}},
+		{common.FiveTuple{SrcIP: "1.1.1.1", DstIP: "10.0.0.1", SrcPort: 53}, []string{"cloudflare"}},
+	}
+	for _, tt := range tests {
+		got := matchAll(rm, tt.header)
+		if len(got) != len(tt.want) {
+			t.Errorf("%v matched %v, want %v", tt.header, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v matched %v, want %v", tt.header, got, tt.want)
+			}
+		}
+	}
+}
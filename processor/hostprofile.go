@@ -0,0 +1,488 @@
+package processor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type HostProfileConfig struct {
+	// Key is ip (the client IP) or mac (the client MAC, needs the packet
+	// parser to record MACs)
+	Key string `mapstructure:"key"`
+	// Period is the length of a profile, periods start at midnight of
+	// TimeZone if they divide a day
+	Period   time.Duration `mapstructure:"period"`
+	TimeZone string        `mapstructure:"time_zone"`
+	// SessionGap is the idle time ending a session
+	SessionGap time.Duration `mapstructure:"session_gap"`
+	// SNI and DNS add the names of protocol.sni and protocol.dns to the
+	// services of a host, at most MaxServices per period
+	SNI         bool `mapstructure:"sni"`
+	DNS         bool `mapstructure:"dns"`
+	MaxServices int  `mapstructure:"max_services"`
+	// StateFile keeps hosts and their open period across runs, '' => none
+	StateFile string `mapstructure:"state_file"`
+	// ForgetAfter drops hosts idle for longer from the state, 0 => never
+	ForgetAfter time.Duration `mapstructure:"forget_after"`
+}
+
+// HostProfileEvent is the profile of a host over a period
+type HostProfileEvent struct {
+	Host  string
+	Start time.Time
+	End   time.Time
+	// Complete is false for the snapshot of a period open at teardown,
+	// the period is published again once it ends
+	Complete  bool
+	FirstSeen time.Time
+	// IPs are the client IPs of a MAC
+	IPs       []string `json:",omitempty"`
+	Sessions  int
+	ActiveMS  int64
+	UpBytes   uint64
+	DownBytes uint64
+	Flows     int
+	// MaxConcurrentFlows counts flows from their first packet to expiry
+	MaxConcurrentFlows int
+	ClassBytes         map[string]uint64
+	Services           []string
+	ServicesDropped    int `json:",omitempty"`
+	// ActiveHours are the hours of day with packets
+	ActiveHours []int
+}
+
+// HostProfiler profiles client hosts, keyed by IP or MAC. A host has
+// sessions, runs of packets without a SessionGap; the time between their
+// packets is its active time. Bytes are attributed to the class of their
+// flow as the flow expires or the period ends. Periods are timed by
+// packets and published as host.profile for every host seen in them.
+type HostProfiler struct {
+	BasePublisher
+	config HostProfileConfig
+	loc    *time.Location
+
+	periodStart time.Time
+	hosts       map[string]*hostState
+	flows       map[common.FiveTuple]*hostFlow
+	// ipMAC maps client IPs to MACs for DNS
+	ipMAC map[string]string
+
+	nPeriods  int
+	nNoMAC    int
+	nUnmapped int
+}
+
+// hostState is what the state file keeps of a host
+type hostState struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	IPs       map[string]bool `json:",omitempty"`
+	Period    hostPeriod
+
+	// active flows, not kept across runs
+	active int
+}
+
+type hostPeriod struct {
+	Seen            bool
+	Sessions        int
+	Active          time.Duration
+	UpBytes         uint64
+	DownBytes       uint64
+	Flows           int
+	MaxConcurrent   int
+	ClassBytes      map[string]uint64
+	Services        map[string]bool
+	ServicesDropped int
+	Hours           [24]bool
+}
+
+type hostProfileState struct {
+	Key         string
+	Period      time.Duration
+	PeriodStart time.Time
+	Hosts       map[string]*hostState
+}
+
+// hostFlow holds the bytes of a flow not yet attributed to its class
+type hostFlow struct {
+	host     *hostState
+	class    string
+	fallback bool
+	bytes    uint64
+	// names seen before the flow's first packet
+	names []string
+}
+
+func NewHostProfiler(config HostProfileConfig) *HostProfiler {
+	if config.Key == "" {
+		config.Key = "ip"
+	}
+	if config.Key != "ip" && config.Key != "mac" {
+		log.Fatal().Str("key", config.Key).Msg("host profile: key must be ip or mac")
+	}
+	if config.Period <= 0 {
+		config.Period = 24 * time.Hour
+	}
+	if config.SessionGap <= 0 {
+		config.SessionGap = 30 * time.Minute
+	}
+	if config.MaxServices <= 0 {
+		config.MaxServices = 1000
+	}
+	loc, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		log.Fatal().Err(err).Str("time_zone", config.TimeZone).Msg("host profile: unknown time zone")
+	}
+	hp := &HostProfiler{
+		config: config,
+		loc:    loc,
+		hosts:  make(map[string]*hostState),
+		flows:  make(map[common.FiveTuple]*hostFlow),
+		ipMAC:  make(map[string]string),
+	}
+	if config.StateFile != "" {
+		hp.loadState()
+	}
+	return hp
+}
+
+func (hp *HostProfiler) loadState() {
+	b, err := ioutil.ReadFile(hp.config.StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("path", hp.config.StateFile).Msg("host profile: unable to read state")
+	}
+	var state hostProfileState
+	if err := json.Unmarshal(b, &state); err != nil {
+		log.Fatal().Err(err).Str("path", hp.config.StateFile).Msg("host profile: unable to parse state")
+	}
+	if state.Key != hp.config.Key || state.Period != hp.config.Period {
+		log.Warn().Str("path", hp.config.StateFile).Str("key", state.Key).Dur("period", state.Period).
+			Msg("host profile: state has another key or period, ignored")
+		return
+	}
+	hp.periodStart = state.PeriodStart
+	for key, h := range state.Hosts {
+		for ip := range h.IPs {
+			hp.ipMAC[ip] = key
+		}
+		hp.hosts[key] = h
+	}
+}
+
+func (hp *HostProfiler) saveState() {
+	b, err := json.Marshal(hostProfileState{
+		Key:         hp.config.Key,
+		Period:      hp.config.Period,
+		PeriodStart: hp.periodStart,
+		Hosts:       hp.hosts,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("host profile: unable to encode state")
+		return
+	}
+	tmp := hp.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Error().Err(err).Str("path", hp.config.StateFile).Msg("host profile: unable to write state")
+		return
+	}
+	if err := os.Rename(tmp, hp.config.StateFile); err != nil {
+		log.Error().Err(err).Str("path", hp.config.StateFile).Msg("host profile: unable to write state")
+	}
+}
+
+func (hp *HostProfiler) Init() {
+	log.Debug().Str("proc", hp.Name()).Str("key", hp.config.Key).Dur("period", hp.config.Period).
+		Str("time_zone", hp.loc.String()).Int("hosts", len(hp.hosts)).Msg("init")
+}
+
+func (hp *HostProfiler) Name() string {
+	return "host_profiler"
+}
+
+func (hp *HostProfiler) Subs() []events.Topic {
+	subs := []events.Topic{events.PACKET, events.CLASSIFICATION, events.FLOW_EXPIRED}
+	if hp.config.SNI {
+		subs = append(subs, events.PROTOCOL_SNI)
+	}
+	if hp.config.DNS {
+		subs = append(subs, events.PROTOCOL_DNS)
+	}
+	return subs
+}
+
+func (hp *HostProfiler) Pubs() []events.Topic {
+	return []events.Topic{events.HOST_PROFILE}
+}
+
+// period returns the start of the period of t, aligned to the time zone
+func (hp *HostProfiler) period(t time.Time) time.Time {
+	_, offset := t.In(hp.loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(hp.config.Period).Add(-shift)
+}
+
+func (hp *HostProfiler) host(key string) *hostState {
+	h, exists := hp.hosts[key]
+	if !exists {
+		h = &hostState{}
+		hp.hosts[key] = h
+	}
+	return h
+}
+
+func (hp *HostProfiler) flow(header common.FiveTuple) *hostFlow {
+	f, exists := hp.flows[header]
+	if !exists {
+		f = &hostFlow{}
+		hp.flows[header] = f
+	}
+	return f
+}
+
+func (hp *HostProfiler) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		hp.packet(event.(common.Packet))
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Class == "" || clf.AtExpiry {
+			return
+		}
+		f := hp.flow(clf.Header)
+		if f.class == "" || (f.fallback && !clf.Fallback) {
+			// bytes so far go to the new class
+			f.class, f.fallback = clf.Class, clf.Fallback
+		}
+	case events.FLOW_EXPIRED:
+		header := event.(FlowExpiredEvent).Header
+		f, exists := hp.flows[header]
+		if !exists {
+			return
+		}
+		hp.attribute(f)
+		if f.host != nil {
+			f.host.active--
+		}
+		delete(hp.flows, header)
+	case events.PROTOCOL_SNI:
+		sni := event.(SNIRecord)
+		f := hp.flow(sni.Header)
+		if f.host == nil {
+			f.names = append(f.names, sni.SNI)
+			return
+		}
+		hp.addService(f.host, sni.SNI)
+	case events.PROTOCOL_DNS:
+		dr := event.(DNSRecord)
+		key := dr.ClientIP
+		if hp.config.Key == "mac" {
+			if key = hp.ipMAC[dr.ClientIP]; key == "" {
+				hp.nUnmapped++
+				return
+			}
+		}
+		hp.addService(hp.host(key), dr.Name)
+	}
+}
+
+func (hp *HostProfiler) packet(p common.Packet) {
+	if start := hp.period(p.Timestamp); hp.periodStart.IsZero() {
+		hp.periodStart = start
+	} else if start.After(hp.periodStart) {
+		hp.closePeriod(true)
+		hp.periodStart = start
+	}
+	header := p.GetKey()
+	f := hp.flow(header)
+	if f.host == nil {
+		key := header.DstIP
+		if hp.config.Key == "mac" {
+			if key = p.ClientMAC; key == "" {
+				hp.nNoMAC++
+				return
+			}
+		}
+		h := hp.host(key)
+		if hp.config.Key == "mac" {
+			if h.IPs == nil {
+				h.IPs = make(map[string]bool)
+			}
+			h.IPs[header.DstIP] = true
+			hp.ipMAC[header.DstIP] = key
+		}
+		f.host = h
+		h.active++
+		h.Period.Flows++
+		for _, name := range f.names {
+			hp.addService(h, name)
+		}
+		f.names = nil
+	}
+	h := f.host
+	hp.touch(h, p.Timestamp)
+	if h.active > h.Period.MaxConcurrent {
+		h.Period.MaxConcurrent = h.active
+	}
+	f.bytes += uint64(p.TotalLen)
+	if p.IsOutbound {
+		h.Period.UpBytes += uint64(p.TotalLen)
+	} else {
+		h.Period.DownBytes += uint64(p.TotalLen)
+	}
+}
+
+// touch adds a packet at t to the sessions and active hours of a host
+func (hp *HostProfiler) touch(h *hostState, t time.Time) {
+	gap := t.Sub(h.LastSeen)
+	newSession := h.LastSeen.IsZero() || gap > hp.config.SessionGap
+	// a session continuing from the last period counts in both
+	if newSession || !h.Period.Seen {
+		h.Period.Sessions++
+	}
+	if !newSession && gap > 0 {
+		from := h.LastSeen
+		if from.Before(hp.periodStart) {
+			from = hp.periodStart
+		}
+		if t.After(from) {
+			h.Period.Active += t.Sub(from)
+		}
+	}
+	h.Period.Seen = true
+	h.Period.Hours[t.In(hp.loc).Hour()] = true
+	if h.FirstSeen.IsZero() {
+		h.FirstSeen = t
+	}
+	if t.After(h.LastSeen) {
+		h.LastSeen = t
+	}
+}
+
+func (hp *HostProfiler) addService(h *hostState, name string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || h.Period.Services[name] {
+		return
+	}
+	if len(h.Period.Services) >= hp.config.MaxServices {
+		h.Period.ServicesDropped++
+		return
+	}
+	if h.Period.Services == nil {
+		h.Period.Services = make(map[string]bool)
+	}
+	h.Period.Services[name] = true
+}
+
+// attribute adds the bytes of a flow to its class
+func (hp *HostProfiler) attribute(f *hostFlow) {
+	if f.host == nil || f.bytes == 0 {
+		return
+	}
+	class := f.class
+	if class == "" {
+		class = "unclassified"
+	}
+	p := &f.host.Period
+	if p.ClassBytes == nil {
+		p.ClassBytes = make(map[string]uint64)
+	}
+	p.ClassBytes[class] += f.bytes
+	f.bytes = 0
+}
+
+// closePeriod publishes the profiles of the hosts seen in the period.
+// Complete periods are reset, hosts idle for ForgetAfter forgotten.
+func (hp *HostProfiler) closePeriod(complete bool) {
+	for _, f := range hp.flows {
+		hp.attribute(f)
+	}
+	keys := make([]string, 0, len(hp.hosts))
+	for key, h := range hp.hosts {
+		if h.Period.Seen {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hp.Publish(events.HOST_PROFILE, hp.profile(key, hp.hosts[key], complete))
+	}
+	if !complete {
+		return
+	}
+	hp.nPeriods++
+	end := hp.periodStart.Add(hp.config.Period)
+	for key, h := range hp.hosts {
+		if hp.config.ForgetAfter > 0 && h.active == 0 && end.Sub(h.LastSeen) > hp.config.ForgetAfter {
+			delete(hp.hosts, key)
+			for ip := range h.IPs {
+				delete(hp.ipMAC, ip)
+			}
+			continue
+		}
+		h.Period = hostPeriod{MaxConcurrent: h.active}
+	}
+	if hp.config.StateFile != "" {
+		hp.saveState()
+	}
+}
+
+func (hp *HostProfiler) profile(key string, h *hostState, complete bool) HostProfileEvent {
+	p := h.Period
+	pe := HostProfileEvent{
+		Host:               key,
+		Start:              hp.periodStart,
+		End:                hp.periodStart.Add(hp.config.Period),
+		Complete:           complete,
+		FirstSeen:          h.FirstSeen,
+		Sessions:           p.Sessions,
+		ActiveMS:           int64(p.Active / time.Millisecond),
+		UpBytes:            p.UpBytes,
+		DownBytes:          p.DownBytes,
+		Flows:              p.Flows,
+		MaxConcurrentFlows: p.MaxConcurrent,
+		ClassBytes:         make(map[string]uint64, len(p.ClassBytes)),
+		Services:           make([]string, 0, len(p.Services)),
+		ServicesDropped:    p.ServicesDropped,
+		ActiveHours:        []int{},
+	}
+	for ip := range h.IPs {
+		pe.IPs = append(pe.IPs, ip)
+	}
+	sort.Strings(pe.IPs)
+	for class, b := range p.ClassBytes {
+		pe.ClassBytes[class] = b
+	}
+	for name := range p.Services {
+		pe.Services = append(pe.Services, name)
+	}
+	sort.Strings(pe.Services)
+	for hour, active := range p.Hours {
+		if active {
+			pe.ActiveHours = append(pe.ActiveHours, hour)
+		}
+	}
+	return pe
+}
+
+func (hp *HostProfiler) Teardown() {
+	if !hp.periodStart.IsZero() {
+		hp.closePeriod(false)
+	}
+	if hp.config.StateFile != "" {
+		hp.saveState()
+	}
+	log.Info().Str("proc", hp.Name()).Int("hosts", len(hp.hosts)).Int("periods", hp.nPeriods).
+		Int("no_mac", hp.nNoMAC).Int("dns_unmapped", hp.nUnmapped).Msg("teardown")
+}
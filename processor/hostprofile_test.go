@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type hostProfileTest struct {
+	hp  *HostProfiler
+	got []HostProfileEvent
+}
+
+func newHostProfileTest(config HostProfileConfig) *hostProfileTest {
+	ht := &hostProfileTest{hp: NewHostProfiler(config)}
+	ht.hp.SetPubFunc(func(topic events.Topic, event interface{}) {
+		ht.got = append(ht.got, event.(HostProfileEvent))
+	})
+	ht.hp.Init()
+	return ht
+}
+
+func (ht *hostProfileTest) packet(t time.Time, key common.FiveTuple, outbound bool, size uint, mac string) {
+	p := common.Packet{Timestamp: t, Header: key, TotalLen: size, ClientMAC: mac}
+	if outbound {
+		p.IsOutbound = true
+		p.Header = common.FiveTuple{SrcIP: key.DstIP, DstIP: key.SrcIP, SrcPort: key.DstPort, DstPort: key.SrcPort, Protocol: key.Protocol}
+	}
+	ht.hp.EventHandler(events.PACKET, p)
+}
+
+// take returns the published profiles and forgets them
+func (ht *hostProfileTest) take() []HostProfileEvent {
+	got := ht.got
+	ht.got = nil
+	return got
+}
+
+func checkProfiles(t *testing.T, got, want []HostProfileEvent) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d profiles, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("profile %d:\n%+v\nwant\n%+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHostProfiler(t *testing.T) {
+	config := HostProfileConfig{
+		TimeZone:   "UTC",
+		SessionGap: 10 * time.Minute,
+		SNI:        true,
+		DNS:        true,
+		StateFile:  filepath.Join(t.TempDir(), "hosts.json"),
+	}
+	day1 := time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)
+	day2, day3 := day1.Add(24*time.Hour), day1.Add(48*time.Hour)
+	at := func(day time.Time, h, m int) time.Time {
+		return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	}
+	flowA := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	flowB := common.FiveTuple{SrcIP: "5.6.7.8", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50001, Protocol: 6}
+	flowC := common.FiveTuple{SrcIP: "5.6.7.8", DstIP: "10.0.0.2", SrcPort: 443, DstPort: 50002, Protocol: 6}
+	flowD := common.FiveTuple{SrcIP: "5.6.7.8", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50003, Protocol: 6}
+
+	ht := newHostProfileTest(config)
+	// sni before the first packet, class after it
+	ht.hp.EventHandler(events.PROTOCOL_SNI, SNIRecord{Header: flowA, SNI: "Netflix.com"})
+	ht.packet(at(day1, 10, 0), flowA, true, 100, "")
+	ht.packet(at(day1, 10, 0).Add(30*time.Second), flowA, false, 1000, "")
+	ht.hp.EventHandler(events.CLASSIFICATION, EventClassification{Header: flowA, Class: "netflix"})
+	ht.packet(at(day1, 10, 5), flowB, false, 500, "")
+	ht.hp.EventHandler(events.PROTOCOL_DNS, DNSRecord{ClientIP: "10.0.0.1", Name: "example.org."})
+	ht.hp.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: flowB})
+	ht.packet(at(day1, 11, 0), flowA, true, 100, "")
+	ht.packet(at(day1, 23, 0), flowC, false, 200, "")
+	if len(ht.got) != 0 {
+		t.Fatalf("%d profiles before the period ended", len(ht.got))
+	}
+
+	ht.packet(at(day2, 0, 30), flowA, true, 50, "")
+	checkProfiles(t, ht.take(), []HostProfileEvent{
+		{Host: "10.0.0.1", Start: day1, End: day2, Complete: true, FirstSeen: at(day1, 10, 0),
+			Sessions: 2, ActiveMS: 300000, UpBytes: 200, DownBytes: 1500, Flows: 2, MaxConcurrentFlows: 2,
+			ClassBytes: map[string]uint64{"netflix": 1200, "unclassified": 500},
+			Services:   []string{"example.org", "netflix.com"}, ActiveHours: []int{10, 11}},
+		{Host: "10.0.0.2", Start: day1, End: day2, Complete: true, FirstSeen: at(day1, 23, 0),
+			Sessions: 1, DownBytes: 200, Flows: 1, MaxConcurrentFlows: 1,
+			ClassBytes: map[string]uint64{"unclassified": 200}, Services: []string{}, ActiveHours: []int{23}},
+	})
+	ht.hp.Teardown()
+	checkProfiles(t, ht.take(), []HostProfileEvent{
+		{Host: "10.0.0.1", Start: day2, End: day3, FirstSeen: at(day1, 10, 0),
+			Sessions: 1, UpBytes: 50, MaxConcurrentFlows: 1,
+			ClassBytes: map[string]uint64{"netflix": 50}, Services: []string{}, ActiveHours: []int{0}},
+	})
+
+	// the next run continues the open period and the session, flowA is
+	// gone with the last run
+	ht = newHostProfileTest(config)
+	ht.packet(at(day2, 0, 35), flowD, false, 10, "")
+	ht.hp.Teardown()
+	day2Profile := HostProfileEvent{Host: "10.0.0.1", Start: day2, End: day3, FirstSeen: at(day1, 10, 0),
+		Sessions: 1, ActiveMS: 300000, UpBytes: 50, DownBytes: 10, Flows: 1, MaxConcurrentFlows: 1,
+		ClassBytes: map[string]uint64{"netflix": 50, "unclassified": 10}, Services: []string{}, ActiveHours: []int{0}}
+	checkProfiles(t, ht.take(), []HostProfileEvent{day2Profile})
+
+	// and publishes it once a later period starts
+	ht = newHostProfileTest(config)
+	ht.packet(at(day3, 8, 0), flowC, false, 10, "")
+	day2Profile.Complete = true
+	checkProfiles(t, ht.take(), []HostProfileEvent{day2Profile})
+}
+
+func TestHostProfilerMAC(t *testing.T) {
+	ht := newHostProfileTest(HostProfileConfig{Key: "mac", DNS: true, TimeZone: "UTC", Period: time.Hour})
+	t0 := time.Date(2020, 9, 13, 10, 0, 0, 0, time.UTC)
+	mac := "aa:bb:cc:dd:ee:ff"
+	ht.packet(t0, common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}, true, 100, mac)
+	ht.packet(t0.Add(time.Minute), common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "fe80::1", SrcPort: 443, DstPort: 50001, Protocol: 6}, false, 100, mac)
+	// no ethernet header
+	ht.packet(t0.Add(time.Minute), common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.9", SrcPort: 443, DstPort: 50002, Protocol: 6}, false, 100, "")
+	ht.hp.EventHandler(events.PROTOCOL_DNS, DNSRecord{ClientIP: "fe80::1", Name: "example.org"})
+	ht.hp.EventHandler(events.PROTOCOL_DNS, DNSRecord{ClientIP: "10.0.0.9", Name: "example.com"})
+	ht.hp.Teardown()
+	got := ht.take()
+	if len(got) != 1 {
+		t.Fatalf("%d profiles, want 1: %+v", len(got), got)
+	}
+	if got[0].Host != mac || !reflect.DeepEqual(got[0].IPs, []string{"10.0.0.1", "fe80::1"}) ||
+		!reflect.DeepEqual(got[0].Services, []string{"example.org"}) || got[0].Flows != 2 {
+		t.Errorf("profile %+v", got[0])
+	}
+	if ht.hp.nNoMAC != 1 || ht.hp.nUnmapped != 1 {
+		t.Errorf("%d packets without mac, %d unmapped dns records", ht.hp.nNoMAC, ht.hp.nUnmapped)
+	}
+}
@@ -0,0 +1,515 @@
+package processor
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+const (
+	ipfixVersion         = 10
+	ipfixHeaderLen       = 16
+	ipfixSetHeaderLen    = 4
+	ipfixTemplateSetID   = 2
+	ipfixTemplateIPv4    = 256
+	ipfixTemplateIPv6    = 257
+	ipfixVarLen          = 0xffff
+	ipfixEnterpriseBit   = 0x8000
+	ipfixReversePEN      = 29305 // RFC 5103 reverse information elements
+	ipfixExamplePEN      = 32473 // RFC 5612 documentation enterprise number
+	ipfixMaxMessageBytes = 1400
+)
+
+// IANA information elements (RFC 7012)
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowEndReason            = 136
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+)
+
+// edrint information elements, under IPFIXConfig.EnterpriseNumber
+const (
+	ieEdrintClass           = 1
+	ieEdrintSNI             = 2
+	ieEdrintRTTMinMS        = 3
+	ieEdrintRTTMedianMS     = 4
+	ieEdrintRTTMaxMS        = 5
+	ieEdrintRTTSamples      = 6
+	ieEdrintRetransmitsUp   = 7
+	ieEdrintRetransmitsDown = 8
+)
+
+type IPFIXConfig struct {
+	// Collector is the host:port records are sent to over Transport,
+	// udp or tcp
+	Collector         string `mapstructure:"collector"`
+	Transport         string `mapstructure:"transport"`
+	ObservationDomain uint32 `mapstructure:"observation_domain"`
+	// EnterpriseNumber is the PEN of the edrint information elements
+	EnterpriseNumber uint32 `mapstructure:"enterprise_number"`
+	// TemplateRefresh is how often templates are resent over UDP
+	TemplateRefresh time.Duration `mapstructure:"template_refresh"`
+	// FlushInterval sends a partial message when a record comes this
+	// long after the last message, otherwise messages are sent when full
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// SNI, RTT and Retransmits add optional fields, which need the SNI
+	// parser and the tcp_rtt and tcp_retransmit_simple telemetry
+	SNI         bool `mapstructure:"sni"`
+	RTT         bool `mapstructure:"rtt"`
+	Retransmits bool `mapstructure:"retransmits"`
+	// QueueSize is the number of messages waiting to be sent, messages
+	// beyond are dropped
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+type ipfixField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+	put        func(b []byte, r *ipfixRecord) []byte
+}
+
+type ipfixRecord struct {
+	fe             FlowExpiredEvent
+	client, server net.IP
+	flow           *ipfixFlow
+}
+
+type ipfixFlow struct {
+	class       string
+	fallback    bool
+	sni         string
+	rtts        []float64
+	retransUp   uint32
+	retransDown uint32
+}
+
+// IPFIXExporter exports a biflow record (RFC 5103) per expired flow to an
+// IPFIX (RFC 7011) collector. The source is the client, forward counters
+// are upstream and reverse counters downstream. The flow's class (its
+// first non fallback class), SNI and RTT and retransmit summaries are
+// enterprise specific elements. Messages are sent from a separate
+// goroutine so a slow collector never blocks the event path.
+type IPFIXExporter struct {
+	BaseSubscriber
+	config    IPFIXConfig
+	templates map[uint16][]ipfixField
+	flows     map[common.FiveTuple]*ipfixFlow
+
+	sets         map[uint16][]byte
+	size         int
+	records      int
+	seq          uint32
+	lastFlush    time.Time
+	lastTemplate time.Time
+
+	queue    chan ipfixMessage
+	wg       sync.WaitGroup
+	nSent    uint64
+	nDropped uint64
+}
+
+type ipfixMessage struct {
+	b       []byte
+	seq     uint32
+	records int
+}
+
+func NewIPFIXExporter(config IPFIXConfig) *IPFIXExporter {
+	switch config.Transport {
+	case "":
+		config.Transport = "udp"
+	case "udp", "tcp":
+	default:
+		log.Fatal().Str("transport", config.Transport).Msg("unknown ipfix transport")
+	}
+	if _, _, err := net.SplitHostPort(config.Collector); err != nil {
+		log.Fatal().Err(err).Str("collector", config.Collector).Msg("invalid ipfix collector")
+	}
+	if config.EnterpriseNumber == 0 {
+		config.EnterpriseNumber = ipfixExamplePEN
+	}
+	if config.TemplateRefresh == 0 {
+		config.TemplateRefresh = time.Minute
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 256
+	}
+	ie := &IPFIXExporter{
+		config: config,
+		flows:  make(map[common.FiveTuple]*ipfixFlow),
+		sets:   make(map[uint16][]byte),
+	}
+	ie.templates = map[uint16][]ipfixField{
+		ipfixTemplateIPv4: ie.fields(false),
+		ipfixTemplateIPv6: ie.fields(true),
+	}
+	return ie
+}
+
+func (ie *IPFIXExporter) fields(v6 bool) []ipfixField {
+	srcIP, dstIP, ipLen := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address), uint16(4)
+	if v6 {
+		srcIP, dstIP, ipLen = ieSourceIPv6Address, ieDestinationIPv6Address, 16
+	}
+	pen := ie.config.EnterpriseNumber
+	fields := []ipfixField{
+		{srcIP, ipLen, 0, func(b []byte, r *ipfixRecord) []byte { return append(b, r.client...) }},
+		{dstIP, ipLen, 0, func(b []byte, r *ipfixRecord) []byte { return append(b, r.server...) }},
+		{ieSourceTransportPort, 2, 0, func(b []byte, r *ipfixRecord) []byte {
+			return appendUint16(b, int(r.fe.Header.DstPort))
+		}},
+		{ieDestinationTransportPort, 2, 0, func(b []byte, r *ipfixRecord) []byte {
+			return appendUint16(b, int(r.fe.Header.SrcPort))
+		}},
+		{ieProtocolIdentifier, 1, 0, func(b []byte, r *ipfixRecord) []byte { return append(b, r.fe.Header.Protocol) }},
+		{ieFlowStartMilliseconds, 8, 0, func(b []byte, r *ipfixRecord) []byte {
+			return appendUint64(b, uint64(r.fe.FirstPacketTS.UnixNano()/int64(time.Millisecond)))
+		}},
+		{ieFlowEndMilliseconds, 8, 0, func(b []byte, r *ipfixRecord) []byte {
+			return appendUint64(b, uint64(r.fe.LastPacketTS.UnixNano()/int64(time.Millisecond)))
+		}},
+		{ieOctetDeltaCount, 8, 0, func(b []byte, r *ipfixRecord) []byte { return appendUint64(b, uint64(r.fe.UpBytes)) }},
+		{iePacketDeltaCount, 8, 0, func(b []byte, r *ipfixRecord) []byte { return appendUint64(b, uint64(r.fe.UpPackets)) }},
+		{ieOctetDeltaCount, 8, ipfixReversePEN, func(b []byte, r *ipfixRecord) []byte {
+			return appendUint64(b, uint64(r.fe.DownBytes))
+		}},
+		{iePacketDeltaCount, 8, ipfixReversePEN, func(b []byte, r *ipfixRecord) []byte {
+			return appendUint64(b, uint64(r.fe.DownPackets))
+		}},
+		// idle timeout
+		{ieFlowEndReason, 1, 0, func(b []byte, r *ipfixRecord) []byte { return append(b, 1) }},
+		{ieEdrintClass, ipfixVarLen, pen, func(b []byte, r *ipfixRecord) []byte {
+			return appendIPFIXString(b, r.flow.class)
+		}},
+	}
+	if ie.config.SNI {
+		fields = append(fields, ipfixField{ieEdrintSNI, ipfixVarLen, pen, func(b []byte, r *ipfixRecord) []byte {
+			return appendIPFIXString(b, r.flow.sni)
+		}})
+	}
+	if ie.config.RTT {
+		rtt := func(p float64) func(b []byte, r *ipfixRecord) []byte {
+			return func(b []byte, r *ipfixRecord) []byte {
+				if len(r.flow.rtts) == 0 {
+					return appendUint32(b, 0)
+				}
+				return appendUint32(b, uint32(percentile(r.flow.rtts, p)))
+			}
+		}
+		fields = append(fields,
+			ipfixField{ieEdrintRTTMinMS, 4, pen, rtt(0)},
+			ipfixField{ieEdrintRTTMedianMS, 4, pen, rtt(50)},
+			ipfixField{ieEdrintRTTMaxMS, 4, pen, rtt(100)},
+			ipfixField{ieEdrintRTTSamples, 4, pen, func(b []byte, r *ipfixRecord) []byte {
+				return appendUint32(b, uint32(len(r.flow.rtts)))
+			}})
+	}
+	if ie.config.Retransmits {
+		fields = append(fields,
+			ipfixField{ieEdrintRetransmitsUp, 4, pen, func(b []byte, r *ipfixRecord) []byte {
+				return appendUint32(b, r.flow.retransUp)
+			}},
+			ipfixField{ieEdrintRetransmitsDown, 4, pen, func(b []byte, r *ipfixRecord) []byte {
+				return appendUint32(b, r.flow.retransDown)
+			}})
+	}
+	return fields
+}
+
+func (ie *IPFIXExporter) Init() {
+	log.Debug().Str("proc", ie.Name()).Str("collector", ie.config.Collector).
+		Str("transport", ie.config.Transport).Uint32("enterprise_number", ie.config.EnterpriseNumber).
+		Bool("sni", ie.config.SNI).Bool("rtt", ie.config.RTT).Bool("retransmits", ie.config.Retransmits).Msg("init")
+	ie.queue = make(chan ipfixMessage, ie.config.QueueSize)
+	ie.lastFlush = time.Now()
+	ie.wg.Add(1)
+	go ie.send()
+}
+
+func (ie *IPFIXExporter) Name() string {
+	return "ipfix_exporter"
+}
+
+func (ie *IPFIXExporter) Subs() []events.Topic {
+	subs := []events.Topic{events.CLASSIFICATION, events.FLOW_EXPIRED}
+	if ie.config.SNI {
+		subs = append(subs, events.PROTOCOL_SNI)
+	}
+	if ie.config.RTT {
+		subs = append(subs, events.TELEMETRY_TCP_RTT)
+	}
+	if ie.config.Retransmits {
+		subs = append(subs, events.TELEMETRY_TCP_RETRANSMIT)
+	}
+	return subs
+}
+
+func (ie *IPFIXExporter) flow(header common.FiveTuple) *ipfixFlow {
+	f, exists := ie.flows[header]
+	if !exists {
+		f = &ipfixFlow{}
+		ie.flows[header] = f
+	}
+	return f
+}
+
+func (ie *IPFIXExporter) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Class == "" || clf.AtExpiry {
+			return
+		}
+		f := ie.flow(clf.Header)
+		if f.class == "" || (f.fallback && !clf.Fallback) {
+			f.class, f.fallback = clf.Class, clf.Fallback
+		}
+	case events.PROTOCOL_SNI:
+		sni := event.(SNIRecord)
+		ie.flow(sni.Header).sni = sni.SNI
+	case events.TELEMETRY_TCP_RTT:
+		if v, header, ok := eventFlow(event); ok {
+			f := ie.flow(header)
+			f.rtts = append(f.rtts, numericField(v, "RTTMS")...)
+		}
+	case events.TELEMETRY_TCP_RETRANSMIT:
+		if v, header, ok := eventFlow(event); ok {
+			f := ie.flow(header)
+			f.retransUp += uint32(sumValues(numericField(v, "RetransmitsUp")))
+			f.retransDown += uint32(sumValues(numericField(v, "RetransmitsDown")))
+		}
+	case events.FLOW_EXPIRED:
+		fe := event.(FlowExpiredEvent)
+		f, exists := ie.flows[fe.Header]
+		if !exists {
+			f = &ipfixFlow{}
+		}
+		delete(ie.flows, fe.Header)
+		ie.add(fe, f)
+	}
+}
+
+func sumValues(values []float64) float64 {
+	var total float64
+	for _, x := range values {
+		total += x
+	}
+	return total
+}
+
+// add encodes the record of an expired flow, sending the pending
+// message first if the record does not fit or it is due
+func (ie *IPFIXExporter) add(fe FlowExpiredEvent, f *ipfixFlow) {
+	r := ipfixRecord{fe: fe, flow: f, server: net.ParseIP(fe.Header.SrcIP), client: net.ParseIP(fe.Header.DstIP)}
+	if r.server == nil || r.client == nil {
+		log.Debug().Str("header", fe.Header.String()).Msg("ipfix: unparsable address")
+		return
+	}
+	template := uint16(ipfixTemplateIPv6)
+	if r.server.To4() != nil && r.client.To4() != nil {
+		template = ipfixTemplateIPv4
+		r.server, r.client = r.server.To4(), r.client.To4()
+	} else {
+		r.server, r.client = r.server.To16(), r.client.To16()
+	}
+
+	var b []byte
+	for _, field := range ie.templates[template] {
+		b = field.put(b, &r)
+	}
+	if ie.size+len(b)+ipfixSetHeaderLen > ipfixMaxMessageBytes-ipfixHeaderLen-ie.templateSetLen() {
+		ie.flush()
+	}
+	if len(ie.sets[template]) == 0 {
+		ie.size += ipfixSetHeaderLen
+	}
+	ie.sets[template] = append(ie.sets[template], b...)
+	ie.size += len(b)
+	ie.records++
+	if time.Since(ie.lastFlush) >= ie.config.FlushInterval {
+		ie.flush()
+	}
+}
+
+func (ie *IPFIXExporter) templateSetLen() int {
+	return len(ie.templateSet())
+}
+
+// templateSet encodes the template set of both templates
+func (ie *IPFIXExporter) templateSet() []byte {
+	b := appendUint16(nil, ipfixTemplateSetID)
+	b = appendUint16(b, 0)
+	for _, id := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+		fields := ie.templates[id]
+		b = appendUint16(b, int(id))
+		b = appendUint16(b, len(fields))
+		for _, f := range fields {
+			if f.enterprise != 0 {
+				b = appendUint16(b, int(f.id|ipfixEnterpriseBit))
+				b = appendUint16(b, int(f.length))
+				b = appendUint32(b, f.enterprise)
+			} else {
+				b = appendUint16(b, int(f.id))
+				b = appendUint16(b, int(f.length))
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+// message encodes an IPFIX message holding sets, seq is the number of
+// data records sent before
+func (ie *IPFIXExporter) message(seq uint32, sets ...[]byte) []byte {
+	b := appendUint16(nil, ipfixVersion)
+	b = appendUint16(b, 0)
+	b = appendUint32(b, uint32(time.Now().Unix()))
+	b = appendUint32(b, seq)
+	b = appendUint32(b, ie.config.ObservationDomain)
+	for _, set := range sets {
+		b = append(b, set...)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+// flush queues the pending records, with the templates over UDP when
+// they are due
+func (ie *IPFIXExporter) flush() {
+	ie.lastFlush = time.Now()
+	if ie.records == 0 {
+		return
+	}
+	var sets [][]byte
+	if ie.config.Transport == "udp" && time.Since(ie.lastTemplate) >= ie.config.TemplateRefresh {
+		sets = append(sets, ie.templateSet())
+		ie.lastTemplate = time.Now()
+	}
+	sets = append(sets, ie.dataSets()...)
+	msg := ipfixMessage{b: ie.message(ie.seq, sets...), seq: ie.seq, records: ie.records}
+	ie.seq += uint32(ie.records)
+	ie.size, ie.records = 0, 0
+	select {
+	case ie.queue <- msg:
+	default:
+		atomic.AddUint64(&ie.nDropped, uint64(msg.records))
+		// the collector must not take the templates as sent
+		ie.lastTemplate = time.Time{}
+	}
+}
+
+// dataSets encodes the pending records as a data set per template
+func (ie *IPFIXExporter) dataSets() [][]byte {
+	var sets [][]byte
+	for _, id := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+		if len(ie.sets[id]) == 0 {
+			continue
+		}
+		set := appendUint16(nil, int(id))
+		set = appendUint16(set, ipfixSetHeaderLen+len(ie.sets[id]))
+		sets = append(sets, append(set, ie.sets[id]...))
+		ie.sets[id] = ie.sets[id][:0]
+	}
+	return sets
+}
+
+// send writes queued messages to the collector, reconnecting over TCP
+// (and resending the templates) after failures
+func (ie *IPFIXExporter) send() {
+	defer ie.wg.Done()
+	var conn net.Conn
+	delay := 100 * time.Millisecond
+	for msg := range ie.queue {
+		for conn == nil {
+			var err error
+			conn, err = net.Dial(ie.config.Transport, ie.config.Collector)
+			if err == nil && ie.config.Transport == "tcp" {
+				_, err = conn.Write(ie.message(msg.seq, ie.templateSet()))
+			}
+			if err == nil {
+				delay = 100 * time.Millisecond
+				break
+			}
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			log.Warn().Err(err).Str("collector", ie.config.Collector).Dur("retry_in", delay).Msg("ipfix: unable to connect")
+			// messages queued meanwhile are dropped, not the event path
+			time.Sleep(delay)
+			if delay < 30*time.Second {
+				delay *= 2
+			}
+			ie.drain()
+		}
+		if _, err := conn.Write(msg.b); err != nil {
+			log.Warn().Err(err).Str("collector", ie.config.Collector).Msg("ipfix: unable to send")
+			atomic.AddUint64(&ie.nDropped, uint64(msg.records))
+			conn.Close()
+			conn = nil
+			continue
+		}
+		atomic.AddUint64(&ie.nSent, uint64(msg.records))
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// drain drops the queued messages but one, keeping the queue from
+// filling up while the collector is unreachable
+func (ie *IPFIXExporter) drain() {
+	for len(ie.queue) > 1 {
+		msg, ok := <-ie.queue
+		if !ok {
+			return
+		}
+		atomic.AddUint64(&ie.nDropped, uint64(msg.records))
+	}
+}
+
+func (ie *IPFIXExporter) Teardown() {
+	ie.flush()
+	close(ie.queue)
+	ie.wg.Wait()
+	log.Info().Str("proc", ie.Name()).Uint64("records_sent", atomic.LoadUint64(&ie.nSent)).
+		Uint64("records_dropped", atomic.LoadUint64(&ie.nDropped)).Msg("teardown")
+}
+
+func (ie *IPFIXExporter) Collect(w *MetricsWriter) {
+	w.Counter("edrint_ipfix_records_sent_total", "IPFIX records sent", float64(atomic.LoadUint64(&ie.nSent)))
+	w.Counter("edrint_ipfix_records_dropped_total", "IPFIX records dropped", float64(atomic.LoadUint64(&ie.nDropped)))
+}
+
+// appendIPFIXString encodes a variable length string (RFC 7011 7.)
+func appendIPFIXString(b []byte, s string) []byte {
+	if len(s) < 255 {
+		b = append(b, byte(len(s)))
+	} else {
+		if len(s) > 0xffff {
+			s = s[:0xffff]
+		}
+		b = append(b, 255)
+		b = appendUint16(b, len(s))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,266 @@
+package processor
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+type ipfixTestField struct {
+	id         uint16
+	enterprise uint32
+	length     uint16
+}
+
+type ipfixTestKey struct {
+	id         uint16
+	enterprise uint32
+}
+
+// ipfixTestDecoder decodes IPFIX messages into records keyed by
+// information element
+type ipfixTestDecoder struct {
+	templates map[uint16][]ipfixTestField
+	records   []map[ipfixTestKey][]byte
+	seq       []uint32
+}
+
+func (d *ipfixTestDecoder) decode(t *testing.T, msg []byte) {
+	t.Helper()
+	if v := binary.BigEndian.Uint16(msg); v != ipfixVersion {
+		t.Fatalf("version %d", v)
+	}
+	if n := int(binary.BigEndian.Uint16(msg[2:])); n != len(msg) {
+		t.Fatalf("message length %d, got %d bytes", n, len(msg))
+	}
+	d.seq = append(d.seq, binary.BigEndian.Uint32(msg[8:]))
+	for b := msg[ipfixHeaderLen:]; len(b) > 0; {
+		id, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		set := b[ipfixSetHeaderLen:n]
+		b = b[n:]
+		if id == ipfixTemplateSetID {
+			for len(set) > 0 {
+				tid, count := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+				set = set[4:]
+				var fields []ipfixTestField
+				for i := 0; i < count; i++ {
+					f := ipfixTestField{id: binary.BigEndian.Uint16(set), length: binary.BigEndian.Uint16(set[2:])}
+					set = set[4:]
+					if f.id&ipfixEnterpriseBit != 0 {
+						f.id &^= ipfixEnterpriseBit
+						f.enterprise = binary.BigEndian.Uint32(set)
+						set = set[4:]
+					}
+					fields = append(fields, f)
+				}
+				d.templates[tid] = fields
+			}
+			continue
+		}
+		fields, exists := d.templates[id]
+		if !exists {
+			t.Fatalf("data set %d before its template", id)
+		}
+		for len(set) > 0 {
+			r := make(map[ipfixTestKey][]byte)
+			for _, f := range fields {
+				n := int(f.length)
+				if f.length == ipfixVarLen {
+					n, set = int(set[0]), set[1:]
+					if n == 255 {
+						n, set = int(binary.BigEndian.Uint16(set)), set[2:]
+					}
+				}
+				r[ipfixTestKey{f.id, f.enterprise}] = set[:n]
+				set = set[n:]
+			}
+			d.records = append(d.records, r)
+		}
+	}
+}
+
+func ipfixTestFlows() []FlowExpiredEvent {
+	start := time.Unix(1600000000, 0)
+	return []FlowExpiredEvent{
+		{
+			FirstPacketTS: start,
+			LastPacketTS:  start.Add(1500 * time.Millisecond),
+			Header:        common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6},
+			UpBytes:       100, UpPackets: 2, DownBytes: 3000, DownPackets: 3,
+		},
+		{
+			FirstPacketTS: start,
+			LastPacketTS:  start.Add(time.Second),
+			Header:        common.FiveTuple{SrcIP: "2001:db8::1", DstIP: "fd00::2", SrcPort: 53, DstPort: 40000, Protocol: 17},
+			UpBytes:       60, UpPackets: 1, DownBytes: 120, DownPackets: 1,
+		},
+	}
+}
+
+func feedIPFIX(ie *IPFIXExporter) {
+	ie.SetPubFunc(func(events.Topic, interface{}) {})
+	ie.Init()
+	flows := ipfixTestFlows()
+	ie.EventHandler(events.CLASSIFICATION, EventClassification{Header: flows[0].Header, Class: "all_https", Fallback: true})
+	ie.EventHandler(events.CLASSIFICATION, EventClassification{Header: flows[0].Header, Class: "netflix"})
+	ie.EventHandler(events.CLASSIFICATION, EventClassification{Header: flows[0].Header, Class: "video"})
+	ie.EventHandler(events.PROTOCOL_SNI, SNIRecord{Header: flows[0].Header, SNI: "a.nflxvideo.net"})
+	ie.EventHandler(events.TELEMETRY_TCP_RTT, struct {
+		Header common.FiveTuple
+		RTTMS  []uint
+	}{flows[0].Header, []uint{30, 10, 20}})
+	ie.EventHandler(events.TELEMETRY_TCP_RETRANSMIT, struct {
+		Header          common.FiveTuple
+		RetransmitsUp   []int
+		RetransmitsDown []int
+	}{flows[0].Header, []int{1, 2}, []int{4}})
+	for _, fe := range flows {
+		ie.EventHandler(events.FLOW_EXPIRED, fe)
+	}
+	ie.Teardown()
+}
+
+func checkIPFIXRecords(t *testing.T, d *ipfixTestDecoder) {
+	t.Helper()
+	if len(d.records) != 2 {
+		t.Fatalf("%d records, want 2", len(d.records))
+	}
+	u64 := func(b []byte) uint64 {
+		var v uint64
+		for _, x := range b {
+			v = v<<8 | uint64(x)
+		}
+		return v
+	}
+	v4, v6 := d.records[0], d.records[1]
+	if ip := net.IP(v4[ipfixTestKey{ieSourceIPv4Address, 0}]); ip.String() != "10.0.0.1" {
+		t.Errorf("source %v, want the client", ip)
+	}
+	if ip := net.IP(v4[ipfixTestKey{ieDestinationIPv4Address, 0}]); ip.String() != "1.2.3.4" {
+		t.Errorf("destination %v, want the server", ip)
+	}
+	pen := uint32(ipfixExamplePEN)
+	for key, want := range map[ipfixTestKey]uint64{
+		{ieSourceTransportPort, 0}:            50000,
+		{ieDestinationTransportPort, 0}:       443,
+		{ieProtocolIdentifier, 0}:             6,
+		{ieFlowStartMilliseconds, 0}:          1600000000000,
+		{ieFlowEndMilliseconds, 0}:            1600000001500,
+		{ieOctetDeltaCount, 0}:                100,
+		{iePacketDeltaCount, 0}:               2,
+		{ieOctetDeltaCount, ipfixReversePEN}:  3000,
+		{iePacketDeltaCount, ipfixReversePEN}: 3,
+		{ieEdrintRTTMinMS, pen}:               10,
+		{ieEdrintRTTMedianMS, pen}:            20,
+		{ieEdrintRTTMaxMS, pen}:               30,
+		{ieEdrintRTTSamples, pen}:             3,
+		{ieEdrintRetransmitsUp, pen}:          3,
+		{ieEdrintRetransmitsDown, pen}:        4,
+	} {
+		if got := u64(v4[key]); got != want {
+			t.Errorf("ipv4 field %v: %d, want %d", key, got, want)
+		}
+	}
+	if class := string(v4[ipfixTestKey{ieEdrintClass, pen}]); class != "netflix" {
+		t.Errorf("class %q, want the first non fallback class", class)
+	}
+	if sni := string(v4[ipfixTestKey{ieEdrintSNI, pen}]); sni != "a.nflxvideo.net" {
+		t.Errorf("sni %q", sni)
+	}
+
+	if ip := net.IP(v6[ipfixTestKey{ieSourceIPv6Address, 0}]); ip.String() != "fd00::2" {
+		t.Errorf("ipv6 source %v", ip)
+	}
+	if ip := net.IP(v6[ipfixTestKey{ieDestinationIPv6Address, 0}]); ip.String() != "2001:db8::1" {
+		t.Errorf("ipv6 destination %v", ip)
+	}
+	if got := u64(v6[ipfixTestKey{ieOctetDeltaCount, ipfixReversePEN}]); got != 120 {
+		t.Errorf("ipv6 reverse octets %d", got)
+	}
+	if class, exists := v6[ipfixTestKey{ieEdrintClass, pen}]; !exists || len(class) != 0 {
+		t.Errorf("unclassified flow: class %q", class)
+	}
+}
+
+func TestIPFIXExporterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	feedIPFIX(NewIPFIXExporter(IPFIXConfig{
+		Collector: conn.LocalAddr().String(), SNI: true, RTT: true, Retransmits: true,
+	}))
+
+	d := &ipfixTestDecoder{templates: make(map[uint16][]ipfixTestField)}
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.decode(t, buf[:n])
+	checkIPFIXRecords(t, d)
+}
+
+func TestIPFIXExporterTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	stream := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(stream)
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		stream <- b
+	}()
+
+	feedIPFIX(NewIPFIXExporter(IPFIXConfig{
+		Collector: ln.Addr().String(), Transport: "tcp", SNI: true, RTT: true, Retransmits: true,
+	}))
+
+	d := &ipfixTestDecoder{templates: make(map[uint16][]ipfixTestField)}
+	select {
+	case b := <-stream:
+		for len(b) > 0 {
+			n := int(binary.BigEndian.Uint16(b[2:]))
+			d.decode(t, b[:n])
+			b = b[n:]
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream")
+	}
+	if len(d.seq) != 2 || d.seq[0] != 0 || d.seq[1] != 0 {
+		t.Errorf("sequence numbers %v, want templates then records from 0", d.seq)
+	}
+	checkIPFIXRecords(t, d)
+}
+
+func TestIPFIXStringEncoding(t *testing.T) {
+	long := make([]byte, 300)
+	for _, tc := range []struct {
+		s      string
+		prefix []byte
+	}{
+		{"", []byte{0}},
+		{"netflix", []byte{7}},
+		{string(long), []byte{255, 1, 44}},
+	} {
+		b := appendIPFIXString(nil, tc.s)
+		if string(b[:len(tc.prefix)]) != string(tc.prefix) || len(b) != len(tc.prefix)+len(tc.s) {
+			t.Errorf("%d byte string: encoded as % x...", len(tc.s), b[:len(tc.prefix)])
+		}
+	}
+}
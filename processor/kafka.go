@@ -0,0 +1,621 @@
+package processor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+// KafkaTopic maps an edrint topic to the Kafka topic it is published to
+type KafkaTopic struct {
+	Topic      string `mapstructure:"topic"`
+	KafkaTopic string `mapstructure:"kafka_topic"`
+}
+
+type KafkaConfig struct {
+	Brokers  []string     `mapstructure:"brokers"`
+	Topics   []KafkaTopic `mapstructure:"topics"`
+	ClientID string       `mapstructure:"client_id"`
+	// Acks is -1 to wait for all in sync replicas, 1 for the leader only
+	Acks int `mapstructure:"acks"`
+	// Compression is none, gzip or zstd (brokers 2.1+)
+	Compression string `mapstructure:"compression"`
+	// A batch is sent once it holds BatchRecords records or BatchBytes
+	// bytes, or Linger after its first record
+	BatchRecords int           `mapstructure:"batch_records"`
+	BatchBytes   int           `mapstructure:"batch_bytes"`
+	Linger       time.Duration `mapstructure:"linger"`
+	// Retries is the number of times a batch is resent, RetryBackoff
+	// after the first failure and doubling
+	Retries      int           `mapstructure:"retries"`
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+	// QueueSize is the number of records waiting to be batched, records
+	// beyond are dropped
+	QueueSize int `mapstructure:"queue_size"`
+	// SpoolDir keeps batches that could not be delivered, '' => they
+	// are dropped. Spooled records are sent, in order, before new ones
+	// once a broker is back, also by the next run.
+	SpoolDir      string        `mapstructure:"spool_dir"`
+	SpoolMaxBytes int64         `mapstructure:"spool_max_bytes"`
+	SpoolRetry    time.Duration `mapstructure:"spool_retry"`
+}
+
+// KafkaOutput publishes events to Kafka as their dump JSON (see
+// DumpItem). Events of a flow are keyed by the hex FlowHash of their
+// five tuple and go to partition FlowHash mod partitions, so a flow's
+// records stay in order in one partition; other events are spread
+// round robin. Records are sent from a separate goroutine and never
+// block the event path: when the queue is full they are dropped.
+type KafkaOutput struct {
+	BaseSubscriber
+	config      KafkaConfig
+	topics      map[events.Topic]string
+	compression int16
+	version     int16
+	anon        *Anonymizer
+
+	queue chan kafkaMessage
+	wg    sync.WaitGroup
+
+	// sender state
+	md         kafkaMetadata
+	conns      map[int32]*kafkaConn
+	roundRobin int32
+	down       bool
+	nextReplay time.Time
+	spool      *os.File
+	spoolBytes int64
+
+	nSent     uint64
+	nSpooled  uint64
+	nReplayed uint64
+	nDropped  uint64
+	nFailed   uint64
+}
+
+// kafkaMessage is a record for a Kafka topic, as queued and spooled
+type kafkaMessage struct {
+	Topic string
+	Key   []byte `json:",omitempty"`
+	Hash  uint64 `json:",omitempty"`
+	Value []byte
+	Time  time.Time
+}
+
+func NewKafkaOutput(config KafkaConfig) *KafkaOutput {
+	if len(config.Brokers) == 0 {
+		log.Fatal().Msg("kafka: no brokers")
+	}
+	ko := &KafkaOutput{config: config, topics: make(map[events.Topic]string), version: 3}
+	for _, t := range config.Topics {
+		if t.Topic == "" {
+			log.Fatal().Str("kafka_topic", t.KafkaTopic).Msg("kafka: topic mapping without topic")
+		}
+		if t.KafkaTopic == "" {
+			t.KafkaTopic = strings.Replace(t.Topic, "/", "_", -1)
+		}
+		ko.topics[events.Topic(t.Topic)] = t.KafkaTopic
+	}
+	switch config.Compression {
+	case "", "none":
+	case "gzip":
+		ko.compression = kafkaCompressionGzip
+	case "zstd":
+		ko.compression = kafkaCompressionZstd
+		ko.version = 7
+	default:
+		log.Fatal().Str("compression", config.Compression).Msg("kafka: unknown compression")
+	}
+	switch config.Acks {
+	case 0:
+		ko.config.Acks = -1
+	case -1, 1:
+	default:
+		log.Fatal().Int("acks", config.Acks).Msg("kafka: acks must be -1 or 1")
+	}
+	if ko.config.ClientID == "" {
+		ko.config.ClientID = "edrint"
+	}
+	if ko.config.BatchRecords == 0 {
+		ko.config.BatchRecords = 1000
+	}
+	if ko.config.BatchBytes == 0 {
+		ko.config.BatchBytes = 1 << 20
+	}
+	if ko.config.Linger == 0 {
+		ko.config.Linger = 100 * time.Millisecond
+	}
+	if ko.config.RetryBackoff == 0 {
+		ko.config.RetryBackoff = 100 * time.Millisecond
+	}
+	if ko.config.Timeout == 0 {
+		ko.config.Timeout = 10 * time.Second
+	}
+	if ko.config.QueueSize == 0 {
+		ko.config.QueueSize = 100000
+	}
+	if ko.config.SpoolMaxBytes == 0 {
+		ko.config.SpoolMaxBytes = 1 << 30
+	}
+	if ko.config.SpoolRetry == 0 {
+		ko.config.SpoolRetry = 5 * time.Second
+	}
+	return ko
+}
+
+// SetAnonymizer anonymizes every event before it is published
+func (ko *KafkaOutput) SetAnonymizer(a *Anonymizer) {
+	ko.anon = a
+}
+
+func (ko *KafkaOutput) Init() {
+	log.Debug().Str("proc", ko.Name()).Strs("brokers", ko.config.Brokers).Int("topics", len(ko.topics)).
+		Str("compression", ko.config.Compression).Str("spool_dir", ko.config.SpoolDir).Msg("init")
+	ko.conns = make(map[int32]*kafkaConn)
+	ko.queue = make(chan kafkaMessage, ko.config.QueueSize)
+	if ko.config.SpoolDir != "" {
+		if err := os.MkdirAll(ko.config.SpoolDir, 0755); err != nil {
+			log.Fatal().Err(err).Str("dir", ko.config.SpoolDir).Msg("kafka: unable to create spool dir")
+		}
+		// records spooled by an earlier run go first
+		if files := ko.spoolFiles(); len(files) > 0 {
+			for _, f := range files {
+				if fi, err := os.Stat(f); err == nil {
+					ko.spoolBytes += fi.Size()
+				}
+			}
+			log.Info().Int("files", len(files)).Int64("bytes", ko.spoolBytes).Msg("kafka: spooled records found")
+			ko.down = true
+		}
+	}
+	ko.wg.Add(1)
+	go ko.run()
+}
+
+func (ko *KafkaOutput) Name() string {
+	return "kafka_output"
+}
+
+func (ko *KafkaOutput) Subs() []events.Topic {
+	var topics []events.Topic
+	for t := range ko.topics {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i] < topics[j] })
+	return topics
+}
+
+func (ko *KafkaOutput) EventHandler(topic events.Topic, event interface{}) {
+	msg := kafkaMessage{Topic: ko.topics[topic], Time: time.Now()}
+	if _, header, ok := eventFlow(event); ok {
+		msg.Hash = telemetry.FlowHash(header)
+		msg.Key = []byte(fmt.Sprintf("%016x", msg.Hash))
+	}
+	if ko.anon != nil {
+		var err error
+		if event, err = ko.anon.Anonymize(event); err != nil {
+			log.Error().Err(err).Str("topic", string(topic)).Msg("unable to anonymize event: dropping event")
+			atomic.AddUint64(&ko.nDropped, 1)
+			return
+		}
+	}
+	var err error
+	msg.Value, err = json.Marshal(DumpItem{Topic: string(topic), Event: event})
+	if err != nil {
+		log.Error().Err(err).Str("topic", string(topic)).Msg("unable to marshal json: dropping event")
+		atomic.AddUint64(&ko.nDropped, 1)
+		return
+	}
+	select {
+	case ko.queue <- msg:
+	default:
+		atomic.AddUint64(&ko.nDropped, 1)
+	}
+}
+
+// run batches queued records and delivers them, until the queue is closed
+func (ko *KafkaOutput) run() {
+	defer ko.wg.Done()
+	var batch []kafkaMessage
+	size := 0
+	linger := time.NewTicker(ko.config.Linger)
+	defer linger.Stop()
+	var batchStart time.Time
+	for {
+		select {
+		case msg, ok := <-ko.queue:
+			if !ok {
+				ko.send(batch)
+				ko.closeSpool()
+				for _, kc := range ko.conns {
+					kc.Close()
+				}
+				return
+			}
+			if len(batch) == 0 {
+				batchStart = time.Now()
+			}
+			batch = append(batch, msg)
+			size += len(msg.Key) + len(msg.Value)
+			if len(batch) >= ko.config.BatchRecords || size >= ko.config.BatchBytes {
+				ko.send(batch)
+				batch, size = nil, 0
+			}
+		case now := <-linger.C:
+			if len(batch) > 0 && now.Sub(batchStart) >= ko.config.Linger {
+				ko.send(batch)
+				batch, size = nil, 0
+			}
+			if ko.down && now.After(ko.nextReplay) {
+				ko.replay()
+			}
+		}
+	}
+}
+
+// send delivers a batch, spooling it when it cannot be. Batches go to
+// the spool while it holds records, so records stay in order.
+func (ko *KafkaOutput) send(batch []kafkaMessage) {
+	if len(batch) == 0 {
+		return
+	}
+	if ko.down {
+		ko.spoolWrite(batch)
+		return
+	}
+	failed := ko.deliver(batch, ko.config.Retries)
+	if len(failed) > 0 {
+		ko.down = true
+		ko.nextReplay = time.Now().Add(ko.config.SpoolRetry)
+		log.Warn().Int("records", len(failed)).Dur("retry_in", ko.config.SpoolRetry).Msg("kafka: unable to deliver, spooling")
+		ko.spoolWrite(failed)
+	}
+}
+
+// deliver sends records to the partition leaders, retrying failures,
+// and returns the records that could not be delivered
+func (ko *KafkaOutput) deliver(batch []kafkaMessage, retries int) []kafkaMessage {
+	backoff := ko.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		batch = ko.attempt(batch)
+		if len(batch) == 0 || attempt >= retries {
+			return batch
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		// leaders may have moved
+		ko.md = kafkaMetadata{}
+	}
+}
+
+type kafkaTopicPartition struct {
+	topic     string
+	partition int32
+}
+
+// attempt sends records once and returns those to retry
+func (ko *KafkaOutput) attempt(batch []kafkaMessage) []kafkaMessage {
+	if err := ko.refreshMetadata(batch); err != nil {
+		log.Debug().Err(err).Msg("kafka: metadata unavailable")
+		return batch
+	}
+	var retry []kafkaMessage
+	byLeader := make(map[int32]map[kafkaTopicPartition][]kafkaMessage)
+	for _, msg := range batch {
+		partitions := ko.md.topics[msg.Topic]
+		if len(partitions) == 0 {
+			retry = append(retry, msg)
+			continue
+		}
+		var p kafkaPartition
+		if msg.Key != nil {
+			p = partitions[msg.Hash%uint64(len(partitions))]
+		} else {
+			ko.roundRobin++
+			p = partitions[int(ko.roundRobin)%len(partitions)]
+		}
+		if byLeader[p.leader] == nil {
+			byLeader[p.leader] = make(map[kafkaTopicPartition][]kafkaMessage)
+		}
+		tp := kafkaTopicPartition{msg.Topic, p.id}
+		byLeader[p.leader][tp] = append(byLeader[p.leader][tp], msg)
+	}
+	for leader, tps := range byLeader {
+		retry = append(retry, ko.produce(leader, tps)...)
+	}
+	return retry
+}
+
+// produce sends a leader its partitions' records and returns those to retry
+func (ko *KafkaOutput) produce(leader int32, tps map[kafkaTopicPartition][]kafkaMessage) []kafkaMessage {
+	all := func() []kafkaMessage {
+		var msgs []kafkaMessage
+		for _, m := range tps {
+			msgs = append(msgs, m...)
+		}
+		return msgs
+	}
+	set := make(kafkaProduceSet)
+	for tp, msgs := range tps {
+		records := make([]kafkaRecord, len(msgs))
+		for i, m := range msgs {
+			records[i] = kafkaRecord{Key: m.Key, Value: m.Value, Time: m.Time}
+		}
+		b, err := encodeRecordBatch(records, ko.compression)
+		if err != nil {
+			log.Error().Err(err).Msg("kafka: unable to encode batch: dropping records")
+			atomic.AddUint64(&ko.nFailed, uint64(len(msgs)))
+			delete(tps, tp)
+			continue
+		}
+		if set[tp.topic] == nil {
+			set[tp.topic] = make(map[int32][]byte)
+		}
+		set[tp.topic][tp.partition] = b
+	}
+	kc, err := ko.conn(leader)
+	if err != nil {
+		log.Debug().Err(err).Int32("broker", leader).Msg("kafka: unable to connect")
+		return all()
+	}
+	codes, err := kc.produce(set, int16(ko.config.Acks), ko.config.Timeout, ko.version)
+	if err != nil {
+		log.Debug().Err(err).Int32("broker", leader).Msg("kafka: produce failed")
+		kc.Close()
+		delete(ko.conns, leader)
+		return all()
+	}
+	var retry []kafkaMessage
+	for tp, msgs := range tps {
+		code, exists := codes[tp.topic][tp.partition]
+		switch {
+		case exists && code == kafkaErrNone:
+			atomic.AddUint64(&ko.nSent, uint64(len(msgs)))
+		case !exists || kafkaRetriable(code):
+			retry = append(retry, msgs...)
+		default:
+			log.Error().Str("topic", tp.topic).Int32("partition", tp.partition).Int16("error_code", code).
+				Int("records", len(msgs)).Msg("kafka: records rejected")
+			atomic.AddUint64(&ko.nFailed, uint64(len(msgs)))
+		}
+	}
+	return retry
+}
+
+// refreshMetadata fetches the partitions of the batch's topics unless known
+func (ko *KafkaOutput) refreshMetadata(batch []kafkaMessage) error {
+	var missing []string
+	seen := make(map[string]struct{})
+	for _, msg := range batch {
+		if _, known := ko.md.topics[msg.Topic]; known {
+			continue
+		}
+		if _, exists := seen[msg.Topic]; !exists {
+			seen[msg.Topic] = struct{}{}
+			missing = append(missing, msg.Topic)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for t := range ko.md.topics {
+		missing = append(missing, t)
+	}
+	addrs := append([]string(nil), ko.config.Brokers...)
+	for _, addr := range ko.md.brokers {
+		addrs = append(addrs, addr)
+	}
+	var err error
+	for _, addr := range addrs {
+		var kc *kafkaConn
+		if kc, err = dialKafka(addr, ko.config.ClientID, ko.config.Timeout); err != nil {
+			continue
+		}
+		var md kafkaMetadata
+		md, err = kc.metadata(missing)
+		kc.Close()
+		if err != nil {
+			continue
+		}
+		// partition leaders are used by index, all must be known
+		for t, partitions := range md.topics {
+			sort.Slice(partitions, func(i, j int) bool { return partitions[i].id < partitions[j].id })
+			for _, p := range partitions {
+				if p.err != kafkaErrNone || p.leader < 0 {
+					delete(md.topics, t)
+					break
+				}
+			}
+		}
+		for t, code := range md.errors {
+			if code != kafkaErrNone {
+				log.Debug().Str("topic", t).Int16("error_code", code).Msg("kafka: topic unavailable")
+			}
+		}
+		for id, kc := range ko.conns {
+			if md.brokers[id] != kc.addr {
+				kc.Close()
+				delete(ko.conns, id)
+			}
+		}
+		ko.md = md
+		return nil
+	}
+	return err
+}
+
+func (ko *KafkaOutput) conn(broker int32) (*kafkaConn, error) {
+	if kc, exists := ko.conns[broker]; exists {
+		return kc, nil
+	}
+	addr, exists := ko.md.brokers[broker]
+	if !exists {
+		return nil, fmt.Errorf("unknown broker %d", broker)
+	}
+	kc, err := dialKafka(addr, ko.config.ClientID, ko.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	ko.conns[broker] = kc
+	return kc, nil
+}
+
+const kafkaSpoolFileBytes = 4 << 20
+
+func (ko *KafkaOutput) spoolFiles() []string {
+	files, _ := filepath.Glob(filepath.Join(ko.config.SpoolDir, "spool-*.jsonl"))
+	sort.Strings(files)
+	return files
+}
+
+// spoolWrite appends records to the spool, dropping them without one
+// or when it is full
+func (ko *KafkaOutput) spoolWrite(batch []kafkaMessage) {
+	if ko.config.SpoolDir == "" {
+		atomic.AddUint64(&ko.nDropped, uint64(len(batch)))
+		return
+	}
+	if ko.spool == nil {
+		path := filepath.Join(ko.config.SpoolDir, fmt.Sprintf("spool-%020d.jsonl", time.Now().UnixNano()))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("kafka: unable to create spool file: dropping records")
+			atomic.AddUint64(&ko.nDropped, uint64(len(batch)))
+			return
+		}
+		ko.spool = f
+	}
+	w := bufio.NewWriter(ko.spool)
+	for i, msg := range batch {
+		b, _ := json.Marshal(msg)
+		if ko.spoolBytes+int64(len(b))+1 > ko.config.SpoolMaxBytes {
+			log.Error().Int("records", len(batch)-i).Msg("kafka: spool full: dropping records")
+			atomic.AddUint64(&ko.nDropped, uint64(len(batch)-i))
+			break
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+		ko.spoolBytes += int64(len(b)) + 1
+		atomic.AddUint64(&ko.nSpooled, 1)
+	}
+	if err := w.Flush(); err != nil {
+		log.Error().Err(err).Str("path", ko.spool.Name()).Msg("kafka: unable to write spool")
+	}
+	if fi, err := ko.spool.Stat(); err == nil && fi.Size() >= kafkaSpoolFileBytes {
+		ko.closeSpool()
+	}
+}
+
+func (ko *KafkaOutput) closeSpool() {
+	if ko.spool == nil {
+		return
+	}
+	if err := ko.spool.Close(); err != nil {
+		log.Error().Err(err).Str("path", ko.spool.Name()).Msg("kafka: unable to close spool file")
+	}
+	ko.spool = nil
+}
+
+// replay delivers spooled records oldest first. A file is removed once
+// delivered; on failure its undelivered records are kept.
+func (ko *KafkaOutput) replay() {
+	ko.closeSpool()
+	for _, path := range ko.spoolFiles() {
+		msgs, err := readKafkaSpool(path)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("kafka: unreadable spool file: removing")
+		}
+		for start := 0; start < len(msgs); start += ko.config.BatchRecords {
+			end := start + ko.config.BatchRecords
+			if end > len(msgs) {
+				end = len(msgs)
+			}
+			if failed := ko.deliver(msgs[start:end], 0); len(failed) > 0 {
+				ko.nextReplay = time.Now().Add(ko.config.SpoolRetry)
+				ko.rewriteSpool(path, append(failed, msgs[end:]...))
+				return
+			}
+			atomic.AddUint64(&ko.nReplayed, uint64(end-start))
+		}
+		if fi, err := os.Stat(path); err == nil {
+			ko.spoolBytes -= fi.Size()
+		}
+		os.Remove(path)
+		log.Info().Str("path", path).Int("records", len(msgs)).Msg("kafka: spool delivered")
+	}
+	ko.down = false
+	ko.spoolBytes = 0
+}
+
+func readKafkaSpool(path string) ([]kafkaMessage, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []kafkaMessage
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		var msg kafkaMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			// a run killed while spooling leaves a partial last line
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// rewriteSpool replaces a spool file by the records still to deliver
+func (ko *KafkaOutput) rewriteSpool(path string, msgs []kafkaMessage) {
+	var b []byte
+	for _, msg := range msgs {
+		line, _ := json.Marshal(msg)
+		b = append(append(b, line...), '\n')
+	}
+	if fi, err := os.Stat(path); err == nil {
+		ko.spoolBytes -= fi.Size()
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("kafka: unable to rewrite spool file")
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("kafka: unable to rewrite spool file")
+		return
+	}
+	ko.spoolBytes += int64(len(b))
+}
+
+func (ko *KafkaOutput) Teardown() {
+	close(ko.queue)
+	ko.wg.Wait()
+	log.Info().Str("proc", ko.Name()).Uint64("sent", atomic.LoadUint64(&ko.nSent)).
+		Uint64("spooled", atomic.LoadUint64(&ko.nSpooled)).Uint64("replayed", atomic.LoadUint64(&ko.nReplayed)).
+		Uint64("dropped", atomic.LoadUint64(&ko.nDropped)).Uint64("rejected", atomic.LoadUint64(&ko.nFailed)).
+		Msg("teardown")
+}
+
+func (ko *KafkaOutput) Collect(w *MetricsWriter) {
+	w.Counter("edrint_kafka_records_sent_total", "Records delivered to Kafka", float64(atomic.LoadUint64(&ko.nSent)))
+	w.Counter("edrint_kafka_records_spooled_total", "Records spooled to disk", float64(atomic.LoadUint64(&ko.nSpooled)))
+	w.Counter("edrint_kafka_records_replayed_total", "Spooled records delivered", float64(atomic.LoadUint64(&ko.nReplayed)))
+	w.Counter("edrint_kafka_records_dropped_total", "Records dropped as the queue or spool was full",
+		float64(atomic.LoadUint64(&ko.nDropped)))
+	w.Counter("edrint_kafka_records_rejected_total", "Records rejected by brokers", float64(atomic.LoadUint64(&ko.nFailed)))
+}
@@ -0,0 +1,324 @@
+package processor
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+// kafkaStub is a single broker leading every partition of any topic
+type kafkaStub struct {
+	ln         net.Listener
+	partitions int32
+
+	mu       sync.Mutex
+	records  map[string]map[int32][]kafkaRecord
+	failNext int16
+	down     bool
+	produces int
+}
+
+func newKafkaStub(t *testing.T, partitions int32) *kafkaStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &kafkaStub{ln: ln, partitions: partitions, records: make(map[string]map[int32][]kafkaRecord)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ks.serve(t, conn)
+		}
+	}()
+	return ks
+}
+
+func (ks *kafkaStub) addr() string {
+	return ks.ln.Addr().String()
+}
+
+func (ks *kafkaStub) setDown(down bool) {
+	ks.mu.Lock()
+	ks.down = down
+	ks.mu.Unlock()
+}
+
+func (ks *kafkaStub) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		ks.mu.Lock()
+		down := ks.down
+		ks.mu.Unlock()
+		if down {
+			return
+		}
+		d := kafkaDecoder{b: req}
+		key, version, corrID := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+		e := kafkaEncoder{}
+		e.int32(0)
+		e.int32(corrID)
+		switch key {
+		case kafkaMetadataKey:
+			ks.metadata(&d, &e)
+		case kafkaProduceKey:
+			if err := ks.produce(&d, &e, version); err != nil {
+				t.Errorf("produce: %v", err)
+				return
+			}
+		default:
+			t.Errorf("unexpected request %d", key)
+			return
+		}
+		binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+		if _, err := conn.Write(e.b); err != nil {
+			return
+		}
+	}
+}
+
+func (ks *kafkaStub) metadata(d *kafkaDecoder, e *kafkaEncoder) {
+	var topics []string
+	d.array(func() { topics = append(topics, d.string()) })
+	host, port, _ := net.SplitHostPort(ks.addr())
+	p, _ := strconv.Atoi(port)
+	e.int32(1)
+	e.int32(0)
+	e.string(host)
+	e.int32(int32(p))
+	e.int16(-1) // rack
+	e.int32(0)  // controller
+	e.int32(int32(len(topics)))
+	for _, topic := range topics {
+		e.int16(kafkaErrNone)
+		e.string(topic)
+		e.int8(0)
+		e.int32(ks.partitions)
+		for i := int32(0); i < ks.partitions; i++ {
+			e.int16(kafkaErrNone)
+			e.int32(i)
+			e.int32(0) // leader
+			e.int32(1) // replicas
+			e.int32(0)
+			e.int32(1) // isr
+			e.int32(0)
+		}
+	}
+}
+
+func (ks *kafkaStub) produce(d *kafkaDecoder, e *kafkaEncoder, version int16) error {
+	d.string() // transactional id
+	d.int16()  // acks
+	d.int32()  // timeout
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.produces++
+	fail := ks.failNext
+	ks.failNext = kafkaErrNone
+	var err error
+	n := d.int32()
+	e.int32(n)
+	for i := int32(0); i < n; i++ {
+		topic := d.string()
+		e.string(topic)
+		np := d.int32()
+		e.int32(np)
+		for j := int32(0); j < np; j++ {
+			p := d.int32()
+			records, derr := decodeRecordBatches(d.bytes())
+			if derr != nil {
+				err = derr
+			}
+			if fail == kafkaErrNone {
+				if ks.records[topic] == nil {
+					ks.records[topic] = make(map[int32][]kafkaRecord)
+				}
+				ks.records[topic][p] = append(ks.records[topic][p], records...)
+			}
+			e.int32(p)
+			e.int16(fail)
+			e.int64(0)
+			e.int64(-1)
+			if version >= 5 {
+				e.int64(0)
+			}
+		}
+	}
+	e.int32(0) // throttle time
+	return err
+}
+
+// all returns a topic's records by partition
+func (ks *kafkaStub) all(topic string) map[int32][]kafkaRecord {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.records[topic]
+}
+
+func kafkaTestConfig(brokers ...string) KafkaConfig {
+	return KafkaConfig{
+		Brokers:      brokers,
+		Topics:       []KafkaTopic{{Topic: "telemetry.flowlet", KafkaTopic: "flowlets"}, {Topic: "packet_parser.metadata"}},
+		Linger:       time.Millisecond,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Timeout:      time.Second,
+		SpoolRetry:   time.Millisecond,
+	}
+}
+
+var kafkaTestFlows = []common.FiveTuple{
+	{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6},
+	{SrcIP: "1.2.3.5", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50001, Protocol: 6},
+	{SrcIP: "1.2.3.6", DstIP: "10.0.0.2", SrcPort: 80, DstPort: 50002, Protocol: 6},
+}
+
+type kafkaTestEvent struct {
+	Header common.FiveTuple
+	N      int
+}
+
+// publishKafka publishes n events of every test flow and n without a flow
+func publishKafka(ko *KafkaOutput, n int) {
+	for i := 0; i < n; i++ {
+		for _, h := range kafkaTestFlows {
+			ko.EventHandler(events.TELEMETRY_FLOWLET, kafkaTestEvent{Header: h, N: i})
+		}
+		ko.EventHandler("packet_parser.metadata", struct{ N int }{i})
+	}
+}
+
+// checkKafka checks every flow's events are in order in its partition
+func checkKafka(t *testing.T, ks *kafkaStub, n int) {
+	t.Helper()
+	flowlets := ks.all("flowlets")
+	seen := make(map[common.FiveTuple]int)
+	total := 0
+	for p, records := range flowlets {
+		total += len(records)
+		for _, r := range records {
+			var item struct {
+				Topic string
+				Event kafkaTestEvent
+			}
+			if err := json.Unmarshal(r.Value, &item); err != nil {
+				t.Fatal(err)
+			}
+			hash := telemetry.FlowHash(item.Event.Header)
+			if string(r.Key) != fmt.Sprintf("%016x", hash) {
+				t.Errorf("key %s for %v", r.Key, item.Event.Header)
+			}
+			if want := int32(hash % uint64(ks.partitions)); p != want {
+				t.Errorf("%v in partition %d, want %d", item.Event.Header, p, want)
+			}
+			if item.Topic != string(events.TELEMETRY_FLOWLET) || item.Event.N != seen[item.Event.Header] {
+				t.Errorf("partition %d: %+v, want N %d", p, item, seen[item.Event.Header])
+			}
+			seen[item.Event.Header]++
+		}
+	}
+	if total != n*len(kafkaTestFlows) {
+		t.Errorf("%d flowlet records, want %d", total, n*len(kafkaTestFlows))
+	}
+	total = 0
+	for _, records := range ks.all("packet_parser.metadata") {
+		for _, r := range records {
+			if r.Key != nil {
+				t.Errorf("key %q for an event without a flow", r.Key)
+			}
+		}
+		total += len(records)
+	}
+	if total != n {
+		t.Errorf("%d metadata records, want %d", total, n)
+	}
+}
+
+func TestKafkaOutput(t *testing.T) {
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			ks := newKafkaStub(t, 4)
+			config := kafkaTestConfig(ks.addr())
+			config.Compression = compression
+			config.BatchRecords = 7
+			ko := NewKafkaOutput(config)
+			ko.Init()
+			publishKafka(ko, 20)
+			ko.Teardown()
+			checkKafka(t, ks, 20)
+			if ks.produces < 80/7 {
+				t.Errorf("%d produce requests for batches of 7", ks.produces)
+			}
+		})
+	}
+}
+
+func TestKafkaOutputRetries(t *testing.T) {
+	ks := newKafkaStub(t, 3)
+	ks.failNext = kafkaErrNotLeaderForPartition
+	ko := NewKafkaOutput(kafkaTestConfig(ks.addr()))
+	ko.Init()
+	publishKafka(ko, 5)
+	ko.Teardown()
+	checkKafka(t, ks, 5)
+	if ko.nSpooled != 0 || ko.nDropped != 0 {
+		t.Errorf("spooled %d, dropped %d", ko.nSpooled, ko.nDropped)
+	}
+}
+
+func TestKafkaOutputSpool(t *testing.T) {
+	ks := newKafkaStub(t, 2)
+	ks.setDown(true)
+	dir := t.TempDir()
+	config := kafkaTestConfig(ks.addr())
+	config.SpoolDir = dir
+	ko := NewKafkaOutput(config)
+	ko.Init()
+	publishKafka(ko, 5)
+	ko.Teardown()
+	if ko.nSpooled != 20 || ko.nSent != 0 {
+		t.Fatalf("spooled %d, sent %d with the broker down", ko.nSpooled, ko.nSent)
+	}
+
+	// the next run delivers the spool before its own records
+	ks.setDown(false)
+	ko = NewKafkaOutput(config)
+	ko.Init()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) == 0 {
+			break
+		}
+	}
+	ko.Teardown()
+	checkKafka(t, ks, 5)
+	if ko.nReplayed != 20 {
+		t.Errorf("replayed %d, want 20", ko.nReplayed)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d spool files left", len(files))
+	}
+}
@@ -0,0 +1,483 @@
+package processor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The subset of the Kafka protocol a producer needs: Metadata v1 and
+// Produce v3 (v7 for zstd) with v2 record batches.
+
+const (
+	kafkaProduceKey  = 0
+	kafkaMetadataKey = 3
+
+	kafkaCompressionNone = 0
+	kafkaCompressionGzip = 1
+	kafkaCompressionZstd = 4
+)
+
+// Kafka error codes the producer acts on
+const (
+	kafkaErrNone                    = 0
+	kafkaErrUnknownTopicOrPartition = 3
+	kafkaErrLeaderNotAvailable      = 5
+	kafkaErrNotLeaderForPartition   = 6
+	kafkaErrRequestTimedOut         = 7
+	kafkaErrNetworkException        = 13
+	kafkaErrNotEnoughReplicas       = 19
+	kafkaErrNotEnoughReplicasAfter  = 20
+)
+
+// kafkaRetriable reports whether a produce error may go away, e.g.
+// after a leader election
+func kafkaRetriable(code int16) bool {
+	switch code {
+	case kafkaErrUnknownTopicOrPartition, kafkaErrLeaderNotAvailable, kafkaErrNotLeaderForPartition,
+		kafkaErrRequestTimedOut, kafkaErrNetworkException, kafkaErrNotEnoughReplicas, kafkaErrNotEnoughReplicasAfter:
+		return true
+	}
+	return false
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.b = appendUint16(e.b, int(uint16(v))) }
+func (e *kafkaEncoder) int32(v int32) { e.b = appendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = appendUint64(e.b, uint64(v)) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.b = append(e.b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// varbytes encodes b with a varint length, nil as -1
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+var errKafkaShort = errors.New("kafka: response truncated")
+
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errKafkaShort
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string decodes a (nullable) string, null as ""
+func (d *kafkaDecoder) string() string {
+	n := int(d.int16())
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(n))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := int(d.int32())
+	if n < 0 {
+		return nil
+	}
+	return d.take(n)
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errKafkaShort
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// array calls f count times, count read as an int32
+func (d *kafkaDecoder) array(f func()) {
+	n := int(d.int32())
+	for i := 0; i < n && d.err == nil; i++ {
+		f()
+	}
+}
+
+// kafkaRecord is a record of a batch
+type kafkaRecord struct {
+	Key, Value []byte
+	Time       time.Time
+}
+
+// encodeRecordBatch encodes records as a v2 record batch
+func encodeRecordBatch(records []kafkaRecord, compression int16) ([]byte, error) {
+	first, max := records[0].Time, records[0].Time
+	for _, r := range records {
+		if r.Time.Before(first) {
+			first = r.Time
+		}
+		if r.Time.After(max) {
+			max = r.Time
+		}
+	}
+	var body kafkaEncoder
+	for i, r := range records {
+		var rec kafkaEncoder
+		rec.int8(0) // attributes
+		rec.varint(kafkaMillis(r.Time) - kafkaMillis(first))
+		rec.varint(int64(i))
+		rec.varbytes(r.Key)
+		rec.varbytes(r.Value)
+		rec.varint(0) // headers
+		body.varint(int64(len(rec.b)))
+		body.b = append(body.b, rec.b...)
+	}
+	compressed, err := kafkaCompress(body.b, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	var e kafkaEncoder
+	e.int64(0)  // base offset
+	e.int32(0)  // batch length, set below
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // crc, set below
+	crcStart := len(e.b)
+	e.int16(compression)
+	e.int32(int32(len(records) - 1)) // last offset delta
+	e.int64(kafkaMillis(first))
+	e.int64(kafkaMillis(max))
+	e.int64(-1) // producer id
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(int32(len(records)))
+	e.b = append(e.b, compressed...)
+	binary.BigEndian.PutUint32(e.b[8:], uint32(len(e.b)-12))
+	binary.BigEndian.PutUint32(e.b[crcStart-4:], crc32.Checksum(e.b[crcStart:], crc32c))
+	return e.b, nil
+}
+
+func kafkaMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func kafkaCompress(b []byte, compression int16) ([]byte, error) {
+	switch compression {
+	case kafkaCompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(b); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case kafkaCompressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(b, nil), nil
+	}
+	return b, nil
+}
+
+func kafkaDecompress(b []byte, compression int16) ([]byte, error) {
+	switch compression {
+	case kafkaCompressionNone:
+		return b, nil
+	case kafkaCompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	case kafkaCompressionZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(b, nil)
+	}
+	return nil, fmt.Errorf("kafka: unsupported compression %d", compression)
+}
+
+// decodeRecordBatches decodes the v2 record batches of a produce
+// request's records, checking their CRCs
+func decodeRecordBatches(b []byte) ([]kafkaRecord, error) {
+	var records []kafkaRecord
+	for len(b) > 0 {
+		d := kafkaDecoder{b: b}
+		d.int64() // base offset
+		n := int(d.int32())
+		batch := d.take(n)
+		if d.err != nil {
+			return records, d.err
+		}
+		b = d.b
+		d = kafkaDecoder{b: batch}
+		d.int32() // partition leader epoch
+		if magic := d.int8(); magic != 2 {
+			return records, fmt.Errorf("kafka: record batch magic %d", magic)
+		}
+		crc := uint32(d.int32())
+		if crc32.Checksum(d.b, crc32c) != crc {
+			return records, errors.New("kafka: record batch crc mismatch")
+		}
+		attributes := d.int16()
+		d.int32() // last offset delta
+		first := d.int64()
+		d.take(8 + 8 + 2 + 4) // max timestamp, producer id, epoch, sequence
+		count := int(d.int32())
+		if d.err != nil {
+			return records, d.err
+		}
+		body, err := kafkaDecompress(d.b, attributes&7)
+		if err != nil {
+			return records, err
+		}
+		d = kafkaDecoder{b: body}
+		for i := 0; i < count && d.err == nil; i++ {
+			rec := kafkaDecoder{b: d.take(int(d.varint()))}
+			rec.int8()
+			delta := rec.varint()
+			rec.varint() // offset delta
+			r := kafkaRecord{Key: rec.varbytes(), Value: rec.varbytes()}
+			r.Time = time.Unix(0, (first+delta)*int64(time.Millisecond))
+			if rec.err != nil {
+				return records, rec.err
+			}
+			records = append(records, r)
+		}
+		if d.err != nil {
+			return records, d.err
+		}
+	}
+	return records, nil
+}
+
+// kafkaConn is a connection to a broker, with one request in flight
+type kafkaConn struct {
+	addr     string
+	conn     net.Conn
+	clientID string
+	timeout  time.Duration
+	corrID   int32
+}
+
+func dialKafka(addr, clientID string, timeout time.Duration) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{addr: addr, conn: conn, clientID: clientID, timeout: timeout}, nil
+}
+
+// request sends a request and returns the response body
+func (kc *kafkaConn) request(key, version int16, body []byte) ([]byte, error) {
+	kc.corrID++
+	var e kafkaEncoder
+	e.int32(0)
+	e.int16(key)
+	e.int16(version)
+	e.int32(kc.corrID)
+	e.string(kc.clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	kc.conn.SetDeadline(time.Now().Add(kc.timeout))
+	if _, err := kc.conn.Write(e.b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(kc.conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(kc.conn, resp); err != nil {
+		return nil, err
+	}
+	d := kafkaDecoder{b: resp}
+	if corrID := d.int32(); d.err != nil || corrID != kc.corrID {
+		return nil, fmt.Errorf("kafka: response correlation id %d, want %d", corrID, kc.corrID)
+	}
+	return d.b, nil
+}
+
+func (kc *kafkaConn) Close() error {
+	return kc.conn.Close()
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+	err    int16
+}
+
+type kafkaMetadata struct {
+	brokers map[int32]string
+	topics  map[string][]kafkaPartition
+	errors  map[string]int16
+}
+
+func (kc *kafkaConn) metadata(topics []string) (kafkaMetadata, error) {
+	var e kafkaEncoder
+	e.int32(int32(len(topics)))
+	for _, t := range topics {
+		e.string(t)
+	}
+	resp, err := kc.request(kafkaMetadataKey, 1, e.b)
+	if err != nil {
+		return kafkaMetadata{}, err
+	}
+	md := kafkaMetadata{
+		brokers: make(map[int32]string),
+		topics:  make(map[string][]kafkaPartition),
+		errors:  make(map[string]int16),
+	}
+	d := kafkaDecoder{b: resp}
+	d.array(func() {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		md.brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	})
+	d.int32() // controller
+	d.array(func() {
+		code := d.int16()
+		name := d.string()
+		d.int8() // internal
+		var partitions []kafkaPartition
+		d.array(func() {
+			p := kafkaPartition{err: d.int16(), id: d.int32(), leader: d.int32()}
+			d.array(func() { d.int32() }) // replicas
+			d.array(func() { d.int32() }) // isr
+			partitions = append(partitions, p)
+		})
+		md.errors[name] = code
+		if code == kafkaErrNone {
+			md.topics[name] = partitions
+		}
+	})
+	return md, d.err
+}
+
+// kafkaProduceSet is the record batches of a produce request
+type kafkaProduceSet map[string]map[int32][]byte
+
+// produce sends batches and returns the error code of every partition
+func (kc *kafkaConn) produce(set kafkaProduceSet, acks int16, timeout time.Duration, version int16) (map[string]map[int32]int16, error) {
+	var e kafkaEncoder
+	e.int16(-1) // transactional id
+	e.int16(acks)
+	e.int32(int32(timeout / time.Millisecond))
+	e.int32(int32(len(set)))
+	for topic, partitions := range set {
+		e.string(topic)
+		e.int32(int32(len(partitions)))
+		for p, batch := range partitions {
+			e.int32(p)
+			e.bytes(batch)
+		}
+	}
+	resp, err := kc.request(kafkaProduceKey, version, e.b)
+	if err != nil {
+		return nil, err
+	}
+	codes := make(map[string]map[int32]int16)
+	d := kafkaDecoder{b: resp}
+	d.array(func() {
+		topic := d.string()
+		codes[topic] = make(map[int32]int16)
+		d.array(func() {
+			p := d.int32()
+			codes[topic][p] = d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if version >= 5 {
+				d.int64() // log start offset
+			}
+		})
+	})
+	return codes, d.err
+}
@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MetricsCollector is implemented by processors exposing Prometheus
+// metrics. Collect is called from the metrics server's goroutine, so
+// anything it reads must be atomic or locked.
+type MetricsCollector interface {
+	Collect(w *MetricsWriter)
+}
+
+// MetricsWriter writes metrics in the Prometheus text exposition format.
+// Samples of a metric must be written one after the other.
+type MetricsWriter struct {
+	w    io.Writer
+	last string
+	err  error
+}
+
+// the text format escapes only these, unlike Go string literals
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w}
+}
+
+// Counter writes a counter sample, labels are name, value pairs
+func (mw *MetricsWriter) Counter(name, help string, value float64, labels ...string) {
+	mw.sample(name, "counter", help, value, labels)
+}
+
+// Gauge writes a gauge sample, labels are name, value pairs
+func (mw *MetricsWriter) Gauge(name, help string, value float64, labels ...string) {
+	mw.sample(name, "gauge", help, value, labels)
+}
+
+func (mw *MetricsWriter) Err() error {
+	return mw.err
+}
+
+func (mw *MetricsWriter) sample(name, typ, help string, value float64, labels []string) {
+	if mw.err != nil {
+		return
+	}
+	var b strings.Builder
+	if name != mw.last {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+		mw.last = name
+	}
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('\n')
+	_, mw.err = io.WriteString(mw.w, b.String())
+}
@@ -0,0 +1,33 @@
+package processor
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var b bytes.Buffer
+	mw := NewMetricsWriter(&b)
+	mw.Counter("edrint_packets_total", "Packets read", 42)
+	mw.Gauge("edrint_rtt_ms", "RTT\nin ms, \\ escaped", 1.5, "class", "netflix")
+	mw.Gauge("edrint_rtt_ms", "RTT\nin ms, \\ escaped", math.Inf(1), "class", `a"b\c`+"\nd", "sni", "café\t")
+	mw.Counter("edrint_events_total", "Events", 1e21, "topic", "flow.expired")
+	if err := mw.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP edrint_packets_total Packets read
+# TYPE edrint_packets_total counter
+edrint_packets_total 42
+# HELP edrint_rtt_ms RTT\nin ms, \\ escaped
+# TYPE edrint_rtt_ms gauge
+edrint_rtt_ms{class="netflix"} 1.5
+edrint_rtt_ms{class="a\"b\\c\nd",sni="café	"} +Inf
+# HELP edrint_events_total Events
+# TYPE edrint_events_total counter
+edrint_events_total{topic="flow.expired"} 1e+21
+`
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,337 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// FlowFeatures collects the size, direction and inter-arrival time of the
+// first packets of a flow
+type FlowFeatures struct {
+	packets int
+	sizes   []float64
+	ups     []float64
+	iats    []float64
+	lastTS  time.Time
+}
+
+func NewFlowFeatures(packets int) *FlowFeatures {
+	return &FlowFeatures{
+		packets: packets,
+		sizes:   make([]float64, 0, packets),
+		ups:     make([]float64, 0, packets),
+		iats:    make([]float64, 0, packets),
+	}
+}
+
+// Add records p unless the feature set is full
+func (ff *FlowFeatures) Add(p common.Packet) {
+	if ff.Full() {
+		return
+	}
+	iat := 0.0
+	if len(ff.sizes) > 0 {
+		iat = msSince(ff.lastTS, p.Timestamp)
+	}
+	up := 0.0
+	if p.IsOutbound {
+		up = 1
+	}
+	ff.sizes = append(ff.sizes, float64(p.TotalLen))
+	ff.ups = append(ff.ups, up)
+	ff.iats = append(ff.iats, iat)
+	ff.lastTS = p.Timestamp
+}
+
+func (ff *FlowFeatures) Len() int {
+	return len(ff.sizes)
+}
+
+func (ff *FlowFeatures) Full() bool {
+	return len(ff.sizes) >= ff.packets
+}
+
+// Vector returns the features of the flow laid out as FeatureNames.
+// Packets not seen are left zero.
+func (ff *FlowFeatures) Vector(header common.FiveTuple) []float64 {
+	v := make([]float64, FeatureCount(ff.packets))
+	v[0] = float64(header.Protocol)
+	v[1] = float64(header.SrcPort)
+	for i := range ff.sizes {
+		v[2+3*i] = ff.sizes[i]
+		v[3+3*i] = ff.ups[i]
+		v[4+3*i] = ff.iats[i]
+	}
+	return v
+}
+
+func FeatureCount(packets int) int {
+	return 2 + 3*packets
+}
+
+// FeatureNames names the features of a vector built from the given
+// number of packets: protocol, server port, then per packet its size,
+// direction (1 => upstream) and inter-arrival time in ms
+func FeatureNames(packets int) []string {
+	names := []string{"protocol", "server_port"}
+	for i := 0; i < packets; i++ {
+		names = append(names,
+			fmt.Sprintf("size_%d", i),
+			fmt.Sprintf("up_%d", i),
+			fmt.Sprintf("iat_ms_%d", i))
+	}
+	return names
+}
+
+// TreeModel is an ensemble of decision trees in a simple JSON format:
+//
+//	{
+//	  "type": "forest",     // or "gbt"
+//	  "packets": 10,        // packets per flow the features were built from
+//	  "classes": ["streaming", "web", "gaming"],
+//	  "base_score": [0, 0, 0], // gbt only, optional
+//	  "trees": [{"class": 0, "nodes": [
+//	    {"feature": 2, "threshold": 120.5, "left": 1, "right": 2},
+//	    {"value": [0.9, 0.1, 0]},
+//	    {"value": [0.2, 0.3, 0.5]}
+//	  ]}]
+//	}
+//
+// Nodes send x[feature] <= threshold left, node 0 is the root and nodes
+// with a value are leaves. Forest leaves hold per class probabilities (or
+// counts) which are averaged over trees. Gbt leaves hold a single score
+// added to the tree's class, classes are scored with a softmax.
+type TreeModel struct {
+	Type      string      `json:"type"`
+	Packets   int         `json:"packets"`
+	Classes   []string    `json:"classes"`
+	BaseScore []float64   `json:"base_score"`
+	Trees     []ModelTree `json:"trees"`
+}
+
+type ModelTree struct {
+	Class int         `json:"class"`
+	Nodes []ModelNode `json:"nodes"`
+}
+
+type ModelNode struct {
+	Feature   int       `json:"feature"`
+	Threshold float64   `json:"threshold"`
+	Left      int       `json:"left"`
+	Right     int       `json:"right"`
+	Value     []float64 `json:"value"`
+}
+
+func LoadTreeModel(path string) (*TreeModel, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m TreeModel
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Validate checks the model can be evaluated without going out of
+// bounds or looping
+func (m *TreeModel) Validate() error {
+	if m.Type != "forest" && m.Type != "gbt" {
+		return fmt.Errorf("unknown model type: %q", m.Type)
+	}
+	if m.Packets <= 0 {
+		return fmt.Errorf("invalid packet count: %d", m.Packets)
+	}
+	if len(m.Classes) == 0 || len(m.Trees) == 0 {
+		return fmt.Errorf("model has no classes or trees")
+	}
+	if m.BaseScore != nil && len(m.BaseScore) != len(m.Classes) {
+		return fmt.Errorf("base_score has %d values for %d classes", len(m.BaseScore), len(m.Classes))
+	}
+	nFeatures := FeatureCount(m.Packets)
+	for t, tree := range m.Trees {
+		if len(tree.Nodes) == 0 {
+			return fmt.Errorf("tree %d: no nodes", t)
+		}
+		if m.Type == "gbt" && (tree.Class < 0 || tree.Class >= len(m.Classes)) {
+			return fmt.Errorf("tree %d: invalid class %d", t, tree.Class)
+		}
+		for i, n := range tree.Nodes {
+			if n.Value != nil {
+				want := len(m.Classes)
+				if m.Type == "gbt" {
+					want = 1
+				}
+				if len(n.Value) != want {
+					return fmt.Errorf("tree %d node %d: %d leaf values, want %d", t, i, len(n.Value), want)
+				}
+				continue
+			}
+			if n.Feature < 0 || n.Feature >= nFeatures {
+				return fmt.Errorf("tree %d node %d: invalid feature %d", t, i, n.Feature)
+			}
+			// children after parents rules out cycles
+			if n.Left <= i || n.Left >= len(tree.Nodes) || n.Right <= i || n.Right >= len(tree.Nodes) {
+				return fmt.Errorf("tree %d node %d: invalid children %d, %d", t, i, n.Left, n.Right)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *ModelTree) leaf(x []float64) []float64 {
+	n := &t.Nodes[0]
+	for n.Value == nil {
+		if x[n.Feature] <= n.Threshold {
+			n = &t.Nodes[n.Left]
+		} else {
+			n = &t.Nodes[n.Right]
+		}
+	}
+	return n.Value
+}
+
+// Predict returns the most likely class of x and its probability
+func (m *TreeModel) Predict(x []float64) (string, float64) {
+	scores := make([]float64, len(m.Classes))
+	switch m.Type {
+	case "forest":
+		for i := range m.Trees {
+			value := m.Trees[i].leaf(x)
+			total := 0.0
+			for _, v := range value {
+				total += v
+			}
+			if total == 0 {
+				continue
+			}
+			for c, v := range value {
+				scores[c] += v / total / float64(len(m.Trees))
+			}
+		}
+	case "gbt":
+		copy(scores, m.BaseScore)
+		for i := range m.Trees {
+			scores[m.Trees[i].Class] += m.Trees[i].leaf(x)[0]
+		}
+		softmax(scores)
+	}
+
+	best := 0
+	for c := range scores {
+		if scores[c] > scores[best] {
+			best = c
+		}
+	}
+	return m.Classes[best], scores[best]
+}
+
+func softmax(scores []float64) {
+	max := math.Inf(-1)
+	for _, s := range scores {
+		max = math.Max(max, s)
+	}
+	total := 0.0
+	for i := range scores {
+		scores[i] = math.Exp(scores[i] - max)
+		total += scores[i]
+	}
+	for i := range scores {
+		scores[i] /= total
+	}
+}
+
+// MLClassifier classifies flows by behaviour by scoring the features of
+// their first packets with a tree model. Flows expiring before enough
+// packets are seen are scored with what was seen. Predictions less
+// confident than minConfidence are dropped.
+type MLClassifier struct {
+	BasePublisher
+	model         *TreeModel
+	minConfidence float64
+	flows         map[common.FiveTuple]*FlowFeatures
+	done          map[common.FiveTuple]struct{}
+}
+
+func NewMLClassifier(model *TreeModel, minConfidence float64) *MLClassifier {
+	return &MLClassifier{
+		model:         model,
+		minConfidence: minConfidence,
+		flows:         make(map[common.FiveTuple]*FlowFeatures),
+		done:          make(map[common.FiveTuple]struct{}),
+	}
+}
+
+func (mc *MLClassifier) Init() {
+	log.Debug().Str("proc", mc.Name()).Str("type", mc.model.Type).Int("trees", len(mc.model.Trees)).
+		Int("packets", mc.model.Packets).Strs("classes", mc.model.Classes).
+		Float64("min_confidence", mc.minConfidence).Msg("init")
+}
+
+func (mc *MLClassifier) Name() string {
+	return "ml_classifier"
+}
+
+func (mc *MLClassifier) Subs() []events.Topic {
+	return []events.Topic{events.PACKET, events.FLOW_EXPIRED}
+}
+
+func (mc *MLClassifier) Pubs() []events.Topic {
+	return []events.Topic{events.CLASSIFICATION}
+}
+
+func (mc *MLClassifier) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		p := event.(common.Packet)
+		key := p.GetKey()
+		if _, done := mc.done[key]; done {
+			return
+		}
+		ff, exists := mc.flows[key]
+		if !exists {
+			ff = NewFlowFeatures(mc.model.Packets)
+			mc.flows[key] = ff
+		}
+		ff.Add(p)
+		if ff.Full() {
+			mc.classify(key, ff, false)
+		}
+	case events.FLOW_EXPIRED:
+		key := event.(FlowExpiredEvent).Header
+		if ff, exists := mc.flows[key]; exists {
+			mc.classify(key, ff, true)
+		}
+		delete(mc.done, key)
+	}
+}
+
+func (mc *MLClassifier) classify(key common.FiveTuple, ff *FlowFeatures, atExpiry bool) {
+	delete(mc.flows, key)
+	mc.done[key] = struct{}{}
+	class, confidence := mc.model.Predict(ff.Vector(key))
+	if confidence < mc.minConfidence {
+		log.Debug().Str("header", key.String()).Str("class", class).
+			Float64("confidence", confidence).Msg("ml classification below threshold")
+		return
+	}
+	mc.Publish(events.CLASSIFICATION, EventClassification{
+		Header:     key,
+		Class:      class,
+		Source:     mc.Name(),
+		Confidence: confidence,
+		AtExpiry:   atExpiry,
+	})
+}
@@ -0,0 +1,217 @@
+package processor
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// features of 2 packets: protocol, server_port, then size, up and iat
+// per packet
+const testForest = `{
+  "type": "forest",
+  "packets": 2,
+  "classes": ["web", "video"],
+  "trees": [
+    {"nodes": [
+      {"feature": 2, "threshold": 100, "left": 1, "right": 2},
+      {"value": [1, 0]},
+      {"value": [0, 3]}
+    ]},
+    {"nodes": [
+      {"feature": 1, "threshold": 1000, "left": 1, "right": 2},
+      {"value": [0.5, 0.5]},
+      {"value": [1, 0]}
+    ]}
+  ]
+}`
+
+func writeTestModel(t *testing.T, model string) string {
+	path := filepath.Join(t.TempDir(), "model.json")
+	if err := ioutil.WriteFile(path, []byte(model), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTreeModelPredict(t *testing.T) {
+	forest, err := LoadTreeModel(writeTestModel(t, testForest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gbt, err := LoadTreeModel(writeTestModel(t, `{
+	  "type": "gbt", "packets": 1, "classes": ["a", "b"], "base_score": [0.5, 0],
+	  "trees": [{"class": 1, "nodes": [
+	    {"feature": 3, "threshold": 0.5, "left": 1, "right": 2},
+	    {"value": [2]},
+	    {"value": [-1]}
+	  ]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigmoid := func(x float64) float64 { return 1 / (1 + math.Exp(-x)) }
+	tests := []struct {
+		name       string
+		model      *TreeModel
+		x          []float64
+		class      string
+		confidence float64
+	}{
+		// leaves are normalized and averaged over trees
+		{"forest small first packet", forest, []float64{6, 443, 60, 1, 0, 0, 0, 0}, "web", 0.75},
+		{"forest large first packet", forest, []float64{6, 443, 1500, 0, 0, 0, 0, 0}, "video", 0.75},
+		// ties go to the first class
+		{"forest tie", forest, []float64{6, 8080, 1500, 0, 0, 0, 0, 0}, "web", 0.5},
+		{"forest threshold goes left", forest, []float64{6, 1000, 100, 0, 0, 0, 0, 0}, "web", 0.75},
+		// softmax of the base score plus the tree's score
+		{"gbt down", gbt, []float64{6, 443, 1500, 0, 0}, "b", sigmoid(1.5)},
+		{"gbt up", gbt, []float64{6, 443, 60, 1, 0}, "a", sigmoid(1.5)},
+	}
+	for _, tt := range tests {
+		class, confidence := tt.model.Predict(tt.x)
+		if class != tt.class || math.Abs(confidence-tt.confidence) > 1e-9 {
+			t.Errorf("%s: %s %v, want %s %v", tt.name, class, confidence, tt.class, tt.confidence)
+		}
+	}
+}
+
+func TestTreeModelValidate(t *testing.T) {
+	leaf := func(v ...float64) ModelNode { return ModelNode{Value: v} }
+	split := func(feature, left, right int) ModelNode {
+		return ModelNode{Feature: feature, Left: left, Right: right}
+	}
+	tree := func(nodes ...ModelNode) []ModelTree { return []ModelTree{{Nodes: nodes}} }
+	classes := []string{"a", "b"}
+	tests := []struct {
+		name  string
+		model TreeModel
+		err   string
+	}{
+		{"valid", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(split(4, 1, 2), leaf(1, 0), leaf(0, 1))}, ""},
+		{"unknown type", TreeModel{Type: "svm", Packets: 1, Classes: classes, Trees: tree(leaf(1, 0))}, "unknown model type"},
+		{"no packets", TreeModel{Type: "forest", Classes: classes, Trees: tree(leaf(1, 0))}, "invalid packet count"},
+		{"no classes", TreeModel{Type: "forest", Packets: 1, Trees: tree(leaf(1, 0))}, "no classes or trees"},
+		{"no trees", TreeModel{Type: "forest", Packets: 1, Classes: classes}, "no classes or trees"},
+		{"base score", TreeModel{Type: "gbt", Packets: 1, Classes: classes, BaseScore: []float64{0}, Trees: tree(leaf(1))}, "base_score"},
+		{"empty tree", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree()}, "no nodes"},
+		{"gbt class", TreeModel{Type: "gbt", Packets: 1, Classes: classes, Trees: []ModelTree{{Class: 2, Nodes: []ModelNode{leaf(1)}}}}, "invalid class"},
+		{"forest leaf", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(leaf(1))}, "1 leaf values, want 2"},
+		{"gbt leaf", TreeModel{Type: "gbt", Packets: 1, Classes: classes, Trees: tree(leaf(1, 0))}, "2 leaf values, want 1"},
+		{"feature", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(split(5, 1, 2), leaf(1, 0), leaf(0, 1))}, "invalid feature 5"},
+		{"negative feature", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(split(-1, 1, 2), leaf(1, 0), leaf(0, 1))}, "invalid feature -1"},
+		{"cycle", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(split(0, 1, 2), split(0, 0, 2), leaf(0, 1))}, "invalid children 0, 2"},
+		{"self", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(split(0, 0, 1), leaf(0, 1))}, "invalid children 0, 1"},
+		{"missing child", TreeModel{Type: "forest", Packets: 1, Classes: classes, Trees: tree(split(0, 1, 3), leaf(1, 0), leaf(0, 1))}, "invalid children 1, 3"},
+	}
+	for _, tt := range tests {
+		err := tt.model.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	path := writeTestModel(t, `{"type": "forest", "packets": 1, "classes": ["a"], "trees": [{"nodes": [{"feature": 9, "left": 1, "right": 2}]}]}`)
+	if _, err := LoadTreeModel(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("loading an invalid model: %v", err)
+	}
+	if _, err := LoadTreeModel(writeTestModel(t, `{"type": "forest",`)); err == nil {
+		t.Error("loading truncated json succeeded")
+	}
+}
+
+// mlTestPacket is a packet of the flow from client port to server port
+func mlTestPacket(ts time.Time, serverPort uint16, outbound bool, size uint) common.Packet {
+	p := common.Packet{Timestamp: ts, IsOutbound: outbound, TotalLen: size,
+		Header: common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: serverPort, DstPort: 50000, Protocol: 6}}
+	if outbound {
+		p.Header = common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "1.2.3.4", SrcPort: 50000, DstPort: serverPort, Protocol: 6}
+	}
+	return p
+}
+
+func TestMLClassifier(t *testing.T) {
+	model, err := LoadTreeModel(writeTestModel(t, testForest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := NewMLClassifier(model, 0.6)
+	var got []EventClassification
+	mc.SetPubFunc(func(topic events.Topic, event interface{}) {
+		got = append(got, event.(EventClassification))
+	})
+	t0 := time.Unix(1600000000, 0)
+	web := mlTestPacket(t0, 443, true, 60).GetKey()
+	video := mlTestPacket(t0, 443, false, 1500)
+	video.Header.DstPort = 50001
+	tie := mlTestPacket(t0, 8080, false, 1500)
+
+	mc.EventHandler(events.PACKET, mlTestPacket(t0, 443, true, 60))
+	mc.EventHandler(events.PACKET, video)
+	mc.EventHandler(events.PACKET, tie)
+	// classified once full
+	mc.EventHandler(events.PACKET, mlTestPacket(t0.Add(time.Millisecond), 443, false, 1500))
+	mc.EventHandler(events.PACKET, mlTestPacket(t0.Add(2*time.Millisecond), 443, false, 1500))
+	mc.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: web})
+	// scored with what was seen
+	mc.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: video.GetKey()})
+	// below min_confidence
+	mc.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: tie.GetKey()})
+
+	want := []EventClassification{
+		{Header: web, Class: "web", Source: "ml_classifier", Confidence: 0.75},
+		{Header: video.GetKey(), Class: "video", Source: "ml_classifier", Confidence: 0.75, AtExpiry: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("classifications\n%+v\nwant\n%+v", got, want)
+	}
+	if len(mc.flows) != 0 || len(mc.done) != 0 {
+		t.Errorf("%d flows and %d done left after expiry", len(mc.flows), len(mc.done))
+	}
+}
+
+func TestFeatureExporter(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	labelled := mlTestPacket(t0, 443, true, 60).GetKey()
+	unlabelled := mlTestPacket(t0, 8080, false, 1000).GetKey()
+	for _, keepUnlabelled := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "features.csv")
+		fe := NewFeatureExporter(path, 2, []string{"sni_classifier"}, keepUnlabelled)
+		fe.Init()
+		fe.EventHandler(events.PACKET, mlTestPacket(t0, 443, true, 60))
+		fe.EventHandler(events.PACKET, mlTestPacket(t0, 8080, false, 1000))
+		fe.EventHandler(events.CLASSIFICATION, EventClassification{Header: labelled, Class: "all_https", Source: "header_classifier"})
+		fe.EventHandler(events.CLASSIFICATION, EventClassification{Header: labelled, Class: "cdn", Source: "sni_classifier", Fallback: true})
+		fe.EventHandler(events.PACKET, mlTestPacket(t0.Add(5*time.Millisecond), 443, false, 1500))
+		fe.EventHandler(events.CLASSIFICATION, EventClassification{Header: labelled, Class: "netflix", Source: "sni_classifier"})
+		fe.EventHandler(events.CLASSIFICATION, EventClassification{Header: labelled, Class: "video", Source: "sni_classifier"})
+		// beyond the packets exported
+		fe.EventHandler(events.PACKET, mlTestPacket(t0.Add(9*time.Millisecond), 443, false, 900))
+		fe.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: labelled})
+		fe.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: unlabelled})
+		fe.Teardown()
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "flow,label,protocol,server_port,size_0,up_0,iat_ms_0,size_1,up_1,iat_ms_1\n" +
+			labelled.String() + ",netflix,6,443,60,1,0,1500,0,5\n"
+		if keepUnlabelled {
+			want += unlabelled.String() + ",,6,8080,1000,0,0,0,0,0\n"
+		}
+		if string(b) != want {
+			t.Errorf("keep_unlabelled %v: got\n%s\nwant\n%s", keepUnlabelled, b, want)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+)
+
+// FlowRecord is a unidirectional (or, in IPFIX, RFC 5103 biflow) flow
+// exported by a router in NetFlow v5, v9 or IPFIX. Header is as exported,
+// source to destination, and IsOutbound is set when the source is a
+// client. Counts are as exported, to be multiplied by SamplingInterval.
+type FlowRecord struct {
+	Exporter         string
+	Start, End       time.Time
+	Header           common.FiveTuple
+	IsOutbound       bool
+	Bytes, Packets   uint64
+	ReverseBytes     uint64 `json:",omitempty"`
+	ReversePackets   uint64 `json:",omitempty"`
+	SamplingInterval uint32
+}
+
+// GetKey returns the flow key, server side as source, as for packets
+func (r FlowRecord) GetKey() common.FiveTuple {
+	return common.Packet{Header: r.Header, IsOutbound: r.IsOutbound}.GetKey()
+}
+
+type netflowField struct {
+	id, length uint16
+	enterprise uint32
+}
+
+type netflowTemplate struct {
+	fields  []netflowField
+	options bool
+}
+
+// templates and sampling intervals are scoped by exporter and
+// observation domain (source id in v9)
+type netflowTemplateKey struct {
+	exporter string
+	version  uint16
+	domain   uint32
+	id       uint16
+}
+
+type netflowDomainKey struct {
+	exporter string
+	version  uint16
+	domain   uint32
+}
+
+// NetFlowDecoder decodes NetFlow v5, v9 and IPFIX (RFC 7011) messages.
+// It keeps the templates of every exporter and the sampling interval
+// announced in option records, which applies to the records of the
+// domain that carry none.
+type NetFlowDecoder struct {
+	templates map[netflowTemplateKey]netflowTemplate
+	sampling  map[netflowDomainKey]uint32
+
+	// Counters, NUnknownTemplate counts data sets whose template was
+	// not received (yet)
+	NMessages        uint64
+	NRecords         uint64
+	NUnknownTemplate uint64
+}
+
+func NewNetFlowDecoder() *NetFlowDecoder {
+	return &NetFlowDecoder{
+		templates: make(map[netflowTemplateKey]netflowTemplate),
+		sampling:  make(map[netflowDomainKey]uint32),
+	}
+}
+
+var errNetFlowShort = errors.New("netflow: message truncated")
+
+// Decode returns the flow records of a message from exporter. now is
+// used for records without timestamps.
+func (d *NetFlowDecoder) Decode(exporter string, b []byte, now time.Time) ([]FlowRecord, error) {
+	if len(b) < 2 {
+		return nil, errNetFlowShort
+	}
+	d.NMessages++
+	var records []FlowRecord
+	var err error
+	switch version := binary.BigEndian.Uint16(b); version {
+	case 5:
+		records, err = d.decodeV5(exporter, b)
+	case 9:
+		records, err = d.decodeV9(exporter, b, now)
+	case 10:
+		records, err = d.decodeIPFIX(exporter, b, now)
+	default:
+		return nil, fmt.Errorf("netflow: unsupported version %d", version)
+	}
+	d.NRecords += uint64(len(records))
+	return records, err
+}
+
+func (d *NetFlowDecoder) decodeV5(exporter string, b []byte) ([]FlowRecord, error) {
+	const headerLen, recordLen = 24, 48
+	if len(b) < headerLen {
+		return nil, errNetFlowShort
+	}
+	count := int(binary.BigEndian.Uint16(b[2:]))
+	uptime := binary.BigEndian.Uint32(b[4:])
+	export := time.Unix(int64(binary.BigEndian.Uint32(b[8:])), int64(binary.BigEndian.Uint32(b[12:])))
+	// the top two bits are the sampling mode
+	sampling := uint32(binary.BigEndian.Uint16(b[22:]) & 0x3fff)
+	if sampling == 0 {
+		sampling = 1
+	}
+	if len(b) < headerLen+count*recordLen {
+		return nil, errNetFlowShort
+	}
+	records := make([]FlowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		r := b[headerLen+i*recordLen:]
+		records = append(records, FlowRecord{
+			Exporter: exporter,
+			Start:    uptimeTime(export, uptime, binary.BigEndian.Uint32(r[24:])),
+			End:      uptimeTime(export, uptime, binary.BigEndian.Uint32(r[28:])),
+			Header: common.FiveTuple{
+				SrcIP:    net.IP(r[0:4]).String(),
+				DstIP:    net.IP(r[4:8]).String(),
+				SrcPort:  binary.BigEndian.Uint16(r[32:]),
+				DstPort:  binary.BigEndian.Uint16(r[34:]),
+				Protocol: r[38],
+			},
+			Packets:          uint64(binary.BigEndian.Uint32(r[16:])),
+			Bytes:            uint64(binary.BigEndian.Uint32(r[20:])),
+			SamplingInterval: sampling,
+		})
+	}
+	return records, nil
+}
+
+// uptimeTime converts a router uptime in ms to a time, given the uptime
+// at export
+func uptimeTime(export time.Time, exportUptime, uptime uint32) time.Time {
+	return export.Add(-time.Duration(exportUptime-uptime) * time.Millisecond)
+}
+
+func (d *NetFlowDecoder) decodeV9(exporter string, b []byte, now time.Time) ([]FlowRecord, error) {
+	const headerLen = 20
+	if len(b) < headerLen {
+		return nil, errNetFlowShort
+	}
+	h := netflowHeader{
+		exporter: exporter,
+		version:  9,
+		uptime:   binary.BigEndian.Uint32(b[4:]),
+		export:   time.Unix(int64(binary.BigEndian.Uint32(b[8:])), 0),
+		domain:   binary.BigEndian.Uint32(b[16:]),
+		now:      now,
+	}
+	return d.decodeSets(h, b[headerLen:])
+}
+
+func (d *NetFlowDecoder) decodeIPFIX(exporter string, b []byte, now time.Time) ([]FlowRecord, error) {
+	if len(b) < ipfixHeaderLen {
+		return nil, errNetFlowShort
+	}
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if n < ipfixHeaderLen || n > len(b) {
+		return nil, errNetFlowShort
+	}
+	h := netflowHeader{
+		exporter: exporter,
+		version:  10,
+		export:   time.Unix(int64(binary.BigEndian.Uint32(b[4:])), 0),
+		domain:   binary.BigEndian.Uint32(b[12:]),
+		now:      now,
+	}
+	return d.decodeSets(h, b[ipfixHeaderLen:n])
+}
+
+type netflowHeader struct {
+	exporter string
+	version  uint16
+	uptime   uint32
+	export   time.Time
+	domain   uint32
+	now      time.Time
+}
+
+// set ids of templates and options templates
+func netflowSetIDs(version uint16) (template, options uint16) {
+	if version == 9 {
+		return 0, 1
+	}
+	return ipfixTemplateSetID, ipfixTemplateSetID + 1
+}
+
+func (d *NetFlowDecoder) decodeSets(h netflowHeader, b []byte) ([]FlowRecord, error) {
+	var records []FlowRecord
+	templateID, optionsID := netflowSetIDs(h.version)
+	for len(b) >= ipfixSetHeaderLen {
+		id, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if n < ipfixSetHeaderLen || n > len(b) {
+			return records, errNetFlowShort
+		}
+		set := b[ipfixSetHeaderLen:n]
+		b = b[n:]
+		var err error
+		switch {
+		case id == templateID:
+			err = d.decodeTemplates(h, set, false)
+		case id == optionsID:
+			err = d.decodeTemplates(h, set, true)
+		case id >= 256:
+			records, err = d.decodeData(h, id, set, records)
+		}
+		if err != nil {
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+func (d *NetFlowDecoder) decodeTemplates(h netflowHeader, b []byte, options bool) error {
+	// sets are padded to 4 bytes
+	for len(b) >= 4 {
+		id, count := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		key := netflowTemplateKey{h.exporter, h.version, h.domain, id}
+		if options {
+			if len(b) < 2 {
+				return errNetFlowShort
+			}
+			if h.version == 9 {
+				// count is the scope length, followed by the option
+				// length, in bytes of field specifiers
+				count = (count + int(binary.BigEndian.Uint16(b))) / 4
+			}
+			// IPFIX scope field count
+			b = b[2:]
+		}
+		if count == 0 {
+			// IPFIX template withdrawal
+			delete(d.templates, key)
+			continue
+		}
+		t := netflowTemplate{options: options, fields: make([]netflowField, 0, count)}
+		for i := 0; i < count; i++ {
+			if len(b) < 4 {
+				return errNetFlowShort
+			}
+			f := netflowField{id: binary.BigEndian.Uint16(b), length: binary.BigEndian.Uint16(b[2:])}
+			b = b[4:]
+			if h.version == 10 && f.id&ipfixEnterpriseBit != 0 {
+				if len(b) < 4 {
+					return errNetFlowShort
+				}
+				f.id &^= ipfixEnterpriseBit
+				f.enterprise = binary.BigEndian.Uint32(b)
+				b = b[4:]
+			}
+			t.fields = append(t.fields, f)
+		}
+		d.templates[key] = t
+	}
+	return nil
+}
+
+func (d *NetFlowDecoder) decodeData(h netflowHeader, id uint16, b []byte, records []FlowRecord) ([]FlowRecord, error) {
+	t, exists := d.templates[netflowTemplateKey{h.exporter, h.version, h.domain, id}]
+	if !exists {
+		d.NUnknownTemplate++
+		return records, nil
+	}
+	domain := netflowDomainKey{h.exporter, h.version, h.domain}
+	for len(b) > 0 {
+		var r netflowValues
+		rest, ok := r.decode(t.fields, b)
+		if !ok || len(rest) == len(b) {
+			// the rest is padding
+			break
+		}
+		b = rest
+		if t.options {
+			if r.sampling > 0 {
+				d.sampling[domain] = r.sampling
+			}
+			continue
+		}
+		record := r.record(h)
+		if record.SamplingInterval == 0 {
+			record.SamplingInterval = d.sampling[domain]
+		}
+		if record.SamplingInterval == 0 {
+			record.SamplingInterval = 1
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// netflowValues are the fields of a data record
+type netflowValues struct {
+	src, dst               net.IP
+	srcPort, dstPort       uint16
+	protocol               uint8
+	bytes, packets         uint64
+	revBytes, revPackets   uint64
+	first, last            uint32 // uptime ms
+	hasUptime              bool
+	initMS                 uint64 // IPFIX systemInitTimeMilliseconds
+	start, end             time.Time
+	sampling               uint32
+	samplingPacketSpace    uint32
+	samplingPacketInterval uint32
+}
+
+// decode reads one record, false if b is shorter than the record
+func (r *netflowValues) decode(fields []netflowField, b []byte) ([]byte, bool) {
+	for _, f := range fields {
+		n := int(f.length)
+		if f.length == ipfixVarLen {
+			if len(b) < 1 {
+				return b, false
+			}
+			n, b = int(b[0]), b[1:]
+			if n == 255 {
+				if len(b) < 2 {
+					return b, false
+				}
+				n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+			}
+		}
+		if len(b) < n {
+			return b, false
+		}
+		r.set(f, b[:n])
+		b = b[n:]
+	}
+	return b, true
+}
+
+func netflowUint(b []byte) uint64 {
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v
+}
+
+// information elements, the NetFlow v9 ids are the same
+const (
+	ieOctetTotalCount            = 85
+	iePacketTotalCount           = 86
+	ieSamplingInterval           = 34
+	ieSamplerRandomInterval      = 50
+	ieFlowEndSysUpTime           = 21
+	ieFlowStartSysUpTime         = 22
+	ieFlowStartSeconds           = 150
+	ieFlowEndSeconds             = 151
+	ieSystemInitTimeMilliseconds = 160
+	ieSamplingPacketInterval     = 305
+	ieSamplingPacketSpace        = 306
+)
+
+func (r *netflowValues) set(f netflowField, b []byte) {
+	if f.enterprise == ipfixReversePEN {
+		switch f.id {
+		case ieOctetDeltaCount, ieOctetTotalCount:
+			r.revBytes = netflowUint(b)
+		case iePacketDeltaCount, iePacketTotalCount:
+			r.revPackets = netflowUint(b)
+		}
+		return
+	}
+	if f.enterprise != 0 {
+		return
+	}
+	switch f.id {
+	case ieSourceIPv4Address, ieSourceIPv6Address:
+		r.src = append(net.IP(nil), b...)
+	case ieDestinationIPv4Address, ieDestinationIPv6Address:
+		r.dst = append(net.IP(nil), b...)
+	case ieSourceTransportPort:
+		r.srcPort = uint16(netflowUint(b))
+	case ieDestinationTransportPort:
+		r.dstPort = uint16(netflowUint(b))
+	case ieProtocolIdentifier:
+		r.protocol = uint8(netflowUint(b))
+	case ieOctetDeltaCount:
+		r.bytes = netflowUint(b)
+	case iePacketDeltaCount:
+		r.packets = netflowUint(b)
+	case ieOctetTotalCount:
+		if r.bytes == 0 {
+			r.bytes = netflowUint(b)
+		}
+	case iePacketTotalCount:
+		if r.packets == 0 {
+			r.packets = netflowUint(b)
+		}
+	case ieFlowStartSysUpTime:
+		r.first, r.hasUptime = uint32(netflowUint(b)), true
+	case ieFlowEndSysUpTime:
+		r.last, r.hasUptime = uint32(netflowUint(b)), true
+	case ieSystemInitTimeMilliseconds:
+		r.initMS = netflowUint(b)
+	case ieFlowStartSeconds:
+		r.start = time.Unix(int64(netflowUint(b)), 0)
+	case ieFlowEndSeconds:
+		r.end = time.Unix(int64(netflowUint(b)), 0)
+	case ieFlowStartMilliseconds:
+		r.start = msTime(netflowUint(b))
+	case ieFlowEndMilliseconds:
+		r.end = msTime(netflowUint(b))
+	case ieSamplingInterval, ieSamplerRandomInterval:
+		r.sampling = uint32(netflowUint(b))
+	case ieSamplingPacketInterval:
+		r.samplingPacketInterval = uint32(netflowUint(b))
+		r.setPacketSampling()
+	case ieSamplingPacketSpace:
+		r.samplingPacketSpace = uint32(netflowUint(b))
+		r.setPacketSampling()
+	}
+}
+
+// setPacketSampling derives the interval of systematic count-based
+// sampling (RFC 5477): interval packets sampled out of interval + space
+func (r *netflowValues) setPacketSampling() {
+	if r.samplingPacketInterval > 0 {
+		r.sampling = (r.samplingPacketInterval + r.samplingPacketSpace) / r.samplingPacketInterval
+	}
+}
+
+func msTime(ms uint64) time.Time {
+	return time.Unix(int64(ms/1000), int64(ms%1000)*int64(time.Millisecond))
+}
+
+func (r *netflowValues) record(h netflowHeader) FlowRecord {
+	record := FlowRecord{
+		Exporter:         h.exporter,
+		Start:            r.start,
+		End:              r.end,
+		Bytes:            r.bytes,
+		Packets:          r.packets,
+		ReverseBytes:     r.revBytes,
+		ReversePackets:   r.revPackets,
+		SamplingInterval: r.sampling,
+		Header: common.FiveTuple{
+			SrcIP:    netflowIP(r.src),
+			DstIP:    netflowIP(r.dst),
+			SrcPort:  r.srcPort,
+			DstPort:  r.dstPort,
+			Protocol: r.protocol,
+		},
+	}
+	if r.hasUptime {
+		switch {
+		case h.version == 9:
+			record.Start = uptimeTime(h.export, h.uptime, r.first)
+			record.End = uptimeTime(h.export, h.uptime, r.last)
+		case r.initMS != 0:
+			record.Start = msTime(r.initMS + uint64(r.first))
+			record.End = msTime(r.initMS + uint64(r.last))
+		}
+	}
+	if record.End.IsZero() {
+		record.End = h.now
+	}
+	if record.Start.IsZero() {
+		record.Start = record.End
+	}
+	return record
+}
+
+func netflowIP(ip net.IP) string {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,227 @@
+package processor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+func TestNetFlowDecoderV5(t *testing.T) {
+	b := appendUint16(nil, 5)
+	b = appendUint16(b, 1)
+	b = appendUint32(b, 100000)     // uptime
+	b = appendUint32(b, 1600000000) // export secs
+	b = appendUint32(b, 0)
+	b = appendUint32(b, 42)         // sequence
+	b = append(b, 0, 0)             // engine
+	b = appendUint16(b, 0x4000|100) // random sampling 1/100
+	b = append(b, net.ParseIP("10.0.0.1").To4()...)
+	b = append(b, net.ParseIP("1.2.3.4").To4()...)
+	b = append(b, 0, 0, 0, 0)  // next hop
+	b = append(b, 0, 0, 0, 0)  // interfaces
+	b = appendUint32(b, 3)     // packets
+	b = appendUint32(b, 180)   // bytes
+	b = appendUint32(b, 90000) // first
+	b = appendUint32(b, 99000) // last
+	b = appendUint16(b, 50000)
+	b = appendUint16(b, 443)
+	b = append(b, 0, 0x18, 6, 0)          // pad, tcp flags, protocol, tos
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0) // as, masks, pad
+
+	records, err := NewNetFlowDecoder().Decode("192.0.2.1", b, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FlowRecord{
+		Exporter:         "192.0.2.1",
+		Start:            time.Unix(1600000000-10, 0),
+		End:              time.Unix(1600000000-1, 0),
+		Header:           common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "1.2.3.4", SrcPort: 50000, DstPort: 443, Protocol: 6},
+		Bytes:            180,
+		Packets:          3,
+		SamplingInterval: 100,
+	}
+	if len(records) != 1 || !records[0].Start.Equal(want.Start) || !records[0].End.Equal(want.End) {
+		t.Fatalf("records %+v, want %+v", records, want)
+	}
+	records[0].Start, records[0].End = want.Start, want.End
+	if records[0] != want {
+		t.Errorf("record %+v, want %+v", records[0], want)
+	}
+}
+
+// netflowV9 builds a v9 message from flow sets
+func netflowV9(sets ...[]byte) []byte {
+	b := appendUint16(nil, 9)
+	b = appendUint16(b, len(sets))
+	b = appendUint32(b, 100000)     // uptime
+	b = appendUint32(b, 1600000000) // export secs
+	b = appendUint32(b, 1)          // sequence
+	b = appendUint32(b, 7)          // source id
+	for _, set := range sets {
+		b = append(b, set...)
+	}
+	return b
+}
+
+func netflowSet(id int, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	return append(appendUint16(appendUint16(nil, id), len(body)+4), body...)
+}
+
+func TestNetFlowDecoderV9(t *testing.T) {
+	var template []byte
+	template = appendUint16(template, 300)
+	template = appendUint16(template, 8)
+	for _, f := range [][2]int{{8, 4}, {12, 4}, {7, 2}, {11, 2}, {4, 1}, {1, 4}, {2, 4}, {22, 4}} {
+		template = appendUint16(appendUint16(template, f[0]), f[1])
+	}
+	// options template: system scope, sampling interval
+	var options []byte
+	options = appendUint16(options, 301)
+	options = appendUint16(options, 4) // scope length
+	options = appendUint16(options, 4) // option length
+	options = appendUint16(appendUint16(options, 1), 4)
+	options = appendUint16(appendUint16(options, ieSamplingInterval), 4)
+	optionsData := appendUint32(appendUint32(nil, 0), 64)
+
+	var data []byte
+	for i, client := range []string{"10.0.0.1", "10.0.0.2"} {
+		data = append(data, net.ParseIP(client).To4()...)
+		data = append(data, net.ParseIP("1.2.3.4").To4()...)
+		data = appendUint16(data, 50000+i)
+		data = appendUint16(data, 443)
+		data = append(data, 6)
+		data = appendUint32(data, 1000)
+		data = appendUint32(data, 10)
+		data = appendUint32(data, 99000)
+	}
+
+	d := NewNetFlowDecoder()
+	records, err := d.Decode("192.0.2.1", netflowV9(netflowSet(300, data)), time.Now())
+	if err != nil || len(records) != 0 || d.NUnknownTemplate != 1 {
+		t.Fatalf("data before template: records %v, err %v, unknown %d", records, err, d.NUnknownTemplate)
+	}
+	msg := netflowV9(netflowSet(0, template), netflowSet(1, options), netflowSet(301, optionsData), netflowSet(300, data))
+	records, err = d.Decode("192.0.2.1", msg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+	r := records[1]
+	if r.Header != (common.FiveTuple{SrcIP: "10.0.0.2", DstIP: "1.2.3.4", SrcPort: 50001, DstPort: 443, Protocol: 6}) {
+		t.Errorf("header %v", r.Header)
+	}
+	if r.Bytes != 1000 || r.Packets != 10 || r.SamplingInterval != 64 {
+		t.Errorf("bytes %d packets %d sampling %d", r.Bytes, r.Packets, r.SamplingInterval)
+	}
+	if !r.Start.Equal(time.Unix(1600000000-1, 0)) {
+		t.Errorf("start %v", r.Start)
+	}
+
+	// templates are per exporter
+	records, _ = d.Decode("192.0.2.2", netflowV9(netflowSet(300, data)), time.Now())
+	if len(records) != 0 {
+		t.Errorf("other exporter: %d records decoded with a foreign template", len(records))
+	}
+}
+
+func TestNetFlowDecoderIPFIX(t *testing.T) {
+	ie := NewIPFIXExporter(IPFIXConfig{Collector: "127.0.0.1:4739"})
+	ie.lastFlush = time.Now()
+	for _, fe := range ipfixTestFlows() {
+		ie.add(fe, &ipfixFlow{class: "netflix"})
+	}
+	msg := ie.message(0, append([][]byte{ie.templateSet()}, ie.dataSets()...)...)
+
+	records, err := NewNetFlowDecoder().Decode("192.0.2.1", msg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+	flows := ipfixTestFlows()
+	for i, r := range records {
+		fe := flows[i]
+		r.IsOutbound = true
+		if r.GetKey() != fe.Header {
+			t.Errorf("key %v, want %v", r.GetKey(), fe.Header)
+		}
+		if r.Bytes != uint64(fe.UpBytes) || r.ReverseBytes != uint64(fe.DownBytes) ||
+			r.Packets != uint64(fe.UpPackets) || r.ReversePackets != uint64(fe.DownPackets) {
+			t.Errorf("flow %d: counts %+v", i, r)
+		}
+		if !r.Start.Equal(fe.FirstPacketTS) || !r.End.Equal(fe.LastPacketTS) {
+			t.Errorf("flow %d: %v - %v, want %v - %v", i, r.Start, r.End, fe.FirstPacketTS, fe.LastPacketTS)
+		}
+	}
+}
+
+func TestFlowRecordProcessor(t *testing.T) {
+	fr := NewFlowRecordProcessor(1)
+	var created, expired []interface{}
+	var unavailable []TelemetryUnavailableEvent
+	fr.SetPubFunc(func(topic events.Topic, event interface{}) {
+		switch topic {
+		case events.FLOW_CREATED:
+			created = append(created, event)
+		case events.FLOW_EXPIRED:
+			expired = append(expired, event)
+		case events.TELEMETRY_UNAVAILABLE:
+			unavailable = append(unavailable, event.(TelemetryUnavailableEvent))
+		}
+	})
+	start := time.Unix(1600000000, 0)
+	up := FlowRecord{
+		Start: start, End: start.Add(time.Second), IsOutbound: true,
+		Header: common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "1.2.3.4", SrcPort: 50000, DstPort: 443, Protocol: 6},
+		Bytes:  100, Packets: 2, SamplingInterval: 10,
+	}
+	down := FlowRecord{
+		Start: start.Add(100 * time.Millisecond), End: start.Add(2 * time.Second),
+		Header: common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6},
+		Bytes:  3000, Packets: 3, SamplingInterval: 10,
+	}
+	fr.EventHandler(events.FLOW_RECORD, up)
+	fr.EventHandler(events.FLOW_RECORD, down)
+	fr.EventHandler(events.FLOW_ATTACH_TELEMETRY, EventAttachPerFlowTelemetry{
+		Header:             down.Header,
+		TelemetryFunctions: []telemetry.Telemetry{&countingTelemetry{}},
+	})
+	if len(created) != 1 {
+		t.Fatalf("%d flows created from both directions, want 1", len(created))
+	}
+	if len(unavailable) != 1 || unavailable[0].Header != down.Header || unavailable[0].Telemetry[0] != "counting" {
+		t.Errorf("unavailable telemetry %+v", unavailable)
+	}
+
+	// a record a timeout later expires the flow
+	other := up
+	other.Header.SrcPort, other.Start, other.End = 50001, start.Add(2*time.Minute), start.Add(2*time.Minute)
+	fr.EventHandler(events.FLOW_RECORD, other)
+	if len(expired) != 1 {
+		t.Fatalf("%d flows expired, want 1", len(expired))
+	}
+	fe := expired[0].(FlowExpiredEvent)
+	want := FlowExpiredEvent{
+		FirstPacketTS: start, LastPacketTS: start.Add(2 * time.Second), ExpiredTS: other.End,
+		Header:  down.Header,
+		UpBytes: 1000, UpPackets: 20, DownBytes: 30000, DownPackets: 30,
+	}
+	if fe != want {
+		t.Errorf("expired %+v, want %+v", fe, want)
+	}
+	fr.Teardown()
+	if len(expired) != 2 {
+		t.Errorf("%d flows expired at teardown, want 2", len(expired))
+	}
+}
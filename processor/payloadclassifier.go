@@ -0,0 +1,264 @@
+package processor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"gopkg.in/yaml.v2"
+)
+
+// Signature matches the first payload bytes of one direction of a flow.
+// Either Regex or Bytes (hex, "??" matches any byte) is used, starting at Offset.
+// Class, if set, is also published as the flow's class.
+type Signature struct {
+	AppProtocol string `yaml:"app_protocol"`
+	Class       string `yaml:"class"`
+	Protocol    uint8  `yaml:"protocol"`  // 0 => any
+	Direction   string `yaml:"direction"` // "up", "down" or "" => any
+	Offset      int    `yaml:"offset"`
+	Regex       string `yaml:"regex"`
+	Bytes       string `yaml:"bytes"`
+	PayloadLen  int    `yaml:"payload_len"` // length of the first payload, 0 => any
+
+	re      *regexp.Regexp
+	pattern []int16
+}
+
+func (s *Signature) Compile() error {
+	if s.AppProtocol == "" {
+		return fmt.Errorf("signature without app_protocol")
+	}
+	if s.Offset < 0 {
+		return fmt.Errorf("%s: negative offset %d", s.AppProtocol, s.Offset)
+	}
+	if s.Direction != "" && s.Direction != "up" && s.Direction != "down" {
+		return fmt.Errorf("%s: unknown direction %q", s.AppProtocol, s.Direction)
+	}
+	switch {
+	case s.Regex != "" && s.Bytes != "":
+		return fmt.Errorf("%s: both regex and bytes set", s.AppProtocol)
+	case s.Regex != "":
+		re, err := regexp.Compile(s.Regex)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.AppProtocol, err)
+		}
+		s.re = re
+	case s.Bytes != "":
+		hexStr := strings.Replace(s.Bytes, " ", "", -1)
+		if len(hexStr)%2 != 0 {
+			return fmt.Errorf("%s: odd length byte pattern", s.AppProtocol)
+		}
+		s.pattern = nil
+		for i := 0; i < len(hexStr); i += 2 {
+			if hexStr[i:i+2] == "??" {
+				s.pattern = append(s.pattern, -1)
+				continue
+			}
+			b, err := hex.DecodeString(hexStr[i : i+2])
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.AppProtocol, err)
+			}
+			s.pattern = append(s.pattern, int16(b[0]))
+		}
+	default:
+		return fmt.Errorf("%s: neither regex nor bytes set", s.AppProtocol)
+	}
+	return nil
+}
+
+// Match reports whether the signature matches the payload seen so far
+// in a direction whose first payload was firstLen bytes long
+func (s *Signature) Match(payload []byte, firstLen int) bool {
+	if s.PayloadLen != 0 && s.PayloadLen != firstLen {
+		return false
+	}
+	if s.Offset >= len(payload) {
+		return false
+	}
+	data := payload[s.Offset:]
+	if s.re != nil {
+		return s.re.Match(data)
+	}
+	if len(data) < len(s.pattern) {
+		return false
+	}
+	for i, b := range s.pattern {
+		if b != -1 && byte(b) != data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Signature) appliesTo(p common.Packet) bool {
+	if s.Protocol != 0 && s.Protocol != p.Header.Protocol {
+		return false
+	}
+	switch s.Direction {
+	case "up":
+		return p.IsOutbound
+	case "down":
+		return !p.IsOutbound
+	}
+	return true
+}
+
+// DefaultSignatures returns signatures for common application protocols
+func DefaultSignatures() []Signature {
+	return []Signature{
+		{AppProtocol: "ssh", Protocol: 6, Regex: `^SSH-[12]\.`},
+		{AppProtocol: "http", Protocol: 6, Direction: "up", Regex: `^(GET|POST|HEAD|PUT|DELETE|OPTIONS|PATCH|CONNECT) \S+ HTTP/1\.[01]\r\n`},
+		{AppProtocol: "http", Protocol: 6, Direction: "down", Regex: `^HTTP/1\.[01] [1-5][0-9][0-9] `},
+		{AppProtocol: "tls", Protocol: 6, Bytes: "16 03 ?? ?? ?? 01"},
+		{AppProtocol: "quic", Protocol: 17, Direction: "up", Bytes: "?? 00 00 00 01"},
+		{AppProtocol: "quic", Protocol: 17, Direction: "up", Bytes: "?? 6b 33 43 cf"},
+		{AppProtocol: "bittorrent", Protocol: 6, Bytes: "13 42 69 74 54 6f 72 72 65 6e 74 20 70 72 6f 74 6f 63 6f 6c"},
+		{AppProtocol: "bittorrent", Protocol: 17, Regex: `^d1:[arq]d2:id20:`},
+		{AppProtocol: "smb", Protocol: 6, Offset: 4, Bytes: "fe 53 4d 42"},
+		{AppProtocol: "smb", Protocol: 6, Offset: 4, Bytes: "ff 53 4d 42"},
+		{AppProtocol: "rdp", Protocol: 6, Direction: "up", Bytes: "03 00 ?? ?? ?? e0"},
+		{AppProtocol: "openvpn", Protocol: 6, Direction: "up", Offset: 2, Bytes: "38"},
+		{AppProtocol: "openvpn", Protocol: 17, Direction: "up", Bytes: "38 ?? ?? ?? ?? ?? ?? ?? ?? 00 00 00 00 00"},
+		{AppProtocol: "wireguard", Protocol: 17, Direction: "up", Bytes: "01 00 00 00", PayloadLen: 148},
+		{AppProtocol: "stun", Protocol: 17, Offset: 4, Bytes: "21 12 a4 42"},
+		{AppProtocol: "sip", Regex: `^(INVITE|REGISTER|OPTIONS|SUBSCRIBE|NOTIFY) sip:`},
+		{AppProtocol: "rtsp", Protocol: 6, Direction: "up", Regex: `^(OPTIONS|DESCRIBE|SETUP|PLAY) rtsp://`},
+	}
+}
+
+// LoadSignatures reads signatures from a YAML file of the form
+//
+//	signatures:
+//	  - app_protocol: ssh
+//	    regex: '^SSH-'
+func LoadSignatures(path string) ([]Signature, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Signatures []Signature `yaml:"signatures"`
+	}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Signatures, nil
+}
+
+type payloadState struct {
+	up, down                 []byte
+	upFirstLen, downFirstLen int
+	done                     bool
+}
+
+// PayloadClassifier classifies flows by matching the first maxBytes
+// payload bytes in each direction against a set of signatures. The
+// matching signature's AppProtocol is published along with its Class,
+// which is empty for signatures that only label the application protocol.
+type PayloadClassifier struct {
+	BasePublisher
+	signatures []Signature
+	maxBytes   int
+	flows      map[common.FiveTuple]*payloadState
+}
+
+func NewPayloadClassifier(signatures []Signature, maxBytes int) *PayloadClassifier {
+	if maxBytes == 0 {
+		log.Warn().Msg("payload_classifier unable to read max bytes. Setting default: 64")
+		maxBytes = 64
+	}
+	for i := range signatures {
+		if err := signatures[i].Compile(); err != nil {
+			log.Fatal().Err(err).Msg("unable to compile signature")
+		}
+	}
+	return &PayloadClassifier{
+		signatures: signatures,
+		maxBytes:   maxBytes,
+		flows:      make(map[common.FiveTuple]*payloadState),
+	}
+}
+
+func (pc *PayloadClassifier) Init() {
+	log.Debug().Str("proc", pc.Name()).Int("signatures", len(pc.signatures)).Int("max_bytes", pc.maxBytes).Msg("init")
+}
+
+func (pc *PayloadClassifier) Name() string {
+	return "payload_classifier"
+}
+
+func (pc *PayloadClassifier) Subs() []events.Topic {
+	return []events.Topic{events.PACKET, events.FLOW_EXPIRED}
+}
+
+func (pc *PayloadClassifier) Pubs() []events.Topic {
+	return []events.Topic{events.CLASSIFICATION}
+}
+
+func (pc *PayloadClassifier) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		pc.OnPacket(event.(common.Packet))
+	case events.FLOW_EXPIRED:
+		delete(pc.flows, event.(FlowExpiredEvent).Header)
+	}
+}
+
+func (pc *PayloadClassifier) OnPacket(p common.Packet) {
+	if len(p.Payload) == 0 {
+		return
+	}
+	key := p.GetKey()
+	st, exists := pc.flows[key]
+	if !exists {
+		st = &payloadState{}
+		pc.flows[key] = st
+	}
+	if st.done {
+		return
+	}
+
+	buf, firstLen := &st.down, &st.downFirstLen
+	if p.IsOutbound {
+		buf, firstLen = &st.up, &st.upFirstLen
+	}
+	if len(*buf) >= pc.maxBytes {
+		return
+	}
+	if *firstLen == 0 {
+		*firstLen = len(p.Payload)
+	}
+	n := pc.maxBytes - len(*buf)
+	if n > len(p.Payload) {
+		n = len(p.Payload)
+	}
+	*buf = append(*buf, p.Payload[:n]...)
+
+	for i := range pc.signatures {
+		sig := &pc.signatures[i]
+		if !sig.appliesTo(p) || !sig.Match(*buf, *firstLen) {
+			continue
+		}
+		log.Debug().Str("header", key.String()).Str("app_protocol", sig.AppProtocol).
+			Str("class", sig.Class).Msg("payload classification")
+		pc.Publish(events.CLASSIFICATION, EventClassification{
+			Header:      key,
+			Class:       sig.Class,
+			Source:      pc.Name(),
+			AppProtocol: sig.AppProtocol,
+		})
+		st.done = true
+		break
+	}
+
+	if st.done || (len(st.up) >= pc.maxBytes && len(st.down) >= pc.maxBytes) {
+		st.done = true
+		st.up, st.down = nil, nil
+	}
+}
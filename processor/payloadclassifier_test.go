@@ -0,0 +1,133 @@
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func TestSignatureCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  Signature
+		ok   bool
+	}{
+		{"regex", Signature{AppProtocol: "ssh", Regex: `^SSH-`}, true},
+		{"bytes", Signature{AppProtocol: "tls", Bytes: "16 03 ?? ?? ?? 01"}, true},
+		{"no app protocol", Signature{Regex: `^SSH-`}, false},
+		{"negative offset", Signature{AppProtocol: "ssh", Offset: -1, Regex: `^SSH-`}, false},
+		{"bad direction", Signature{AppProtocol: "ssh", Direction: "left", Regex: `^SSH-`}, false},
+		{"regex and bytes", Signature{AppProtocol: "ssh", Regex: `^SSH-`, Bytes: "00"}, false},
+		{"odd bytes", Signature{AppProtocol: "tls", Bytes: "16 0"}, false},
+		{"bad hex", Signature{AppProtocol: "tls", Bytes: "zz"}, false},
+		{"no pattern", Signature{AppProtocol: "tls"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sig.Compile()
+			if (err == nil) != tt.ok {
+				t.Errorf("Compile() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+	for _, sig := range DefaultSignatures() {
+		if err := sig.Compile(); err != nil {
+			t.Errorf("default signature: %v", err)
+		}
+	}
+}
+
+func TestSignatureMatch(t *testing.T) {
+	sig := Signature{AppProtocol: "smb", Offset: 4, Bytes: "fe 53 4d 42"}
+	if err := sig.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		payload []byte
+		want    bool
+	}{
+		{[]byte{0, 0, 0, 0x40, 0xfe, 'S', 'M', 'B', 0x40}, true},
+		{[]byte{0, 0, 0, 0x40, 0xff, 'S', 'M', 'B', 0x40}, false},
+		{[]byte{0, 0, 0, 0x40, 0xfe, 'S'}, false},
+		{[]byte{0, 0}, false},
+	}
+	for _, tt := range tests {
+		if got := sig.Match(tt.payload, len(tt.payload)); got != tt.want {
+			t.Errorf("Match(% x) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestPayloadClassifier(t *testing.T) {
+	signatures := DefaultSignatures()
+	signatures = append(signatures, Signature{AppProtocol: "custom", Class: "custom_app", Protocol: 17, Regex: `^hello`})
+	pc := NewPayloadClassifier(signatures, 64)
+	var got []EventClassification
+	pc.SetPubFunc(func(topic events.Topic, event interface{}) {
+		got = append(got, event.(EventClassification))
+	})
+
+	ssh := common.Packet{
+		Header:     common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "1.2.3.4", SrcPort: 50000, DstPort: 443, Protocol: 6},
+		IsOutbound: true,
+	}
+	for _, payload := range []string{"SSH-2.", "0-OpenSSH_8.2\r\n", "SSH-2.0-again"} {
+		ssh.Payload = []byte(payload)
+		pc.OnPacket(ssh)
+	}
+	custom := common.Packet{
+		Header:  common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 9000, DstPort: 50001, Protocol: 17},
+		Payload: []byte("hello world"),
+	}
+	pc.OnPacket(custom)
+
+	want := []EventClassification{
+		{Header: ssh.GetKey(), Source: "payload_classifier", AppProtocol: "ssh"},
+		{Header: custom.GetKey(), Class: "custom_app", Source: "payload_classifier", AppProtocol: "custom"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d classifications, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("classification %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoadSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signatures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signatures.yaml")
+	yaml := "signatures:\n  - app_protocol: redis\n    protocol: 6\n    direction: up\n    regex: '^\\*[0-9]+\\r\\n'\n"
+	if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := LoadSignatures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 1 || signatures[0].AppProtocol != "redis" || signatures[0].Direction != "up" {
+		t.Fatalf("unexpected signatures: %+v", signatures)
+	}
+	if err := signatures[0].Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !signatures[0].Match([]byte("*3\r\n$3\r\nSET\r\n"), 14) {
+		t.Error("redis signature did not match")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("signatures:\n  - app_protocol: x\n    unknown: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSignatures(path); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PrefixFile describes a file of server prefixes to be turned into rules.
+// Every prefix becomes a copy of the Template rule (same syntax as a header
+// classifier class) with its server_ip replaced. For csv and json, Class is
+// used for prefixes without a class of their own. For aws and gcp, Class
+// labels every prefix or, if empty, prefixes are named by provider and
+// service, e.g. aws_cloudfront.
+//
+// Formats:
+//
+//	csv:  prefix[,class[,priority]] per line, '#' starts a comment
+//	json: [{"prefix": "1.2.3.0/24", "class": "x", "priority": 1}, ...]
+//	aws:  https://ip-ranges.amazonaws.com/ip-ranges.json
+//	gcp:  https://www.gstatic.com/ipranges/cloud.json
+type PrefixFile struct {
+	Path     string            `mapstructure:"path"`
+	Format   string            `mapstructure:"format"`
+	Class    string            `mapstructure:"class"`
+	Template map[string]string `mapstructure:"template"`
+}
+
+type prefixEntry struct {
+	Prefix   string `json:"prefix"`
+	Class    string `json:"class"`
+	Priority *int   `json:"priority"`
+}
+
+func LoadPrefixRules(pf PrefixFile) ([]Rule, error) {
+	f, err := os.Open(pf.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []prefixEntry
+	switch pf.Format {
+	case "csv":
+		entries, err = readCSVPrefixes(f)
+	case "json":
+		err = json.NewDecoder(f).Decode(&entries)
+	case "aws":
+		entries, err = readAWSPrefixes(f, pf.Class)
+	case "gcp":
+		entries, err = readGCPPrefixes(f, pf.Class)
+	default:
+		err = fmt.Errorf("unknown prefix file format: %q", pf.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pf.Path, err)
+	}
+
+	template, err := ParseRule(pf.Template)
+	if err != nil {
+		return nil, fmt.Errorf("%s: template: %w", pf.Path, err)
+	}
+	rules := make([]Rule, 0, len(entries))
+	for _, e := range entries {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(e.Prefix))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pf.Path, err)
+		}
+		r := template
+		r.ServerSubnet = *subnet
+		r.Class = e.Class
+		if r.Class == "" {
+			r.Class = pf.Class
+		}
+		if r.Class == "" {
+			return nil, fmt.Errorf("%s: no class for prefix %s", pf.Path, e.Prefix)
+		}
+		if e.Priority != nil {
+			r.Priority = *e.Priority
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func readCSVPrefixes(r io.Reader) ([]prefixEntry, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []prefixEntry
+	for i, rec := range records {
+		if len(rec) == 0 || rec[0] == "" {
+			continue
+		}
+		// skip a header line
+		if i == 0 && !strings.Contains(rec[0], "/") {
+			continue
+		}
+		e := prefixEntry{Prefix: rec[0]}
+		if len(rec) > 1 {
+			e.Class = rec[1]
+		}
+		if len(rec) > 2 && rec[2] != "" {
+			p, err := strconv.Atoi(rec[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			e.Priority = &p
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func readAWSPrefixes(r io.Reader, class string) ([]prefixEntry, error) {
+	var ranges struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&ranges); err != nil {
+		return nil, err
+	}
+	var entries []prefixEntry
+	for _, p := range ranges.Prefixes {
+		entries = append(entries, prefixEntry{Prefix: p.IPPrefix, Class: serviceClass(class, "aws", p.Service)})
+	}
+	for _, p := range ranges.IPv6Prefixes {
+		entries = append(entries, prefixEntry{Prefix: p.IPv6Prefix, Class: serviceClass(class, "aws", p.Service)})
+	}
+	return entries, nil
+}
+
+func readGCPPrefixes(r io.Reader, class string) ([]prefixEntry, error) {
+	var ranges struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&ranges); err != nil {
+		return nil, err
+	}
+	var entries []prefixEntry
+	for _, p := range ranges.Prefixes {
+		prefix := p.IPv4Prefix
+		if prefix == "" {
+			prefix = p.IPv6Prefix
+		}
+		entries = append(entries, prefixEntry{Prefix: prefix, Class: serviceClass(class, "gcp", p.Service)})
+	}
+	return entries, nil
+}
+
+func serviceClass(class, provider, service string) string {
+	if class != "" {
+		return class
+	}
+	service = strings.ToLower(strings.Replace(strings.TrimSpace(service), " ", "_", -1))
+	if service == "" {
+		return provider
+	}
+	return provider + "_" + service
+}
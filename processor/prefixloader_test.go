@@ -0,0 +1,139 @@
+package processor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadPrefixRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		class    string
+		template map[string]string
+		content  string
+		// want is class, priority and server subnet per rule
+		want []string
+		err  string
+	}{
+		{
+			name:   "csv",
+			format: "csv",
+			class:  "default",
+			content: "prefix,class,priority\n" +
+				"# comment\n" +
+				"1.2.3.0/24,cdn,5\n" +
+				"10.1.0.0/16\n" +
+				"2001:db8::/32, video\n",
+			want: []string{"cdn 5 1.2.3.0/24", "default 0 10.1.0.0/16", "video 0 2001:db8::/32"},
+		},
+		{
+			name:     "json",
+			format:   "json",
+			class:    "default",
+			template: map[string]string{"priority": "3"},
+			content:  `[{"prefix": "1.2.3.0/24", "class": "cdn", "priority": 1}, {"prefix": "5.6.0.0/16"}]`,
+			want:     []string{"cdn 1 1.2.3.0/24", "default 3 5.6.0.0/16"},
+		},
+		{
+			name:   "aws",
+			format: "aws",
+			content: `{"prefixes": [{"ip_prefix": "3.5.140.0/22", "service": "AMAZON"},
+				{"ip_prefix": "13.32.0.0/15", "service": "CLOUDFRONT"}],
+				"ipv6_prefixes": [{"ipv6_prefix": "2600:9000::/28", "service": "CLOUDFRONT"}]}`,
+			want: []string{"aws_amazon 0 3.5.140.0/22", "aws_cloudfront 0 13.32.0.0/15", "aws_cloudfront 0 2600:9000::/28"},
+		},
+		{
+			name:    "aws with class",
+			format:  "aws",
+			class:   "amazon",
+			content: `{"prefixes": [{"ip_prefix": "3.5.140.0/22", "service": "AMAZON"}]}`,
+			want:    []string{"amazon 0 3.5.140.0/22"},
+		},
+		{
+			name:   "gcp",
+			format: "gcp",
+			content: `{"prefixes": [{"ipv4Prefix": "34.80.0.0/15", "service": "Google Cloud"},
+				{"ipv6Prefix": "2600:1900::/35", "service": "Google Cloud"}]}`,
+			want: []string{"gcp_google_cloud 0 34.80.0.0/15", "gcp_google_cloud 0 2600:1900::/35"},
+		},
+		{
+			name:    "csv without class",
+			format:  "csv",
+			content: "1.2.3.0/24\n",
+			err:     "no class for prefix",
+		},
+		{
+			name:    "bad prefix",
+			format:  "json",
+			class:   "x",
+			content: `[{"prefix": "1.2.3.4"}]`,
+			err:     "invalid CIDR",
+		},
+		{
+			name:    "bad priority",
+			format:  "csv",
+			content: "1.2.3.0/24,cdn,high\n",
+			err:     "line 1",
+		},
+		{
+			name:     "bad template",
+			format:   "csv",
+			template: map[string]string{"server_port": "https"},
+			content:  "1.2.3.0/24,cdn\n",
+			err:      "template: server_port",
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			content: "<prefixes/>",
+			err:     "unknown prefix file format",
+		},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("prefixes%d", i))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := LoadPrefixRules(PrefixFile{Path: path, Format: tt.format, Class: tt.class, Template: tt.template})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range rules {
+				got = append(got, fmt.Sprintf("%s %d %s", r.Class, r.Priority, r.ServerSubnet.String()))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPrefixRulesTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefixes.csv")
+	if err := ioutil.WriteFile(path, []byte("1.2.3.0/24,cdn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadPrefixRules(PrefixFile{Path: path, Format: "csv",
+		Template: map[string]string{"server_ip": "9.9.9.9/32", "server_port": "443", "protocol": "6"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rules[0]
+	if r.ServerSubnet.String() != "1.2.3.0/24" || r.ServerPortRange != [2]uint16{443, 443} || !r.ProtocolMatch || r.Protocol != 6 {
+		t.Errorf("rule = %+v, want the template with the file's prefix", r)
+	}
+}
@@ -0,0 +1,159 @@
+package processor
+
+import (
+	"net"
+)
+
+// PrefixTrie is a path compressed binary trie of IP prefixes. IPv4 prefixes
+// are stored as IPv4-mapped IPv6 prefixes so one trie holds both families
+// and a lookup takes at most 128 bit comparisons regardless of its size.
+type PrefixTrie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	key      [16]byte
+	bits     int
+	children [2]*trieNode
+	values   []int
+}
+
+func NewPrefixTrie() *PrefixTrie {
+	return &PrefixTrie{root: &trieNode{}}
+}
+
+// Len returns the number of values inserted
+func (t *PrefixTrie) Len() int {
+	return t.size
+}
+
+// Insert associates value with subnet. A subnet can hold multiple values.
+func (t *PrefixTrie) Insert(subnet net.IPNet, value int) {
+	key, bits, ok := trieKey(subnet)
+	if !ok {
+		return
+	}
+	t.size++
+	cur := t.root
+	for {
+		if cur.bits == bits {
+			cur.values = append(cur.values, value)
+			return
+		}
+		b := bitAt(key, cur.bits)
+		child := cur.children[b]
+		if child == nil {
+			cur.children[b] = &trieNode{key: key, bits: bits, values: []int{value}}
+			return
+		}
+
+		limit := child.bits
+		if bits < limit {
+			limit = bits
+		}
+		cl := commonPrefixLen(child.key, key, limit)
+		if cl == child.bits {
+			cur = child
+			continue
+		}
+
+		leaf := &trieNode{key: maskKey(key, bits), bits: bits, values: []int{value}}
+		if cl == bits {
+			// new prefix contains the child
+			leaf.children[bitAt(child.key, bits)] = child
+			cur.children[b] = leaf
+			return
+		}
+		branch := &trieNode{key: maskKey(key, cl), bits: cl}
+		branch.children[bitAt(child.key, cl)] = child
+		branch.children[bitAt(key, cl)] = leaf
+		cur.children[b] = branch
+		return
+	}
+}
+
+// Lookup calls fn with the values of every prefix containing ip,
+// shortest prefix first. As with net.IPNet, IPv6 prefixes never contain
+// IPv4 addresses.
+func (t *PrefixTrie) Lookup(ip net.IP, fn func(value int)) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+	// prefixes shorter than the IPv4-mapped prefix are IPv6 ones
+	minBits := 0
+	if ip.To4() != nil {
+		minBits = 96
+	}
+
+	cur := t.root
+	for {
+		if cur.bits >= minBits {
+			for _, v := range cur.values {
+				fn(v)
+			}
+		}
+		if cur.bits == 128 {
+			return
+		}
+		child := cur.children[bitAt(key, cur.bits)]
+		if child == nil || commonPrefixLen(child.key, key, child.bits) < child.bits {
+			return
+		}
+		cur = child
+	}
+}
+
+func trieKey(subnet net.IPNet) ([16]byte, int, bool) {
+	var key [16]byte
+	ones, size := subnet.Mask.Size()
+	ip := subnet.IP.To16()
+	if ip == nil || (size != 32 && size != 128) {
+		return key, 0, false
+	}
+	copy(key[:], ip)
+	if size == 32 {
+		ones += 96
+	}
+	return maskKey(key, ones), ones, true
+}
+
+func bitAt(key [16]byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+func commonPrefixLen(a, b [16]byte, limit int) int {
+	n := 0
+	for i := 0; i < 16 && n < limit; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > limit {
+		n = limit
+	}
+	return n
+}
+
+func maskKey(key [16]byte, bits int) [16]byte {
+	var masked [16]byte
+	for i := 0; i < 16; i++ {
+		switch {
+		case bits >= (i+1)*8:
+			masked[i] = key[i]
+		case bits > i*8:
+			masked[i] = key[i] & (0xff << uint(8-(bits-i*8)))
+		}
+	}
+	return masked
+}
@@ -0,0 +1,53 @@
+package processor
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixTrieLookup(t *testing.T) {
+	prefixes := []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"10.1.2.0/24",
+		"192.168.0.0/16",
+		"0.0.0.0/0",
+		"2600:1f00::/24",
+		"2600:1f00:1::/48",
+		"::/0",
+	}
+	trie := NewPrefixTrie()
+	for i, p := range prefixes {
+		_, subnet, err := net.ParseCIDR(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.Insert(*subnet, i)
+	}
+	if trie.Len() != len(prefixes) {
+		t.Errorf("Len() = %d, want %d", trie.Len(), len(prefixes))
+	}
+
+	tests := []struct {
+		ip   string
+		want []int
+	}{
+		{"10.1.2.3", []int{5, 0, 1, 2, 3}},
+		{"10.1.3.3", []int{5, 0, 1}},
+		{"10.200.0.1", []int{5, 0}},
+		{"192.168.255.255", []int{5, 4}},
+		{"8.8.8.8", []int{5}},
+		{"2600:1f00:1::1", []int{8, 6, 7}},
+		{"2600:1f00:2::1", []int{8, 6}},
+		{"2001:db8::1", []int{8}},
+	}
+	for _, tt := range tests {
+		var got []int
+		trie.Lookup(net.ParseIP(tt.ip), func(v int) { got = append(got, v) })
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package processor
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+type RotateConfig struct {
+	// MaxBytes and MaxAge start a new file once this many (uncompressed)
+	// bytes were written or the file is this old, 0 => never
+	MaxBytes int64         `mapstructure:"max_bytes"`
+	MaxAge   time.Duration `mapstructure:"max_age"`
+	// Compression is gzip, zstd or '' for none
+	Compression string `mapstructure:"compression"`
+}
+
+func (rc RotateConfig) rotates() bool {
+	return rc.MaxBytes > 0 || rc.MaxAge > 0
+}
+
+// RotatingWriter writes records to a series of files. Each file is
+// written as <name>.tmp and renamed to <name> once complete, so readers
+// never see partial files. Without rotation <name> is the path (plus a
+// compression extension), otherwise the path with the opening time
+// appended, e.g. dump.json.log.20201019T101500Z.gz. A file never
+// replaces one written before: files after the first without rotation,
+// and rotated files of the same second, get a sequence suffix, e.g.
+// dump.json.log.1 for the file opened after a failed write.
+//
+// Each Write is a record. Records are buffered and written out in
+// batches. A failed file write keeps the batch: the file is closed and
+// renamed as is (its last record may be truncated) and the batch goes to
+// the next file, opened no earlier than RetryDelay later, doubling up to
+// MaxRetryDelay. Meanwhile records are buffered up to MaxPending bytes,
+// records beyond are lost and counted, see Lost.
+type RotatingWriter struct {
+	path   string
+	config RotateConfig
+
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	MaxPending    int
+
+	file      *os.File
+	comp      io.WriteCloser
+	w         io.Writer
+	tmpPath   string
+	finalPath string
+	opened    time.Time
+	written   int64
+	// segments counts the files opened
+	segments int
+
+	pending  []byte
+	nPending uint64
+	retryAt  time.Time
+	delay    time.Duration
+	lost     uint64
+}
+
+const rotateBatchBytes = 64 * 1024
+
+// createOutput creates output files, replaced in tests
+var createOutput = os.Create
+
+func NewRotatingWriter(path string, config RotateConfig) (*RotatingWriter, error) {
+	switch config.Compression {
+	case "", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("unknown compression: %q", config.Compression)
+	}
+	rw := &RotatingWriter{
+		path:          path,
+		config:        config,
+		RetryDelay:    100 * time.Millisecond,
+		MaxRetryDelay: 30 * time.Second,
+		MaxPending:    16 * 1024 * 1024,
+	}
+	createDirs(path)
+	return rw, rw.open(time.Now())
+}
+
+func (rw *RotatingWriter) segmentPath() string {
+	if rw.config.rotates() {
+		stamp := rw.opened.UTC().Format("20060102T150405Z")
+		path := fmt.Sprintf("%s.%s", rw.path, stamp)
+		for seq := 1; fileExists(path + rw.extension()); seq++ {
+			path = fmt.Sprintf("%s.%s-%d", rw.path, stamp, seq)
+		}
+		return path + rw.extension()
+	}
+	// the first file replaces the output of earlier runs
+	if rw.segments == 0 {
+		return rw.path + rw.extension()
+	}
+	path := fmt.Sprintf("%s.%d", rw.path, rw.segments)
+	for seq := rw.segments + 1; fileExists(path + rw.extension()); seq++ {
+		path = fmt.Sprintf("%s.%d", rw.path, seq)
+	}
+	return path + rw.extension()
+}
+
+func (rw *RotatingWriter) extension() string {
+	switch rw.config.Compression {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (rw *RotatingWriter) open(now time.Time) error {
+	rw.opened = now
+	rw.written = 0
+	rw.finalPath = rw.segmentPath()
+	rw.tmpPath = rw.finalPath + ".tmp"
+	file, err := createOutput(rw.tmpPath)
+	if err != nil {
+		return err
+	}
+	rw.segments++
+	rw.w = file
+	rw.comp = nil
+	switch rw.config.Compression {
+	case "gzip":
+		rw.comp = gzip.NewWriter(file)
+		rw.w = rw.comp
+	case "zstd":
+		enc, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		rw.comp, rw.w = enc, enc
+	}
+	rw.file = file
+	log.Debug().Str("path", rw.tmpPath).Msg("output file opened")
+	return nil
+}
+
+// Write buffers record b. It fails only if b is lost as too many
+// records are waiting for a file write to succeed.
+func (rw *RotatingWriter) Write(b []byte) (int, error) {
+	now := time.Now()
+	if rw.file != nil && rw.due(now) {
+		rw.finalize(now)
+	}
+	if len(rw.pending)+len(b) > rw.MaxPending && len(rw.pending) > 0 {
+		rw.writePending(now)
+	}
+	if len(rw.pending)+len(b) > rw.MaxPending {
+		rw.lost++
+		return 0, fmt.Errorf("output buffer full, %d records waiting", rw.nPending)
+	}
+	rw.pending = append(rw.pending, b...)
+	rw.nPending++
+	if len(rw.pending) >= rotateBatchBytes || rw.file == nil {
+		rw.writePending(now)
+	}
+	return len(b), nil
+}
+
+func (rw *RotatingWriter) due(now time.Time) bool {
+	return (rw.config.MaxBytes > 0 && rw.written+int64(len(rw.pending)) >= rw.config.MaxBytes) ||
+		(rw.config.MaxAge > 0 && now.Sub(rw.opened) >= rw.config.MaxAge)
+}
+
+// writePending writes the buffered records to the current file, opening
+// one if the last failure is RetryDelay old
+func (rw *RotatingWriter) writePending(now time.Time) error {
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	if rw.file == nil {
+		if now.Before(rw.retryAt) {
+			return fmt.Errorf("output file failed, retrying in %v", rw.retryAt.Sub(now))
+		}
+		if err := rw.open(now); err != nil {
+			rw.failed(now, err)
+			return err
+		}
+	}
+	n, err := rw.w.Write(rw.pending)
+	rw.written += int64(n)
+	if err == nil && rw.comp != nil {
+		// so failures show up while the batch is still pending
+		err = rw.comp.(interface{ Flush() error }).Flush()
+	}
+	if err != nil {
+		rw.failed(now, err)
+		rw.closeFile()
+		return err
+	}
+	rw.pending = rw.pending[:0]
+	rw.nPending = 0
+	rw.delay = 0
+	return nil
+}
+
+func (rw *RotatingWriter) failed(now time.Time, err error) {
+	switch {
+	case rw.delay == 0:
+		rw.delay = rw.RetryDelay
+	case rw.delay < rw.MaxRetryDelay:
+		rw.delay *= 2
+		if rw.delay > rw.MaxRetryDelay {
+			rw.delay = rw.MaxRetryDelay
+		}
+	}
+	rw.retryAt = now.Add(rw.delay)
+	log.Error().Err(err).Str("path", rw.tmpPath).Uint64("pending_records", rw.nPending).
+		Dur("retry_in", rw.delay).Msg("unable to write output file")
+}
+
+// Rotate completes the current file; the next write starts a new one
+func (rw *RotatingWriter) Rotate() error {
+	return rw.finalize(time.Now())
+}
+
+// Close completes the current file. Records that cannot be written,
+// even to a new file, are lost.
+func (rw *RotatingWriter) Close() error {
+	err := rw.finalize(time.Now())
+	if len(rw.pending) != 0 {
+		rw.retryAt = time.Time{}
+		err = rw.finalize(time.Now())
+	}
+	if len(rw.pending) != 0 {
+		log.Error().Uint64("records", rw.nPending).Msg("output records lost")
+		rw.lost += rw.nPending
+		rw.pending, rw.nPending = nil, 0
+	}
+	return err
+}
+
+// Lost returns the number of records that were never written
+func (rw *RotatingWriter) Lost() uint64 {
+	return rw.lost
+}
+
+func (rw *RotatingWriter) finalize(now time.Time) error {
+	if err := rw.writePending(now); err != nil {
+		return err
+	}
+	if rw.file == nil {
+		return nil
+	}
+	return rw.closeFile()
+}
+
+// closeFile completes the compressed stream, closes the file and
+// renames it, keeping what was written even after a failed write
+func (rw *RotatingWriter) closeFile() error {
+	var err error
+	if rw.comp != nil {
+		err = rw.comp.Close()
+	}
+	if serr := rw.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := rw.file.Close(); err == nil {
+		err = cerr
+	}
+	rw.file, rw.comp, rw.w = nil, nil, nil
+	if rerr := os.Rename(rw.tmpPath, rw.finalPath); rerr != nil {
+		log.Error().Err(rerr).Str("path", rw.tmpPath).Msg("unable to rename output file")
+		if err == nil {
+			err = rerr
+		}
+		return err
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", rw.finalPath).Int64("bytes", rw.written).Msg("output file may be truncated")
+		return err
+	}
+	log.Info().Str("path", rw.finalPath).Int64("bytes", rw.written).Msg("output file finalized")
+	return nil
+}
@@ -0,0 +1,240 @@
+package processor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// failOutputs makes output files fail on write until the returned
+// function is called
+func failOutputs(t *testing.T) func() {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	createOutput = func(string) (*os.File, error) {
+		return os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	}
+	return func() { createOutput = os.Create }
+}
+
+func testRecords(n int) [][]byte {
+	records := make([][]byte, n)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf("{\"record\":%d,\"pad\":%q}\n", i, bytes.Repeat([]byte("x"), 1000)))
+	}
+	return records
+}
+
+func readOutputs(t *testing.T, dir string, gz bool) []byte {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".tmp" {
+			t.Errorf("%s left behind", f.Name())
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gz {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err = ioutil.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		all = append(all, b...)
+	}
+	return all
+}
+
+func TestRotatingWriterRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rw, err := NewRotatingWriter(filepath.Join(dir, "dump.log"), RotateConfig{MaxBytes: 50000, Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for _, r := range testRecords(200) {
+		want = append(want, r...)
+		if _, err := rw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) < 4 {
+		t.Errorf("%d files, want rotation every 50 records", len(files))
+	}
+	// segments of the same second are ordered by suffix, not by name
+	got := bytes.SplitAfter(readOutputs(t, dir, true), []byte("\n"))
+	sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i], got[j]) < 0 })
+	wantLines := bytes.SplitAfter(want, []byte("\n"))
+	sort.Slice(wantLines, func(i, j int) bool { return bytes.Compare(wantLines[i], wantLines[j]) < 0 })
+	if !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("read %d records, want %d", len(got), len(wantLines))
+	}
+}
+
+func TestRotatingWriterRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restore := failOutputs(t)
+	defer restore()
+	rw, err := NewRotatingWriter(filepath.Join(dir, "dump.log"), RotateConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.RetryDelay = time.Hour
+
+	records := testRecords(200)
+	start := time.Now()
+	var want []byte
+	for _, r := range records[:100] {
+		want = append(want, r...)
+		if _, err := rw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writes blocked for %v", elapsed)
+	}
+	if len(rw.pending) != len(want) {
+		t.Fatalf("%d bytes pending, want %d", len(rw.pending), len(want))
+	}
+
+	restore()
+	rw.retryAt = time.Time{}
+	for _, r := range records[100:] {
+		want = append(want, r...)
+		if _, err := rw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Lost() != 0 {
+		t.Errorf("lost %d records", rw.Lost())
+	}
+	if got := readOutputs(t, dir, false); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRotatingWriterKeepsFailedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []*os.File
+	createOutput = func(path string) (*os.File, error) {
+		f, err := os.Create(path)
+		files = append(files, f)
+		return f, err
+	}
+	defer func() { createOutput = os.Create }()
+	rw, err := NewRotatingWriter(filepath.Join(dir, "dump.log"), RotateConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.RetryDelay = time.Hour
+
+	records := testRecords(300)
+	var want []byte
+	for _, r := range records[:200] {
+		want = append(want, r...)
+		if _, err := rw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+		// the file fails once the first batch is written
+		if rw.written > 0 && files[0] != nil {
+			files[0].Close()
+			files[0] = nil
+		}
+	}
+	if rw.file != nil {
+		t.Fatal("the file did not fail")
+	}
+	rw.retryAt = time.Time{}
+	for _, r := range records[200:] {
+		want = append(want, r...)
+		if _, err := rw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Lost() != 0 {
+		t.Errorf("lost %d records", rw.Lost())
+	}
+	// the file opened after the failure must not replace the first
+	infos, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"dump.log", "dump.log.1"}) {
+		t.Errorf("files %v, want dump.log and dump.log.1", names)
+	}
+	if got := readOutputs(t, dir, false); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRotatingWriterCountsLost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer failOutputs(t)()
+	rw, err := NewRotatingWriter(filepath.Join(dir, "dump.log"), RotateConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.MaxPending = 100000
+
+	var rejected uint64
+	for _, r := range testRecords(300) {
+		if _, err := rw.Write(r); err != nil {
+			rejected++
+		}
+	}
+	if rejected == 0 {
+		t.Error("no write rejected with a full buffer")
+	}
+	if rw.Lost() != rejected {
+		t.Errorf("lost %d, rejected %d", rw.Lost(), rejected)
+	}
+	if err := rw.Close(); err == nil {
+		t.Error("Close succeeded")
+	}
+	if rw.Lost() != 300 {
+		t.Errorf("lost %d records, want 300", rw.Lost())
+	}
+}
@@ -0,0 +1,161 @@
+package processor
+
+import (
+	"math"
+	"net"
+	"sort"
+
+	"github.com/sharat910/edrint/common"
+)
+
+// RuleMatcher indexes rules so that a header is only checked against rules
+// that can match it. Rules with a server subnet are indexed in a prefix trie,
+// rules matching any server are indexed by server ASN or server port range
+// and the rest (negations, any port) are always checked. Geo fields are
+// only matched if Geo is set.
+type RuleMatcher struct {
+	Geo        *GeoDB
+	rules      []Rule
+	servers    *PrefixTrie
+	asns       map[uint][]int
+	ports      *PortRanges
+	unindexed  []int
+	candidates []int
+}
+
+// NewRuleMatcher indexes rules, which are expected to be sorted
+func NewRuleMatcher(rules []Rule) *RuleMatcher {
+	rm := &RuleMatcher{
+		rules:   rules,
+		servers: NewPrefixTrie(),
+		asns:    make(map[uint][]int),
+		ports:   &PortRanges{},
+	}
+	for i, r := range rules {
+		ones, _ := r.ServerSubnet.Mask.Size()
+		switch {
+		case !r.ServerSubnetNegate && ones > 0:
+			rm.servers.Insert(r.ServerSubnet, i)
+		case !r.ServerASNNegate && len(r.ServerASNs) > 0:
+			for _, asn := range r.ServerASNs {
+				rm.asns[asn] = append(rm.asns[asn], i)
+			}
+		case !r.ServerPortNegate && r.ServerPortRange != [2]uint16{0, math.MaxUint16}:
+			rm.ports.Add(r.ServerPortRange, i)
+		default:
+			rm.unindexed = append(rm.unindexed, i)
+		}
+	}
+	rm.ports.Build()
+	return rm
+}
+
+func (rm *RuleMatcher) Len() int {
+	return len(rm.rules)
+}
+
+// Match calls fn with every rule matching header in rule order
+// until fn returns false
+func (rm *RuleMatcher) Match(header common.FiveTuple, fn func(r Rule) bool) {
+	serverIP := net.ParseIP(header.SrcIP)
+	clientIP := net.ParseIP(header.DstIP)
+
+	rm.candidates = rm.candidates[:0]
+	rm.servers.Lookup(serverIP, func(i int) {
+		rm.candidates = append(rm.candidates, i)
+	})
+	var geo GeoInfo
+	geoDone := false
+	if len(rm.asns) > 0 && rm.Geo != nil {
+		geo, geoDone = rm.Geo.Lookup(serverIP), true
+		rm.candidates = append(rm.candidates, rm.asns[geo.ServerASN]...)
+	}
+	rm.candidates = append(rm.candidates, rm.ports.Lookup(header.SrcPort)...)
+	rm.candidates = append(rm.candidates, rm.unindexed...)
+	sort.Ints(rm.candidates)
+
+	for _, i := range rm.candidates {
+		r := rm.rules[i]
+		if !r.MatchIPs(header, serverIP, clientIP) {
+			continue
+		}
+		if r.NeedsGeo() {
+			if rm.Geo == nil {
+				continue
+			}
+			if !geoDone {
+				geo, geoDone = rm.Geo.Lookup(serverIP), true
+			}
+			if !r.MatchGeo(geo) {
+				continue
+			}
+		}
+		if !fn(r) {
+			return
+		}
+	}
+}
+
+// PortRanges indexes values by port range. Build splits the port space
+// at every range boundary into sorted segments, each holding the values
+// of the ranges covering it, so a lookup is a binary search.
+type PortRanges struct {
+	ranges []portRange
+	starts []int
+	values [][]int
+}
+
+type portRange struct {
+	ports [2]uint16
+	value int
+}
+
+// Add adds a range, Build must be called before the next Lookup
+func (pr *PortRanges) Add(ports [2]uint16, value int) {
+	pr.ranges = append(pr.ranges, portRange{ports, value})
+}
+
+func (pr *PortRanges) Build() {
+	bounds := make(map[int]struct{})
+	for _, r := range pr.ranges {
+		bounds[int(r.ports[0])] = struct{}{}
+		bounds[int(r.ports[1])+1] = struct{}{}
+	}
+	pr.starts = pr.starts[:0]
+	for b := range bounds {
+		pr.starts = append(pr.starts, b)
+	}
+	sort.Ints(pr.starts)
+
+	// sweep the segments, adding ranges as they start
+	sort.SliceStable(pr.ranges, func(i, j int) bool {
+		return pr.ranges[i].ports[0] < pr.ranges[j].ports[0]
+	})
+	pr.values = make([][]int, len(pr.starts))
+	var active []portRange
+	next := 0
+	for i, start := range pr.starts {
+		for next < len(pr.ranges) && int(pr.ranges[next].ports[0]) == start {
+			active = append(active, pr.ranges[next])
+			next++
+		}
+		kept := active[:0]
+		for _, r := range active {
+			if int(r.ports[1]) >= start {
+				kept = append(kept, r)
+				pr.values[i] = append(pr.values[i], r.value)
+			}
+		}
+		active = kept
+		sort.Ints(pr.values[i])
+	}
+}
+
+// Lookup returns the values of the ranges containing port, sorted
+func (pr *PortRanges) Lookup(port uint16) []int {
+	i := sort.Search(len(pr.starts), func(i int) bool { return pr.starts[i] > int(port) }) - 1
+	if i < 0 {
+		return nil
+	}
+	return pr.values[i]
+}
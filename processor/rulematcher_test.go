@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+)
+
+func TestRuleMatchIPv6(t *testing.T) {
+	tests := []struct {
+		config map[string]string
+		header common.FiveTuple
+		want   bool
+	}{
+		{map[string]string{"server_ip": "2600:1f00::/24"},
+			common.FiveTuple{SrcIP: "2600:1f00::1", DstIP: "2001:db8::5"}, true},
+		{map[string]string{"server_ip": "2600:1f00::/24", "client_ip": "*"},
+			common.FiveTuple{SrcIP: "2600:1f00::1", DstIP: "2001:db8::5"}, true},
+		{map[string]string{"server_ip": "*", "server_port": "443"},
+			common.FiveTuple{SrcIP: "2600:1f00::1", DstIP: "2001:db8::5", SrcPort: 443}, true},
+		{map[string]string{"client_ip": "0.0.0.0/0"},
+			common.FiveTuple{SrcIP: "2600:1f00::1", DstIP: "2001:db8::5"}, false},
+		{map[string]string{"client_ip": "!10.0.0.0/8"},
+			common.FiveTuple{SrcIP: "1.1.1.1", DstIP: "2001:db8::5"}, true},
+		{map[string]string{"server_ip": "2600:1f00::/24"},
+			common.FiveTuple{SrcIP: "1.1.1.1", DstIP: "10.0.0.1"}, false},
+	}
+	for _, tt := range tests {
+		r, err := ParseRule(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Match(tt.header); got != tt.want {
+			t.Errorf("%v matching %v = %v, want %v", tt.config, tt.header, got, tt.want)
+		}
+		if got := len(matchAll(NewRuleMatcher([]Rule{r}), tt.header)) == 1; got != tt.want {
+			t.Errorf("RuleMatcher %v matching %v = %v, want %v", tt.config, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	var pr PortRanges
+	pr.Add([2]uint16{443, 443}, 0)
+	pr.Add([2]uint16{8000, 8999}, 1)
+	pr.Add([2]uint16{0, 1023}, 2)
+	pr.Add([2]uint16{8080, 8080}, 3)
+	pr.Add([2]uint16{60000, 65535}, 4)
+	pr.Build()
+	tests := []struct {
+		port uint16
+		want []int
+	}{
+		{0, []int{2}},
+		{443, []int{0, 2}},
+		{444, []int{2}},
+		{1024, nil},
+		{8000, []int{1}},
+		{8080, []int{1, 3}},
+		{8081, []int{1}},
+		{9000, nil},
+		{65535, []int{4}},
+	}
+	for _, tt := range tests {
+		if got := pr.Lookup(tt.port); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%d) = %v, want %v", tt.port, got, tt.want)
+		}
+	}
+}
+
+// The matcher must return the same rules, in the same order, as checking
+// every rule
+func TestRuleMatcherEqualsLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ports := []string{"*", "443", "80", "8000-8999", "!443", "1-1024", "50000-65535"}
+	subnets := []string{"*", "10.0.0.0/8", "10.1.0.0/16", "!10.0.0.0/8", "2600:1f00::/24", "192.168.1.0/24", "0.0.0.0/0"}
+	var rules []Rule
+	for i := 0; i < 500; i++ {
+		r, err := ParseRule(map[string]string{
+			"priority":    fmt.Sprint(rng.Intn(5)),
+			"server_ip":   subnets[rng.Intn(len(subnets))],
+			"client_ip":   subnets[rng.Intn(len(subnets))],
+			"server_port": ports[rng.Intn(len(ports))],
+			"client_port": ports[rng.Intn(len(ports))],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Class = fmt.Sprintf("class%03d", i)
+		rules = append(rules, r)
+	}
+	SortRules(rules)
+	rm := NewRuleMatcher(rules)
+
+	ips := []string{"10.1.2.3", "10.2.0.1", "192.168.1.7", "8.8.8.8", "2600:1f00::1", "2001:db8::1"}
+	for i := 0; i < 2000; i++ {
+		header := common.FiveTuple{
+			SrcIP:   ips[rng.Intn(len(ips))],
+			DstIP:   ips[rng.Intn(len(ips))],
+			SrcPort: uint16(rng.Intn(65536)),
+			DstPort: uint16(rng.Intn(65536)),
+		}
+		if i%2 == 0 {
+			header.SrcPort = []uint16{80, 443, 8080, 1024, 60000}[rng.Intn(5)]
+		}
+		var want []string
+		for _, r := range rules {
+			if r.Match(header) {
+				want = append(want, r.Class)
+			}
+		}
+		if got := matchAll(rm, header); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%v: matcher %v, linear scan %v", header, got, want)
+		}
+	}
+}
+
+func matchAll(rm *RuleMatcher, header common.FiveTuple) []string {
+	var classes []string
+	rm.Match(header, func(r Rule) bool {
+		classes = append(classes, r.Class)
+		return true
+	})
+	return classes
+}
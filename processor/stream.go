@@ -0,0 +1,378 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// StreamServer streams events to HTTP clients as server-sent events.
+// A client GETs /events with query parameters selecting what it gets:
+//
+//	topic        topic pattern (path.Match syntax, e.g. telemetry.*), repeatable
+//	class        flow class, '!' negates, repeatable (any listed class matches)
+//	client_ip, server_ip, client_port, server_port, protocol
+//	             flow fields in header classifier rule syntax
+//
+// e.g. /events?topic=telemetry.*&class=netflix&server_port=443. Each event
+// is sent with its topic as event type and the dump JSON (see DumpItem)
+// as data. With flow filters, only events of a flow (having a Header
+// five tuple) are sent. GET /topics lists the topics served.
+//
+// Every client has a queue of Buffer events: a client too slow to keep
+// up is disconnected rather than stalling the event bus.
+type StreamServer struct {
+	BaseSubscriber
+	topics []events.Topic
+	// Buffer is the number of events queued per client
+	Buffer int
+	// Heartbeat is the interval of keep-alive comments
+	Heartbeat time.Duration
+	anon      *Anonymizer
+
+	ln      net.Listener
+	srv     *http.Server
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	classes map[common.FiveTuple][]string
+
+	nClients      uint64
+	nSlowClients  uint64
+	nEventsSent   uint64
+	nMarshalFails uint64
+}
+
+type streamClient struct {
+	topics  []string
+	classes []string
+	negate  []bool
+	rule    *Rule
+	ch      chan []byte
+	gone    chan struct{}
+	reason  string
+}
+
+func NewStreamServer(listen string, topics []events.Topic) *StreamServer {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal().Err(err).Str("listen", listen).Msg("unable to start stream server")
+	}
+	ss := &StreamServer{
+		Buffer:    1024,
+		Heartbeat: 15 * time.Second,
+		ln:        ln,
+		clients:   make(map[*streamClient]struct{}),
+		classes:   make(map[common.FiveTuple][]string),
+	}
+	seen := make(map[events.Topic]struct{})
+	// classes are tracked for flow filters, flows forgotten on expiry
+	for _, t := range append(topics, events.CLASSIFICATION, events.FLOW_EXPIRED) {
+		if _, exists := seen[t]; !exists {
+			seen[t] = struct{}{}
+			ss.topics = append(ss.topics, t)
+		}
+	}
+	return ss
+}
+
+// SetAnonymizer anonymizes every event before it is sent
+func (ss *StreamServer) SetAnonymizer(a *Anonymizer) {
+	ss.anon = a
+}
+
+// Addr returns the address the server listens on
+func (ss *StreamServer) Addr() string {
+	return ss.ln.Addr().String()
+}
+
+func (ss *StreamServer) Init() {
+	log.Debug().Str("proc", ss.Name()).Str("listen", ss.Addr()).Int("buffer", ss.Buffer).Msg("init")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", ss.serveEvents)
+	mux.HandleFunc("/topics", ss.serveTopics)
+	ss.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := ss.srv.Serve(ss.ln); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("stream server stopped")
+		}
+	}()
+}
+
+func (ss *StreamServer) Name() string {
+	return "stream_server"
+}
+
+func (ss *StreamServer) Subs() []events.Topic {
+	return ss.topics
+}
+
+func (ss *StreamServer) serveTopics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ss.topics)
+}
+
+// newStreamClient parses the query of a client's request
+func (ss *StreamServer) newStreamClient(r *http.Request) (*streamClient, error) {
+	q := r.URL.Query()
+	c := &streamClient{
+		topics: q["topic"],
+		ch:     make(chan []byte, ss.Buffer),
+		gone:   make(chan struct{}),
+	}
+	for _, pattern := range c.topics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("topic %q: %w", pattern, err)
+		}
+		if !c.wantsAny(ss.topics, pattern) {
+			return nil, fmt.Errorf("topic %q: matches no topic served, see /topics", pattern)
+		}
+	}
+	for _, class := range q["class"] {
+		class, negate := parseNegation(class)
+		c.classes = append(c.classes, class)
+		c.negate = append(c.negate, negate)
+	}
+	config := make(map[string]string)
+	for _, field := range []string{"client_ip", "server_ip", "client_port", "server_port", "protocol"} {
+		if value := q.Get(field); value != "" {
+			config[field] = value
+		}
+	}
+	if len(config) > 0 {
+		rule, err := ParseRule(config)
+		if err != nil {
+			return nil, err
+		}
+		c.rule = &rule
+	}
+	return c, nil
+}
+
+func (c *streamClient) wantsAny(topics []events.Topic, pattern string) bool {
+	for _, t := range topics {
+		if ok, _ := path.Match(pattern, string(t)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *streamClient) wantsTopic(topic events.Topic) bool {
+	if len(c.topics) == 0 {
+		return true
+	}
+	for _, pattern := range c.topics {
+		if ok, _ := path.Match(pattern, string(topic)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *streamClient) filtersFlows() bool {
+	return c.rule != nil || len(c.classes) > 0
+}
+
+// wantsFlow checks the flow filters, negated classes must all differ
+// from the flow's classes and one of the others must be among them
+func (c *streamClient) wantsFlow(header common.FiveTuple, classes []string) bool {
+	if c.rule != nil && !c.rule.Match(header) {
+		return false
+	}
+	matched, positive := false, false
+	for i, class := range c.classes {
+		has := false
+		for _, fc := range classes {
+			if fc == class {
+				has = true
+				break
+			}
+		}
+		if c.negate[i] {
+			if has {
+				return false
+			}
+			continue
+		}
+		positive = true
+		matched = matched || has
+	}
+	return matched || !positive
+}
+
+func (ss *StreamServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c, err := ss.newStreamClient(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ss.mu.Lock()
+	ss.clients[c] = struct{}{}
+	ss.mu.Unlock()
+	atomic.AddUint64(&ss.nClients, 1)
+	log.Info().Str("proc", ss.Name()).Str("client", r.RemoteAddr).Str("query", r.URL.RawQuery).Msg("client connected")
+	defer func() {
+		ss.remove(c, "closed by client")
+		log.Info().Str("proc", ss.Name()).Str("client", r.RemoteAddr).Str("reason", c.reason).Msg("client disconnected")
+	}()
+
+	heartbeat := time.NewTicker(ss.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case b := <-c.ch:
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			// send what is queued before flushing
+			for n := len(c.ch); n > 0; n-- {
+				if _, err := w.Write(<-c.ch); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.gone:
+			for n := len(c.ch); n > 0; n-- {
+				if _, err := w.Write(<-c.ch); err != nil {
+					return
+				}
+			}
+			fmt.Fprintf(w, "event: disconnect\ndata: %q\n\n", c.reason)
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// remove forgets a client unless it is gone already
+func (ss *StreamServer) remove(c *streamClient, reason string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, exists := ss.clients[c]; !exists {
+		return
+	}
+	delete(ss.clients, c)
+	c.reason = reason
+	close(c.gone)
+}
+
+func (ss *StreamServer) EventHandler(topic events.Topic, event interface{}) {
+	_, header, isFlow := eventFlow(event)
+	switch topic {
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Class != "" {
+			ss.classes[clf.Header] = append(ss.classes[clf.Header], clf.Class)
+		}
+	case events.FLOW_EXPIRED:
+		defer delete(ss.classes, header)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var b []byte
+	for c := range ss.clients {
+		if !c.wantsTopic(topic) {
+			continue
+		}
+		if c.filtersFlows() && (!isFlow || !c.wantsFlow(header, ss.classes[header])) {
+			continue
+		}
+		if b == nil {
+			var err error
+			if b, err = ss.marshal(topic, event); err != nil {
+				log.Error().Err(err).Str("topic", string(topic)).Msg("unable to marshal event: dropping event")
+				atomic.AddUint64(&ss.nMarshalFails, 1)
+				return
+			}
+		}
+		select {
+		case c.ch <- b:
+			atomic.AddUint64(&ss.nEventsSent, 1)
+		default:
+			atomic.AddUint64(&ss.nSlowClients, 1)
+			delete(ss.clients, c)
+			c.reason = fmt.Sprintf("too slow: %d events queued", len(c.ch))
+			close(c.gone)
+		}
+	}
+}
+
+// marshal encodes an event as a server-sent event
+func (ss *StreamServer) marshal(topic events.Topic, event interface{}) ([]byte, error) {
+	if ss.anon != nil {
+		var err error
+		if event, err = ss.anon.Anonymize(event); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(DumpItem{Topic: string(topic), Event: event})
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(data)+len(topic)+16)
+	b = append(b, "event: "...)
+	b = append(b, topic...)
+	b = append(b, "\ndata: "...)
+	b = append(b, data...)
+	return append(b, '\n', '\n'), nil
+}
+
+func (ss *StreamServer) Teardown() {
+	ss.mu.Lock()
+	for c := range ss.clients {
+		delete(ss.clients, c)
+		c.reason = "shutting down"
+		close(c.gone)
+	}
+	ss.mu.Unlock()
+	// let handlers send what is queued
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ss.srv.Shutdown(ctx); err != nil {
+		ss.srv.Close()
+	}
+	log.Info().Str("proc", ss.Name()).Uint64("clients", atomic.LoadUint64(&ss.nClients)).
+		Uint64("slow_clients", atomic.LoadUint64(&ss.nSlowClients)).
+		Uint64("events_sent", atomic.LoadUint64(&ss.nEventsSent)).Msg("teardown")
+}
+
+func (ss *StreamServer) Collect(w *MetricsWriter) {
+	ss.mu.Lock()
+	connected := len(ss.clients)
+	ss.mu.Unlock()
+	w.Gauge("edrint_stream_clients", "Stream clients connected", float64(connected))
+	w.Counter("edrint_stream_clients_total", "Stream clients connected since start", float64(atomic.LoadUint64(&ss.nClients)))
+	w.Counter("edrint_stream_slow_clients_total", "Stream clients disconnected for being too slow",
+		float64(atomic.LoadUint64(&ss.nSlowClients)))
+	w.Counter("edrint_stream_events_sent_total", "Events queued to stream clients", float64(atomic.LoadUint64(&ss.nEventsSent)))
+	w.Counter("edrint_stream_marshal_failures_total", "Events not streamed as they could not be encoded",
+		float64(atomic.LoadUint64(&ss.nMarshalFails)))
+}
@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func newTestStreamServer(t *testing.T) *StreamServer {
+	ss := NewStreamServer("127.0.0.1:0", []events.Topic{events.TELEMETRY_FLOWLET, "packet_parser.metadata"})
+	ss.Init()
+	t.Cleanup(ss.Teardown)
+	return ss
+}
+
+// waitClients waits for n clients to be registered
+func waitClients(t *testing.T, ss *StreamServer, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ss.mu.Lock()
+		connected := len(ss.clients)
+		ss.mu.Unlock()
+		if connected == n {
+			return
+		}
+	}
+	t.Fatalf("%d clients never connected", n)
+}
+
+func TestStreamServerFilters(t *testing.T) {
+	ss := newTestStreamServer(t)
+	resp, err := http.Get("http://" + ss.Addr() + "/events?topic=flow.*&topic=telemetry.*&class=netflix&server_port=443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	waitClients(t, ss, 1)
+
+	netflix := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	other := common.FiveTuple{SrcIP: "1.2.3.5", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50001, Protocol: 6}
+	netflix80 := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 80, DstPort: 50002, Protocol: 6}
+	for _, h := range []common.FiveTuple{netflix, netflix80} {
+		ss.EventHandler(events.CLASSIFICATION, EventClassification{Header: h, Class: "netflix"})
+	}
+	ss.EventHandler(events.CLASSIFICATION, EventClassification{Header: other, Class: "zoom"})
+	ss.EventHandler("packet_parser.metadata", struct{ NPackets int }{10})
+	for _, h := range []common.FiveTuple{other, netflix80, netflix} {
+		ss.EventHandler(events.TELEMETRY_FLOWLET, struct{ Header common.FiveTuple }{h})
+		ss.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: h})
+	}
+	if len(ss.classes) != 0 {
+		t.Errorf("%d flow classes kept after expiry", len(ss.classes))
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	var got []string
+	for len(got) < 2 && sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "event: ") {
+			got = append(got, strings.TrimPrefix(line, "event: "))
+			continue
+		}
+		if strings.HasPrefix(line, "data: ") && !strings.Contains(line, `"SrcPort":443,"DstPort":50000`) {
+			t.Errorf("event of another flow: %s", line)
+		}
+	}
+	if strings.Join(got, ",") != "telemetry.flowlet,flow.expired" {
+		t.Errorf("events %v", got)
+	}
+}
+
+func TestStreamServerBadRequest(t *testing.T) {
+	ss := newTestStreamServer(t)
+	for _, query := range []string{"topic=protocol.*", "topic=[", "server_ip=nonsense"} {
+		resp, err := http.Get("http://" + ss.Addr() + "/events?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestStreamServerDisconnectsSlowClients(t *testing.T) {
+	ss := newTestStreamServer(t)
+	ss.Buffer = 2
+	c, err := ss.newStreamClient(httptest.NewRequest("GET", "/events", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.clients[c] = struct{}{}
+	for i := 0; i < 3; i++ {
+		ss.EventHandler(events.TELEMETRY_FLOWLET, struct{ N int }{i})
+	}
+	select {
+	case <-c.gone:
+	default:
+		t.Fatal("slow client still connected")
+	}
+	if len(ss.clients) != 0 || !strings.HasPrefix(c.reason, "too slow") {
+		t.Errorf("clients %d, reason %q", len(ss.clients), c.reason)
+	}
+	if len(c.ch) != 2 {
+		t.Errorf("%d events queued, want the first 2", len(c.ch))
+	}
+}
@@ -0,0 +1,289 @@
+package processor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// TableWriter writes the events of each topic to <dir>/<topic>.<format>
+// as CSV or Parquet. The columns are taken from the first event of the
+// topic (see EventColumns); events of another type are dropped. Every
+// table ends with sample_rate_flow and sample_rate_packet columns so
+// sampled telemetry can be scaled back up.
+//
+// CSV times are RFC3339Nano and list columns are JSON arrays. Parquet
+// times are TIMESTAMP_MICROS and lists are LIST columns.
+//
+// With an Anonymizer, values are anonymized as in dumped events.
+type TableWriter struct {
+	BaseSubscriber
+	format string
+	dir    string
+	topics []events.Topic
+	// FlushRows is the number of rows buffered before a CSV flush and
+	// the number of rows in a Parquet row group
+	FlushRows int
+	// Compression is the Parquet codec: snappy, gzip or none
+	Compression string
+	tables      map[events.Topic]*table
+	anon        *Anonymizer
+}
+
+type table struct {
+	typ     reflect.Type
+	columns []Column
+	out     tableFile
+	rows    int
+	dropped int
+}
+
+type tableFile interface {
+	Write(values []interface{}) error
+	Flush() error
+	Close() error
+}
+
+func NewTableWriter(format, dir string, topics []events.Topic) *TableWriter {
+	if format != "csv" && format != "parquet" {
+		log.Fatal().Str("format", format).Msg("unknown table format")
+	}
+	return &TableWriter{
+		format:      format,
+		dir:         dir,
+		topics:      topics,
+		FlushRows:   10000,
+		Compression: "snappy",
+		tables:      make(map[events.Topic]*table),
+	}
+}
+
+// SetAnonymizer anonymizes every value before it is written
+func (tw *TableWriter) SetAnonymizer(a *Anonymizer) {
+	tw.anon = a
+}
+
+func (tw *TableWriter) Init() {
+	log.Debug().Str("proc", tw.Name()).Str("dir", tw.dir).Int("flush_rows", tw.FlushRows).
+		Str("compression", tw.Compression).Msg("init")
+}
+
+func (tw *TableWriter) Name() string {
+	return tw.format + "_writer"
+}
+
+func (tw *TableWriter) Subs() []events.Topic {
+	return tw.topics
+}
+
+func (tw *TableWriter) EventHandler(topic events.Topic, event interface{}) {
+	event, rates := telemetry.Unsampled(event)
+	rates = rates.Normalized()
+	t, exists := tw.tables[topic]
+	if !exists {
+		t = tw.newTable(topic, reflect.TypeOf(event))
+		tw.tables[topic] = t
+	}
+	if reflect.TypeOf(event) != t.typ {
+		if t.dropped == 0 {
+			log.Warn().Str("proc", tw.Name()).Str("topic", string(topic)).
+				Str("type", fmt.Sprintf("%T", event)).Msg("event type differs from table: dropping")
+		}
+		t.dropped++
+		return
+	}
+
+	v := reflect.ValueOf(event)
+	values := make([]interface{}, 0, len(t.columns)+2)
+	for _, c := range t.columns {
+		value := c.Value(v)
+		if tw.anon != nil {
+			value = tw.anon.AnonymizeColumn(c, value)
+		}
+		values = append(values, value)
+	}
+	values = append(values, int64(rates.Flow), int64(rates.Packet))
+	if err := t.out.Write(values); err != nil {
+		log.Fatal().Err(err).Str("topic", string(topic)).Msg("unable to write row")
+	}
+	t.rows++
+	if tw.FlushRows > 0 && t.rows%tw.FlushRows == 0 {
+		if err := t.out.Flush(); err != nil {
+			log.Fatal().Err(err).Str("topic", string(topic)).Msg("unable to flush table")
+		}
+	}
+}
+
+func (tw *TableWriter) newTable(topic events.Topic, typ reflect.Type) *table {
+	columns := EventColumns(typ)
+	all := append(append([]Column(nil), columns...),
+		Column{Name: "sample_rate_flow", Kind: ColInt},
+		Column{Name: "sample_rate_packet", Kind: ColInt})
+	path := filepath.Join(tw.dir, strings.Replace(string(topic), "/", "_", -1)+"."+tw.format)
+	file := createFile(path)
+
+	var out tableFile
+	var err error
+	switch tw.format {
+	case "csv":
+		out, err = newCSVTable(file, all)
+	case "parquet":
+		out, err = newParquetTable(file, all, tw.Compression)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("unable to create table")
+	}
+	log.Info().Str("proc", tw.Name()).Str("path", path).Int("columns", len(all)).Msg("table created")
+	return &table{typ: typ, columns: columns, out: out}
+}
+
+func (tw *TableWriter) Teardown() {
+	for topic, t := range tw.tables {
+		if err := t.out.Close(); err != nil {
+			log.Fatal().Err(err).Str("topic", string(topic)).Msg("unable to close table")
+		}
+		log.Info().Str("proc", tw.Name()).Str("topic", string(topic)).Int("rows", t.rows).
+			Int("dropped", t.dropped).Msg("table closed")
+	}
+}
+
+type csvTable struct {
+	file *os.File
+	w    *csv.Writer
+	row  []string
+}
+
+func newCSVTable(file *os.File, columns []Column) (*csvTable, error) {
+	ct := &csvTable{file: file, w: csv.NewWriter(file), row: make([]string, len(columns))}
+	for i, c := range columns {
+		ct.row[i] = c.Name
+	}
+	return ct, ct.w.Write(ct.row)
+}
+
+func (ct *csvTable) Write(values []interface{}) error {
+	for i, v := range values {
+		ct.row[i] = csvValue(v)
+	}
+	return ct.w.Write(ct.row)
+}
+
+func csvValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (ct *csvTable) Flush() error {
+	ct.w.Flush()
+	return ct.w.Error()
+}
+
+func (ct *csvTable) Close() error {
+	if err := ct.Flush(); err != nil {
+		return err
+	}
+	return ct.file.Close()
+}
+
+type parquetTable struct {
+	file *os.File
+	pw   *writer.ParquetWriter
+	row  reflect.Type
+}
+
+var parquetTypes = map[ColumnKind]struct {
+	goType reflect.Type
+	tag    string
+}{
+	ColString: {reflect.TypeOf(""), "UTF8"},
+	ColJSON:   {reflect.TypeOf(""), "UTF8"},
+	ColInt:    {reflect.TypeOf(int64(0)), "INT64"},
+	ColTime:   {reflect.TypeOf(int64(0)), "TIMESTAMP_MICROS"},
+	ColFloat:  {reflect.TypeOf(float64(0)), "DOUBLE"},
+	ColBool:   {reflect.TypeOf(false), "BOOLEAN"},
+}
+
+func newParquetTable(file *os.File, columns []Column, compression string) (*parquetTable, error) {
+	fields := make([]reflect.StructField, len(columns))
+	for i, c := range columns {
+		pt := parquetTypes[c.Kind]
+		fields[i] = reflect.StructField{
+			Name: fmt.Sprintf("C%d", i),
+			Type: pt.goType,
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"name=%s, type=%s"`, c.Name, pt.tag)),
+		}
+		if c.List {
+			fields[i].Type = reflect.SliceOf(pt.goType)
+			fields[i].Tag = reflect.StructTag(fmt.Sprintf(`parquet:"name=%s, type=LIST, valuetype=%s"`, c.Name, pt.tag))
+		}
+	}
+	row := reflect.StructOf(fields)
+	pw, err := writer.NewParquetWriterFromWriter(file, reflect.New(row).Interface(), 1)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case "gzip":
+		pw.CompressionType = parquet.CompressionCodec_GZIP
+	case "none":
+		pw.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+	default:
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	}
+	return &parquetTable{file: file, pw: pw, row: row}, nil
+}
+
+func (pt *parquetTable) Write(values []interface{}) error {
+	row := reflect.New(pt.row).Elem()
+	for i, v := range values {
+		switch val := v.(type) {
+		case time.Time:
+			row.Field(i).SetInt(val.UnixNano() / 1000)
+		case []time.Time:
+			micros := make([]int64, len(val))
+			for j, t := range val {
+				micros[j] = t.UnixNano() / 1000
+			}
+			row.Field(i).Set(reflect.ValueOf(micros))
+		default:
+			row.Field(i).Set(reflect.ValueOf(v))
+		}
+	}
+	return pt.pw.Write(row.Interface())
+}
+
+// Flush ends the current row group
+func (pt *parquetTable) Flush() error {
+	return pt.pw.Flush(true)
+}
+
+func (pt *parquetTable) Close() error {
+	if err := pt.pw.WriteStop(); err != nil {
+		return err
+	}
+	return pt.file.Close()
+}
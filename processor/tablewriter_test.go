@@ -0,0 +1,165 @@
+package processor
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestTableWriterAnonymize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, local, _ := net.ParseCIDR("10.0.0.0/8")
+	anon, err := NewAnonymizer(cryptoPAnTestKey, []net.IPNet{*local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anon.RedactPorts = true
+	anon.RedactNames = true
+
+	type event struct {
+		Header  common.FiveTuple
+		SAN     []string
+		Servers map[string]int
+	}
+	tw := NewTableWriter("csv", dir, []events.Topic{"test"})
+	tw.SetAnonymizer(anon)
+	tw.EventHandler("test", event{
+		Header:  common.FiveTuple{SrcIP: "128.11.68.132", DstIP: "10.1.2.3", SrcPort: 443, DstPort: 50000, Protocol: 6},
+		SAN:     []string{"example.com"},
+		Servers: map[string]int{"129.118.74.4": 1},
+	})
+	tw.Teardown()
+
+	f, err := os.Open(filepath.Join(dir, "test.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"header_src_ip", "header_dst_ip", "header_src_port", "header_dst_port", "header_protocol",
+			"san", "servers", "sample_rate_flow", "sample_rate_packet"},
+		{"135.242.180.132", "10.1.2.3", "0", "0", "6", `["redacted"]`, `{"134.136.186.123":1}`, "1", "1"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+type parquetTestEvent struct {
+	Header   common.FiveTuple
+	Start    time.Time
+	Bytes    int
+	RTT      float64
+	Final    bool
+	SAN      []string
+	Arrivals []time.Time
+	Servers  map[string]int
+}
+
+// parquetTestRow is parquetTestEvent as read back: nested structs are
+// flattened, times are microseconds and maps are JSON
+type parquetTestRow struct {
+	HeaderSrcIP      string   `parquet:"name=header_src_ip, type=UTF8"`
+	HeaderDstIP      string   `parquet:"name=header_dst_ip, type=UTF8"`
+	HeaderSrcPort    int64    `parquet:"name=header_src_port, type=INT64"`
+	HeaderDstPort    int64    `parquet:"name=header_dst_port, type=INT64"`
+	HeaderProtocol   int64    `parquet:"name=header_protocol, type=INT64"`
+	Start            int64    `parquet:"name=start, type=TIMESTAMP_MICROS"`
+	Bytes            int64    `parquet:"name=bytes, type=INT64"`
+	RTT              float64  `parquet:"name=rtt, type=DOUBLE"`
+	Final            bool     `parquet:"name=final, type=BOOLEAN"`
+	SAN              []string `parquet:"name=san, type=LIST, valuetype=UTF8"`
+	Arrivals         []int64  `parquet:"name=arrivals, type=LIST, valuetype=TIMESTAMP_MICROS"`
+	Servers          string   `parquet:"name=servers, type=UTF8"`
+	SampleRateFlow   int64    `parquet:"name=sample_rate_flow, type=INT64"`
+	SampleRatePacket int64    `parquet:"name=sample_rate_packet, type=INT64"`
+}
+
+func TestTableWriterParquet(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2020, 10, 19, 10, 15, 0, 123456789, time.UTC)
+	header := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	for _, compression := range []string{"snappy", "gzip", "none"} {
+		tw := NewTableWriter("parquet", dir, []events.Topic{"test"})
+		tw.Compression = compression
+		// rows span row groups
+		tw.FlushRows = 2
+		tw.EventHandler("test", parquetTestEvent{
+			Header:   header,
+			Start:    start,
+			Bytes:    1500,
+			RTT:      12.5,
+			Final:    true,
+			SAN:      []string{"example.com", "www.example.com"},
+			Arrivals: []time.Time{start, start.Add(time.Millisecond)},
+			Servers:  map[string]int{"1.2.3.4": 2},
+		})
+		tw.EventHandler("test", telemetry.SampledEvent{
+			Event:       parquetTestEvent{Header: header, Start: start},
+			SampleRates: telemetry.SampleRates{Flow: 4},
+		})
+		tw.EventHandler("test", parquetTestEvent{Header: header, Start: start, SAN: []string{}})
+		tw.EventHandler("test", "dropped")
+		tw.Teardown()
+
+		fr, err := local.NewLocalFileReader(filepath.Join(dir, "test.parquet"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, err := reader.NewParquetReader(fr, new(parquetTestRow), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := make([]parquetTestRow, pr.GetNumRows())
+		if err := pr.Read(&rows); err != nil {
+			t.Fatal(err)
+		}
+		pr.ReadStop()
+		fr.Close()
+
+		micros := start.UnixNano() / 1000
+		empty := parquetTestRow{
+			HeaderSrcIP: "1.2.3.4", HeaderDstIP: "10.0.0.1", HeaderSrcPort: 443, HeaderDstPort: 50000, HeaderProtocol: 6,
+			Start: micros, Servers: "null", SampleRateFlow: 1, SampleRatePacket: 1,
+		}
+		full := empty
+		full.Bytes, full.RTT, full.Final = 1500, 12.5, true
+		full.SAN = []string{"example.com", "www.example.com"}
+		full.Arrivals = []int64{micros, micros + 1000}
+		full.Servers = `{"1.2.3.4":2}`
+		sampled := empty
+		sampled.SampleRateFlow = 4
+		want := []parquetTestRow{full, sampled, empty}
+		for i := range rows {
+			// empty and nil lists read back alike
+			if len(rows[i].SAN) == 0 {
+				rows[i].SAN = nil
+			}
+			if len(rows[i].Arrivals) == 0 {
+				rows[i].Arrivals = nil
+			}
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("%s: rows = %+v, want %+v", compression, rows, want)
+		}
+	}
+}
@@ -10,36 +10,83 @@ import (
 	"github.com/sharat910/edrint/telemetry"
 )
 
+// TelemetryManager attaches the telemetry of a flow's classes to it.
+// With Reclassify, a flow's telemetry follows its latest classifier:
+// a classification from a different source than the flow's current
+// classes (or a non-fallback one replacing a fallback) detaches the
+// telemetry the new class does not have. Fallback classifications never
+// replace real ones. Without it, telemetry of every class is attached.
+//
+// Sampling (or ClassSampling for a class) attaches a class's telemetry
+// to 1-in-N flows by hash of the flow's five tuple and feeds it 1-in-N
+// of their packets. Events of sampled telemetry are SampledEvents.
 type TelemetryManager struct {
 	BasePublisher
-	Classes map[string][]telemetry.TeleGen
+	Classes       map[string][]telemetry.TeleGen
+	Reclassify    bool
+	Sampling      telemetry.SampleRates
+	ClassSampling map[string]telemetry.SampleRates
+	flows         map[common.FiveTuple]*flowClasses
+	nSkipped      uint
+}
+
+type flowClasses struct {
+	source   string
+	fallback bool
+	classes  []string
+	attached map[string]struct{}
 }
 
 func NewTelemetryManager() *TelemetryManager {
 	return &TelemetryManager{
-		Classes: make(map[string][]telemetry.TeleGen),
+		Classes:       make(map[string][]telemetry.TeleGen),
+		ClassSampling: make(map[string]telemetry.SampleRates),
+		flows:         make(map[common.FiveTuple]*flowClasses),
+	}
+}
+
+// SampleRates returns the sample rates of a class
+func (tm *TelemetryManager) SampleRates(class string) telemetry.SampleRates {
+	if rates, exists := tm.ClassSampling[class]; exists {
+		return rates
 	}
+	return tm.Sampling
 }
 
 func (tm *TelemetryManager) AddTFToClass(class string, tfgen telemetry.TeleGen) {
 	tm.Classes[class] = append(tm.Classes[class], tfgen)
 }
 
+// SetClasses replaces the class -> telemetry mapping. Telemetry
+// already attached to flows is not affected.
+func (tm *TelemetryManager) SetClasses(classes map[string][]telemetry.TeleGen) {
+	tm.Classes = classes
+}
+
 func (tm *TelemetryManager) Name() string {
 	return "telemetry_manager"
 }
 
 func (tm *TelemetryManager) Init() {
-	log.Debug().Str("proc", tm.Name()).Str("classes", fmt.Sprint(tm.Classes)).Msg("Init")
+	log.Debug().Str("proc", tm.Name()).Str("classes", fmt.Sprint(tm.Classes)).
+		Bool("reclassify", tm.Reclassify).Interface("sampling", tm.Sampling).
+		Interface("class_sampling", tm.ClassSampling).Msg("Init")
+}
+
+func (tm *TelemetryManager) Teardown() {
+	if tm.nSkipped > 0 {
+		log.Info().Str("proc", tm.Name()).Uint("sampled_out", tm.nSkipped).Msg("teardown")
+	}
 }
 
 func (tm *TelemetryManager) Subs() []events.Topic {
-	return []events.Topic{events.CLASSIFICATION}
+	return []events.Topic{events.CLASSIFICATION, events.FLOW_EXPIRED}
 }
 
 func (tm *TelemetryManager) Pubs() []events.Topic {
 	pubMap := map[events.Topic]struct{}{
 		events.FLOW_ATTACH_TELEMETRY: {},
+		events.FLOW_DETACH_TELEMETRY: {},
 	}
 	for _, tfgens := range tm.Classes {
 		for _, tfgen := range tfgens {
@@ -60,26 +107,106 @@ func (tm *TelemetryManager) EventHandler(topic events.Topic, event interface{})
 	switch topic {
 	case events.CLASSIFICATION:
 		clf := event.(EventClassification)
-		var tfs []telemetry.Telemetry
-		for _, tfgen := range tm.Classes[clf.Class] {
-			tf := tfgen()
-			tf.SetPubFunc(tm.pf)
-			tf.SetHeader(clf.Header)
-			tfs = append(tfs, tf)
+		if clf.Class == "" || clf.AtExpiry {
+			return
 		}
+		if !tm.Reclassify {
+			tm.attach(clf, nil)
+			return
+		}
+		tm.reclassify(clf)
+	case events.FLOW_EXPIRED:
+		delete(tm.flows, event.(FlowExpiredEvent).Header)
+	}
+}
 
-		if len(tfs) != 0 {
-			tm.Publish(events.FLOW_ATTACH_TELEMETRY, EventAttachPerFlowTelemetry{
-				Header:             clf.Header,
-				TelemetryFunctions: tfs,
+func (tm *TelemetryManager) reclassify(clf EventClassification) {
+	fc, exists := tm.flows[clf.Header]
+	switch {
+	case !exists:
+		fc = &flowClasses{attached: make(map[string]struct{})}
+		tm.flows[clf.Header] = fc
+	case clf.Fallback && !fc.fallback:
+		return
+	case clf.Source == fc.source && clf.Fallback == fc.fallback:
+		// same classifier adding a class
+		fc.classes = append(fc.classes, clf.Class)
+		tm.attach(clf, fc.attached)
+		return
+	default:
+		keep := make(map[string]struct{})
+		for _, tfgen := range tm.Classes[clf.Class] {
+			keep[tfgen().Name()] = struct{}{}
+		}
+		var detach []string
+		for name := range fc.attached {
+			if _, ok := keep[name]; !ok {
+				detach = append(detach, name)
+				delete(fc.attached, name)
+			}
+		}
+		if len(detach) != 0 {
+			log.Debug().Str("header", clf.Header.String()).Strs("from", fc.classes).
+				Str("to", clf.Class).Strs("detach", detach).Msg("reclassified")
+			tm.Publish(events.FLOW_DETACH_TELEMETRY, EventDetachPerFlowTelemetry{
+				Header:         clf.Header,
+				TelemetryNames: detach,
 			})
 		}
 	}
+	fc.source, fc.fallback, fc.classes = clf.Source, clf.Fallback, []string{clf.Class}
+	tm.attach(clf, fc.attached)
+}
+
+// attach creates the telemetry of clf's class, if the flow is sampled,
+// skipping names already in attached, which is updated if not nil
+func (tm *TelemetryManager) attach(clf EventClassification, attached map[string]struct{}) {
+	tfgens := tm.Classes[clf.Class]
+	if len(tfgens) == 0 {
+		return
+	}
+	rates := tm.SampleRates(clf.Class).Normalized()
+	if !telemetry.FlowSampled(clf.Header, rates.Flow) {
+		tm.nSkipped++
+		return
+	}
+
+	var tfs []telemetry.Telemetry
+	for _, tfgen := range tfgens {
+		tf := tfgen()
+		if attached != nil {
+			if _, ok := attached[tf.Name()]; ok {
+				continue
+			}
+			attached[tf.Name()] = struct{}{}
+		}
+		if rates.IsSampling() {
+			tf = telemetry.NewSampled(tf, rates)
+		}
+		tf.SetPubFunc(tm.pf)
+		tf.SetHeader(clf.Header)
+		tfs = append(tfs, tf)
+	}
+	if len(tfs) != 0 {
+		tm.Publish(events.FLOW_ATTACH_TELEMETRY, EventAttachPerFlowTelemetry{
+			Header:             clf.Header,
+			TelemetryFunctions: tfs,
+			SampleRates:        rates,
+		})
+	}
+}
+
+// EventDetachPerFlowTelemetry tears down and removes the named
+// telemetry functions from a flow
+type EventDetachPerFlowTelemetry struct {
+	Header         common.FiveTuple
+	TelemetryNames []string
 }
 
 type EventAttachPerFlowTelemetry struct {
 	Header             common.FiveTuple
 	TelemetryFunctions []telemetry.Telemetry
+	SampleRates        telemetry.SampleRates
 }
 
 func (e EventAttachPerFlowTelemetry) MarshalJSON() ([]byte, error) {
@@ -90,8 +217,10 @@ func (e EventAttachPerFlowTelemetry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Header             common.FiveTuple
 		TelemetryFunctions []string
+		SampleRates        telemetry.SampleRates
 	}{
 		e.Header,
 		tfNames,
+		e.SampleRates,
 	})
 }
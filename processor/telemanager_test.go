@@ -0,0 +1,33 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+func TestTelemetryManagerSkipsExpiryClassifications(t *testing.T) {
+	tm := NewTelemetryManager()
+	tm.AddTFToClass("video", telemetry.NewFlowSummary())
+	var attached []common.FiveTuple
+	tm.SetPubFunc(func(topic events.Topic, event interface{}) {
+		if topic == events.FLOW_ATTACH_TELEMETRY {
+			attached = append(attached, event.(EventAttachPerFlowTelemetry).Header)
+		}
+	})
+
+	live := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	expired := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50001, Protocol: 6}
+	for _, reclassify := range []bool{false, true} {
+		attached = nil
+		tm.Reclassify = reclassify
+		tm.EventHandler(events.CLASSIFICATION, EventClassification{Header: live, Class: "video", Source: "ml_classifier"})
+		tm.EventHandler(events.CLASSIFICATION, EventClassification{Header: expired, Class: "video", Source: "ml_classifier", AtExpiry: true})
+		if len(attached) != 1 || attached[0] != live {
+			t.Errorf("reclassify %v: attached to %v, want only %v", reclassify, attached, live)
+		}
+		tm.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: live})
+	}
+}
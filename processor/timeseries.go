@@ -0,0 +1,545 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+	"github.com/sharat910/edrint/telemetry"
+)
+
+type TimeSeriesConfig struct {
+	// Format is influx (line protocol) or sql
+	Format string `mapstructure:"format"`
+	// Topics are telemetry topics with per interval arrays (IntervalMS
+	// and FirstPacketTS, e.g. flowpulse) or per sample arrays
+	// (RelTimestampMS, e.g. tcp.rtt)
+	Topics []string `mapstructure:"topics"`
+	// SNI tags points with the flow's SNI, needs an SNI parser
+	SNI bool `mapstructure:"sni"`
+	// FlowTag tags points with the flow hash, one series per flow
+	FlowTag bool `mapstructure:"flow_tag"`
+
+	// influx: Path appends lines to a file, URL posts them to a write
+	// endpoint (e.g. http://localhost:8086/api/v2/write?org=o&bucket=b&precision=ns)
+	Path  string `mapstructure:"path"`
+	URL   string `mapstructure:"url"`
+	Token string `mapstructure:"token"`
+
+	// sql: Driver is a database/sql driver (sqlite3, postgres). A table
+	// per measurement is created unless it exists.
+	Driver      string `mapstructure:"driver"`
+	DSN         string `mapstructure:"dsn"`
+	TablePrefix string `mapstructure:"table_prefix"`
+
+	// points are written in batches of BatchPoints or FlushInterval apart
+	BatchPoints   int           `mapstructure:"batch_points"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// QueueSize is the number of batches waiting to be written, batches
+	// beyond are dropped
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// TimeSeriesOutput turns interval indexed telemetry into time stamped
+// points, one per interval (skipping intervals without any count) or
+// sample, tagged with the flow's class, server IP and SNI. A topic's
+// measurement is its name without the telemetry prefix (e.g. flowpulse,
+// tcp_rtt) and its fields are the snake cased array names.
+type TimeSeriesOutput struct {
+	BaseSubscriber
+	config TimeSeriesConfig
+	sink   tsSink
+	flows  map[common.FiveTuple]*tsFlow
+
+	batch     []tsPoint
+	lastFlush time.Time
+	queue     chan []tsPoint
+	wg        sync.WaitGroup
+
+	nPoints  uint64
+	nDropped uint64
+}
+
+type tsFlow struct {
+	class    string
+	fallback bool
+	sni      string
+}
+
+type tsPoint struct {
+	Measurement string
+	Time        time.Time
+	Tags        tsTags
+	Fields      []tsField
+}
+
+// tsTags are in key order, empty tags are left out
+type tsTags struct {
+	Class    string
+	Flow     string
+	ServerIP string
+	SNI      string
+}
+
+type tsField struct {
+	Name  string
+	Value float64
+	Int   bool
+}
+
+// tsSink writes batches of points
+type tsSink interface {
+	Write(points []tsPoint) error
+	Close() error
+}
+
+func NewTimeSeriesOutput(config TimeSeriesConfig) *TimeSeriesOutput {
+	if len(config.Topics) == 0 {
+		log.Fatal().Msg("timeseries: no topics")
+	}
+	if config.BatchPoints == 0 {
+		config.BatchPoints = 5000
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = 10 * time.Second
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 64
+	}
+	ts := &TimeSeriesOutput{config: config, flows: make(map[common.FiveTuple]*tsFlow)}
+	var err error
+	switch config.Format {
+	case "influx":
+		switch {
+		case config.URL != "":
+			ts.sink = &influxHTTPSink{url: config.URL, token: config.Token, client: &http.Client{Timeout: 30 * time.Second}}
+		case config.Path != "":
+			ts.sink, err = newInfluxFileSink(config.Path)
+		default:
+			log.Fatal().Msg("timeseries: influx needs a path or url")
+		}
+	case "sql":
+		ts.sink, err = newSQLSink(config.Driver, config.DSN, config.TablePrefix)
+	default:
+		log.Fatal().Str("format", config.Format).Msg("timeseries: unknown format")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Str("format", config.Format).Msg("timeseries: unable to open output")
+	}
+	return ts
+}
+
+func (ts *TimeSeriesOutput) Init() {
+	log.Debug().Str("proc", ts.Name()).Str("format", ts.config.Format).Strs("topics", ts.config.Topics).Msg("init")
+	ts.lastFlush = time.Now()
+	ts.queue = make(chan []tsPoint, ts.config.QueueSize)
+	ts.wg.Add(1)
+	go ts.write()
+}
+
+func (ts *TimeSeriesOutput) Name() string {
+	return "timeseries_output"
+}
+
+func (ts *TimeSeriesOutput) Subs() []events.Topic {
+	subs := []events.Topic{events.CLASSIFICATION, events.FLOW_EXPIRED}
+	if ts.config.SNI {
+		subs = append(subs, events.PROTOCOL_SNI)
+	}
+	for _, t := range ts.config.Topics {
+		subs = append(subs, events.Topic(t))
+	}
+	return subs
+}
+
+func (ts *TimeSeriesOutput) flow(header common.FiveTuple) *tsFlow {
+	f, exists := ts.flows[header]
+	if !exists {
+		f = &tsFlow{}
+		ts.flows[header] = f
+	}
+	return f
+}
+
+func (ts *TimeSeriesOutput) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.CLASSIFICATION:
+		clf := event.(EventClassification)
+		if clf.Class == "" || clf.AtExpiry {
+			return
+		}
+		f := ts.flow(clf.Header)
+		if f.class == "" || (f.fallback && !clf.Fallback) {
+			f.class, f.fallback = clf.Class, clf.Fallback
+		}
+	case events.PROTOCOL_SNI:
+		sni := event.(SNIRecord)
+		ts.flow(sni.Header).sni = sni.SNI
+	case events.FLOW_EXPIRED:
+		// telemetry is published before its flow expires
+		delete(ts.flows, event.(FlowExpiredEvent).Header)
+	default:
+		v, header, ok := eventFlow(event)
+		if !ok {
+			return
+		}
+		tags := tsTags{ServerIP: header.SrcIP}
+		if f, exists := ts.flows[header]; exists {
+			tags.Class, tags.SNI = f.class, f.sni
+		}
+		if ts.config.FlowTag {
+			tags.Flow = fmt.Sprintf("%016x", telemetry.FlowHash(header))
+		}
+		ts.batch = append(ts.batch, telemetryPoints(measurementName(topic), v, tags)...)
+	}
+	if len(ts.batch) >= ts.config.BatchPoints || time.Since(ts.lastFlush) >= ts.config.FlushInterval {
+		ts.flush()
+	}
+}
+
+// measurementName is a topic without the telemetry prefix, e.g. tcp_rtt
+func measurementName(topic events.Topic) string {
+	return strings.Replace(strings.TrimPrefix(string(topic), "telemetry."), ".", "_", -1)
+}
+
+// telemetryPoints returns a point per interval with any non-zero count
+// (IntervalMS) or per sample (RelTimestampMS) of a telemetry event
+func telemetryPoints(measurement string, v reflect.Value, tags tsTags) []tsPoint {
+	first, _ := fieldTime(v, "FirstPacketTS")
+	var offsets []time.Duration
+	interval := numericField(v, "IntervalMS")
+	if len(interval) == 1 {
+		n := 0
+		tsArrays(v, func(name string, values []float64, isInt bool) {
+			if len(values) > n {
+				n = len(values)
+			}
+		})
+		for i := 0; i < n; i++ {
+			offsets = append(offsets, time.Duration(float64(i)*interval[0])*time.Millisecond)
+		}
+	} else if rel := numericField(v, "RelTimestampMS"); rel != nil {
+		for _, ms := range rel {
+			offsets = append(offsets, time.Duration(ms)*time.Millisecond)
+		}
+	} else {
+		return nil
+	}
+	points := make([]tsPoint, len(offsets))
+	for i := range points {
+		points[i] = tsPoint{Measurement: measurement, Time: first.Add(offsets[i]), Tags: tags}
+	}
+	tsArrays(v, func(name string, values []float64, isInt bool) {
+		for i := range points {
+			var x float64
+			if i < len(values) {
+				x = values[i]
+			}
+			points[i].Fields = append(points[i].Fields, tsField{Name: name, Value: x, Int: isInt})
+		}
+	})
+	if len(interval) != 1 {
+		return points
+	}
+	kept := points[:0]
+	for _, p := range points {
+		for _, f := range p.Fields {
+			if f.Value != 0 {
+				kept = append(kept, p)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// tsArrays calls f for every numeric slice field of v but the time offsets
+func tsArrays(v reflect.Value, f func(name string, values []float64, isInt bool)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" || sf.Type.Kind() != reflect.Slice || sf.Name == "RelTimestampMS" {
+			continue
+		}
+		kind, ok := basicKind(sf.Type.Elem())
+		if !ok || (kind != ColInt && kind != ColFloat) {
+			continue
+		}
+		f(snakeCase(sf.Name), numericField(v, sf.Name), kind == ColInt)
+	}
+}
+
+func fieldTime(v reflect.Value, name string) (time.Time, bool) {
+	f := v.FieldByName(name)
+	if !f.IsValid() || f.Type() != timeType {
+		return time.Time{}, false
+	}
+	return f.Interface().(time.Time), true
+}
+
+func (ts *TimeSeriesOutput) flush() {
+	ts.lastFlush = time.Now()
+	if len(ts.batch) == 0 {
+		return
+	}
+	select {
+	case ts.queue <- ts.batch:
+	default:
+		log.Warn().Int("points", len(ts.batch)).Msg("timeseries: output too slow, dropping points")
+		atomic.AddUint64(&ts.nDropped, uint64(len(ts.batch)))
+	}
+	ts.batch = nil
+}
+
+// write writes queued batches, off the event path
+func (ts *TimeSeriesOutput) write() {
+	defer ts.wg.Done()
+	for batch := range ts.queue {
+		if err := ts.sink.Write(batch); err != nil {
+			log.Error().Err(err).Int("points", len(batch)).Msg("timeseries: unable to write points")
+			atomic.AddUint64(&ts.nDropped, uint64(len(batch)))
+			continue
+		}
+		atomic.AddUint64(&ts.nPoints, uint64(len(batch)))
+	}
+}
+
+func (ts *TimeSeriesOutput) Teardown() {
+	ts.flush()
+	close(ts.queue)
+	ts.wg.Wait()
+	if err := ts.sink.Close(); err != nil {
+		log.Error().Err(err).Msg("timeseries: unable to close output")
+	}
+	log.Info().Str("proc", ts.Name()).Uint64("points", atomic.LoadUint64(&ts.nPoints)).
+		Uint64("dropped", atomic.LoadUint64(&ts.nDropped)).Msg("teardown")
+}
+
+func (ts *TimeSeriesOutput) Collect(w *MetricsWriter) {
+	w.Counter("edrint_timeseries_points_total", "Time series points written", float64(atomic.LoadUint64(&ts.nPoints)))
+	w.Counter("edrint_timeseries_points_dropped_total", "Time series points not written",
+		float64(atomic.LoadUint64(&ts.nDropped)))
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// appendInfluxLine encodes a point in line protocol
+func appendInfluxLine(b []byte, p tsPoint) []byte {
+	b = append(b, influxMeasurementEscaper.Replace(p.Measurement)...)
+	for _, tag := range [][2]string{{"class", p.Tags.Class}, {"flow", p.Tags.Flow},
+		{"server_ip", p.Tags.ServerIP}, {"sni", p.Tags.SNI}} {
+		if tag[1] != "" {
+			b = append(b, ',')
+			b = append(b, tag[0]...)
+			b = append(b, '=')
+			b = append(b, influxTagEscaper.Replace(tag[1])...)
+		}
+	}
+	for i, f := range p.Fields {
+		if i == 0 {
+			b = append(b, ' ')
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, f.Name...)
+		b = append(b, '=')
+		if f.Int {
+			b = strconv.AppendInt(b, int64(f.Value), 10)
+			b = append(b, 'i')
+		} else {
+			b = strconv.AppendFloat(b, f.Value, 'g', -1, 64)
+		}
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, p.Time.UnixNano(), 10)
+	return append(b, '\n')
+}
+
+type influxFileSink struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func newInfluxFileSink(path string) (*influxFileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &influxFileSink{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (s *influxFileSink) Write(points []tsPoint) error {
+	var b []byte
+	for _, p := range points {
+		b = appendInfluxLine(b[:0], p)
+		if _, err := s.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *influxFileSink) Close() error {
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+type influxHTTPSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *influxHTTPSink) Write(points []tsPoint) error {
+	var b []byte
+	for _, p := range points {
+		b = appendInfluxLine(b, p)
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *influxHTTPSink) Close() error {
+	return nil
+}
+
+// sqlSink inserts points in a table per measurement: time, tags and a
+// column per field
+type sqlSink struct {
+	db       *sql.DB
+	postgres bool
+	prefix   string
+	tables   map[string]bool
+}
+
+func newSQLSink(driver, dsn, prefix string) (*sqlSink, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlSink{db: db, postgres: driver == "postgres", prefix: prefix, tables: make(map[string]bool)}, nil
+}
+
+func (s *sqlSink) createTable(p tsPoint) error {
+	timeType, intType, floatType := "TIMESTAMP", "INTEGER", "REAL"
+	if s.postgres {
+		timeType, intType, floatType = "TIMESTAMPTZ", "BIGINT", "DOUBLE PRECISION"
+	}
+	columns := []string{"time " + timeType + " NOT NULL", "class TEXT", "flow TEXT", "server_ip TEXT", "sni TEXT"}
+	for _, f := range p.Fields {
+		if f.Int {
+			columns = append(columns, f.Name+" "+intType)
+		} else {
+			columns = append(columns, f.Name+" "+floatType)
+		}
+	}
+	_, err := s.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s (%s)", s.prefix, p.Measurement, strings.Join(columns, ", ")))
+	return err
+}
+
+func (s *sqlSink) insert(p tsPoint) string {
+	columns := []string{"time", "class", "flow", "server_ip", "sni"}
+	for _, f := range p.Fields {
+		columns = append(columns, f.Name)
+	}
+	params := make([]string, len(columns))
+	for i := range params {
+		params[i] = "?"
+		if s.postgres {
+			params[i] = "$" + strconv.Itoa(i+1)
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s%s (%s) VALUES (%s)", s.prefix, p.Measurement,
+		strings.Join(columns, ", "), strings.Join(params, ", "))
+}
+
+func (s *sqlSink) Write(points []tsPoint) error {
+	for _, p := range points {
+		if !s.tables[p.Measurement] {
+			if err := s.createTable(p); err != nil {
+				return err
+			}
+			s.tables[p.Measurement] = true
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmts := make(map[string]*sql.Stmt)
+	for _, p := range points {
+		stmt, exists := stmts[p.Measurement]
+		if !exists {
+			if stmt, err = tx.Prepare(s.insert(p)); err != nil {
+				tx.Rollback()
+				return err
+			}
+			stmts[p.Measurement] = stmt
+		}
+		args := []interface{}{p.Time.UTC(), nullString(p.Tags.Class), nullString(p.Tags.Flow),
+			nullString(p.Tags.ServerIP), nullString(p.Tags.SNI)}
+		for _, f := range p.Fields {
+			if f.Int {
+				args = append(args, int64(f.Value))
+			} else if math.IsNaN(f.Value) {
+				args = append(args, nil)
+			} else {
+				args = append(args, f.Value)
+			}
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (s *sqlSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+var tsTestHeader = common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+
+// publishTimeSeries publishes a flow's class, SNI, flowpulse and rtt
+func publishTimeSeries(ts *TimeSeriesOutput) {
+	start := time.Unix(1600000000, 0)
+	ts.EventHandler(events.CLASSIFICATION, EventClassification{Header: tsTestHeader, Class: "netflix"})
+	ts.EventHandler(events.PROTOCOL_SNI, SNIRecord{Header: tsTestHeader, SNI: "a b.example.com"})
+	ts.EventHandler(events.TELEMETRY_FLOWPULSE, struct {
+		Header        common.FiveTuple
+		IntervalMS    int
+		FirstPacketTS time.Time
+		DownBytes     []uint
+		UpBytes       []uint
+	}{tsTestHeader, 500, start, []uint{1500, 0, 3000}, []uint{60, 0, 0}})
+	ts.EventHandler(events.TELEMETRY_TCP_RTT, struct {
+		FirstPacketTS  time.Time
+		Header         common.FiveTuple
+		RelTimestampMS []uint
+		RTTMS          []uint
+	}{start, tsTestHeader, []uint{20, 1250}, []uint{18, 0}})
+	ts.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: tsTestHeader})
+}
+
+var tsTestLines = []string{
+	`flowpulse,class=netflix,server_ip=1.2.3.4,sni=a\ b.example.com down_bytes=1500i,up_bytes=60i 1600000000000000000`,
+	`flowpulse,class=netflix,server_ip=1.2.3.4,sni=a\ b.example.com down_bytes=3000i,up_bytes=0i 1600000001000000000`,
+	`tcp_rtt,class=netflix,server_ip=1.2.3.4,sni=a\ b.example.com rttms=18i 1600000000020000000`,
+	`tcp_rtt,class=netflix,server_ip=1.2.3.4,sni=a\ b.example.com rttms=0i 1600000001250000000`,
+}
+
+func tsTestConfig() TimeSeriesConfig {
+	return TimeSeriesConfig{Topics: []string{"telemetry.flowpulse", "telemetry.tcp.rtt"}, SNI: true}
+}
+
+func checkInfluxLines(t *testing.T, got string) {
+	t.Helper()
+	want := strings.Join(tsTestLines, "\n") + "\n"
+	if got != want {
+		t.Errorf("lines\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTimeSeriesInfluxFile(t *testing.T) {
+	config := tsTestConfig()
+	config.Format = "influx"
+	config.Path = filepath.Join(t.TempDir(), "points.lp")
+	ts := NewTimeSeriesOutput(config)
+	ts.Init()
+	publishTimeSeries(ts)
+	if len(ts.flows) != 0 {
+		t.Errorf("%d flows kept after expiry", len(ts.flows))
+	}
+	ts.Teardown()
+	b, err := ioutil.ReadFile(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInfluxLines(t, string(b))
+}
+
+func TestTimeSeriesInfluxHTTP(t *testing.T) {
+	var body, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body, auth = string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	config := tsTestConfig()
+	config.Format = "influx"
+	config.URL = srv.URL + "/api/v2/write?org=o&bucket=b&precision=ns"
+	config.Token = "secret"
+	ts := NewTimeSeriesOutput(config)
+	ts.Init()
+	publishTimeSeries(ts)
+	ts.Teardown()
+	checkInfluxLines(t, body)
+	if auth != "Token secret" {
+		t.Errorf("authorization %q", auth)
+	}
+	if ts.nPoints != 4 || ts.nDropped != 0 {
+		t.Errorf("points %d, dropped %d", ts.nPoints, ts.nDropped)
+	}
+}
+
+func TestTimeSeriesSQL(t *testing.T) {
+	config := tsTestConfig()
+	config.Format = "sql"
+	config.Driver = "sqlite3"
+	config.DSN = filepath.Join(t.TempDir(), "points.db")
+	config.FlowTag = true
+	config.TablePrefix = "edrint_"
+	ts := NewTimeSeriesOutput(config)
+	ts.Init()
+	publishTimeSeries(ts)
+	publishTimeSeries(ts)
+	ts.Teardown()
+
+	db, err := sql.Open("sqlite3", config.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n, downBytes int
+	var class, sni, flow string
+	err = db.QueryRow("SELECT COUNT(*), SUM(down_bytes), MAX(class), MAX(sni), MAX(flow) FROM edrint_flowpulse").
+		Scan(&n, &downBytes, &class, &sni, &flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 || downBytes != 9000 || class != "netflix" || sni != "a b.example.com" || len(flow) != 16 {
+		t.Errorf("flowpulse rows %d, down bytes %d, class %q, sni %q, flow %q", n, downBytes, class, sni, flow)
+	}
+	var rtt float64
+	if err := db.QueryRow("SELECT COUNT(*), AVG(rttms) FROM edrint_tcp_rtt").Scan(&n, &rtt); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 || rtt != 9 {
+		t.Errorf("rtt rows %d, mean %v", n, rtt)
+	}
+}
@@ -0,0 +1,372 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+const (
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+
+	tlsContentChangeCipherSpec = 20
+	tlsContentHandshake        = 22
+	tlsContentApplicationData  = 23
+
+	tlsHandshakeServerHello = 2
+	tlsHandshakeCertificate = 11
+
+	tlsExtALPN = 16
+
+	// Certificate chains rarely exceed a few KB, stop
+	// reassembling a server stream that grows beyond this
+	tlsMaxServerStream = 256 * 1024
+)
+
+var tlsVersions = map[uint16]string{
+	0x0300: "SSL3.0",
+	0x0301: "TLS1.0",
+	0x0302: "TLS1.1",
+	0x0303: "TLS1.2",
+	0x0304: "TLS1.3",
+}
+
+type CertificateInfo struct {
+	Subject     string
+	SAN         []string
+	Issuer      string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Expired     bool
+	SelfSigned  bool
+	ChainLength int
+}
+
+// TLSServerRecord describes the server side of a TLS handshake.
+// Certificate and ALPN are only available for TLS <= 1.2 as they
+// are encrypted in TLS 1.3.
+type TLSServerRecord struct {
+	Timestamp         time.Time
+	Header            common.FiveTuple
+	Version           string
+	CipherSuite       string
+	ALPN              string
+	Certificate       *CertificateInfo
+	ServerHelloMS     float64
+	HandshakeMS       float64
+	HandshakeComplete bool
+}
+
+type tlsServerFlow struct {
+	record         TLSServerRecord
+	clientOutbound bool
+
+	// Server to client stream reassembly
+	seqSeen bool
+	nextSeq uint32
+	broken  bool
+	stream  []byte
+	hsBuf   []byte
+
+	serverHelloSeen bool
+	tls13           bool
+	clientCCS       bool
+	serverCCS       bool
+}
+
+type TLSServerParser struct {
+	BasePublisher
+	flows map[common.FiveTuple]*tlsServerFlow
+}
+
+func NewTLSServerParser() *TLSServerParser {
+	return &TLSServerParser{flows: make(map[common.FiveTuple]*tlsServerFlow)}
+}
+
+func (tp *TLSServerParser) Name() string {
+	return "tls_server"
+}
+
+func (tp *TLSServerParser) Subs() []events.Topic {
+	return []events.Topic{events.PACKET, events.FLOW_EXPIRED}
+}
+
+func (tp *TLSServerParser) Pubs() []events.Topic {
+	return []events.Topic{events.PROTOCOL_TLS_SERVER}
+}
+
+func (tp *TLSServerParser) EventHandler(topic events.Topic, event interface{}) {
+	switch topic {
+	case events.PACKET:
+		tp.OnPacket(event.(common.Packet))
+	case events.FLOW_EXPIRED:
+		fe := event.(FlowExpiredEvent)
+		if st, exists := tp.flows[fe.Header]; exists {
+			tp.Publish(events.PROTOCOL_TLS_SERVER, st.record)
+			delete(tp.flows, fe.Header)
+		}
+	}
+}
+
+func (tp *TLSServerParser) OnPacket(p common.Packet) {
+	// Packet Filter
+	if p.Header.Protocol != 6 || len(p.Payload) == 0 {
+		return
+	}
+
+	key := p.GetKey()
+	st, exists := tp.flows[key]
+	if !exists {
+		pl := p.Payload
+		if len(pl) > tlsRecordHeaderLen && pl[0] == tlsContentHandshake && pl[5] == 0x01 {
+			st = &tlsServerFlow{clientOutbound: p.IsOutbound}
+			st.record.Timestamp = p.Timestamp
+			st.record.Header = key
+			tp.flows[key] = st
+		}
+		return
+	}
+
+	if p.IsOutbound == st.clientOutbound {
+		tp.onClientPayload(st, p)
+	} else {
+		tp.onServerPayload(st, p)
+	}
+
+	if st.complete() {
+		st.record.HandshakeComplete = true
+		st.record.HandshakeMS = msSince(st.record.Timestamp, p.Timestamp)
+		log.Debug().Str("header", key.String()).Str("version", st.record.Version).
+			Float64("handshake_ms", st.record.HandshakeMS).Msg("tls handshake complete")
+		tp.Publish(events.PROTOCOL_TLS_SERVER, st.record)
+		delete(tp.flows, key)
+	}
+}
+
+func (tp *TLSServerParser) onClientPayload(st *tlsServerFlow, p common.Packet) {
+	// Client records are small and usually aligned to segments
+	for _, r := range splitTLSRecords(p.Payload) {
+		switch r.ContentType {
+		case tlsContentChangeCipherSpec:
+			st.clientCCS = true
+		case tlsContentApplicationData:
+			// First encrypted client record in TLS 1.3 is its Finished
+			if st.tls13 && st.serverHelloSeen {
+				st.clientCCS = true
+			}
+		}
+	}
+}
+
+func (tp *TLSServerParser) onServerPayload(st *tlsServerFlow, p common.Packet) {
+	seq := p.TCPLayer.Seq
+	if !st.seqSeen {
+		st.nextSeq = seq
+		st.seqSeen = true
+	}
+
+	if st.broken {
+		for _, r := range splitTLSRecords(p.Payload) {
+			if r.ContentType == tlsContentChangeCipherSpec {
+				st.serverCCS = true
+			}
+		}
+		return
+	}
+
+	if seq != st.nextSeq {
+		if int32(seq-st.nextSeq) < 0 {
+			// retransmission of data already seen
+			return
+		}
+		log.Debug().Str("header", st.record.Header.String()).Uint32("seq", seq).
+			Uint32("expected", st.nextSeq).Msg("tls server stream gap")
+		st.broken = true
+		return
+	}
+	st.nextSeq += uint32(len(p.Payload))
+	st.stream = append(st.stream, p.Payload...)
+	if len(st.stream) > tlsMaxServerStream {
+		st.broken = true
+		st.stream = nil
+		return
+	}
+
+	for len(st.stream) >= tlsRecordHeaderLen {
+		length := bytesToInt16(st.stream[3:5])
+		if len(st.stream) < tlsRecordHeaderLen+length {
+			break
+		}
+		contentType := st.stream[0]
+		fragment := st.stream[tlsRecordHeaderLen : tlsRecordHeaderLen+length]
+		switch contentType {
+		case tlsContentHandshake:
+			if !st.serverCCS {
+				st.hsBuf = append(st.hsBuf, fragment...)
+				tp.parseHandshakeMessages(st, p.Timestamp)
+			}
+		case tlsContentChangeCipherSpec:
+			st.serverCCS = true
+		}
+		st.stream = st.stream[tlsRecordHeaderLen+length:]
+	}
+}
+
+func (tp *TLSServerParser) parseHandshakeMessages(st *tlsServerFlow, now time.Time) {
+	for len(st.hsBuf) >= tlsHandshakeHeaderLen {
+		length := bytesToInt24(st.hsBuf[1:4])
+		if len(st.hsBuf) < tlsHandshakeHeaderLen+length {
+			return
+		}
+		msgType := st.hsBuf[0]
+		body := st.hsBuf[tlsHandshakeHeaderLen : tlsHandshakeHeaderLen+length]
+		switch msgType {
+		case tlsHandshakeServerHello:
+			if !st.serverHelloSeen {
+				st.serverHelloSeen = true
+				st.record.ServerHelloMS = msSince(st.record.Timestamp, now)
+				tp.parseServerHello(st, body)
+			}
+		case tlsHandshakeCertificate:
+			if st.record.Certificate == nil {
+				st.record.Certificate = ParseCertificateMessage(body, now)
+			}
+		}
+		st.hsBuf = st.hsBuf[tlsHandshakeHeaderLen+length:]
+	}
+}
+
+func (tp *TLSServerParser) parseServerHello(st *tlsServerFlow, body []byte) {
+	// <Version> <Random> <Session ID Length>
+	if len(body) < 35 {
+		return
+	}
+	version := binary.BigEndian.Uint16(body[0:2])
+	index := 35 + int(body[34])
+
+	// <Cipher Suite> <Compression Method>
+	if index+3 > len(body) {
+		return
+	}
+	st.record.CipherSuite = tls.CipherSuiteName(binary.BigEndian.Uint16(body[index : index+2]))
+	index += 3
+
+	if index+2 <= len(body) {
+		index += 2
+		for index+4 <= len(body) {
+			extType := bytesToInt16(body[index : index+2])
+			extLength := bytesToInt16(body[index+2 : index+4])
+			index += 4
+			if index+extLength > len(body) {
+				break
+			}
+			ext := body[index : index+extLength]
+			switch extType {
+			case tlsExtSupportedVersions:
+				if len(ext) == 2 {
+					version = binary.BigEndian.Uint16(ext)
+				}
+			case tlsExtALPN:
+				// <List Length> <Protocol Length> <Protocol>
+				if len(ext) > 3 && 3+int(ext[2]) <= len(ext) {
+					st.record.ALPN = string(ext[3 : 3+int(ext[2])])
+				}
+			}
+			index += extLength
+		}
+	}
+
+	st.record.Version = tlsVersionString(version)
+	st.tls13 = version == tls.VersionTLS13
+}
+
+// ParseCertificateMessage extracts the leaf certificate of a
+// TLS <= 1.2 Certificate handshake message
+func ParseCertificateMessage(body []byte, now time.Time) *CertificateInfo {
+	if len(body) < 3 {
+		return nil
+	}
+	listLength := bytesToInt24(body[0:3])
+	if 3+listLength > len(body) {
+		return nil
+	}
+
+	var chain [][]byte
+	index := 3
+	for index+3 <= 3+listLength {
+		certLength := bytesToInt24(body[index : index+3])
+		index += 3
+		if index+certLength > len(body) {
+			break
+		}
+		chain = append(chain, body[index:index+certLength])
+		index += certLength
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		log.Debug().Err(err).Msg("unable to parse server certificate")
+		return nil
+	}
+	return &CertificateInfo{
+		Subject:   leaf.Subject.String(),
+		SAN:       leaf.DNSNames,
+		Issuer:    leaf.Issuer.String(),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		Expired:   now.After(leaf.NotAfter) || now.Before(leaf.NotBefore),
+		SelfSigned: bytes.Equal(leaf.RawIssuer, leaf.RawSubject) &&
+			leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil,
+		ChainLength: len(chain),
+	}
+}
+
+func (st *tlsServerFlow) complete() bool {
+	return st.serverHelloSeen && st.clientCCS && (st.serverCCS || st.tls13)
+}
+
+type tlsRecord struct {
+	ContentType uint8
+	Fragment    []byte
+}
+
+func splitTLSRecords(payload []byte) []tlsRecord {
+	var records []tlsRecord
+	index := 0
+	for index+tlsRecordHeaderLen <= len(payload) {
+		contentType := payload[index]
+		if contentType < 20 || contentType > 24 || payload[index+1] != 0x03 {
+			break
+		}
+		length := bytesToInt16(payload[index+3 : index+5])
+		end := index + tlsRecordHeaderLen + length
+		if end > len(payload) {
+			end = len(payload)
+		}
+		records = append(records, tlsRecord{contentType, payload[index+tlsRecordHeaderLen : end]})
+		index = end
+	}
+	return records
+}
+
+func tlsVersionString(v uint16) string {
+	if name, known := tlsVersions[v]; known {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func msSince(start, now time.Time) float64 {
+	return float64(now.Sub(start)) / float64(time.Millisecond)
+}
@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func selfSignedCert(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com", "example.com"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func tlsRecordBytes(contentType uint8, fragment []byte) []byte {
+	r := []byte{contentType, 0x03, 0x03}
+	r = appendUint16(r, len(fragment))
+	return append(r, fragment...)
+}
+
+func tlsHandshakeMessage(msgType uint8, body []byte) []byte {
+	return append(appendUint24([]byte{msgType}, len(body)), body...)
+}
+
+// tlsServerFlight builds the ServerHello and Certificate records of a
+// TLS 1.2 server negotiating h2
+func tlsServerFlight(cert []byte) []byte {
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello, 0)          // session id
+	hello = append(hello, 0xc0, 0x2f) // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	hello = append(hello, 0)
+	alpn := appendUint16(nil, 3)
+	alpn = append(alpn, 2, 'h', '2')
+	exts := appendUint16(nil, tlsExtALPN)
+	exts = appendUint16(exts, len(alpn))
+	exts = append(exts, alpn...)
+	hello = appendUint16(hello, len(exts))
+	hello = append(hello, exts...)
+
+	certs := appendUint24(nil, len(cert))
+	certs = append(certs, cert...)
+	certMsg := appendUint24(nil, len(certs))
+	certMsg = append(certMsg, certs...)
+
+	flight := tlsRecordBytes(tlsContentHandshake, tlsHandshakeMessage(tlsHandshakeServerHello, hello))
+	return append(flight, tlsRecordBytes(tlsContentHandshake, tlsHandshakeMessage(tlsHandshakeCertificate, certMsg))...)
+}
+
+func TestTLSServerParser(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	cert := selfSignedCert(t, start.Add(-time.Hour))
+	flight := tlsServerFlight(cert)
+	client := common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "1.2.3.4", SrcPort: 50000, DstPort: 443, Protocol: 6}
+	server := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	clientHello := tlsRecordBytes(tlsContentHandshake, tlsHandshakeMessage(1, make([]byte, 40)))
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	serverSegment := func(ms int, seq uint32, payload []byte) common.Packet {
+		return common.Packet{Timestamp: at(ms), Header: server, Payload: payload, TCPLayer: layers.TCP{Seq: seq}}
+	}
+
+	tests := []struct {
+		name    string
+		packets []common.Packet
+		check   func(t *testing.T, r TLSServerRecord)
+	}{
+		{"reassembled", []common.Packet{
+			{Timestamp: at(0), Header: client, IsOutbound: true, Payload: clientHello},
+			serverSegment(20, 1000, flight[:100]),
+			serverSegment(21, 1000, flight[:100]), // retransmission
+			serverSegment(22, 1100, flight[100:]),
+			{Timestamp: at(40), Header: client, IsOutbound: true, Payload: tlsRecordBytes(tlsContentChangeCipherSpec, []byte{1})},
+			serverSegment(60, 1000+uint32(len(flight)), tlsRecordBytes(tlsContentChangeCipherSpec, []byte{1})),
+		}, func(t *testing.T, r TLSServerRecord) {
+			if !r.HandshakeComplete || r.HandshakeMS != 60 || r.ServerHelloMS != 20 || r.Header != server {
+				t.Errorf("record = %+v", r)
+			}
+			if r.Version != "TLS1.2" || r.CipherSuite != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" || r.ALPN != "h2" {
+				t.Errorf("record = %+v", r)
+			}
+			c := r.Certificate
+			if c == nil {
+				t.Fatal("no certificate")
+			}
+			if c.Subject != "CN=www.example.com" || len(c.SAN) != 2 || !c.SelfSigned || !c.Expired || c.ChainLength != 1 {
+				t.Errorf("certificate = %+v", c)
+			}
+		}},
+		{"gap", []common.Packet{
+			{Timestamp: at(0), Header: client, IsOutbound: true, Payload: clientHello},
+			serverSegment(20, 1000, flight[:100]),
+			serverSegment(22, 1200, flight[200:]),
+			{Timestamp: at(40), Header: client, IsOutbound: true, Payload: tlsRecordBytes(tlsContentChangeCipherSpec, []byte{1})},
+			serverSegment(60, 1000+uint32(len(flight)), tlsRecordBytes(tlsContentChangeCipherSpec, []byte{1})),
+		}, func(t *testing.T, r TLSServerRecord) {
+			// the ServerHello fits in the first segment, the certificate
+			// is lost and the server CCS is found without reassembly
+			if !r.HandshakeComplete || r.Version != "TLS1.2" || r.Certificate != nil {
+				t.Errorf("record = %+v", r)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := NewTLSServerParser()
+			var got []TLSServerRecord
+			tp.SetPubFunc(func(topic events.Topic, event interface{}) {
+				got = append(got, event.(TLSServerRecord))
+			})
+			for _, p := range tt.packets {
+				tp.OnPacket(p)
+			}
+			tp.EventHandler(events.FLOW_EXPIRED, FlowExpiredEvent{Header: server})
+			if len(got) != 1 {
+				t.Fatalf("got %d records, want 1", len(got))
+			}
+			tt.check(t, got[0])
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package edrint
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/events"
+)
+
+// Reload swaps in new configuration. Apply is called from the packet
+// processing goroutine between two packets so processors need no locking;
+// anything that can fail (parsing, compiling) should be done beforehand.
+type Reload struct {
+	Trigger  string
+	Checksum string
+	Apply    func()
+}
+
+type ConfigReloadedEvent struct {
+	Version   int
+	Trigger   string
+	Checksum  string
+	Timestamp time.Time
+}
+
+// RequestReload queues a reload to be applied before the next packet.
+// It never blocks: a reload still pending is replaced by r, as each
+// reload carries the complete new configuration.
+func (m *Manager) RequestReload(r Reload) {
+	for {
+		select {
+		case m.reloads <- r:
+			return
+		default:
+		}
+		select {
+		case old := <-m.reloads:
+			log.Info().Str("trigger", old.Trigger).Str("checksum", old.Checksum).Msg("pending reload superseded")
+		default:
+		}
+	}
+}
+
+// ReloadOnSignal calls prepare on every SIGHUP and queues the returned reload
+func (m *Manager) ReloadOnSignal(prepare func(trigger string) (Reload, error)) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			log.Info().Msg("SIGHUP received: reloading config")
+			r, err := prepare("sighup")
+			if err != nil {
+				log.Error().Err(err).Msg("config reload failed: keeping current config")
+				continue
+			}
+			m.RequestReload(r)
+		}
+	}()
+}
+
+// publish applies pending reloads before publishing top level events
+func (m *Manager) publish(topic events.Topic, event interface{}) {
+	select {
+	case r := <-m.reloads:
+		m.applyReload(r)
+	default:
+	}
+	m.eb.Publish(topic, event)
+}
+
+func (m *Manager) applyReload(r Reload) {
+	r.Apply()
+	m.reloadVersion++
+	log.Info().Int("version", m.reloadVersion).Str("trigger", r.Trigger).Str("checksum", r.Checksum).Msg("config reloaded")
+	m.eb.Publish(events.CONFIG_RELOADED, ConfigReloadedEvent{
+		Version:   m.reloadVersion,
+		Trigger:   r.Trigger,
+		Checksum:  r.Checksum,
+		Timestamp: time.Now(),
+	})
+}
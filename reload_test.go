@@ -0,0 +1,80 @@
+package edrint
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sharat910/edrint/events"
+)
+
+func TestReload(t *testing.T) {
+	m := New()
+	var log []string
+	var reloaded []ConfigReloadedEvent
+	m.eb.Subscribe(events.PACKET, func(topic events.Topic, event interface{}) {
+		log = append(log, "packet")
+	})
+	m.eb.Subscribe(events.CONFIG_RELOADED, func(topic events.Topic, event interface{}) {
+		e := event.(ConfigReloadedEvent)
+		e.Timestamp = time.Time{}
+		reloaded = append(reloaded, e)
+	})
+	reload := func(checksum string) Reload {
+		return Reload{Trigger: "test", Checksum: checksum, Apply: func() { log = append(log, "apply "+checksum) }}
+	}
+
+	// a pending reload is superseded
+	m.RequestReload(reload("a"))
+	m.RequestReload(reload("b"))
+	if len(log) != 0 {
+		t.Fatalf("applied before a packet: %v", log)
+	}
+	m.publish(events.PACKET, nil)
+	m.publish(events.PACKET, nil)
+	m.RequestReload(reload("c"))
+	m.publish(events.PACKET, nil)
+
+	if want := []string{"apply b", "packet", "packet", "apply c", "packet"}; !reflect.DeepEqual(log, want) {
+		t.Errorf("log %v, want %v", log, want)
+	}
+	want := []ConfigReloadedEvent{{Version: 1, Trigger: "test", Checksum: "b"}, {Version: 2, Trigger: "test", Checksum: "c"}}
+	if !reflect.DeepEqual(reloaded, want) {
+		t.Errorf("reloaded %+v, want %+v", reloaded, want)
+	}
+}
+
+func TestRequestReloadNeverBlocks(t *testing.T) {
+	m := New()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.RequestReload(Reload{Trigger: "test", Apply: func() {}})
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RequestReload blocked")
+	}
+
+	versions := 0
+	m.eb.Subscribe(events.CONFIG_RELOADED, func(topic events.Topic, event interface{}) {
+		versions = event.(ConfigReloadedEvent).Version
+	})
+	m.publish(events.PACKET, nil)
+	m.publish(events.PACKET, nil)
+	if versions != 1 {
+		t.Errorf("version %d after 800 requests, want them coalesced into 1", versions)
+	}
+}
@@ -0,0 +1,118 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"hash/fnv"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// SampleRates are 1-in-N rates, 0 and 1 both meaning no sampling
+type SampleRates struct {
+	Flow   uint `mapstructure:"flow"`
+	Packet uint `mapstructure:"packet"`
+}
+
+func (sr SampleRates) IsSampling() bool {
+	return sr.Flow > 1 || sr.Packet > 1
+}
+
+// Normalized replaces rates of 0 with 1
+func (sr SampleRates) Normalized() SampleRates {
+	if sr.Flow == 0 {
+		sr.Flow = 1
+	}
+	if sr.Packet == 0 {
+		sr.Packet = 1
+	}
+	return sr
+}
+
+// FlowHash is an FNV-1a hash of the five tuple, stable across runs and
+// machines so every shard samples the same flows. Both directions of a
+// flow hash the same: the endpoints are hashed in a fixed order.
+func FlowHash(ft common.FiveTuple) uint64 {
+	if ft.SrcIP > ft.DstIP || (ft.SrcIP == ft.DstIP && ft.SrcPort > ft.DstPort) {
+		ft.SrcIP, ft.DstIP = ft.DstIP, ft.SrcIP
+		ft.SrcPort, ft.DstPort = ft.DstPort, ft.SrcPort
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ft.SrcIP))
+	h.Write([]byte{0})
+	h.Write([]byte(ft.DstIP))
+	h.Write([]byte{0, byte(ft.SrcPort >> 8), byte(ft.SrcPort), byte(ft.DstPort >> 8), byte(ft.DstPort), ft.Protocol})
+	return h.Sum64()
+}
+
+// FlowSampled reports whether the flow is in the 1-in-rate sample
+func FlowSampled(ft common.FiveTuple, rate uint) bool {
+	return rate <= 1 || FlowHash(ft)%uint64(rate) == 0
+}
+
+// Sampled feeds every Packet-th packet of a flow to its telemetry and
+// tags the events it publishes with the sample rates
+type Sampled struct {
+	Telemetry
+	rates SampleRates
+	n     uint
+}
+
+func NewSampled(tf Telemetry, rates SampleRates) *Sampled {
+	return &Sampled{Telemetry: tf, rates: rates.Normalized()}
+}
+
+func (s *Sampled) OnFlowPacket(p common.Packet) {
+	s.n++
+	if (s.n-1)%s.rates.Packet == 0 {
+		s.Telemetry.OnFlowPacket(p)
+	}
+}
+
+func (s *Sampled) SetPubFunc(pf events.PubFunc) {
+	s.Telemetry.SetPubFunc(func(topic events.Topic, event interface{}) {
+		pf(topic, SampledEvent{Event: event, SampleRates: s.rates})
+	})
+}
+
+// SampledEvent is an event of sampled telemetry. Counts in Event are
+// scaled back up by multiplying with the rates.
+type SampledEvent struct {
+	Event       interface{}
+	SampleRates SampleRates
+}
+
+// MarshalJSON adds a SampleRates field to the event's own fields
+func (se SampledEvent) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(se.Event)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 || b[0] != '{' {
+		return json.Marshal(struct {
+			Event       interface{}
+			SampleRates SampleRates
+		}{se.Event, se.SampleRates})
+	}
+	rates, err := json.Marshal(se.SampleRates)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(b)+len(rates)+16)
+	out = append(out, b[:len(b)-1]...)
+	if len(b) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, `"SampleRates":`...)
+	out = append(out, rates...)
+	return append(out, '}'), nil
+}
+
+// Unsampled returns the event inside a SampledEvent along with its
+// rates, or event itself with rates of 1
+func Unsampled(event interface{}) (interface{}, SampleRates) {
+	if se, ok := event.(SampledEvent); ok {
+		return se.Event, se.SampleRates
+	}
+	return event, SampleRates{Flow: 1, Packet: 1}
+}
@@ -0,0 +1,147 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+func TestFlowHash(t *testing.T) {
+	ft := common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+	reverse := common.FiveTuple{SrcIP: ft.DstIP, DstIP: ft.SrcIP, SrcPort: ft.DstPort, DstPort: ft.SrcPort, Protocol: 6}
+	if FlowHash(ft) != FlowHash(reverse) {
+		t.Errorf("directions hash %016x and %016x", FlowHash(ft), FlowHash(reverse))
+	}
+	// same hash in every run and on every machine
+	if got, want := FlowHash(ft), uint64(0x8721c24d38512e34); got != want {
+		t.Errorf("FlowHash = %016x, want %016x", got, want)
+	}
+	sameIP := common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "10.0.0.1", SrcPort: 80, DstPort: 8080, Protocol: 6}
+	sameIPReverse := common.FiveTuple{SrcIP: "10.0.0.1", DstIP: "10.0.0.1", SrcPort: 8080, DstPort: 80, Protocol: 6}
+	if FlowHash(sameIP) != FlowHash(sameIPReverse) {
+		t.Error("directions of a flow between ports of one host hash differently")
+	}
+	udp := ft
+	udp.Protocol = 17
+	otherPort := ft
+	otherPort.DstPort++
+	if FlowHash(udp) == FlowHash(ft) || FlowHash(otherPort) == FlowHash(ft) {
+		t.Error("different flows hash the same")
+	}
+}
+
+func TestFlowSampled(t *testing.T) {
+	const flows = 100000
+	for _, rate := range []uint{0, 1, 4, 16, 100} {
+		n := 0
+		for i := 0; i < flows; i++ {
+			ft := common.FiveTuple{SrcIP: fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff),
+				DstIP: "1.2.3.4", SrcPort: uint16(40000 + i%20000), DstPort: 443, Protocol: 6}
+			if FlowSampled(ft, rate) {
+				n++
+			}
+		}
+		want := flows
+		if rate > 1 {
+			want = flows / int(rate)
+		}
+		if n < want*9/10 || n > want*11/10 {
+			t.Errorf("rate %d sampled %d of %d flows, want about %d", rate, n, flows, want)
+		}
+	}
+}
+
+type countingTelemetry struct {
+	BaseFlowTelemetry
+	packets []uint
+}
+
+func (ct *countingTelemetry) Pubs() []events.Topic { return []events.Topic{"test"} }
+
+func (ct *countingTelemetry) OnFlowPacket(p common.Packet) {
+	ct.packets = append(ct.packets, p.TotalLen)
+}
+
+func (ct *countingTelemetry) Teardown() {
+	ct.Publish("test", struct{ Packets []uint }{ct.packets})
+}
+
+func TestSampled(t *testing.T) {
+	ct := &countingTelemetry{}
+	s := NewSampled(ct, SampleRates{Packet: 3})
+	var published []interface{}
+	s.SetPubFunc(func(topic events.Topic, event interface{}) {
+		published = append(published, event)
+	})
+	for i := uint(1); i <= 10; i++ {
+		s.OnFlowPacket(common.Packet{TotalLen: i})
+	}
+	s.Teardown()
+	if want := []uint{1, 4, 7, 10}; !reflect.DeepEqual(ct.packets, want) {
+		t.Errorf("packets %v, want every third %v", ct.packets, want)
+	}
+	if len(published) != 1 {
+		t.Fatalf("%d events, want 1", len(published))
+	}
+	se, ok := published[0].(SampledEvent)
+	if !ok {
+		t.Fatalf("event is %T, want SampledEvent", published[0])
+	}
+	if want := (SampleRates{Flow: 1, Packet: 3}); se.SampleRates != want {
+		t.Errorf("rates %+v, want %+v", se.SampleRates, want)
+	}
+	if event, rates := Unsampled(se); !reflect.DeepEqual(event, se.Event) || rates != se.SampleRates {
+		t.Errorf("Unsampled = %v, %+v", event, rates)
+	}
+	if _, rates := Unsampled(se.Event); rates != (SampleRates{Flow: 1, Packet: 1}) {
+		t.Errorf("rates of an unsampled event %+v", rates)
+	}
+}
+
+func TestSampledEventJSON(t *testing.T) {
+	rates := SampleRates{Flow: 8, Packet: 2}
+	type event struct {
+		Header  common.FiveTuple
+		Packets []int
+	}
+	tests := []struct {
+		name  string
+		event interface{}
+		// want is the event's own JSON with rates added
+		want string
+	}{
+		{"struct", event{Header: common.FiveTuple{SrcIP: "1.2.3.4", SrcPort: 443}, Packets: []int{1, 2}},
+			`{"Header":{"SrcIP":"1.2.3.4","DstIP":"","SrcPort":443,"DstPort":0,"Protocol":0},"Packets":[1,2],"SampleRates":{"Flow":8,"Packet":2}}`},
+		{"pointer", &event{Packets: []int{}},
+			`{"Header":{"SrcIP":"","DstIP":"","SrcPort":0,"DstPort":0,"Protocol":0},"Packets":[],"SampleRates":{"Flow":8,"Packet":2}}`},
+		{"empty", struct{}{}, `{"SampleRates":{"Flow":8,"Packet":2}}`},
+		{"not an object", 42, `{"Event":42,"SampleRates":{"Flow":8,"Packet":2}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(SampledEvent{Event: tt.event, SampleRates: rates})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("got  %s\nwant %s", b, tt.want)
+			}
+		})
+	}
+
+	// the event's fields are where they are without sampling
+	e := event{Header: common.FiveTuple{SrcIP: "1.2.3.4"}, Packets: []int{3}}
+	var plain, sampled map[string]interface{}
+	b, _ := json.Marshal(e)
+	json.Unmarshal(b, &plain)
+	b, _ = json.Marshal(SampledEvent{Event: e, SampleRates: rates})
+	json.Unmarshal(b, &sampled)
+	delete(sampled, "SampleRates")
+	if !reflect.DeepEqual(plain, sampled) {
+		t.Errorf("sampled %v, want %v", sampled, plain)
+	}
+}
@@ -2,7 +2,6 @@ package telemetry
 
 import (
 	"fmt"
-	"math"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -18,6 +17,8 @@ type TCPRetransmit struct {
 	intervalMS      int
 	MaxSeqUp        uint32
 	MaxSeqDown      uint32
+	seenUp          bool
+	seenDown        bool
 	RetransmitsUp   []int
 	RetransmitsDown []int
 
@@ -93,34 +94,24 @@ func (tsl *TCPRetransmit) Teardown() {
 	})
 }
 
+// IncRetransmitCounters counts segments starting below the highest
+// sequence seen in their direction. Pure ACKs carry no sequence space
+// and are ignored.
 func (tsl *TCPRetransmit) IncRetransmitCounters(p common.Packet, idx int) {
+	if len(p.Payload) == 0 && !p.TCPLayer.SYN && !p.TCPLayer.FIN {
+		return
+	}
+	seq := p.TCPLayer.Seq
 	if p.IsOutbound {
-		if p.TCPLayer.Seq >= tsl.MaxSeqUp {
-			tsl.MaxSeqUp = p.TCPLayer.Seq
-		} else { // seq less than max seq, filling the hole
-
-			// Check for overflow
-			if tsl.MaxSeqUp-p.TCPLayer.Seq > math.MaxUint32/2 {
-				tsl.MaxSeqUp = p.TCPLayer.Seq
-				return
-			}
-
-			// Packet retransmit
+		if !tsl.seenUp || !seqAfter(tsl.MaxSeqUp, seq) {
+			tsl.MaxSeqUp, tsl.seenUp = seq, true
+		} else {
 			tsl.RetransmitsUp[idx]++
 		}
 	} else {
-
-		if p.TCPLayer.Seq >= tsl.MaxSeqDown {
-			tsl.MaxSeqDown = p.TCPLayer.Seq
-		} else { // seq less than max seq, filling the hole
-
-			// Check for overflow -- approx check
-			if tsl.MaxSeqDown-p.TCPLayer.Seq > math.MaxUint32/2 {
-				tsl.MaxSeqDown = p.TCPLayer.Seq
-				return
-			}
-
-			// Packet retransmit
+		if !tsl.seenDown || !seqAfter(tsl.MaxSeqDown, seq) {
+			tsl.MaxSeqDown, tsl.seenDown = seq, true
+		} else {
 			tsl.RetransmitsDown[idx]++
 		}
 	}
@@ -0,0 +1,23 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/sharat910/edrint/common"
+)
+
+func TestTCPRetransmitSimple(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	published := runTelemetry(t, NewTCPRetransmit(1000), []common.Packet{
+		tcpTestPacket(t0, true, layers.TCP{ACK: true, Seq: 4294967200}, 100),
+		// wrapped around
+		tcpTestPacket(t0, true, layers.TCP{ACK: true, Seq: 4}, 100),
+		tcpTestPacket(t0, true, layers.TCP{ACK: true, Seq: 104}, 100),
+		// pure ACK below the highest sequence
+		tcpTestPacket(t0, true, layers.TCP{ACK: true, Seq: 4}, 0),
+		tcpTestPacket(t0, true, layers.TCP{ACK: true, Seq: 4}, 100),
+	})
+	checkFields(t, published[0], map[string]interface{}{"RetransmitsUp": []int{1}, "RetransmitsDown": []int{0}})
+}
@@ -0,0 +1,225 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+const (
+	tcpOptionKindFastOpen = layers.TCPOptionKind(34)
+	// tcpOptionKindExperimental carries fast open before RFC 7413,
+	// tagged by tcpFastOpenMagic
+	tcpOptionKindExperimental = layers.TCPOptionKind(254)
+	tcpFastOpenMagic          = 0xf989
+)
+
+// tcpOptions are the connection setup options of a SYN or SYN/ACK
+type tcpOptions struct {
+	mss           int
+	wscale        int
+	sackPermitted bool
+	timestamps    bool
+	// fastOpen is the length of the fast open cookie, -1 without the
+	// option, 0 for a cookie request
+	fastOpen int
+}
+
+func parseTCPOptions(tcp *layers.TCP) tcpOptions {
+	o := tcpOptions{wscale: -1, fastOpen: -1}
+	for _, opt := range tcp.Options {
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				o.mss = int(binary.BigEndian.Uint16(opt.OptionData))
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) == 1 {
+				o.wscale = int(opt.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			o.sackPermitted = true
+		case layers.TCPOptionKindTimestamps:
+			o.timestamps = true
+		case tcpOptionKindFastOpen:
+			o.fastOpen = len(opt.OptionData)
+		case tcpOptionKindExperimental:
+			if len(opt.OptionData) >= 2 && binary.BigEndian.Uint16(opt.OptionData) == tcpFastOpenMagic {
+				o.fastOpen = len(opt.OptionData) - 2
+			}
+		}
+	}
+	return o
+}
+
+// tcpDir indexes per direction state: 0 up, 1 down
+func tcpDir(p common.Packet) int {
+	if p.IsOutbound {
+		return 0
+	}
+	return 1
+}
+
+// TCPHandshake times the connection setup of a TCP flow. The RTTs are
+// seen from the capture point: SYN to SYN/ACK is the RTT to the server
+// side, SYN/ACK to ACK the RTT to the client side, each from the last
+// (retransmitted) SYN or SYN/ACK. Times to first data are from the
+// first SYN, or the first packet of flows captured mid connection.
+type TCPHandshake struct {
+	BaseFlowTelemetry
+	firstPacketTS time.Time
+	startTS       time.Time
+
+	synSeen    bool
+	synDir     int
+	synSeq     uint32
+	synTS      time.Time
+	synData    int
+	synAckSeen bool
+	synAckSeq  uint32
+	synAckTS   time.Time
+	complete   bool
+	serverRTT  time.Duration
+	clientRTT  time.Duration
+
+	synRetransmits    int
+	synAckRetransmits int
+	options           [2]tcpOptions
+	tfoAccepted       bool
+	firstData         [2]time.Time
+}
+
+func NewTCPHandshake() TeleGen {
+	return func() Telemetry {
+		return &TCPHandshake{options: [2]tcpOptions{{wscale: -1, fastOpen: -1}, {wscale: -1, fastOpen: -1}}}
+	}
+}
+
+func (th *TCPHandshake) Name() string {
+	return "tcp_handshake"
+}
+
+func (th *TCPHandshake) Pubs() []events.Topic {
+	return []events.Topic{events.TELEMETRY_TCP_HANDSHAKE}
+}
+
+func (th *TCPHandshake) OnFlowPacket(p common.Packet) {
+	if p.Header.Protocol != uint8(layers.IPProtocolTCP) {
+		return
+	}
+	if th.firstPacketTS.IsZero() {
+		th.firstPacketTS, th.startTS = p.Timestamp, p.Timestamp
+	}
+	tcp := &p.TCPLayer
+	dir := tcpDir(p)
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if !th.synSeen {
+			th.synSeen, th.synDir, th.synSeq = true, dir, tcp.Seq
+			th.startTS = p.Timestamp
+			th.options[dir] = parseTCPOptions(tcp)
+			th.synData = len(p.Payload)
+			th.synTS = p.Timestamp
+		} else if dir == th.synDir && tcp.Seq == th.synSeq {
+			// after a SYN/ACK, that SYN/ACK was lost past the capture point
+			th.synRetransmits++
+			if !th.synAckSeen {
+				th.synTS = p.Timestamp
+			}
+		}
+	case tcp.SYN && tcp.ACK:
+		if !th.synSeen || dir == th.synDir || (tcp.Ack != th.synSeq+1+uint32(th.synData) && tcp.Ack != th.synSeq+1) {
+			return
+		}
+		if !th.synAckSeen {
+			th.synAckSeen, th.synAckSeq = true, tcp.Seq
+			th.serverRTT = p.Timestamp.Sub(th.synTS)
+			th.options[dir] = parseTCPOptions(tcp)
+			th.tfoAccepted = th.synData > 0 && tcp.Ack == th.synSeq+1+uint32(th.synData)
+		} else if tcp.Seq == th.synAckSeq && !th.complete {
+			th.synAckRetransmits++
+		}
+		th.synAckTS = p.Timestamp
+	case tcp.ACK && th.synAckSeen && !th.complete && dir == th.synDir && tcp.Ack == th.synAckSeq+1:
+		th.complete = true
+		th.clientRTT = p.Timestamp.Sub(th.synAckTS)
+	}
+	if len(p.Payload) > 0 && th.firstData[dir].IsZero() {
+		th.firstData[dir] = p.Timestamp
+	}
+}
+
+// durationMS is d in milliseconds, -1 if not measured
+func durationMS(d time.Duration, measured bool) float64 {
+	if !measured {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (th *TCPHandshake) Teardown() {
+	if th.firstPacketTS.IsZero() {
+		return
+	}
+	up, down := th.options[0], th.options[1]
+	// options count once both sides sent theirs
+	negotiated := th.synAckSeen
+	tfo := ""
+	if syn := th.options[th.synDir]; th.synSeen && syn.fastOpen == 0 {
+		tfo = "cookie_request"
+	} else if th.synSeen && syn.fastOpen > 0 {
+		tfo = "cookie"
+	}
+	th.Publish(events.TELEMETRY_TCP_HANDSHAKE, struct {
+		FirstPacketTS time.Time
+		Header        common.FiveTuple
+		// SYNSeen is false for flows captured mid connection, SYNUp
+		// if the client side sent the SYN
+		SYNSeen           bool
+		SYNUp             bool
+		Complete          bool
+		ServerRTTMS       float64
+		ClientRTTMS       float64
+		SYNRetransmits    int
+		SYNACKRetransmits int
+		// MSS is 0 and WindowScale -1 if a side sent none
+		MSSUp           int
+		MSSDown         int
+		WindowScaleUp   int
+		WindowScaleDown int
+		WindowScaling   bool
+		SACKPermitted   bool
+		Timestamps      bool
+		// TFO is cookie_request, cookie (the SYN carries one) or empty
+		TFO             string
+		SYNDataBytes    int
+		TFOAccepted     bool
+		FirstDataUpMS   float64
+		FirstDataDownMS float64
+	}{
+		th.firstPacketTS,
+		th.header,
+		th.synSeen,
+		th.synSeen && th.synDir == 0,
+		th.complete,
+		durationMS(th.serverRTT, th.synAckSeen),
+		durationMS(th.clientRTT, th.complete),
+		th.synRetransmits,
+		th.synAckRetransmits,
+		up.mss,
+		down.mss,
+		up.wscale,
+		down.wscale,
+		negotiated && up.wscale >= 0 && down.wscale >= 0,
+		negotiated && up.sackPermitted && down.sackPermitted,
+		negotiated && up.timestamps && down.timestamps,
+		tfo,
+		th.synData,
+		th.tfoAccepted,
+		durationMS(th.firstData[0].Sub(th.startTS), !th.firstData[0].IsZero()),
+		durationMS(th.firstData[1].Sub(th.startTS), !th.firstData[1].IsZero()),
+	})
+}
@@ -0,0 +1,117 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+var tcpTestFlow = common.FiveTuple{SrcIP: "1.2.3.4", DstIP: "10.0.0.1", SrcPort: 443, DstPort: 50000, Protocol: 6}
+
+// tcpTestPacket is a packet of tcpTestFlow, its header flipped if outbound
+func tcpTestPacket(ts time.Time, outbound bool, tcp layers.TCP, payload int) common.Packet {
+	p := common.Packet{Timestamp: ts, Header: tcpTestFlow, IsOutbound: outbound, TCPLayer: tcp,
+		Payload: make([]byte, payload), TotalLen: uint(40 + payload)}
+	if outbound {
+		p.Header = common.FiveTuple{SrcIP: tcpTestFlow.DstIP, DstIP: tcpTestFlow.SrcIP,
+			SrcPort: tcpTestFlow.DstPort, DstPort: tcpTestFlow.SrcPort, Protocol: 6}
+	}
+	return p
+}
+
+func tcpOption(kind layers.TCPOptionKind, data ...byte) layers.TCPOption {
+	return layers.TCPOption{OptionType: kind, OptionLength: uint8(2 + len(data)), OptionData: data}
+}
+
+func mssOption(mss uint16) layers.TCPOption {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, mss)
+	return tcpOption(layers.TCPOptionKindMSS, b...)
+}
+
+// runTelemetry feeds packets to a telemetry function and returns the
+// events it publishes at teardown
+func runTelemetry(t *testing.T, gen TeleGen, packets []common.Packet) []interface{} {
+	t.Helper()
+	tf := gen()
+	var published []interface{}
+	tf.SetPubFunc(func(topic events.Topic, event interface{}) {
+		published = append(published, event)
+	})
+	tf.SetHeader(tcpTestFlow)
+	tf.Init()
+	for _, p := range packets {
+		tf.OnFlowPacket(p)
+	}
+	tf.Teardown()
+	return published
+}
+
+// checkFields compares fields of an event to want
+func checkFields(t *testing.T, event interface{}, want map[string]interface{}) {
+	t.Helper()
+	v := reflect.ValueOf(event)
+	for name, w := range want {
+		f := v.FieldByName(name)
+		if !f.IsValid() {
+			t.Errorf("no field %s", name)
+			continue
+		}
+		if got := f.Interface(); !reflect.DeepEqual(got, w) {
+			t.Errorf("%s: %v, want %v", name, got, w)
+		}
+	}
+}
+
+func TestTCPHandshake(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	synOptions := []layers.TCPOption{
+		mssOption(1460),
+		tcpOption(layers.TCPOptionKindSACKPermitted),
+		tcpOption(layers.TCPOptionKindTimestamps, make([]byte, 8)...),
+		tcpOption(layers.TCPOptionKindWindowScale, 7),
+		tcpOption(34, 1, 2, 3, 4, 5, 6, 7, 8),
+	}
+	synAckOptions := []layers.TCPOption{
+		mssOption(1400),
+		tcpOption(layers.TCPOptionKindSACKPermitted),
+		tcpOption(layers.TCPOptionKindTimestamps, make([]byte, 8)...),
+		tcpOption(layers.TCPOptionKindWindowScale, 8),
+	}
+	packets := []common.Packet{
+		tcpTestPacket(at(0), true, layers.TCP{SYN: true, Seq: 1000, Options: synOptions}, 100),
+		tcpTestPacket(at(1000), true, layers.TCP{SYN: true, Seq: 1000, Options: synOptions}, 100),
+		// acks the syn data: fast open accepted
+		tcpTestPacket(at(1020), false, layers.TCP{SYN: true, ACK: true, Seq: 5000, Ack: 1101, Options: synAckOptions}, 0),
+		tcpTestPacket(at(1025), true, layers.TCP{ACK: true, Seq: 1101, Ack: 5001}, 0),
+		tcpTestPacket(at(1050), false, layers.TCP{ACK: true, Seq: 5001, Ack: 1101}, 1000),
+	}
+	published := runTelemetry(t, NewTCPHandshake(), packets)
+	if len(published) != 1 {
+		t.Fatalf("%d events, want 1", len(published))
+	}
+	checkFields(t, published[0], map[string]interface{}{
+		"SYNSeen": true, "SYNUp": true, "Complete": true,
+		"ServerRTTMS": 20.0, "ClientRTTMS": 5.0, "SYNRetransmits": 1, "SYNACKRetransmits": 0,
+		"MSSUp": 1460, "MSSDown": 1400, "WindowScaleUp": 7, "WindowScaleDown": 8, "WindowScaling": true,
+		"SACKPermitted": true, "Timestamps": true,
+		"TFO": "cookie", "SYNDataBytes": 100, "TFOAccepted": true,
+		"FirstDataUpMS": 0.0, "FirstDataDownMS": 1050.0,
+	})
+
+	// captured mid connection
+	published = runTelemetry(t, NewTCPHandshake(), []common.Packet{
+		tcpTestPacket(at(0), true, layers.TCP{ACK: true, Seq: 1, Ack: 1}, 10),
+		tcpTestPacket(at(30), false, layers.TCP{ACK: true, Seq: 1, Ack: 11}, 0),
+	})
+	checkFields(t, published[0], map[string]interface{}{
+		"SYNSeen": false, "Complete": false, "ServerRTTMS": -1.0, "ClientRTTMS": -1.0,
+		"WindowScaleUp": -1, "WindowScaling": false, "TFO": "", "FirstDataUpMS": 0.0, "FirstDataDownMS": -1.0,
+	})
+}
@@ -0,0 +1,476 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+const (
+	lossFast = iota
+	lossRTO
+	lossOther
+	lossSpurious
+)
+
+const (
+	// lossMinRTO is Linux' minimum retransmission timeout
+	lossMinRTO = 200 * time.Millisecond
+	// lossInitialRTO applies until the RTT is sampled (RFC 6298)
+	lossInitialRTO = time.Second
+	// lossReorderWindow tells reordering from upstream loss until the
+	// RTT is sampled
+	lossReorderWindow = 3 * time.Millisecond
+	// lossKeep is how long retransmissions stay for spurious detection
+	// once acked, at least
+	lossKeep = time.Second
+	// lossMaxSegments bounds the unacked segments and retransmissions
+	// kept, e.g. if the capture misses the ACKs
+	lossMaxSegments = 1 << 16
+)
+
+// tcpTimestamps returns the TSval and TSecr of a segment
+func tcpTimestamps(tcp *layers.TCP) (val, ecr uint32, ok bool) {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8 {
+			return binary.BigEndian.Uint32(opt.OptionData), binary.BigEndian.Uint32(opt.OptionData[4:]), true
+		}
+	}
+	return 0, 0, false
+}
+
+// tcpSACKBlocks returns the left and right edges of the SACK blocks
+func tcpSACKBlocks(tcp *layers.TCP) [][2]uint32 {
+	var blocks [][2]uint32
+	for _, opt := range tcp.Options {
+		if opt.OptionType != layers.TCPOptionKindSACK {
+			continue
+		}
+		for b := opt.OptionData; len(b) >= 8; b = b[8:] {
+			blocks = append(blocks, [2]uint32{binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])})
+		}
+	}
+	return blocks
+}
+
+// rttEstimate is a smoothed RTT (RFC 6298)
+type rttEstimate struct {
+	srtt, rttvar time.Duration
+}
+
+func (r *rttEstimate) add(sample time.Duration) {
+	if r.srtt == 0 {
+		r.srtt, r.rttvar = sample, sample/2
+		return
+	}
+	diff := r.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	r.rttvar = (3*r.rttvar + diff) / 4
+	r.srtt = (7*r.srtt + sample) / 8
+}
+
+// lossSegment is data seen at the capture point and not yet acked
+type lossSegment struct {
+	seq, end      uint32
+	ts            time.Time
+	retransmitted bool
+}
+
+// lossRetransmit is a retransmission kept for spurious detection
+type lossRetransmit struct {
+	seq, end   uint32
+	tsval      uint32
+	hasTS      bool
+	class      int
+	idx        int
+	downstream bool
+	acked      bool
+	ackedTS    time.Time
+	spurious   bool
+}
+
+// lossDir is the sequence space of the data one side sends
+type lossDir struct {
+	started bool
+	nxt     uint32
+	// advanceTS is when nxt last advanced, opening any hole below
+	advanceTS time.Time
+	una       uint32
+	unaSeen   bool
+	dupAcks   int
+	ackWindow uint16
+	// segs are ordered by seq
+	segs     []lossSegment
+	retrans  []*lossRetransmit
+	counts   [4][]int
+	reorders []int
+	packets  []int
+	// lost upstream (sender to capture point) and downstream (capture
+	// point to receiver)
+	upstream   []int
+	downstream []int
+}
+
+// segment returns the index of the segment holding seq, -1 if none
+func (ld *lossDir) segment(seq uint32) int {
+	i := sort.Search(len(ld.segs), func(i int) bool { return seqAfter(ld.segs[i].end, seq) })
+	if i < len(ld.segs) && !seqAfter(ld.segs[i].seq, seq) {
+		return i
+	}
+	return -1
+}
+
+// holeTS is when the hole below seq opened: the first segment after
+// it was seen
+func (ld *lossDir) holeTS(seq uint32) time.Time {
+	i := sort.Search(len(ld.segs), func(i int) bool { return seqAfter(ld.segs[i].seq, seq) })
+	if i < len(ld.segs) {
+		return ld.segs[i].ts
+	}
+	return ld.advanceTS
+}
+
+func (ld *lossDir) append(s lossSegment) {
+	if len(ld.segs) >= lossMaxSegments {
+		ld.segs = ld.segs[1:]
+	}
+	ld.segs = append(ld.segs, s)
+}
+
+func (ld *lossDir) insert(s lossSegment) {
+	i := sort.Search(len(ld.segs), func(i int) bool { return seqAfter(ld.segs[i].seq, s.seq) })
+	ld.segs = append(ld.segs, lossSegment{})
+	copy(ld.segs[i+1:], ld.segs[i:])
+	ld.segs[i] = s
+}
+
+// TCPLoss classifies the retransmissions of each side, following
+// sequence space with serial arithmetic. Pure ACKs and keep-alives are
+// not data. Data below the highest sequence seen is
+//
+//	reordering  if never seen before and within half an RTT of the
+//	            hole opening: it was overtaken, not lost
+//	fast        if the receiver sent duplicate ACKs or SACKs for it
+//	RTO         if a retransmission timeout passed since it was sent,
+//	            or the hole it fills opened
+//	spurious    if it was already acked, or D-SACK or the timestamp
+//	            echoed by its ACK (Eifel) shows the original arrived
+//	other       otherwise, e.g. tail loss probes
+//
+// Spurious retransmissions found later move out of their class. The
+// RTT is the sum of the RTTs from the capture point to either side,
+// sampled from ACKs of data sent once (Karn). A retransmission of data
+// never seen was lost upstream of the capture point, of data seen
+// downstream.
+type TCPLoss struct {
+	BaseFlowTelemetry
+	intervalMS    int
+	firstPacketTS time.Time
+	lastPacketTS  time.Time
+	dirs          [2]lossDir
+	// rtt is the RTT from the capture point to a side
+	rtt [2]rttEstimate
+}
+
+func NewTCPLoss(intervalMS int) TeleGen {
+	if intervalMS == 0 {
+		log.Warn().Msg("tcp_loss unable to read intervalMS. Setting default: 1sec")
+		intervalMS = 1000
+	}
+	return func() Telemetry {
+		t := &TCPLoss{intervalMS: intervalMS}
+		log.Debug().Str("telemetry", t.Name()).Int("intervalMS", intervalMS).Msg("config")
+		return t
+	}
+}
+
+func (tl *TCPLoss) Name() string {
+	return "tcp_loss"
+}
+
+func (tl *TCPLoss) Pubs() []events.Topic {
+	return []events.Topic{events.TELEMETRY_TCP_LOSS}
+}
+
+func (tl *TCPLoss) extendUntil(idx int) {
+	for d := range tl.dirs {
+		ld := &tl.dirs[d]
+		for i := len(ld.packets); i <= idx; i++ {
+			for c := range ld.counts {
+				ld.counts[c] = append(ld.counts[c], 0)
+			}
+			ld.reorders = append(ld.reorders, 0)
+			ld.packets = append(ld.packets, 0)
+			ld.upstream = append(ld.upstream, 0)
+			ld.downstream = append(ld.downstream, 0)
+		}
+	}
+}
+
+func (tl *TCPLoss) srtt() time.Duration {
+	return tl.rtt[0].srtt + tl.rtt[1].srtt
+}
+
+func (tl *TCPLoss) rto() time.Duration {
+	if tl.srtt() == 0 {
+		return lossInitialRTO
+	}
+	rto := tl.srtt() + 4*(tl.rtt[0].rttvar+tl.rtt[1].rttvar)
+	if rto < lossMinRTO {
+		rto = lossMinRTO
+	}
+	return rto
+}
+
+func (tl *TCPLoss) reorderWindow() time.Duration {
+	if tl.srtt() == 0 {
+		return lossReorderWindow
+	}
+	return tl.srtt() / 2
+}
+
+func (tl *TCPLoss) OnFlowPacket(p common.Packet) {
+	if p.Header.Protocol != uint8(layers.IPProtocolTCP) {
+		return
+	}
+	if tl.firstPacketTS.IsZero() {
+		tl.firstPacketTS = p.Timestamp
+	}
+	idx, err := GetIndex(tl.firstPacketTS, p.Timestamp, tl.intervalMS)
+	if err != nil {
+		log.Warn().Err(err).Str("telemetry", tl.Name()).Msg("get_index throwing err")
+		return
+	}
+	tl.extendUntil(idx)
+	tl.lastPacketTS = p.Timestamp
+	tcp := &p.TCPLayer
+	if tcp.RST {
+		return
+	}
+	d := tcpDir(p)
+	if tcp.ACK {
+		tl.onAck(p, d)
+	}
+	tl.onData(p, d, idx)
+}
+
+// onAck handles the ACK of the data of the other side
+func (tl *TCPLoss) onAck(p common.Packet, d int) {
+	tcp := &p.TCPLayer
+	ld := &tl.dirs[1-d]
+	ack := tcp.Ack
+	_, tsecr, hasTS := tcpTimestamps(tcp)
+	blocks := tcpSACKBlocks(tcp)
+	switch {
+	case !ld.unaSeen || seqAfter(ack, ld.una):
+		n := 0
+		for ; n < len(ld.segs) && !seqAfter(ld.segs[n].end, ack); n++ {
+			if s := ld.segs[n]; s.end == ack && !s.retransmitted {
+				tl.rtt[d].add(p.Timestamp.Sub(s.ts))
+			}
+		}
+		ld.segs = ld.segs[n:]
+		for _, r := range ld.retrans {
+			if r.acked || seqAfter(r.end, ack) {
+				continue
+			}
+			r.acked, r.ackedTS = true, p.Timestamp
+			// the ACK echoes the timestamp of the original
+			if hasTS && r.hasTS && seqAfter(r.tsval, tsecr) {
+				tl.markSpurious(ld, r)
+			}
+		}
+		ld.una, ld.unaSeen, ld.dupAcks = ack, true, 0
+	case ack == ld.una && len(p.Payload) == 0 && !tcp.SYN && !tcp.FIN &&
+		tcp.Window == ld.ackWindow && ld.started && seqAfter(ld.nxt, ld.una):
+		ld.dupAcks++
+	}
+	ld.ackWindow = tcp.Window
+
+	// D-SACK: the first block is below the ACK or within the second,
+	// other blocks mean the receiver misses data
+	if len(blocks) > 0 {
+		b := blocks[0]
+		if !seqAfter(b[1], ack) || (len(blocks) > 1 && !seqAfter(blocks[1][0], b[0]) && !seqAfter(b[1], blocks[1][1])) {
+			// the duplicate is the latest retransmission of the block
+			for i := len(ld.retrans) - 1; i >= 0; i-- {
+				if r := ld.retrans[i]; !r.spurious && !seqAfter(b[0], r.seq) && !seqAfter(r.end, b[1]) {
+					tl.markSpurious(ld, r)
+					break
+				}
+			}
+		} else if ld.dupAcks == 0 {
+			ld.dupAcks = 1
+		}
+	}
+
+	keep := lossKeep
+	if 4*tl.srtt() > keep {
+		keep = 4 * tl.srtt()
+	}
+	n := 0
+	for _, r := range ld.retrans {
+		if !r.acked || p.Timestamp.Sub(r.ackedTS) <= keep {
+			ld.retrans[n] = r
+			n++
+		}
+	}
+	ld.retrans = ld.retrans[:n]
+	if n > lossMaxSegments {
+		ld.retrans = ld.retrans[n-lossMaxSegments:]
+	}
+}
+
+func (tl *TCPLoss) markSpurious(ld *lossDir, r *lossRetransmit) {
+	if r.spurious {
+		return
+	}
+	r.spurious = true
+	ld.counts[r.class][r.idx]--
+	ld.counts[lossSpurious][r.idx]++
+	if r.downstream {
+		ld.downstream[r.idx]--
+	} else {
+		ld.upstream[r.idx]--
+	}
+}
+
+// onData handles the data a side sends
+func (tl *TCPLoss) onData(p common.Packet, d, idx int) {
+	tcp := &p.TCPLayer
+	segLen := uint32(len(p.Payload))
+	if tcp.SYN {
+		segLen++
+	}
+	if tcp.FIN {
+		segLen++
+	}
+	if segLen == 0 {
+		return
+	}
+	ld := &tl.dirs[d]
+	seq, end := tcp.Seq, tcp.Seq+segLen
+	seg := lossSegment{seq: seq, end: end, ts: p.Timestamp}
+	if !ld.started {
+		ld.started, ld.nxt, ld.advanceTS = true, end, p.Timestamp
+		ld.append(seg)
+		ld.packets[idx]++
+		return
+	}
+	// keep-alives resend the last acked byte, or none
+	if len(p.Payload) <= 1 && !tcp.SYN && !tcp.FIN && ld.unaSeen && seq+1 == ld.una {
+		return
+	}
+	ld.packets[idx]++
+	if !seqAfter(ld.nxt, seq) {
+		ld.nxt, ld.advanceTS = end, p.Timestamp
+		ld.append(seg)
+		return
+	}
+
+	r := &lossRetransmit{seq: seq, end: end, idx: idx}
+	r.tsval, _, r.hasTS = tcpTimestamps(tcp)
+	since := ld.holeTS(seq)
+	if ld.unaSeen && !seqAfter(end, ld.una) {
+		// acked before it was resent
+		r.class, r.spurious, r.downstream = lossSpurious, true, true
+	} else if i := ld.segment(seq); i >= 0 {
+		r.downstream = true
+		since = ld.segs[i].ts
+		ld.segs[i].retransmitted = true
+	} else {
+		if p.Timestamp.Sub(since) < tl.reorderWindow() {
+			ld.reorders[idx]++
+			ld.insert(seg)
+			return
+		}
+		seg.retransmitted = true
+		ld.insert(seg)
+	}
+	if !r.spurious {
+		switch {
+		case ld.dupAcks > 0:
+			r.class = lossFast
+		case p.Timestamp.Sub(since) >= tl.rto():
+			r.class = lossRTO
+		default:
+			r.class = lossOther
+		}
+		if r.downstream {
+			ld.downstream[idx]++
+		} else {
+			ld.upstream[idx]++
+		}
+	}
+	ld.counts[r.class][idx]++
+	ld.retrans = append(ld.retrans, r)
+	if seqAfter(end, ld.nxt) {
+		ld.nxt, ld.advanceTS = end, p.Timestamp
+	}
+}
+
+func (tl *TCPLoss) Teardown() {
+	if tl.firstPacketTS.IsZero() {
+		return
+	}
+	up, down := &tl.dirs[0], &tl.dirs[1]
+	tl.Publish(events.TELEMETRY_TCP_LOSS, struct {
+		FirstPacketTS time.Time
+		LastPacketTS  time.Time
+		IntervalMS    int
+		Header        common.FiveTuple
+		// RTTs from the capture point to the client and server side
+		ClientRTTMS float64
+		ServerRTTMS float64
+		// per interval counts of the data the client (Up) and server
+		// (Down) send
+		DataPacketsUp           []int
+		DataPacketsDown         []int
+		FastRetransmitsUp       []int
+		FastRetransmitsDown     []int
+		RTORetransmitsUp        []int
+		RTORetransmitsDown      []int
+		SpuriousRetransmitsUp   []int
+		SpuriousRetransmitsDown []int
+		OtherRetransmitsUp      []int
+		OtherRetransmitsDown    []int
+		ReorderingsUp           []int
+		ReorderingsDown         []int
+		// losses between the sender and the capture point (upstream)
+		// and the capture point and the receiver (downstream)
+		UpstreamLossUp     []int
+		UpstreamLossDown   []int
+		DownstreamLossUp   []int
+		DownstreamLossDown []int
+	}{
+		tl.firstPacketTS,
+		tl.lastPacketTS,
+		tl.intervalMS,
+		tl.header,
+		durationMS(tl.rtt[0].srtt, tl.rtt[0].srtt > 0),
+		durationMS(tl.rtt[1].srtt, tl.rtt[1].srtt > 0),
+		up.packets,
+		down.packets,
+		up.counts[lossFast],
+		down.counts[lossFast],
+		up.counts[lossRTO],
+		down.counts[lossRTO],
+		up.counts[lossSpurious],
+		down.counts[lossSpurious],
+		up.counts[lossOther],
+		down.counts[lossOther],
+		up.reorders,
+		down.reorders,
+		up.upstream,
+		down.upstream,
+		up.downstream,
+		down.downstream,
+	})
+}
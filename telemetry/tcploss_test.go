@@ -0,0 +1,254 @@
+package telemetry
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/sharat910/edrint/common"
+)
+
+func sackOption(blocks ...uint32) layers.TCPOption {
+	b := make([]byte, 4*len(blocks))
+	for i, edge := range blocks {
+		binary.BigEndian.PutUint32(b[4*i:], edge)
+	}
+	return tcpOption(layers.TCPOptionKindSACK, b...)
+}
+
+func TestTCPLoss(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	data := func(ms int, seq uint32) common.Packet {
+		return tcpTestPacket(at(ms), false, layers.TCP{ACK: true, Seq: seq, Ack: 1, Window: 1000}, 1000)
+	}
+	ack := func(ms int, ack uint32, window uint16, options ...layers.TCPOption) common.Packet {
+		return tcpTestPacket(at(ms), true, layers.TCP{ACK: true, Seq: 1, Ack: ack, Window: window, Options: options}, 0)
+	}
+	published := runTelemetry(t, NewTCPLoss(1000), []common.Packet{
+		tcpTestPacket(at(0), true, layers.TCP{SYN: true, Seq: 0, Window: 1000}, 0),
+		tcpTestPacket(at(10), false, layers.TCP{SYN: true, ACK: true, Seq: 0, Ack: 1, Window: 1000}, 0),
+		ack(12, 1, 1000),
+		data(20, 1),
+		// 1001 overtaken by 2001 and 3001
+		data(22, 2001),
+		data(23, 3001),
+		data(24, 1001),
+		ack(26, 4001, 1000),
+		// 5001 lost past the capture point, resent on a duplicate ACK
+		data(30, 4001),
+		data(31, 5001),
+		data(32, 6001),
+		ack(35, 5001, 1000),
+		ack(36, 5001, 1000),
+		data(40, 5001),
+		ack(45, 7001, 1000),
+		// 7001 lost before the capture point, resent on timeout: a window
+		// update is no duplicate ACK
+		data(1050, 8001),
+		ack(1060, 7001, 2000),
+		data(1300, 7001),
+		// resent again, D-SACK shows that was spurious
+		data(1550, 7001),
+		ack(1560, 9001, 2000, sackOption(7001, 8001)),
+		// keep-alive
+		tcpTestPacket(at(1600), true, layers.TCP{ACK: true, Seq: 0, Ack: 9001, Window: 2000}, 1),
+	})
+	if len(published) != 1 {
+		t.Fatalf("%d events, want 1", len(published))
+	}
+	checkFields(t, published[0], map[string]interface{}{
+		"ServerRTTMS":             10.0,
+		"DataPacketsUp":           []int{1, 0},
+		"DataPacketsDown":         []int{9, 3},
+		"ReorderingsDown":         []int{1, 0},
+		"FastRetransmitsDown":     []int{1, 0},
+		"RTORetransmitsDown":      []int{0, 1},
+		"SpuriousRetransmitsDown": []int{0, 1},
+		"OtherRetransmitsDown":    []int{0, 0},
+		"UpstreamLossDown":        []int{0, 1},
+		"DownstreamLossDown":      []int{1, 0},
+		"FastRetransmitsUp":       []int{0, 0},
+		"UpstreamLossUp":          []int{0, 0},
+	})
+}
+
+func tsOption(val, ecr uint32) layers.TCPOption {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, val)
+	binary.BigEndian.PutUint32(b[4:], ecr)
+	return tcpOption(layers.TCPOptionKindTimestamps, b...)
+}
+
+// lossTestPackets is a handshake of tcpTestFlow, the server's data
+// starting at sequence 1 unless serverISN is given, then packets
+func lossTestPackets(serverISN uint32, packets ...common.Packet) []common.Packet {
+	t0 := time.Unix(1600000000, 0)
+	return append([]common.Packet{
+		tcpTestPacket(t0, true, layers.TCP{SYN: true, Seq: 0, Window: 1000}, 0),
+		tcpTestPacket(t0.Add(10*time.Millisecond), false,
+			layers.TCP{SYN: true, ACK: true, Seq: serverISN, Ack: 1, Window: 1000}, 0),
+		tcpTestPacket(t0.Add(12*time.Millisecond), true, layers.TCP{ACK: true, Seq: 1, Ack: serverISN + 1, Window: 1000}, 0),
+	}, packets...)
+}
+
+func TestTCPLossSpurious(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	data := func(ms int, seq uint32, options ...layers.TCPOption) common.Packet {
+		return tcpTestPacket(at(ms), false, layers.TCP{ACK: true, Seq: seq, Ack: 1, Window: 1000, Options: options}, 1000)
+	}
+	ack := func(ms int, ack uint32, options ...layers.TCPOption) common.Packet {
+		return tcpTestPacket(at(ms), true, layers.TCP{ACK: true, Seq: 1, Ack: ack, Window: 1000, Options: options}, 0)
+	}
+	tests := []struct {
+		name    string
+		packets []common.Packet
+		// fast, RTO, spurious and downstream loss counts
+		want [4]int
+	}{
+		{
+			name: "acked before resent",
+			packets: []common.Packet{
+				data(20, 1), ack(30, 1001),
+				// the ACK was lost past the capture point
+				data(400, 1),
+			},
+			want: [4]int{0, 0, 1, 0},
+		},
+		{
+			name: "D-SACK below the ACK",
+			packets: []common.Packet{
+				data(20, 1), data(21, 1001),
+				data(400, 1), ack(410, 2001, sackOption(1, 1001)),
+			},
+			want: [4]int{0, 0, 1, 0},
+		},
+		{
+			name: "D-SACK within a SACK block",
+			packets: []common.Packet{
+				data(20, 1), data(21, 1001), data(22, 2001),
+				// 1 lost past the capture point
+				ack(30, 1, sackOption(1001, 3001)),
+				data(32, 2001),
+				ack(40, 1, sackOption(2001, 3001, 1001, 3001)),
+				data(45, 1), ack(50, 3001),
+			},
+			want: [4]int{1, 0, 1, 1},
+		},
+		{
+			name: "D-SACK of the latest retransmission",
+			packets: []common.Packet{
+				data(20, 1),
+				data(400, 1), data(800, 1),
+				ack(810, 1001, sackOption(1, 1001)),
+			},
+			want: [4]int{0, 1, 1, 1},
+		},
+		{
+			name: "Eifel: the ACK echoes the original",
+			packets: []common.Packet{
+				data(20, 1, tsOption(100, 0)),
+				data(400, 1, tsOption(200, 0)),
+				ack(410, 1001, tsOption(50, 100)),
+			},
+			want: [4]int{0, 0, 1, 0},
+		},
+		{
+			name: "Eifel: the ACK echoes the retransmission",
+			packets: []common.Packet{
+				data(20, 1, tsOption(100, 0)),
+				data(400, 1, tsOption(200, 0)),
+				ack(410, 1001, tsOption(50, 200)),
+			},
+			want: [4]int{0, 1, 0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			published := runTelemetry(t, NewTCPLoss(1000), lossTestPackets(0, tt.packets...))
+			checkFields(t, published[0], map[string]interface{}{
+				"FastRetransmitsDown":     []int{tt.want[0]},
+				"RTORetransmitsDown":      []int{tt.want[1]},
+				"SpuriousRetransmitsDown": []int{tt.want[2]},
+				"DownstreamLossDown":      []int{tt.want[3]},
+				"UpstreamLossDown":        []int{0},
+				"OtherRetransmitsDown":    []int{0},
+			})
+		})
+	}
+}
+
+func TestTCPLossUpstreamDownstream(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	for _, outbound := range []bool{false, true} {
+		// the sender is the server, or the client
+		data := func(ms int, seq uint32) common.Packet {
+			return tcpTestPacket(at(ms), outbound, layers.TCP{ACK: true, Seq: seq, Ack: 1, Window: 1000}, 1000)
+		}
+		ack := func(ms int, ack uint32) common.Packet {
+			return tcpTestPacket(at(ms), !outbound, layers.TCP{ACK: true, Seq: 1, Ack: ack, Window: 1000}, 0)
+		}
+		published := runTelemetry(t, NewTCPLoss(1000), lossTestPackets(0,
+			// the handshake ACK acks nothing of the client
+			ack(13, 1),
+			// 1001 lost before the capture point
+			data(20, 1), data(22, 2001),
+			ack(25, 1001), ack(26, 1001),
+			data(30, 1001), ack(35, 3001),
+			// 3001 lost past the capture point
+			data(40, 3001), data(41, 4001),
+			ack(45, 3001), ack(46, 3001),
+			data(50, 3001), ack(55, 5001),
+		))
+		sender, receiver := "Down", "Up"
+		if outbound {
+			sender, receiver = "Up", "Down"
+		}
+		checkFields(t, published[0], map[string]interface{}{
+			"FastRetransmits" + sender:   []int{2},
+			"UpstreamLoss" + sender:      []int{1},
+			"DownstreamLoss" + sender:    []int{1},
+			"Reorderings" + sender:       []int{0},
+			"FastRetransmits" + receiver: []int{0},
+			"UpstreamLoss" + receiver:    []int{0},
+			"DownstreamLoss" + receiver:  []int{0},
+		})
+	}
+}
+
+func TestTCPLossWraparound(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	data := func(ms int, seq uint32) common.Packet {
+		return tcpTestPacket(at(ms), false, layers.TCP{ACK: true, Seq: seq, Ack: 1, Window: 1000}, 1000)
+	}
+	ack := func(ms int, ack uint32) common.Packet {
+		return tcpTestPacket(at(ms), true, layers.TCP{ACK: true, Seq: 1, Ack: ack, Window: 1000}, 0)
+	}
+	// the server's data wraps around after the first segment
+	const isn = 1<<32 - 1001
+	published := runTelemetry(t, NewTCPLoss(1000), lossTestPackets(isn,
+		data(20, isn+1),
+		// 0 lost before the capture point
+		data(22, 1000), data(23, 2000),
+		ack(25, 0), ack(26, 0),
+		data(30, 0),
+		ack(35, 3000),
+		// the ACK was lost past the capture point
+		data(400, isn+1),
+		data(410, 3000),
+	))
+	checkFields(t, published[0], map[string]interface{}{
+		"DataPacketsDown":         []int{7},
+		"FastRetransmitsDown":     []int{1},
+		"RTORetransmitsDown":      []int{0},
+		"SpuriousRetransmitsDown": []int{1},
+		"OtherRetransmitsDown":    []int{0},
+		"ReorderingsDown":         []int{0},
+		"UpstreamLossDown":        []int{1},
+		"DownstreamLossDown":      []int{0},
+	})
+}
@@ -0,0 +1,224 @@
+package telemetry
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"github.com/sharat910/edrint/common"
+	"github.com/sharat910/edrint/events"
+)
+
+// seqAfter is a > b in sequence space (RFC 1982 serial arithmetic)
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// TCPWindow tracks flow control per interval, by the side sending the
+// packets: the advertised receive window, scaled if the handshake
+// negotiated window scaling, zero window advertisements and persist
+// probes. Bytes in flight are the sequence space sent but not acked
+// as seen at the capture point, a window-full stall is in flight
+// reaching the peer's non-zero window. Counters count events, e.g. a
+// run of zero windows is one.
+type TCPWindow struct {
+	BaseFlowTelemetry
+	intervalMS    int
+	firstPacketTS time.Time
+	lastPacketTS  time.Time
+
+	synSeen [2]bool
+	wscale  [2]int
+	// window is the last window advertised by a side, -1 before one
+	window  [2]int
+	sndNxt  [2]uint32
+	nxtSeen [2]bool
+	sndUna  [2]uint32
+	unaSeen [2]bool
+	stalled [2]bool
+
+	windowMin     [2][]int
+	windowMax     [2][]int
+	inFlightMax   [2][]int
+	zeroWindows   [2][]int
+	windowFull    [2][]int
+	persistProbes [2][]int
+}
+
+func NewTCPWindow(intervalMS int) TeleGen {
+	if intervalMS == 0 {
+		log.Warn().Msg("tcp_window unable to read intervalMS. Setting default: 1sec")
+		intervalMS = 1000
+	}
+	return func() Telemetry {
+		t := &TCPWindow{intervalMS: intervalMS, wscale: [2]int{-1, -1}, window: [2]int{-1, -1}}
+		log.Debug().Str("telemetry", t.Name()).Int("intervalMS", intervalMS).Msg("config")
+		return t
+	}
+}
+
+func (tw *TCPWindow) Name() string {
+	return "tcp_window"
+}
+
+func (tw *TCPWindow) Pubs() []events.Topic {
+	return []events.Topic{events.TELEMETRY_TCP_WINDOW}
+}
+
+// scaleKnown is whether windows are known to be scaled right: both
+// SYNs were seen, scaling applies if both carried the option
+func (tw *TCPWindow) scaleKnown() bool {
+	return tw.synSeen[0] && tw.synSeen[1]
+}
+
+func (tw *TCPWindow) extendUntil(idx int) {
+	for d := 0; d < 2; d++ {
+		for i := len(tw.windowMin[d]); i <= idx; i++ {
+			// the last window holds until the next advertisement
+			tw.windowMin[d] = append(tw.windowMin[d], tw.window[d])
+			tw.windowMax[d] = append(tw.windowMax[d], tw.window[d])
+			tw.inFlightMax[d] = append(tw.inFlightMax[d], 0)
+			tw.zeroWindows[d] = append(tw.zeroWindows[d], 0)
+			tw.windowFull[d] = append(tw.windowFull[d], 0)
+			tw.persistProbes[d] = append(tw.persistProbes[d], 0)
+		}
+	}
+}
+
+func (tw *TCPWindow) OnFlowPacket(p common.Packet) {
+	if p.Header.Protocol != uint8(layers.IPProtocolTCP) {
+		return
+	}
+	if tw.firstPacketTS.IsZero() {
+		tw.firstPacketTS = p.Timestamp
+	}
+	idx, err := GetIndex(tw.firstPacketTS, p.Timestamp, tw.intervalMS)
+	if err != nil {
+		log.Warn().Err(err).Str("telemetry", tw.Name()).Msg("get_index throwing err")
+		return
+	}
+	tw.extendUntil(idx)
+	tw.lastPacketTS = p.Timestamp
+	tcp := &p.TCPLayer
+	if tcp.RST {
+		return
+	}
+	d := tcpDir(p)
+	o := 1 - d
+
+	// windows of SYNs are never scaled
+	win := int(tcp.Window)
+	if tcp.SYN {
+		tw.synSeen[d] = true
+		tw.wscale[d] = parseTCPOptions(tcp).wscale
+	} else if tw.wscale[0] >= 0 && tw.wscale[1] >= 0 {
+		shift := tw.wscale[d]
+		if shift > 14 {
+			shift = 14
+		}
+		win <<= uint(shift)
+	}
+	if win == 0 && tw.window[d] != 0 {
+		tw.zeroWindows[d][idx]++
+	}
+	tw.window[d] = win
+	if win < tw.windowMin[d][idx] || tw.windowMin[d][idx] < 0 {
+		tw.windowMin[d][idx] = win
+	}
+	if win > tw.windowMax[d][idx] {
+		tw.windowMax[d][idx] = win
+	}
+
+	// a persist probe sends at most a byte into a zero window, Linux
+	// probes with an empty segment below the acked sequence
+	payload := len(p.Payload)
+	if tw.window[o] == 0 && !tcp.SYN && !tcp.FIN && payload <= 1 && tw.nxtSeen[d] {
+		if (payload == 1 && (tcp.Seq == tw.sndNxt[d] || tcp.Seq+1 == tw.sndNxt[d])) ||
+			(payload == 0 && tw.unaSeen[d] && tcp.Seq+1 == tw.sndUna[d]) {
+			tw.persistProbes[d][idx]++
+		}
+	}
+
+	segLen := uint32(payload)
+	if tcp.SYN {
+		segLen++
+	}
+	if tcp.FIN {
+		segLen++
+	}
+	if end := tcp.Seq + segLen; segLen > 0 && (!tw.nxtSeen[d] || seqAfter(end, tw.sndNxt[d])) {
+		tw.sndNxt[d], tw.nxtSeen[d] = end, true
+	}
+	if tcp.ACK && (!tw.unaSeen[o] || seqAfter(tcp.Ack, tw.sndUna[o])) {
+		tw.sndUna[o], tw.unaSeen[o] = tcp.Ack, true
+	}
+
+	for _, x := range []int{d, o} {
+		if !tw.nxtSeen[x] || !tw.unaSeen[x] || !seqAfter(tw.sndNxt[x], tw.sndUna[x]) {
+			tw.stalled[x] = false
+			continue
+		}
+		inFlight := int(tw.sndNxt[x] - tw.sndUna[x])
+		if inFlight > tw.inFlightMax[x][idx] {
+			tw.inFlightMax[x][idx] = inFlight
+		}
+		full := tw.window[1-x] > 0 && inFlight >= tw.window[1-x]
+		if full && !tw.stalled[x] {
+			tw.windowFull[x][idx]++
+		}
+		tw.stalled[x] = full
+	}
+}
+
+func (tw *TCPWindow) Teardown() {
+	if tw.firstPacketTS.IsZero() {
+		return
+	}
+	tw.Publish(events.TELEMETRY_TCP_WINDOW, struct {
+		FirstPacketTS time.Time
+		LastPacketTS  time.Time
+		IntervalMS    int
+		Header        common.FiveTuple
+		// ScaleKnown is false if the handshake was missed, windows are
+		// then unscaled
+		ScaleKnown      bool
+		WindowScaleUp   int
+		WindowScaleDown int
+		// windows advertised by the client (Up) and server (Down) in
+		// bytes, -1 before the first
+		WindowMinUp   []int
+		WindowMaxUp   []int
+		WindowMinDown []int
+		WindowMaxDown []int
+		// in flight, window-full stalls and persist probes of the data
+		// each side sends, zero windows each side advertises
+		InFlightMaxUp     []int
+		InFlightMaxDown   []int
+		ZeroWindowsUp     []int
+		ZeroWindowsDown   []int
+		WindowFullUp      []int
+		WindowFullDown    []int
+		PersistProbesUp   []int
+		PersistProbesDown []int
+	}{
+		tw.firstPacketTS,
+		tw.lastPacketTS,
+		tw.intervalMS,
+		tw.header,
+		tw.scaleKnown(),
+		tw.wscale[0],
+		tw.wscale[1],
+		tw.windowMin[0],
+		tw.windowMax[0],
+		tw.windowMin[1],
+		tw.windowMax[1],
+		tw.inFlightMax[0],
+		tw.inFlightMax[1],
+		tw.zeroWindows[0],
+		tw.zeroWindows[1],
+		tw.windowFull[0],
+		tw.windowFull[1],
+		tw.persistProbes[0],
+		tw.persistProbes[1],
+	})
+}
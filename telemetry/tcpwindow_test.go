@@ -0,0 +1,40 @@
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/sharat910/edrint/common"
+)
+
+func TestTCPWindow(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	published := runTelemetry(t, NewTCPWindow(1000), []common.Packet{
+		tcpTestPacket(at(0), true, layers.TCP{SYN: true, Seq: 0, Window: 64240,
+			Options: []layers.TCPOption{tcpOption(layers.TCPOptionKindWindowScale, 7)}}, 0),
+		tcpTestPacket(at(10), false, layers.TCP{SYN: true, ACK: true, Seq: 0, Ack: 1, Window: 65535,
+			Options: []layers.TCPOption{tcpOption(layers.TCPOptionKindWindowScale, 2)}}, 0),
+		tcpTestPacket(at(20), true, layers.TCP{ACK: true, Seq: 1, Ack: 1, Window: 100}, 0),
+		// the download fills the client's 12800 byte window
+		tcpTestPacket(at(30), false, layers.TCP{ACK: true, Seq: 1, Ack: 1, Window: 1000}, 6400),
+		tcpTestPacket(at(31), false, layers.TCP{ACK: true, Seq: 6401, Ack: 1, Window: 1000}, 6400),
+		tcpTestPacket(at(50), true, layers.TCP{ACK: true, Seq: 1, Ack: 12801, Window: 0}, 0),
+		tcpTestPacket(at(1200), false, layers.TCP{ACK: true, Seq: 12801, Ack: 1, Window: 1000}, 1),
+		tcpTestPacket(at(1210), true, layers.TCP{ACK: true, Seq: 1, Ack: 12801, Window: 0}, 0),
+		tcpTestPacket(at(1300), true, layers.TCP{ACK: true, Seq: 1, Ack: 12802, Window: 50}, 0),
+	})
+	if len(published) != 1 {
+		t.Fatalf("%d events, want 1", len(published))
+	}
+	checkFields(t, published[0], map[string]interface{}{
+		"ScaleKnown": true, "WindowScaleUp": 7, "WindowScaleDown": 2,
+		"WindowMinUp": []int{0, 0}, "WindowMaxUp": []int{64240, 6400},
+		"WindowMinDown": []int{4000, 4000}, "WindowMaxDown": []int{65535, 4000},
+		"InFlightMaxUp": []int{0, 0}, "InFlightMaxDown": []int{12800, 1},
+		"ZeroWindowsUp": []int{1, 0}, "ZeroWindowsDown": []int{0, 0},
+		"WindowFullUp": []int{0, 0}, "WindowFullDown": []int{1, 0},
+		"PersistProbesUp": []int{0, 0}, "PersistProbesDown": []int{0, 1},
+	})
+}